@@ -2,11 +2,33 @@ package main
 
 import (
 	"log"
+	"os"
 
 	"github.com/benshields/messagebox/internal/api"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := api.Migrate("", os.Args[2:], os.Stdout); err != nil {
+			log.Fatalln(err)
+		}
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "token" {
+		if err := api.Token("", os.Args[2:], os.Stdout); err != nil {
+			log.Fatalln(err)
+		}
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "config" {
+		if err := api.Config("", os.Args[2:], os.Stdout); err != nil {
+			log.Fatalln(err)
+		}
+		return
+	}
+
 	err := api.Start("")
 	log.Println(err)
 }
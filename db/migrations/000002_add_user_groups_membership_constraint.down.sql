@@ -0,0 +1,6 @@
+BEGIN;
+
+ALTER TABLE "user_groups"
+    DROP CONSTRAINT user_groups_group_id_user_id_key;
+
+COMMIT;
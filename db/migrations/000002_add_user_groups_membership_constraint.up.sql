@@ -0,0 +1,6 @@
+BEGIN;
+
+ALTER TABLE "user_groups"
+    ADD CONSTRAINT user_groups_group_id_user_id_key UNIQUE (group_id, user_id);
+
+COMMIT;
@@ -0,0 +1,6 @@
+BEGIN;
+
+ALTER TABLE "groups"
+    DROP COLUMN created_at;
+
+COMMIT;
@@ -0,0 +1,6 @@
+BEGIN;
+
+ALTER TABLE "groups"
+    ADD COLUMN created_at TIMESTAMPTZ NOT NULL DEFAULT NOW();
+
+COMMIT;
@@ -0,0 +1,13 @@
+BEGIN;
+
+CREATE TABLE "receipts"
+(
+    message_id INT NOT NULL,
+    user_id    INT NOT NULL,
+    read_at    TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (message_id, user_id),
+    CONSTRAINT receipts_message_id_fkey FOREIGN KEY (message_id) REFERENCES messages (id),
+    CONSTRAINT receipts_user_id_fkey    FOREIGN KEY (user_id)    REFERENCES users    (id)
+);
+
+COMMIT;
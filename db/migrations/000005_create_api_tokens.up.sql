@@ -0,0 +1,12 @@
+BEGIN;
+
+CREATE TABLE "api_tokens"
+(
+    id INT GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+    user_id    INT NOT NULL,
+    token_hash CHAR (64) UNIQUE NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    CONSTRAINT api_tokens_user_id_fkey FOREIGN KEY (user_id) REFERENCES users (id)
+);
+
+COMMIT;
@@ -0,0 +1,5 @@
+BEGIN;
+
+DROP TABLE "message_recipients" CASCADE;
+
+COMMIT;
@@ -0,0 +1,20 @@
+BEGIN;
+
+CREATE TABLE "message_recipients"
+(
+    id INT GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+    message_id INT NOT NULL,
+    recipient  INT NOT NULL,
+    kind VARCHAR (3) NOT NULL DEFAULT 'to',
+    CONSTRAINT message_recipients_kind_check CHECK (kind IN ('to', 'cc', 'bcc')),
+    CONSTRAINT message_recipients_message_id_fkey FOREIGN KEY (message_id) REFERENCES messages (id),
+    CONSTRAINT message_recipients_message_id_recipient_key UNIQUE (message_id, recipient)
+);
+
+CREATE INDEX message_recipients_recipient_idx ON message_recipients (recipient);
+
+-- messages.recipient remains as the primary recipient of each message
+INSERT INTO message_recipients (message_id, recipient, kind)
+SELECT id, recipient, 'to' FROM messages WHERE recipient IS NOT NULL;
+
+COMMIT;
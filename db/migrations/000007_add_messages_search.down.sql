@@ -0,0 +1,8 @@
+BEGIN;
+
+DROP INDEX messages_search_idx;
+
+ALTER TABLE "messages"
+    DROP COLUMN search;
+
+COMMIT;
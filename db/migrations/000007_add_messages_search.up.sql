@@ -0,0 +1,11 @@
+BEGIN;
+
+ALTER TABLE "messages"
+    ADD COLUMN search TSVECTOR GENERATED ALWAYS AS (
+        setweight(to_tsvector('english', coalesce(subject, '')), 'A') ||
+        setweight(to_tsvector('english', coalesce(body, '')), 'B')
+    ) STORED;
+
+CREATE INDEX messages_search_idx ON messages USING GIN (search);
+
+COMMIT;
@@ -0,0 +1,17 @@
+BEGIN;
+
+CREATE TABLE "attachments"
+(
+    id INT GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+    message_id   INT NOT NULL,
+    filename     VARCHAR (255) NOT NULL,
+    content_type VARCHAR (255) NOT NULL,
+    size         BIGINT NOT NULL,
+    storage_key  VARCHAR (255) UNIQUE NOT NULL,
+    created_at   TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    CONSTRAINT attachments_message_id_fkey FOREIGN KEY (message_id) REFERENCES messages (id)
+);
+
+CREATE INDEX attachments_message_id_idx ON attachments (message_id);
+
+COMMIT;
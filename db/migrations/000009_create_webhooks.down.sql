@@ -0,0 +1,7 @@
+BEGIN;
+
+DROP TABLE "webhook_deliveries" CASCADE;
+DROP TABLE "webhook_events" CASCADE;
+DROP TABLE "webhooks" CASCADE;
+
+COMMIT;
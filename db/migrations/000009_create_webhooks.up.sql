@@ -0,0 +1,51 @@
+BEGIN;
+
+-- owner is a user ID, or a group ID when negative, like messages.recipient
+CREATE TABLE "webhooks"
+(
+    id INT GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+    owner      INT NOT NULL,
+    url        VARCHAR (2048) NOT NULL,
+    secret     VARCHAR (255) NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX webhooks_owner_idx ON webhooks (owner);
+
+-- webhook_events is the outbox: one row per webhook per message, written in
+-- the same transaction as the message and delivered afterwards
+CREATE TABLE "webhook_events"
+(
+    id INT GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+    webhook_id      INT NOT NULL,
+    message_id      INT NOT NULL,
+    payload         JSONB NOT NULL,
+    attempts        INT NOT NULL DEFAULT 0,
+    next_attempt_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    delivered_at    TIMESTAMPTZ,
+    failed_at       TIMESTAMPTZ,
+    created_at      TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    CONSTRAINT webhook_events_webhook_id_fkey FOREIGN KEY (webhook_id) REFERENCES webhooks (id) ON DELETE CASCADE,
+    CONSTRAINT webhook_events_message_id_fkey FOREIGN KEY (message_id) REFERENCES messages (id)
+);
+
+CREATE INDEX webhook_events_pending_idx ON webhook_events (next_attempt_at)
+    WHERE delivered_at IS NULL AND failed_at IS NULL;
+
+CREATE TABLE "webhook_deliveries"
+(
+    id INT GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+    event_id     INT NOT NULL,
+    webhook_id   INT NOT NULL,
+    attempt      INT NOT NULL,
+    status_code  INT,
+    error        TEXT,
+    duration_ms  INT NOT NULL,
+    attempted_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    CONSTRAINT webhook_deliveries_event_id_fkey FOREIGN KEY (event_id) REFERENCES webhook_events (id) ON DELETE CASCADE,
+    CONSTRAINT webhook_deliveries_webhook_id_fkey FOREIGN KEY (webhook_id) REFERENCES webhooks (id) ON DELETE CASCADE
+);
+
+CREATE INDEX webhook_deliveries_webhook_id_idx ON webhook_deliveries (webhook_id);
+
+COMMIT;
@@ -0,0 +1,14 @@
+BEGIN;
+
+-- token buckets shared by every replica, keyed by scope and client, such as
+-- "sender:super.mario"
+CREATE TABLE "rate_limit_buckets"
+(
+    key        VARCHAR (255) PRIMARY KEY,
+    tokens     DOUBLE PRECISION NOT NULL,
+    updated_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX rate_limit_buckets_updated_at_idx ON rate_limit_buckets (updated_at);
+
+COMMIT;
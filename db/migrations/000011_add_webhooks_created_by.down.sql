@@ -0,0 +1,6 @@
+BEGIN;
+
+ALTER TABLE "webhooks"
+    DROP COLUMN created_by;
+
+COMMIT;
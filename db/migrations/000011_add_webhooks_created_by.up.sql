@@ -0,0 +1,11 @@
+BEGIN;
+
+-- created_by is the user who created the webhook. A group webhook is only sent
+-- messages while its creator is a member of the group; those created before
+-- this column existed have no creator, and are no longer sent any.
+ALTER TABLE "webhooks"
+    ADD COLUMN created_by INT;
+
+UPDATE "webhooks" SET created_by = owner WHERE owner > 0;
+
+COMMIT;
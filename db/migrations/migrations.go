@@ -0,0 +1,10 @@
+// Package migrations embeds the SQL migrations of the database schema, so
+// that the API can apply them itself.
+package migrations
+
+import "embed"
+
+// FS holds every migration, as NNNNNN_name.up.sql and NNNNNN_name.down.sql.
+//
+//go:embed *.sql
+var FS embed.FS
@@ -7,11 +7,19 @@ import (
 	"os/signal"
 	"time"
 
+	"github.com/benshields/messagebox/internal/api/controllers"
+	"github.com/benshields/messagebox/internal/pkg/blob"
 	"github.com/benshields/messagebox/internal/pkg/config"
 	"github.com/benshields/messagebox/internal/pkg/db"
+	"github.com/benshields/messagebox/internal/pkg/events"
 	"github.com/benshields/messagebox/internal/pkg/logger"
+	"github.com/benshields/messagebox/internal/pkg/metrics"
+	"github.com/benshields/messagebox/internal/pkg/persistence"
+	"github.com/benshields/messagebox/internal/pkg/ratelimit"
 	"github.com/benshields/messagebox/internal/pkg/router"
 	"github.com/benshields/messagebox/internal/pkg/server"
+	"github.com/benshields/messagebox/internal/pkg/tracing"
+	"github.com/benshields/messagebox/internal/pkg/webhooks"
 )
 
 func Start(configPath string) error {
@@ -25,12 +33,80 @@ func Start(configPath string) error {
 		return err
 	}
 
-	_, err = db.Setup(cfg.Database, log)
+	tp, err := tracing.Setup(cfg.Tracing, log)
 	if err != nil {
 		return err
 	}
+	defer tp.Close()
 
-	r := router.Setup()
+	m := metrics.New()
+
+	// the memory backend needs no database, and has no notifications to stream
+	var hub *events.Hub
+	if cfg.Storage.Backend != persistence.BackendMemory {
+		database, err := db.Setup(cfg.Database, log)
+		if err != nil {
+			return err
+		}
+
+		sqlDB, err := database.DB()
+		if err != nil {
+			return err
+		}
+		if err := m.RegisterDB(sqlDB, cfg.Database.DatabaseName); err != nil {
+			return err
+		}
+
+		// replicas starting together take turns, under an advisory lock
+		if cfg.Database.AutoMigrate {
+			m, err := newMigrator(database, log)
+			if err != nil {
+				return err
+			}
+			if err := m.Up(context.Background()); err != nil {
+				return err
+			}
+		}
+
+		hub, err = events.Setup(cfg.Database, log)
+		if err != nil {
+			return err
+		}
+		defer hub.Close()
+	}
+
+	repos, err := persistence.Setup(cfg.Storage, log)
+	if err != nil {
+		return err
+	}
+
+	store, err := blob.Setup(cfg.Attachments, log)
+	if err != nil {
+		return err
+	}
+
+	dispatcher, err := webhooks.Setup(cfg.Webhooks, repos.Webhooks, log)
+	if err != nil {
+		return err
+	}
+	defer dispatcher.Close()
+
+	limiter, err := ratelimit.Setup(cfg.RateLimit, log)
+	if err != nil {
+		return err
+	}
+
+	r, err := router.Setup(cfg.Server, repos, controllers.Services{
+		Limiter:      limiter,
+		Blobs:        store,
+		Attachments:  cfg.Attachments,
+		Events:       hub,
+		Metrics:      m,
+		WebhookGuard: webhooks.Guard{AllowPrivate: cfg.Webhooks.AllowPrivateAddresses},
+	}, log)
+	if err != nil {
+		return err
+	}
 
 	srv, err := server.Setup(cfg.Server, log, r)
 	if err != nil {
@@ -44,7 +120,7 @@ func Start(configPath string) error {
 		srv.Start(startCtx, startErr)
 	}()
 
-	quit := make(chan os.Signal)
+	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, os.Interrupt)
 
 	select {
@@ -54,6 +130,10 @@ func Start(configPath string) error {
 		}
 		return nil
 	case <-quit:
+		// end mailbox streams first, as Shutdown waits for open requests
+		if hub != nil {
+			hub.Close()
+		}
 		shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 10*time.Second)
 		defer shutdownCancel()
 		return srv.Shutdown(shutdownCtx)
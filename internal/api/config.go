@@ -0,0 +1,51 @@
+package api
+
+import (
+	"fmt"
+	"io"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/benshields/messagebox/internal/pkg/config"
+)
+
+const configUsage = "usage: config validate|print [--redacted]"
+
+// Config runs the config subcommand given by args: "validate" loads the
+// configuration and reports whether it is valid, and "print" writes it to out
+// as YAML, once environment variables and files have been applied. With
+// "--redacted", secrets are printed as config.Redacted.
+func Config(configPath string, args []string, out io.Writer) error {
+	command, redacted, err := parseConfigArgs(args)
+	if err != nil {
+		return err
+	}
+
+	cfg, err := config.New(configPath)
+	if err != nil {
+		return err
+	}
+
+	if command == "validate" {
+		_, err := fmt.Fprintln(out, "configuration is valid")
+		return err
+	}
+
+	b, err := yaml.Marshal(cfg.Settings(redacted))
+	if err != nil {
+		return err
+	}
+	_, err = out.Write(b)
+	return err
+}
+
+func parseConfigArgs(args []string) (string, bool, error) {
+	switch {
+	case len(args) == 1 && (args[0] == "validate" || args[0] == "print"):
+		return args[0], false, nil
+	case len(args) == 2 && args[0] == "print" && args[1] == "--redacted":
+		return args[0], true, nil
+	default:
+		return "", false, UsageError{Usage: configUsage}
+	}
+}
@@ -0,0 +1,294 @@
+package controllers
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+
+	"github.com/benshields/messagebox/internal/api/middleware"
+	"github.com/benshields/messagebox/internal/pkg/blob"
+	"github.com/benshields/messagebox/internal/pkg/config"
+	"github.com/benshields/messagebox/internal/pkg/httperr"
+	"github.com/benshields/messagebox/internal/pkg/models"
+	"github.com/benshields/messagebox/internal/pkg/persistence"
+)
+
+// errBodyTooLarge is returned by a limitedBody read past its limit.
+var errBodyTooLarge = errors.New("request body too large")
+
+const (
+	DefaultMaxAttachmentSize  = 10 << 20
+	DefaultMaxAttachmentCount = 10
+
+	// messageFormField and attachmentsFormField name the parts of a multipart
+	// message: the message itself as JSON, and any number of files.
+	messageFormField     = "message"
+	attachmentsFormField = "attachments"
+)
+
+func (ctl *Controller) GetAttachment(c *gin.Context) {
+	var req models.UriAttachment
+	if err := c.BindUri(&req); err != nil {
+		httperr.NewError(c, http.StatusBadRequest, errors.New("invalid request"))
+		return
+	}
+
+	in := models.Attachment{
+		Model: models.Model{
+			ID: req.AttachmentID,
+		},
+		MessageID: req.ID,
+	}
+
+	r := ctl.attachments
+	out, err := r.Read(c.Request.Context(), &in)
+	if err != nil {
+		switch {
+		case errors.Is(err, persistence.ErrAttachmentNotFound):
+			httperr.NewError(c, http.StatusNotFound, err)
+			return
+		default:
+			middleware.InternalError(c, err)
+			return
+		}
+	}
+
+	store := ctl.blobs
+	if store == nil {
+		middleware.InternalError(c, blob.ErrNotSetup)
+		return
+	}
+	content, err := store.Get(c.Request.Context(), out.StorageKey)
+	if err != nil {
+		switch {
+		case errors.Is(err, blob.ErrNotFound):
+			httperr.NewError(c, http.StatusNotFound, errors.New("attachment ID does not exist"))
+			return
+		default:
+			middleware.InternalError(c, err)
+			return
+		}
+	}
+	defer content.Close()
+
+	c.Header("X-Content-Type-Options", "nosniff")
+	c.DataFromReader(http.StatusOK, out.Size, out.ContentType, content, map[string]string{
+		"Content-Disposition": mime.FormatMediaType("attachment", map[string]string{"filename": out.Filename}),
+	})
+}
+
+// bindMessage binds a message sent either as JSON or as a multipart form,
+// and returns the files attached to a multipart message.
+func (ctl *Controller) bindMessage(c *gin.Context, obj interface{}) ([]*multipart.FileHeader, bool) {
+	if c.ContentType() != binding.MIMEMultipartPOSTForm {
+		if err := c.ShouldBindJSON(obj); err != nil {
+			httperr.NewBindError(c, err)
+			return nil, false
+		}
+		return nil, true
+	}
+
+	cfg := ctl.limits
+	c.Request.Body = &limitedBody{ReadCloser: c.Request.Body, remaining: cfg.MaxSize*int64(cfg.MaxCount) + 1<<20}
+	form, err := c.MultipartForm()
+	if err != nil {
+		if errors.Is(err, errBodyTooLarge) {
+			httperr.NewError(c, http.StatusRequestEntityTooLarge, errors.New("attachments too large"))
+			return nil, false
+		}
+		httperr.NewError(c, http.StatusBadRequest, errors.New("invalid request"))
+		return nil, false
+	}
+
+	values := form.Value[messageFormField]
+	if len(values) != 1 {
+		httperr.NewError(c, http.StatusBadRequest, errors.New("invalid request"))
+		return nil, false
+	}
+	if err := binding.JSON.BindBody([]byte(values[0]), obj); err != nil {
+		httperr.NewBindError(c, err)
+		return nil, false
+	}
+
+	return form.File[attachmentsFormField], true
+}
+
+// limitedBody reads a request body up to remaining more bytes, and fails with
+// errBodyTooLarge once the body goes past them.
+type limitedBody struct {
+	io.ReadCloser
+	remaining int64
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	// read one byte more than remains, to tell a body that ends at the limit
+	// from one that goes past it
+	if int64(len(p)) > b.remaining+1 {
+		p = p[:b.remaining+1]
+	}
+	n, err := b.ReadCloser.Read(p)
+	if int64(n) <= b.remaining {
+		b.remaining -= int64(n)
+		return n, err
+	}
+	n = int(b.remaining)
+	b.remaining = 0
+	return n, errBodyTooLarge
+}
+
+// storeAttachments checks files against the configured limits and puts them
+// in the blob store. The content type of each file is sniffed from its
+// contents rather than taken from the request.
+func (ctl *Controller) storeAttachments(c *gin.Context, files []*multipart.FileHeader) ([]models.Attachment, bool) {
+	if len(files) == 0 {
+		return nil, true
+	}
+
+	cfg := ctl.limits
+	if len(files) > cfg.MaxCount {
+		httperr.NewError(c, http.StatusRequestEntityTooLarge, errors.New("too many attachments"))
+		return nil, false
+	}
+
+	contentTypes := make([]string, len(files))
+	for i, fh := range files {
+		if fh.Size > cfg.MaxSize {
+			httperr.NewError(c, http.StatusRequestEntityTooLarge, errors.New("attachments too large"))
+			return nil, false
+		}
+
+		contentType, err := sniffContentType(fh)
+		if err != nil {
+			httperr.NewError(c, http.StatusBadRequest, errors.New("invalid request"))
+			return nil, false
+		}
+		if !allowedContentType(contentType, cfg.AllowedTypes) {
+			httperr.NewError(c, http.StatusUnsupportedMediaType, errors.New("attachment type not allowed"))
+			return nil, false
+		}
+		contentTypes[i] = contentType
+	}
+
+	store := ctl.blobs
+	if store == nil {
+		middleware.InternalError(c, blob.ErrNotSetup)
+		return nil, false
+	}
+
+	attachments := make([]models.Attachment, 0, len(files))
+	for i, fh := range files {
+		attachment, err := putAttachment(c, store, fh, contentTypes[i])
+		if err != nil {
+			ctl.discardAttachments(c, attachments)
+			middleware.InternalError(c, err)
+			return nil, false
+		}
+		attachments = append(attachments, attachment)
+	}
+
+	return attachments, true
+}
+
+func putAttachment(c *gin.Context, store blob.Store, fh *multipart.FileHeader, contentType string) (models.Attachment, error) {
+	key, err := newStorageKey()
+	if err != nil {
+		return models.Attachment{}, err
+	}
+
+	f, err := fh.Open()
+	if err != nil {
+		return models.Attachment{}, err
+	}
+	defer f.Close()
+
+	size, err := store.Put(c.Request.Context(), key, f)
+	if err != nil {
+		return models.Attachment{}, err
+	}
+
+	filename := filepath.Base(fh.Filename)
+	if len(filename) > 255 {
+		filename = filename[len(filename)-255:]
+	}
+
+	return models.Attachment{
+		Filename:    filename,
+		ContentType: contentType,
+		Size:        size,
+		StorageKey:  key,
+	}, nil
+}
+
+// discardAttachments removes attachments from the blob store after the message
+// they were sent with could not be stored.
+func (ctl *Controller) discardAttachments(c *gin.Context, attachments []models.Attachment) {
+	store := ctl.blobs
+	if store == nil {
+		return
+	}
+	for _, a := range attachments {
+		_ = store.Delete(c.Request.Context(), a.StorageKey)
+	}
+}
+
+func sniffContentType(fh *multipart.FileHeader) (string, error) {
+	f, err := fh.Open()
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	head := make([]byte, 512)
+	n, err := f.Read(head)
+	if err != nil && n == 0 && fh.Size > 0 {
+		return "", err
+	}
+
+	mediaType, _, err := mime.ParseMediaType(http.DetectContentType(head[:n]))
+	return mediaType, err
+}
+
+// allowedContentType matches a media type against patterns such as
+// "image/png" or "image/*". No patterns at all allows every type.
+func allowedContentType(contentType string, patterns []string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		if pattern == contentType {
+			return true
+		}
+		if strings.HasSuffix(pattern, "/*") && strings.HasPrefix(contentType, strings.TrimSuffix(pattern, "*")) {
+			return true
+		}
+	}
+	return false
+}
+
+// attachmentLimits returns cfg with defaults for any limits left unset.
+func attachmentLimits(cfg config.AttachmentsConfiguration) config.AttachmentsConfiguration {
+	if cfg.MaxSize <= 0 {
+		cfg.MaxSize = DefaultMaxAttachmentSize
+	}
+	if cfg.MaxCount <= 0 {
+		cfg.MaxCount = DefaultMaxAttachmentCount
+	}
+	return cfg
+}
+
+func newStorageKey() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
@@ -0,0 +1,63 @@
+package controllers
+
+import (
+	"github.com/benshields/messagebox/internal/pkg/blob"
+	"github.com/benshields/messagebox/internal/pkg/config"
+	"github.com/benshields/messagebox/internal/pkg/events"
+	"github.com/benshields/messagebox/internal/pkg/metrics"
+	"github.com/benshields/messagebox/internal/pkg/persistence"
+	"github.com/benshields/messagebox/internal/pkg/ratelimit"
+	"github.com/benshields/messagebox/internal/pkg/webhooks"
+)
+
+// Services are what the controllers use besides the repositories. A nil
+// Limiter leaves the groups that messages are sent to unlimited, a nil Blobs
+// fails every request with attachments, and a nil Events leaves mailbox
+// streaming unavailable. Attachments holds the limits on attachments; those
+// left unset take their defaults. Metrics counts what the controllers do, and
+// WebhookGuard checks the URLs of new webhooks.
+type Services struct {
+	Limiter      *ratelimit.Limiter
+	Blobs        blob.Store
+	Attachments  config.AttachmentsConfiguration
+	Events       *events.Hub
+	Metrics      *metrics.Metrics
+	WebhookGuard webhooks.Guard
+}
+
+// Controller handles API requests using the repositories and services it was
+// created with.
+type Controller struct {
+	users       persistence.Users
+	groups      persistence.Groups
+	messages    persistence.Messages
+	tokens      persistence.Tokens
+	attachments persistence.Attachments
+	webhooks    persistence.Webhooks
+	health      persistence.Health
+	limiter     *ratelimit.Limiter
+	blobs       blob.Store
+	limits      config.AttachmentsConfiguration
+	events      *events.Hub
+	metrics     *metrics.Metrics
+	guard       webhooks.Guard
+}
+
+// New returns the controller for repos and services.
+func New(repos *persistence.Repositories, services Services) *Controller {
+	return &Controller{
+		users:       repos.Users,
+		groups:      repos.Groups,
+		messages:    repos.Messages,
+		tokens:      repos.Tokens,
+		attachments: repos.Attachments,
+		webhooks:    repos.Webhooks,
+		health:      repos.Health,
+		limiter:     services.Limiter,
+		blobs:       services.Blobs,
+		limits:      attachmentLimits(services.Attachments),
+		events:      services.Events,
+		metrics:     services.Metrics,
+		guard:       services.WebhookGuard,
+	}
+}
@@ -3,12 +3,11 @@ package controllers
 import (
 	"errors"
 	"net/http"
-	"strings"
-
-	"gorm.io/gorm"
+	"time"
 
 	"github.com/gin-gonic/gin"
 
+	"github.com/benshields/messagebox/internal/api/middleware"
 	"github.com/benshields/messagebox/internal/pkg/httperr"
 	"github.com/benshields/messagebox/internal/pkg/models"
 	"github.com/benshields/messagebox/internal/pkg/persistence"
@@ -19,10 +18,22 @@ type GroupCreation struct {
 	Usernames []string `json:"usernames" binding:"required"`
 }
 
-func CreateGroup(c *gin.Context) {
+func (ctl *Controller) CreateGroup(c *gin.Context) {
 	var req GroupCreation
-	if err := c.BindJSON(&req); err != nil {
-		httperr.NewError(c, http.StatusBadRequest, errors.New("invalid request"))
+	if err := c.ShouldBindJSON(&req); err != nil {
+		httperr.NewBindError(c, err)
+		return
+	}
+
+	creator, ok := middleware.CurrentUser(c)
+	if !ok {
+		httperr.NewError(c, http.StatusUnauthorized, errors.New("missing bearer token"))
+		return
+	}
+	// a group is created by one of its members, so nobody is put in a group
+	// that none of its members chose
+	if !containsName(req.Usernames, creator.Name) {
+		httperr.NewError(c, http.StatusForbidden, errors.New("not a member of the group"))
 		return
 	}
 
@@ -37,21 +48,21 @@ func CreateGroup(c *gin.Context) {
 		in.Users[i] = u
 	}
 
-	r := persistence.GetGroupRepository()
-	out, err := r.Create(&in)
+	r := ctl.groups
+	out, err := r.Create(c.Request.Context(), &in)
 	if err != nil {
-		switch { // TODO improve error handling accross the entire API
-		case strings.Contains(err.Error(), "duplicate key value violates unique constraint"):
-			httperr.NewError(c, http.StatusConflict, errors.New("group with the same groupname already registered"))
+		switch {
+		case errors.Is(err, persistence.ErrDuplicateName):
+			httperr.NewError(c, http.StatusConflict, err)
 			return
-		case errors.Is(err, gorm.ErrRecordNotFound):
-			httperr.NewError(c, http.StatusNotFound, errors.New("one or more users with given usernames do not exist"))
+		case errors.Is(err, persistence.ErrUserNotFound):
+			httperr.NewError(c, http.StatusNotFound, err)
 			return
-		case errors.Is(err, gorm.ErrInvalidValue), errors.Is(err, gorm.ErrInvalidValueOfLength):
-			httperr.NewError(c, http.StatusBadRequest, errors.New("invalid request"))
+		case errors.Is(err, persistence.ErrInvalidValue):
+			httperr.NewError(c, http.StatusBadRequest, err)
 			return
 		default:
-			httperr.NewError(c, http.StatusInternalServerError, errors.New("internal server error"))
+			middleware.InternalError(c, err)
 			return
 		}
 	}
@@ -63,22 +74,188 @@ func CreateGroup(c *gin.Context) {
 	for i, u := range out.Users {
 		resp.Usernames[i] = u.Name
 	}
+	ctl.metrics.GroupsCreated.Inc()
 	c.JSON(http.StatusCreated, resp)
 }
 
-func GetGroup(c *gin.Context) {
-	req := c.Param("groupname")
+type GroupDetails struct {
+	Groupname    string    `json:"groupname"`
+	Usernames    []string  `json:"usernames"`
+	CreatedAt    time.Time `json:"createdAt"`
+	MemberCount  int       `json:"memberCount"`
+	MessageCount int64     `json:"messageCount"`
+}
+
+func (ctl *Controller) GetGroup(c *gin.Context) {
+	var req models.UriGroupname
+	if err := c.BindUri(&req); err != nil {
+		httperr.NewError(c, http.StatusBadRequest, errors.New("invalid request"))
+		return
+	}
+
+	in := models.Group{
+		Name: req.Groupname,
+	}
+
+	r := ctl.groups
+	out, err := r.Read(c.Request.Context(), &in)
+	if err != nil {
+		switch {
+		case errors.Is(err, persistence.ErrGroupNotFound):
+			httperr.NewError(c, http.StatusNotFound, err)
+			return
+		default:
+			middleware.InternalError(c, err)
+			return
+		}
+	}
 
-	in := models.User{
-		Name: req,
+	members, err := r.GetMembers(c.Request.Context(), out)
+	if err != nil {
+		middleware.InternalError(c, err)
+		return
 	}
 
-	r := persistence.GetUserRepository()
-	out, err := r.Read(&in)
+	messageCount, err := r.CountMessages(c.Request.Context(), out)
 	if err != nil {
-		httperr.NewError(c, http.StatusNotFound, errors.New("user with given username does not exist"))
+		middleware.InternalError(c, err)
 		return
 	}
 
-	c.JSON(http.StatusOK, out)
+	resp := GroupDetails{
+		Groupname:    out.Name,
+		Usernames:    make([]string, len(members)),
+		CreatedAt:    out.CreatedAt,
+		MemberCount:  len(members),
+		MessageCount: messageCount,
+	}
+	for i, u := range members {
+		resp.Usernames[i] = u.Name
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+type GroupMembership struct {
+	Username string `json:"username" binding:"required,min=1,max=32"`
+}
+
+func (ctl *Controller) AddGroupMember(c *gin.Context) {
+	var reqURI models.UriGroupname
+	if err := c.BindUri(&reqURI); err != nil {
+		httperr.NewError(c, http.StatusBadRequest, errors.New("invalid request"))
+		return
+	}
+
+	var req GroupMembership
+	if err := c.ShouldBindJSON(&req); err != nil {
+		httperr.NewBindError(c, err)
+		return
+	}
+
+	group, user, ok := ctl.readGroupMember(c, reqURI.Groupname, req.Username)
+	if !ok {
+		return
+	}
+
+	r := ctl.groups
+	out, err := r.AddMember(c.Request.Context(), group, user)
+	if err != nil {
+		switch {
+		case errors.Is(err, persistence.ErrAlreadyMember):
+			httperr.NewError(c, http.StatusConflict, err)
+			return
+		default:
+			middleware.InternalError(c, err)
+			return
+		}
+	}
+
+	resp := GroupCreation{
+		Groupname: out.Name,
+		Usernames: make([]string, len(out.Users)),
+	}
+	for i, u := range out.Users {
+		resp.Usernames[i] = u.Name
+	}
+	c.JSON(http.StatusCreated, resp)
+}
+
+func (ctl *Controller) RemoveGroupMember(c *gin.Context) {
+	var req models.UriGroupMember
+	if err := c.BindUri(&req); err != nil {
+		httperr.NewError(c, http.StatusBadRequest, errors.New("invalid request"))
+		return
+	}
+
+	ctl.removeGroupMember(c, req.Groupname, req.Username)
+}
+
+// LeaveGroup is the self-service counterpart of RemoveGroupMember, addressed
+// from the user's side of the membership.
+func (ctl *Controller) LeaveGroup(c *gin.Context) {
+	var req models.UriGroupMember
+	if err := c.BindUri(&req); err != nil {
+		httperr.NewError(c, http.StatusBadRequest, errors.New("invalid request"))
+		return
+	}
+
+	ctl.removeGroupMember(c, req.Groupname, req.Username)
+}
+
+func (ctl *Controller) removeGroupMember(c *gin.Context, groupname, username string) {
+	group, user, ok := ctl.readGroupMember(c, groupname, username)
+	if !ok {
+		return
+	}
+
+	r := ctl.groups
+	if err := r.RemoveMember(c.Request.Context(), group, user); err != nil {
+		switch {
+		case errors.Is(err, persistence.ErrNotMember):
+			httperr.NewError(c, http.StatusNotFound, err)
+			return
+		default:
+			middleware.InternalError(c, err)
+			return
+		}
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// readGroupMember looks up both sides of a membership, writing the error
+// response itself when either does not exist.
+func (ctl *Controller) readGroupMember(c *gin.Context, groupname, username string) (*models.Group, *models.User, bool) {
+	group, err := ctl.groups.Read(c.Request.Context(), &models.Group{Name: groupname})
+	if err != nil {
+		switch {
+		case errors.Is(err, persistence.ErrGroupNotFound):
+			httperr.NewError(c, http.StatusNotFound, err)
+		default:
+			middleware.InternalError(c, err)
+		}
+		return nil, nil, false
+	}
+
+	user, err := ctl.users.Read(c.Request.Context(), &models.User{Name: username})
+	if err != nil {
+		switch {
+		case errors.Is(err, persistence.ErrUserNotFound):
+			httperr.NewError(c, http.StatusNotFound, err)
+		default:
+			middleware.InternalError(c, err)
+		}
+		return nil, nil, false
+	}
+
+	return group, user, true
+}
+
+func containsName(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
 }
@@ -0,0 +1,39 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/benshields/messagebox/internal/pkg/httperr"
+)
+
+// ReadyTimeout bounds how long Readyz waits on the storage backend.
+var ReadyTimeout = 2 * time.Second
+
+type HealthStatus struct {
+	Status string `json:"status"`
+}
+
+// Healthz reports that the process is up. It checks nothing else, so that an
+// unreachable database does not get the API restarted.
+func (ctl *Controller) Healthz(c *gin.Context) {
+	c.JSON(http.StatusOK, HealthStatus{Status: "ok"})
+}
+
+// Readyz reports whether the API can serve requests, which it cannot while
+// the database is unreachable. It becomes ready again by itself once the
+// database is back.
+func (ctl *Controller) Readyz(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), ReadyTimeout)
+	defer cancel()
+
+	if err := ctl.health.Ping(ctx); err != nil {
+		httperr.NewError(c, http.StatusServiceUnavailable, errors.New("database is unreachable"))
+		return
+	}
+	c.JSON(http.StatusOK, HealthStatus{Status: "ready"})
+}
@@ -2,53 +2,182 @@ package controllers
 
 import (
 	"errors"
+	"fmt"
 	"net/http"
 
 	"github.com/gin-gonic/gin"
-	"gorm.io/gorm"
 
+	"github.com/benshields/messagebox/internal/api/middleware"
 	"github.com/benshields/messagebox/internal/pkg/httperr"
 	"github.com/benshields/messagebox/internal/pkg/models"
 	"github.com/benshields/messagebox/internal/pkg/persistence"
 )
 
-func CreateMessage(c *gin.Context) {
+func (ctl *Controller) CreateMessage(c *gin.Context) {
 	var req models.ComposedMessage
-	if err := c.BindJSON(&req); err != nil {
-		httperr.NewError(c, http.StatusBadRequest, errors.New("invalid request"))
+	files, ok := ctl.bindMessage(c, &req)
+	if !ok {
 		return
 	}
 
-	// ensure only 1 recipient
-	switch {
-	case req.Recipient.Username == "" && req.Recipient.Groupname == "":
-		httperr.NewError(c, http.StatusBadRequest, errors.New("invalid request"))
+	sender, ok := authenticatedSender(c, req.Sender)
+	if !ok {
 		return
-	case req.Recipient.Username != "" && req.Recipient.Groupname != "":
-		httperr.NewError(c, http.StatusBadRequest, errors.New("invalid request"))
+	}
+	req.Sender = sender
+
+	if fields := recipientErrors(&req); len(fields) > 0 {
+		httperr.NewError(c, http.StatusBadRequest, fields)
 		return
 	}
+	// a lone recipient is the first "to" recipient
+	if req.Recipient != (models.Recipient{}) {
+		req.To = append([]models.Recipient{req.Recipient}, req.To...)
+	}
 
-	r := persistence.GetMessageRepository()
-	out, err := r.Create(&req)
+	if !ctl.allowGroups(c, groupnames(req.To, req.Cc, req.Bcc)) {
+		return
+	}
+
+	req.Attachments, ok = ctl.storeAttachments(c, files)
+	if !ok {
+		return
+	}
+
+	r := ctl.messages
+	out, err := r.Create(c.Request.Context(), &req)
 	if err != nil {
+		ctl.discardAttachments(c, req.Attachments)
 		switch {
-		case errors.Is(err, gorm.ErrRecordNotFound):
-			httperr.NewError(c, http.StatusNotFound, errors.New("sender or recipient does not exist")) // TODO improve specificity
+		case errors.Is(err, persistence.ErrSenderNotFound), errors.Is(err, persistence.ErrRecipientNotFound):
+			httperr.NewError(c, http.StatusNotFound, err)
 			return
-		case errors.Is(err, gorm.ErrInvalidValue), errors.Is(err, gorm.ErrInvalidValueOfLength):
-			httperr.NewError(c, http.StatusBadRequest, errors.New("invalid request"))
+		case errors.Is(err, persistence.ErrInvalidValue):
+			httperr.NewError(c, http.StatusBadRequest, err)
 			return
 		default:
-			httperr.NewError(c, http.StatusInternalServerError, errors.New("internal server error"))
+			middleware.InternalError(c, err)
 			return
 		}
 	}
 
+	ctl.metrics.MessagesSent.Inc()
 	c.JSON(http.StatusCreated, out)
 }
 
-func GetMessage(c *gin.Context) {
+// recipientErrors ensures there is at least 1 recipient, and that each names
+// exactly 1 user or group.
+func recipientErrors(msg *models.ComposedMessage) httperr.ValidationErrors {
+	var out httperr.ValidationErrors
+	count := 0
+	check := func(field string, rcpt models.Recipient) {
+		if (rcpt.Username == "") == (rcpt.Groupname == "") {
+			out = append(out, httperr.FieldError{
+				Field:   field,
+				Rule:    "exactly_one",
+				Message: field + " must name exactly one of username or groupname",
+			})
+		}
+		count++
+	}
+
+	if msg.Recipient != (models.Recipient{}) {
+		check("recipient", msg.Recipient)
+	}
+	lists := []struct {
+		field      string
+		recipients []models.Recipient
+	}{
+		{"to", msg.To},
+		{"cc", msg.Cc},
+		{"bcc", msg.Bcc},
+	}
+	for _, l := range lists {
+		for i, rcpt := range l.recipients {
+			check(fmt.Sprintf("%s[%d]", l.field, i), rcpt)
+		}
+	}
+
+	if count == 0 {
+		out = append(out, httperr.FieldError{
+			Field:   "to",
+			Rule:    "required",
+			Message: "at least one recipient is required",
+		})
+	}
+	return out
+}
+
+// groupnames returns the groups in the recipient lists, each once.
+func groupnames(lists ...[]models.Recipient) []string {
+	var out []string
+	seen := map[string]bool{}
+	for _, list := range lists {
+		for _, rcpt := range list {
+			if rcpt.Groupname != "" && !seen[rcpt.Groupname] {
+				seen[rcpt.Groupname] = true
+				out = append(out, rcpt.Groupname)
+			}
+		}
+	}
+	return out
+}
+
+// allowGroups answers with a 404 when any of the groups does not exist, so
+// that no tokens are taken for groups that do not, and otherwise takes a token
+// from the bucket of each group.
+func (ctl *Controller) allowGroups(c *gin.Context, groupnames []string) bool {
+	if ctl.limiter == nil {
+		return true
+	}
+
+	for _, name := range groupnames {
+		if _, err := ctl.groups.Read(c.Request.Context(), &models.Group{Name: name}); err != nil {
+			if errors.Is(err, persistence.ErrGroupNotFound) {
+				httperr.NewError(c, http.StatusNotFound, persistence.ErrRecipientNotFound)
+			} else {
+				middleware.InternalError(c, err)
+			}
+			return false
+		}
+	}
+	return middleware.AllowGroups(c, ctl.limiter, groupnames)
+}
+
+// replyGroupnames returns the groups a reply to the message with id is sent
+// to: those the message was sent or copied to, as CreateReply picks them.
+func (ctl *Controller) replyGroupnames(c *gin.Context, id int32) ([]string, bool) {
+	viewer, _ := middleware.CurrentUser(c)
+	original, err := ctl.messages.Read(c.Request.Context(), viewer, &models.Message{Model: models.Model{ID: id}})
+	if err != nil {
+		if errors.Is(err, persistence.ErrMessageNotFound) {
+			httperr.NewError(c, http.StatusNotFound, err)
+		} else {
+			middleware.InternalError(c, err)
+		}
+		return nil, false
+	}
+	return groupnames(original.To, original.Cc), true
+}
+
+// authenticatedSender returns the name of the authenticated user, who is
+// always the sender. A sender given in the request body must agree with it.
+func authenticatedSender(c *gin.Context, claimed string) (string, bool) {
+	user, ok := middleware.CurrentUser(c)
+	if !ok {
+		httperr.NewError(c, http.StatusUnauthorized, errors.New("missing bearer token"))
+		return "", false
+	}
+
+	if claimed != "" && claimed != user.Name {
+		httperr.NewError(c, http.StatusForbidden, errors.New("sender does not match the authenticated user"))
+		return "", false
+	}
+
+	return user.Name, true
+}
+
+func (ctl *Controller) GetMessage(c *gin.Context) {
 	var req models.UriId
 	if err := c.BindUri(&req); err != nil {
 		httperr.NewError(c, http.StatusBadRequest, errors.New("invalid request"))
@@ -61,17 +190,24 @@ func GetMessage(c *gin.Context) {
 		},
 	}
 
-	r := persistence.GetMessageRepository()
-	out, err := r.Read(&in)
+	viewer, _ := middleware.CurrentUser(c)
+	r := ctl.messages
+	out, err := r.Read(c.Request.Context(), viewer, &in)
 	if err != nil {
-		httperr.NewError(c, http.StatusNotFound, errors.New("message ID does not exist"))
-		return
+		switch {
+		case errors.Is(err, persistence.ErrMessageNotFound):
+			httperr.NewError(c, http.StatusNotFound, err)
+			return
+		default:
+			middleware.InternalError(c, err)
+			return
+		}
 	}
 
 	c.JSON(http.StatusOK, out)
 }
 
-func CreateReply(c *gin.Context) {
+func (ctl *Controller) CreateReply(c *gin.Context) {
 	var reqID models.UriId
 	if err := c.BindUri(&reqID); err != nil {
 		httperr.NewError(c, http.StatusBadRequest, errors.New("invalid request"))
@@ -79,38 +215,58 @@ func CreateReply(c *gin.Context) {
 	}
 
 	var reqReply models.ReplyMessage
-	if err := c.BindJSON(&reqReply); err != nil {
-		httperr.NewError(c, http.StatusBadRequest, errors.New("invalid request"))
+	files, ok := ctl.bindMessage(c, &reqReply)
+	if !ok {
+		return
+	}
+
+	sender, ok := authenticatedSender(c, reqReply.Sender)
+	if !ok {
+		return
+	}
+
+	if ctl.limiter != nil {
+		groups, ok := ctl.replyGroupnames(c, reqID.ID)
+		if !ok || !ctl.allowGroups(c, groups) {
+			return
+		}
+	}
+
+	attachments, ok := ctl.storeAttachments(c, files)
+	if !ok {
 		return
 	}
 
 	in := models.Message{
-		Re:      reqID.ID,
-		Sender:  reqReply.Sender,
-		Subject: reqReply.Subject,
-		Body:    reqReply.Body,
+		Re:          reqID.ID,
+		Sender:      sender,
+		Subject:     reqReply.Subject,
+		Body:        reqReply.Body,
+		Attachments: attachments,
 	}
 
-	r := persistence.GetMessageRepository()
-	out, err := r.CreateReply(&in)
+	r := ctl.messages
+	out, err := r.CreateReply(c.Request.Context(), &in)
 	if err != nil {
+		ctl.discardAttachments(c, attachments)
 		switch {
-		case errors.Is(err, gorm.ErrRecordNotFound):
-			httperr.NewError(c, http.StatusNotFound, errors.New("sender or message ID does not exist")) // TODO improve specificity
+		case errors.Is(err, persistence.ErrSenderNotFound), errors.Is(err, persistence.ErrMessageNotFound):
+			httperr.NewError(c, http.StatusNotFound, err)
 			return
-		case errors.Is(err, gorm.ErrInvalidValue), errors.Is(err, gorm.ErrInvalidValueOfLength):
-			httperr.NewError(c, http.StatusBadRequest, errors.New("invalid request"))
+		case errors.Is(err, persistence.ErrInvalidValue):
+			httperr.NewError(c, http.StatusBadRequest, err)
 			return
 		default:
-			httperr.NewError(c, http.StatusInternalServerError, errors.New("internal server error"))
+			middleware.InternalError(c, err)
 			return
 		}
 	}
 
+	ctl.metrics.RepliesCreated.Inc()
 	c.JSON(http.StatusCreated, out)
 }
 
-func GetReplies(c *gin.Context) {
+func (ctl *Controller) GetReplies(c *gin.Context) {
 	var req models.UriId
 	if err := c.BindUri(&req); err != nil {
 		httperr.NewError(c, http.StatusBadRequest, errors.New("invalid request"))
@@ -123,12 +279,79 @@ func GetReplies(c *gin.Context) {
 		},
 	}
 
-	r := persistence.GetMessageRepository()
-	out, err := r.GetReplies(&in)
+	viewer, _ := middleware.CurrentUser(c)
+	r := ctl.messages
+	out, err := r.GetReplies(c.Request.Context(), viewer, &in)
 	if err != nil {
-		httperr.NewError(c, http.StatusNotFound, errors.New("message ID does not exist"))
+		switch {
+		case errors.Is(err, persistence.ErrMessageNotFound):
+			httperr.NewError(c, http.StatusNotFound, err)
+			return
+		default:
+			middleware.InternalError(c, err)
+			return
+		}
+	}
+
+	c.JSON(http.StatusOK, out)
+}
+
+func (ctl *Controller) GetThread(c *gin.Context) {
+	var req models.UriId
+	if err := c.BindUri(&req); err != nil {
+		httperr.NewError(c, http.StatusBadRequest, errors.New("invalid request"))
+		return
+	}
+
+	var query models.ThreadQuery
+	if err := c.ShouldBindQuery(&query); err != nil {
+		httperr.NewError(c, http.StatusBadRequest, errors.New("invalid request"))
 		return
 	}
 
+	in := models.Message{
+		Model: models.Model{
+			ID: req.ID,
+		},
+	}
+
+	viewer, _ := middleware.CurrentUser(c)
+	r := ctl.messages
+	out, err := r.GetThread(c.Request.Context(), viewer, &in)
+	if err != nil {
+		switch {
+		case errors.Is(err, persistence.ErrMessageNotFound):
+			httperr.NewError(c, http.StatusNotFound, err)
+			return
+		default:
+			middleware.InternalError(c, err)
+			return
+		}
+	}
+
+	if query.Format == models.ThreadFormatTree {
+		c.JSON(http.StatusOK, threadTree(out))
+		return
+	}
 	c.JSON(http.StatusOK, out)
 }
+
+// threadTree nests a depth-first thread listing under its first message. The
+// listing leaves out the messages the viewer may not read, so a message whose
+// parent is missing is nested under the first message instead.
+func threadTree(thread []*models.ThreadMessage) *models.ThreadMessage {
+	byID := make(map[int32]*models.ThreadMessage, len(thread))
+	for _, tm := range thread {
+		byID[tm.ID] = tm
+	}
+
+	for _, tm := range thread[1:] {
+		parent, ok := byID[tm.Re]
+		if !ok {
+			parent = thread[0]
+		}
+		parent.Replies = append(parent.Replies, tm)
+	}
+
+	return thread[0]
+}
@@ -0,0 +1,193 @@
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/benshields/messagebox/internal/api/middleware"
+	"github.com/benshields/messagebox/internal/pkg/events"
+	"github.com/benshields/messagebox/internal/pkg/httperr"
+	"github.com/benshields/messagebox/internal/pkg/models"
+	"github.com/benshields/messagebox/internal/pkg/persistence"
+)
+
+// HeartbeatInterval is how often an idle mailbox stream sends a comment, so
+// that proxies and clients can tell it is still alive.
+var HeartbeatInterval = 15 * time.Second
+
+// ResumeLookback is how many message IDs before the last event a client saw a
+// resuming stream looks back over. IDs are taken as messages are created, but
+// messages commit in whatever order their transactions finish, so one with a
+// lower ID may have committed after the last event was sent.
+var ResumeLookback int32 = 100
+
+const (
+	eventMessage = "message"
+	eventReply   = "reply"
+)
+
+// StreamMailbox pushes messages to the user's mailbox as server-sent events,
+// as they are committed. The ID of each event is the message ID; a client
+// reconnecting with a Last-Event-ID header, or a lastEventId query parameter,
+// first receives every message it missed. Those include the messages within
+// ResumeLookback IDs of its last event, some of which it may already have, and
+// which it can tell by their IDs.
+func (ctl *Controller) StreamMailbox(c *gin.Context) {
+	var req models.UriUsername
+	if err := c.BindUri(&req); err != nil {
+		httperr.NewError(c, http.StatusBadRequest, errors.New("invalid request"))
+		return
+	}
+
+	lastID, err := lastEventID(c)
+	if err != nil {
+		httperr.NewError(c, http.StatusBadRequest, errors.New("invalid Last-Event-ID"))
+		return
+	}
+
+	hub := ctl.events
+	if hub == nil {
+		httperr.NewError(c, http.StatusServiceUnavailable, errors.New("mailbox streaming is unavailable"))
+		return
+	}
+
+	r := ctl.users
+	user, err := r.Read(c.Request.Context(), &models.User{Name: req.Username})
+	if err != nil {
+		switch {
+		case errors.Is(err, persistence.ErrUserNotFound):
+			httperr.NewError(c, http.StatusNotFound, err)
+			return
+		default:
+			middleware.InternalError(c, err)
+			return
+		}
+	}
+
+	// subscribe before catching up, so that nothing committed in between is lost
+	sub, unsubscribe := hub.Subscribe()
+	defer unsubscribe()
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+	c.Writer.Flush()
+
+	// the messages sent while catching up, whose events may still arrive
+	caughtUp := map[int32]bool{}
+	if lastID > 0 {
+		afterID := lastID - ResumeLookback
+		if afterID < 0 {
+			afterID = 0
+		}
+		for {
+			missed, err := r.GetMailboxAfter(c.Request.Context(), user, afterID, persistence.DefaultPageLimit)
+			if err != nil {
+				return
+			}
+			for _, msg := range missed {
+				if err := writeMessageEvent(c, msg); err != nil {
+					return
+				}
+				caughtUp[msg.ID] = true
+				afterID = msg.ID
+			}
+			if len(missed) < persistence.DefaultPageLimit {
+				break
+			}
+		}
+	}
+
+	heartbeat := time.NewTicker(HeartbeatInterval)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-c.Request.Context().Done():
+			return
+		case <-heartbeat.C:
+			if _, err := c.Writer.WriteString(": heartbeat\n\n"); err != nil {
+				return
+			}
+			c.Writer.Flush()
+		case ev, ok := <-sub:
+			if !ok {
+				// fell behind; the client reconnects and catches up from its last event
+				return
+			}
+			// each message is announced once, so its ID is done with either way
+			if caughtUp[ev.MessageID] {
+				delete(caughtUp, ev.MessageID)
+				continue
+			}
+			if !mayConcern(user, ev) {
+				continue
+			}
+
+			msg, err := r.GetMailboxMessage(c.Request.Context(), user, &models.Message{Model: models.Model{ID: ev.MessageID}})
+			if errors.Is(err, persistence.ErrMessageNotFound) {
+				continue
+			}
+			if err != nil {
+				return
+			}
+			if err := writeMessageEvent(c, msg); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func lastEventID(c *gin.Context) (int32, error) {
+	raw := c.GetHeader("Last-Event-ID")
+	if raw == "" {
+		raw = c.Query("lastEventId")
+	}
+	if raw == "" {
+		return 0, nil
+	}
+
+	id, err := strconv.ParseInt(raw, 10, 32)
+	if err != nil || id < 0 {
+		return 0, errors.New("invalid event ID")
+	}
+	return int32(id), nil
+}
+
+// mayConcern rules out events for messages addressed only to other users,
+// without a trip to the database. Group messages still need a membership
+// check.
+func mayConcern(user *models.User, ev events.MessageEvent) bool {
+	for _, id := range ev.Recipients {
+		if id == user.ID || !persistence.IsUserID(id) {
+			return true
+		}
+	}
+	return false
+}
+
+func writeMessageEvent(c *gin.Context, msg *models.Message) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	event := eventMessage
+	if msg.Re != 0 {
+		event = eventReply
+	}
+
+	if _, err := fmt.Fprintf(c.Writer, "id: %d\nevent: %s\ndata: %s\n\n", msg.ID, event, data); err != nil {
+		return err
+	}
+	c.Writer.Flush()
+	return nil
+}
@@ -0,0 +1,68 @@
+package controllers
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/benshields/messagebox/internal/api/middleware"
+	"github.com/benshields/messagebox/internal/pkg/httperr"
+	"github.com/benshields/messagebox/internal/pkg/models"
+	"github.com/benshields/messagebox/internal/pkg/persistence"
+)
+
+func (ctl *Controller) CreateToken(c *gin.Context) {
+	user, _ := middleware.CurrentUser(c)
+
+	r := ctl.tokens
+	out, err := r.Create(c.Request.Context(), user)
+	if err != nil {
+		middleware.InternalError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, out)
+}
+
+func (ctl *Controller) GetTokens(c *gin.Context) {
+	user, _ := middleware.CurrentUser(c)
+
+	r := ctl.tokens
+	out, err := r.FindByUserID(c.Request.Context(), user)
+	if err != nil {
+		middleware.InternalError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, out)
+}
+
+func (ctl *Controller) DeleteToken(c *gin.Context) {
+	var req models.UriUserToken
+	if err := c.BindUri(&req); err != nil {
+		httperr.NewError(c, http.StatusBadRequest, errors.New("invalid request"))
+		return
+	}
+
+	user, _ := middleware.CurrentUser(c)
+	in := models.APIToken{
+		Model: models.Model{
+			ID: req.ID,
+		},
+	}
+
+	r := ctl.tokens
+	if err := r.Delete(c.Request.Context(), user, &in); err != nil {
+		switch {
+		case errors.Is(err, persistence.ErrTokenNotFound):
+			httperr.NewError(c, http.StatusNotFound, err)
+			return
+		default:
+			middleware.InternalError(c, err)
+			return
+		}
+	}
+
+	c.Status(http.StatusNoContent)
+}
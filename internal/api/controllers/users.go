@@ -1,12 +1,13 @@
 package controllers
 
 import (
+	"context"
 	"errors"
 	"net/http"
 
 	"github.com/gin-gonic/gin"
-	"gorm.io/gorm"
 
+	"github.com/benshields/messagebox/internal/api/middleware"
 	"github.com/benshields/messagebox/internal/pkg/httperr"
 	"github.com/benshields/messagebox/internal/pkg/models"
 	"github.com/benshields/messagebox/internal/pkg/persistence"
@@ -16,10 +17,15 @@ type UserRegistration struct {
 	Username string `json:"username" binding:"required,min=1,max=32"`
 }
 
-func CreateUser(c *gin.Context) {
+type UserRegistered struct {
+	Username string `json:"username"`
+	Token    string `json:"token"`
+}
+
+func (ctl *Controller) CreateUser(c *gin.Context) {
 	var req UserRegistration
-	if err := c.BindJSON(&req); err != nil {
-		httperr.NewError(c, http.StatusBadRequest, errors.New("invalid request"))
+	if err := c.ShouldBindJSON(&req); err != nil {
+		httperr.NewBindError(c, err)
 		return
 	}
 
@@ -27,57 +33,222 @@ func CreateUser(c *gin.Context) {
 		Name: req.Username,
 	}
 
-	r := persistence.GetUserRepository()
-	out, err := r.Create(&in)
+	r := ctl.users
+	out, token, err := r.Register(c.Request.Context(), &in)
 	if err != nil {
-		httperr.NewError(c, http.StatusConflict, errors.New("user with the same username already registered"))
-		return
+		switch {
+		case errors.Is(err, persistence.ErrDuplicateName):
+			httperr.NewError(c, http.StatusConflict, err)
+			return
+		case errors.Is(err, persistence.ErrInvalidValue):
+			httperr.NewError(c, http.StatusBadRequest, err)
+			return
+		default:
+			middleware.InternalError(c, err)
+			return
+		}
 	}
 
-	resp := UserRegistration{Username: out.Name}
+	resp := UserRegistered{
+		Username: out.Name,
+		Token:    token.Token,
+	}
+	ctl.metrics.UsersRegistered.Inc()
 	c.JSON(http.StatusCreated, resp)
 }
 
-func GetUser(c *gin.Context) {
+func (ctl *Controller) GetUser(c *gin.Context) {
 	req := c.Param("username")
 
 	in := models.User{
 		Name: req,
 	}
 
-	r := persistence.GetUserRepository()
-	out, err := r.Read(&in)
+	r := ctl.users
+	out, err := r.Read(c.Request.Context(), &in)
 	if err != nil {
-		httperr.NewError(c, http.StatusNotFound, errors.New("user with given username does not exist"))
+		switch {
+		case errors.Is(err, persistence.ErrUserNotFound):
+			httperr.NewError(c, http.StatusNotFound, err)
+			return
+		default:
+			middleware.InternalError(c, err)
+			return
+		}
+	}
+
+	c.JSON(http.StatusOK, out)
+}
+
+func (ctl *Controller) GetMailbox(c *gin.Context) {
+	var req models.UriUsername
+	if err := c.BindUri(&req); err != nil {
+		httperr.NewError(c, http.StatusBadRequest, errors.New("invalid request"))
 		return
 	}
 
+	var query models.MailboxQuery
+	if err := c.ShouldBindQuery(&query); err != nil {
+		httperr.NewError(c, http.StatusBadRequest, errors.New("invalid request"))
+		return
+	}
+
+	in := models.User{
+		Name: req.Username,
+	}
+
+	r := ctl.users
+	out, err := r.GetMailbox(c.Request.Context(), &in, query)
+	if err != nil {
+		switch {
+		case errors.Is(err, persistence.ErrUserNotFound):
+			httperr.NewError(c, http.StatusNotFound, err)
+			return
+		case errors.Is(err, persistence.ErrInvalidCursor):
+			httperr.NewError(c, http.StatusBadRequest, err)
+			return
+		default:
+			middleware.InternalError(c, err)
+			return
+		}
+	}
+
 	c.JSON(http.StatusOK, out)
 }
 
-func GetMailbox(c *gin.Context) {
+func (ctl *Controller) SearchMailbox(c *gin.Context) {
 	var req models.UriUsername
 	if err := c.BindUri(&req); err != nil {
 		httperr.NewError(c, http.StatusBadRequest, errors.New("invalid request"))
 		return
 	}
 
+	var query models.SearchQuery
+	if err := c.ShouldBindQuery(&query); err != nil {
+		httperr.NewError(c, http.StatusBadRequest, errors.New("invalid request"))
+		return
+	}
+
 	in := models.User{
 		Name: req.Username,
 	}
 
-	r := persistence.GetUserRepository()
-	out, err := r.GetMailbox(&in)
+	r := ctl.users
+	out, err := r.SearchMailbox(c.Request.Context(), &in, query)
 	if err != nil {
 		switch {
-		case errors.Is(err, gorm.ErrRecordNotFound):
-			httperr.NewError(c, http.StatusNotFound, errors.New("user with given username does not exist"))
+		case errors.Is(err, persistence.ErrUserNotFound):
+			httperr.NewError(c, http.StatusNotFound, err)
+			return
+		case errors.Is(err, persistence.ErrInvalidCursor):
+			httperr.NewError(c, http.StatusBadRequest, err)
 			return
 		default:
-			httperr.NewError(c, http.StatusInternalServerError, errors.New("internal server error"))
+			middleware.InternalError(c, err)
 			return
 		}
 	}
 
 	c.JSON(http.StatusOK, out)
 }
+
+func (ctl *Controller) GetSent(c *gin.Context) {
+	var req models.UriUsername
+	if err := c.BindUri(&req); err != nil {
+		httperr.NewError(c, http.StatusBadRequest, errors.New("invalid request"))
+		return
+	}
+
+	var query models.MailboxQuery
+	if err := c.ShouldBindQuery(&query); err != nil {
+		httperr.NewError(c, http.StatusBadRequest, errors.New("invalid request"))
+		return
+	}
+
+	in := models.User{
+		Name: req.Username,
+	}
+
+	r := ctl.users
+	out, err := r.GetSent(c.Request.Context(), &in, query)
+	if err != nil {
+		switch {
+		case errors.Is(err, persistence.ErrUserNotFound):
+			httperr.NewError(c, http.StatusNotFound, err)
+			return
+		case errors.Is(err, persistence.ErrInvalidCursor):
+			httperr.NewError(c, http.StatusBadRequest, err)
+			return
+		default:
+			middleware.InternalError(c, err)
+			return
+		}
+	}
+
+	c.JSON(http.StatusOK, out)
+}
+
+func (ctl *Controller) GetMailboxSummary(c *gin.Context) {
+	var req models.UriUsername
+	if err := c.BindUri(&req); err != nil {
+		httperr.NewError(c, http.StatusBadRequest, errors.New("invalid request"))
+		return
+	}
+
+	in := models.User{
+		Name: req.Username,
+	}
+
+	r := ctl.users
+	out, err := r.GetMailboxSummary(c.Request.Context(), &in)
+	if err != nil {
+		switch {
+		case errors.Is(err, persistence.ErrUserNotFound):
+			httperr.NewError(c, http.StatusNotFound, err)
+			return
+		default:
+			middleware.InternalError(c, err)
+			return
+		}
+	}
+
+	c.JSON(http.StatusOK, out)
+}
+
+func (ctl *Controller) MarkRead(c *gin.Context) {
+	markMailboxMessage(c, ctl.users.MarkRead)
+}
+
+func (ctl *Controller) MarkUnread(c *gin.Context) {
+	markMailboxMessage(c, ctl.users.MarkUnread)
+}
+
+func markMailboxMessage(c *gin.Context, mark func(context.Context, *models.User, *models.Message) error) {
+	var req models.UriMailboxMessage
+	if err := c.BindUri(&req); err != nil {
+		httperr.NewError(c, http.StatusBadRequest, errors.New("invalid request"))
+		return
+	}
+
+	user := models.User{
+		Name: req.Username,
+	}
+	message := models.Message{
+		Model: models.Model{
+			ID: req.ID,
+		},
+	}
+
+	if err := mark(c.Request.Context(), &user, &message); err != nil {
+		switch {
+		case errors.Is(err, persistence.ErrUserNotFound), errors.Is(err, persistence.ErrMessageNotFound):
+			httperr.NewError(c, http.StatusNotFound, err)
+			return
+		default:
+			middleware.InternalError(c, err)
+			return
+		}
+	}
+
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,134 @@
+package controllers
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/benshields/messagebox/internal/api/middleware"
+	"github.com/benshields/messagebox/internal/pkg/httperr"
+	"github.com/benshields/messagebox/internal/pkg/models"
+	"github.com/benshields/messagebox/internal/pkg/persistence"
+	"github.com/benshields/messagebox/internal/pkg/webhooks"
+)
+
+func (ctl *Controller) CreateWebhook(c *gin.Context) {
+	var req models.WebhookCreation
+	if err := c.ShouldBindJSON(&req); err != nil {
+		httperr.NewBindError(c, err)
+		return
+	}
+
+	// only deliver over HTTP(S)
+	if u, err := url.Parse(req.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		httperr.NewError(c, http.StatusBadRequest, httperr.ValidationErrors{{
+			Field:   "url",
+			Rule:    "url",
+			Message: "url must be an http or https URL",
+		}})
+		return
+	}
+
+	if err := ctl.guard.CheckURL(c.Request.Context(), req.URL); err != nil {
+		message := "url host could not be resolved"
+		if errors.Is(err, webhooks.ErrPrivateAddress) {
+			message = "url must not be a loopback, link-local or private address"
+		}
+		httperr.NewError(c, http.StatusBadRequest, httperr.ValidationErrors{{
+			Field:   "url",
+			Rule:    "url",
+			Message: message,
+		}})
+		return
+	}
+
+	creator, _ := middleware.CurrentUser(c)
+	r := ctl.webhooks
+	out, err := r.Create(c.Request.Context(), webhookOwner(c), creator.ID, req.URL)
+	if err != nil {
+		middleware.InternalError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, out)
+}
+
+func (ctl *Controller) GetWebhooks(c *gin.Context) {
+	r := ctl.webhooks
+	out, err := r.FindByOwnerID(c.Request.Context(), webhookOwner(c))
+	if err != nil {
+		middleware.InternalError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, out)
+}
+
+func (ctl *Controller) DeleteWebhook(c *gin.Context) {
+	var req models.UriId
+	if err := c.BindUri(&req); err != nil {
+		httperr.NewError(c, http.StatusBadRequest, errors.New("invalid request"))
+		return
+	}
+
+	in := models.Webhook{
+		Model: models.Model{
+			ID: req.ID,
+		},
+	}
+
+	r := ctl.webhooks
+	if err := r.Delete(c.Request.Context(), webhookOwner(c), &in); err != nil {
+		switch {
+		case errors.Is(err, persistence.ErrWebhookNotFound):
+			httperr.NewError(c, http.StatusNotFound, err)
+			return
+		default:
+			middleware.InternalError(c, err)
+			return
+		}
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+func (ctl *Controller) GetWebhookDeliveries(c *gin.Context) {
+	var req models.UriId
+	if err := c.BindUri(&req); err != nil {
+		httperr.NewError(c, http.StatusBadRequest, errors.New("invalid request"))
+		return
+	}
+
+	in := models.Webhook{
+		Model: models.Model{
+			ID: req.ID,
+		},
+	}
+
+	r := ctl.webhooks
+	out, err := r.FindDeliveries(c.Request.Context(), webhookOwner(c), &in)
+	if err != nil {
+		switch {
+		case errors.Is(err, persistence.ErrWebhookNotFound):
+			httperr.NewError(c, http.StatusNotFound, err)
+			return
+		default:
+			middleware.InternalError(c, err)
+			return
+		}
+	}
+
+	c.JSON(http.StatusOK, out)
+}
+
+// webhookOwner returns the ID of the group the webhooks belong to under
+// /groups/:groupname, and otherwise of the authenticated user.
+func webhookOwner(c *gin.Context) int32 {
+	if group, ok := middleware.CurrentGroup(c); ok {
+		return group.ID
+	}
+	user, _ := middleware.CurrentUser(c)
+	return user.ID
+}
@@ -0,0 +1,107 @@
+package middleware
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+
+	"github.com/benshields/messagebox/internal/pkg/httperr"
+	"github.com/benshields/messagebox/internal/pkg/models"
+	"github.com/benshields/messagebox/internal/pkg/persistence"
+)
+
+const (
+	bearerScheme = "Bearer"
+	userKey      = "messagebox.user"
+	groupKey     = "messagebox.group"
+)
+
+// Authenticate requires a bearer API token, or else a client certificate
+// verified during the TLS handshake, and stores the user it belongs to in the
+// context, where handlers can retrieve it with CurrentUser. A certificate
+// belongs to the user named by its subject common name.
+func Authenticate(tokens persistence.Tokens, users persistence.Users) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var user *models.User
+		var err error
+		if token, ok := bearerToken(c.GetHeader("Authorization")); ok {
+			user, err = tokens.Authenticate(c.Request.Context(), token)
+			if errors.Is(err, persistence.ErrTokenNotFound) {
+				unauthorized(c, errors.New("invalid bearer token"))
+				return
+			}
+		} else if name, ok := certificateSubject(c); ok {
+			user, err = users.Read(c.Request.Context(), &models.User{Name: name})
+			if errors.Is(err, persistence.ErrUserNotFound) {
+				unauthorized(c, errors.New("no user for client certificate subject"))
+				return
+			}
+		} else {
+			unauthorized(c, errors.New("missing bearer token"))
+			return
+		}
+		if err != nil {
+			InternalError(c, err)
+			c.Abort()
+			return
+		}
+
+		c.Set(userKey, user)
+		setLogger(c, Logger(c).With(zap.String("user", user.Name)))
+		c.Next()
+	}
+}
+
+// CurrentUser returns the user authenticated for this request.
+func CurrentUser(c *gin.Context) (*models.User, bool) {
+	v, ok := c.Get(userKey)
+	if !ok {
+		return nil, false
+	}
+	user, ok := v.(*models.User)
+	return user, ok
+}
+
+func bearerToken(header string) (string, bool) {
+	parts := strings.SplitN(header, " ", 2)
+	if len(parts) != 2 || !strings.EqualFold(parts[0], bearerScheme) {
+		return "", false
+	}
+	token := strings.TrimSpace(parts[1])
+	return token, token != ""
+}
+
+// certificateSubject returns the subject common name of the client certificate
+// that the TLS handshake verified, if any.
+func certificateSubject(c *gin.Context) (string, bool) {
+	state := c.Request.TLS
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return "", false
+	}
+	name := state.VerifiedChains[0][0].Subject.CommonName
+	return name, name != ""
+}
+
+func unauthorized(c *gin.Context, err error) {
+	c.Header("WWW-Authenticate", bearerScheme)
+	httperr.NewError(c, http.StatusUnauthorized, err)
+	c.Abort()
+}
+
+// RequireSelf only lets a request through when the authenticated user is the
+// user named by the :username path parameter. It must run after Authenticate.
+func RequireSelf() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user, ok := CurrentUser(c)
+		if !ok || user.Name != c.Param("username") {
+			httperr.NewError(c, http.StatusForbidden, errors.New("not permitted to act for another user"))
+			c.Abort()
+			return
+		}
+
+		c.Next()
+	}
+}
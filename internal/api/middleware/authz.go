@@ -0,0 +1,114 @@
+package middleware
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/benshields/messagebox/internal/pkg/httperr"
+	"github.com/benshields/messagebox/internal/pkg/models"
+	"github.com/benshields/messagebox/internal/pkg/persistence"
+)
+
+// AuthorizeMessage only lets a request through when the authenticated user
+// may read the message named by the :id path parameter. It must run after
+// Authenticate.
+func AuthorizeMessage(messages persistence.Messages) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req models.UriId
+		if err := c.ShouldBindUri(&req); err != nil {
+			httperr.NewError(c, http.StatusBadRequest, errors.New("invalid request"))
+			c.Abort()
+			return
+		}
+
+		user, ok := CurrentUser(c)
+		if !ok {
+			unauthorized(c, errors.New("missing bearer token"))
+			return
+		}
+
+		in := models.Message{
+			Model: models.Model{
+				ID: req.ID,
+			},
+		}
+
+		allowed, err := messages.CanRead(c.Request.Context(), user, &in)
+		if err != nil {
+			switch {
+			case errors.Is(err, persistence.ErrMessageNotFound):
+				httperr.NewError(c, http.StatusNotFound, err)
+			default:
+				InternalError(c, err)
+			}
+			c.Abort()
+			return
+		}
+		if !allowed {
+			httperr.NewError(c, http.StatusForbidden, errors.New("not permitted to read this message"))
+			c.Abort()
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// RequireMember only lets a request through when the authenticated user
+// belongs to the group named by the :groupname path parameter, which is then
+// available from CurrentGroup. It must run after Authenticate.
+func RequireMember(groups persistence.Groups) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req models.UriGroupname
+		if err := c.ShouldBindUri(&req); err != nil {
+			httperr.NewError(c, http.StatusBadRequest, errors.New("invalid request"))
+			c.Abort()
+			return
+		}
+
+		user, ok := CurrentUser(c)
+		if !ok {
+			unauthorized(c, errors.New("missing bearer token"))
+			return
+		}
+
+		group, err := groups.Read(c.Request.Context(), &models.Group{Name: req.Groupname})
+		if err != nil {
+			switch {
+			case errors.Is(err, persistence.ErrGroupNotFound):
+				httperr.NewError(c, http.StatusNotFound, err)
+			default:
+				InternalError(c, err)
+			}
+			c.Abort()
+			return
+		}
+
+		member, err := groups.IsMember(c.Request.Context(), group, user)
+		if err != nil {
+			InternalError(c, err)
+			c.Abort()
+			return
+		}
+		if !member {
+			httperr.NewError(c, http.StatusForbidden, errors.New("not a member of the group"))
+			c.Abort()
+			return
+		}
+
+		c.Set(groupKey, group)
+		c.Next()
+	}
+}
+
+// CurrentGroup returns the group that RequireMember authorized.
+func CurrentGroup(c *gin.Context) (*models.Group, bool) {
+	v, ok := c.Get(groupKey)
+	if !ok {
+		return nil, false
+	}
+	group, ok := v.(*models.Group)
+	return group, ok
+}
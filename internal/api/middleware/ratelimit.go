@@ -0,0 +1,95 @@
+package middleware
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+
+	"github.com/benshields/messagebox/internal/pkg/httperr"
+	"github.com/benshields/messagebox/internal/pkg/ratelimit"
+)
+
+const rateLimitKey = "messagebox.ratelimit"
+
+// LimitIP takes a token from the bucket of the client IP of every request.
+// A nil limiter lets everything through.
+func LimitIP(limiter *ratelimit.Limiter) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !allow(c, limiter, ratelimit.PerIP, c.ClientIP()) {
+			return
+		}
+		c.Next()
+	}
+}
+
+// LimitSender takes a token from the bucket of the authenticated user. It
+// must run after Authenticate.
+func LimitSender(limiter *ratelimit.Limiter) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user, ok := CurrentUser(c)
+		if ok && !allow(c, limiter, ratelimit.PerSender, user.Name) {
+			return
+		}
+		c.Next()
+	}
+}
+
+// AllowGroups takes a token from the bucket of each group, for handlers that
+// only learn the groups a message is sent to once they bind its body. It
+// answers and returns false once a bucket is empty.
+func AllowGroups(c *gin.Context, limiter *ratelimit.Limiter, groupnames []string) bool {
+	for _, name := range groupnames {
+		if !allow(c, limiter, ratelimit.PerGroup, name) {
+			return false
+		}
+	}
+	return true
+}
+
+// allow takes a token from the bucket of key in scope, and describes the
+// bucket in the RateLimit-Limit, RateLimit-Remaining and RateLimit-Reset
+// headers. Of the buckets a request draws from, the headers describe the one
+// with the fewest tokens left. When the bucket is empty, allow answers with
+// Retry-After and aborts.
+//
+// The limits protect the API rather than guard anything, so requests are let
+// through while the store is failing.
+func allow(c *gin.Context, limiter *ratelimit.Limiter, scope ratelimit.Scope, key string) bool {
+	if limiter == nil {
+		return true
+	}
+
+	res, err := limiter.Take(c.Request.Context(), scope, key)
+	if err != nil {
+		Logger(c).Warn("rate limit store failed, allowing the request", zap.String("scope", string(scope)), zap.Error(err))
+		return true
+	}
+	if res.Limit == 0 {
+		return true
+	}
+
+	if prev, ok := c.Get(rateLimitKey); !ok || res.Remaining < prev.(ratelimit.Result).Remaining || !res.Allowed {
+		c.Set(rateLimitKey, res)
+		c.Header("RateLimit-Limit", strconv.Itoa(res.Limit))
+		c.Header("RateLimit-Remaining", strconv.Itoa(res.Remaining))
+		c.Header("RateLimit-Reset", seconds(res.Reset))
+	}
+
+	if !res.Allowed {
+		c.Header("Retry-After", seconds(res.RetryAfter))
+		httperr.NewError(c, http.StatusTooManyRequests, errors.New("rate limit exceeded, retry later"))
+		c.Abort()
+		return false
+	}
+	return true
+}
+
+// seconds rounds d up to whole seconds, as headers give them.
+func seconds(d time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(d.Seconds())))
+}
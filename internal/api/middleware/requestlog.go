@@ -0,0 +1,121 @@
+package middleware
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	mathrand "math/rand"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+
+	"github.com/benshields/messagebox/internal/pkg/httperr"
+	"github.com/benshields/messagebox/internal/pkg/logger"
+)
+
+// RequestIDHeader carries the ID of a request, from the caller if it sent a
+// valid one, and back to it in the response.
+const RequestIDHeader = "X-Request-ID"
+
+const loggerKey = "messagebox.logger"
+
+// validRequestID bounds the request IDs taken from callers, so that they
+// cannot forge log lines or fill them.
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// RequestLogger assigns every request an ID, stores a logger carrying it in
+// the context, where handlers can retrieve it with Logger and repositories
+// with logger.FromContext, and logs the request once it is handled.
+//
+// sampling maps route templates to the fraction of their requests that are
+// logged, so that probes and scrapes do not drown the rest. Routes that are
+// not listed, and server errors on any route, are always logged.
+func RequestLogger(log *zap.Logger, sampling map[string]float64) gin.HandlerFunc {
+	if log == nil {
+		log = zap.NewNop()
+	}
+	return func(c *gin.Context) {
+		start := time.Now()
+
+		id := c.GetHeader(RequestIDHeader)
+		if !validRequestID.MatchString(id) {
+			id = newRequestID()
+		}
+		c.Header(RequestIDHeader, id)
+
+		fields := []zap.Field{zap.String("request_id", id)}
+		if span := trace.SpanContextFromContext(c.Request.Context()); span.HasTraceID() {
+			fields = append(fields, zap.String("trace_id", span.TraceID().String()))
+		}
+		setLogger(c, log.With(fields...))
+
+		c.Next()
+
+		route := c.FullPath()
+		status := c.Writer.Status()
+		if !sampled(sampling, route, status) {
+			return
+		}
+
+		size := c.Writer.Size()
+		if size < 0 {
+			size = 0
+		}
+		fields = []zap.Field{
+			zap.String("method", c.Request.Method),
+			zap.String("route", route),
+			zap.Int("status", status),
+			zap.Duration("latency", time.Since(start)),
+			zap.Int("size", size),
+			zap.String("client_ip", c.ClientIP()),
+		}
+		// the logger carries the user once Authenticate has run
+		Logger(c).Info("request handled", fields...)
+	}
+}
+
+// Logger returns the logger for this request, which carries its ID and, once
+// it is authenticated, the name of its user.
+func Logger(c *gin.Context) *zap.Logger {
+	if v, ok := c.Get(loggerKey); ok {
+		if log, ok := v.(*zap.Logger); ok {
+			return log
+		}
+	}
+	return zap.NewNop()
+}
+
+// InternalError logs err, which is not for callers to see, and answers with
+// an internal server error.
+func InternalError(c *gin.Context, err error) {
+	Logger(c).Error("request failed", zap.Error(err))
+	httperr.NewError(c, http.StatusInternalServerError, errors.New("internal server error"))
+}
+
+// setLogger makes log the logger of this request, for handlers and for the
+// repositories they pass the request context to.
+func setLogger(c *gin.Context, log *zap.Logger) {
+	c.Set(loggerKey, log)
+	c.Request = c.Request.WithContext(logger.NewContext(c.Request.Context(), log))
+}
+
+func sampled(sampling map[string]float64, route string, status int) bool {
+	rate, ok := sampling[route]
+	if !ok || status >= http.StatusInternalServerError {
+		return true
+	}
+	return mathrand.Float64() < rate
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		// crypto/rand only fails when the system has no entropy to give
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,118 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+
+	"github.com/benshields/messagebox/db/migrations"
+	"github.com/benshields/messagebox/internal/pkg/config"
+	"github.com/benshields/messagebox/internal/pkg/db"
+	"github.com/benshields/messagebox/internal/pkg/logger"
+	"github.com/benshields/messagebox/internal/pkg/migrate"
+)
+
+const migrateUsage = "usage: migrate up|down|status|goto N"
+
+type UsageError struct {
+	Usage string
+}
+
+func (e UsageError) Error() string {
+	return e.Usage
+}
+
+// Migrate runs the migrate subcommand given by args: "up" applies every
+// pending migration, "down" reverts the latest one, "goto N" migrates up or
+// down to version N, 0 being the empty schema, and "status" writes the
+// version of the database and of every migration to out.
+func Migrate(configPath string, args []string, out io.Writer) error {
+	command, version, err := parseMigrateArgs(args)
+	if err != nil {
+		return err
+	}
+
+	cfg, err := config.New(configPath)
+	if err != nil {
+		return err
+	}
+
+	log, err := logger.Setup(cfg.Logger)
+	if err != nil {
+		return err
+	}
+
+	database, err := db.Setup(cfg.Database, log)
+	if err != nil {
+		return err
+	}
+
+	m, err := newMigrator(database, log)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	switch command {
+	case "up":
+		return m.Up(ctx)
+	case "down":
+		return m.Down(ctx)
+	case "goto":
+		return m.Goto(ctx, version)
+	default:
+		status, err := m.Status(ctx)
+		if err != nil {
+			return err
+		}
+		return writeStatus(out, status)
+	}
+}
+
+func parseMigrateArgs(args []string) (string, uint, error) {
+	switch {
+	case len(args) == 1 && (args[0] == "up" || args[0] == "down" || args[0] == "status"):
+		return args[0], 0, nil
+	case len(args) == 2 && args[0] == "goto":
+		version, err := strconv.ParseUint(args[1], 10, 32)
+		if err != nil {
+			return "", 0, UsageError{Usage: migrateUsage}
+		}
+		return args[0], uint(version), nil
+	default:
+		return "", 0, UsageError{Usage: migrateUsage}
+	}
+}
+
+func newMigrator(database *gorm.DB, log *zap.Logger) (*migrate.Migrator, error) {
+	sqlDB, err := database.DB()
+	if err != nil {
+		return nil, err
+	}
+	return migrate.New(sqlDB, migrations.FS, log)
+}
+
+func writeStatus(out io.Writer, status *migrate.Status) error {
+	current := strconv.FormatUint(uint64(status.Version), 10)
+	if status.Dirty {
+		current += " (dirty)"
+	}
+	if _, err := fmt.Fprintf(out, "version: %s\n", current); err != nil {
+		return err
+	}
+
+	for _, mig := range status.Migrations {
+		state := "pending"
+		if mig.Applied {
+			state = "applied"
+		}
+		if _, err := fmt.Fprintf(out, "%6d  %-7s  %s\n", mig.Version, state, mig.Name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
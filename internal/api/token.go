@@ -0,0 +1,60 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/benshields/messagebox/internal/pkg/config"
+	"github.com/benshields/messagebox/internal/pkg/db"
+	"github.com/benshields/messagebox/internal/pkg/logger"
+	"github.com/benshields/messagebox/internal/pkg/models"
+	"github.com/benshields/messagebox/internal/pkg/persistence"
+)
+
+const tokenUsage = "usage: token issue USERNAME"
+
+// Token runs the token subcommand given by args: "issue USERNAME" issues a new
+// API token for the user and writes it to out. Tokens are otherwise issued
+// only at registration, or to a user already holding one, so this is how
+// users registered before tokens existed, or who lost every token, get one.
+func Token(configPath string, args []string, out io.Writer) error {
+	if len(args) != 2 || args[0] != "issue" {
+		return UsageError{Usage: tokenUsage}
+	}
+
+	cfg, err := config.New(configPath)
+	if err != nil {
+		return err
+	}
+
+	log, err := logger.Setup(cfg.Logger)
+	if err != nil {
+		return err
+	}
+
+	if cfg.Storage.Backend == persistence.BackendMemory {
+		return errors.New("token issue needs the postgres backend, as the memory backend keeps no users between runs")
+	}
+	if _, err := db.Setup(cfg.Database, log); err != nil {
+		return err
+	}
+
+	return issueToken(context.Background(), persistence.NewPostgres(), args[1], out)
+}
+
+func issueToken(ctx context.Context, repos *persistence.Repositories, username string, out io.Writer) error {
+	user, err := repos.Users.Read(ctx, &models.User{Name: username})
+	if err != nil {
+		return err
+	}
+
+	token, err := repos.Tokens.Create(ctx, user)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintln(out, token.Token)
+	return err
+}
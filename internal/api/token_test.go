@@ -0,0 +1,36 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/benshields/messagebox/internal/pkg/models"
+	"github.com/benshields/messagebox/internal/pkg/persistence"
+)
+
+func TestIssueToken(t *testing.T) {
+	ctx := context.Background()
+
+	// a user registered before tokens existed holds none
+	repos := persistence.NewMemoryWith(persistence.Rows{Users: []models.User{{Name: "super.mario"}}})
+
+	var out bytes.Buffer
+	assert.NoError(t, issueToken(ctx, repos, "super.mario", &out))
+
+	user, err := repos.Tokens.Authenticate(ctx, strings.TrimSpace(out.String()))
+	assert.NoError(t, err)
+	assert.Equal(t, "super.mario", user.Name)
+
+	err = issueToken(ctx, repos, "luigi", &out)
+	assert.ErrorIs(t, err, persistence.ErrUserNotFound)
+}
+
+func TestToken(t *testing.T) {
+	for _, args := range [][]string{nil, {"issue"}, {"revoke", "super.mario"}, {"issue", "super.mario", "luigi"}} {
+		assert.Equal(t, UsageError{Usage: tokenUsage}, Token("", args, nil))
+	}
+}
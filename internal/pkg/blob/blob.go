@@ -0,0 +1,57 @@
+package blob
+
+import (
+	"context"
+	"errors"
+	"io"
+
+	"go.uber.org/zap"
+
+	"github.com/benshields/messagebox/internal/pkg/config"
+)
+
+const StoreLocal = "local"
+
+var (
+	ErrNotFound   = errors.New("blob not found")
+	ErrInvalidKey = errors.New("invalid blob key")
+	ErrNotSetup   = errors.New("blob store is not set up")
+)
+
+type UnknownStoreError struct {
+	Store string
+}
+
+func (e UnknownStoreError) Error() string {
+	return "blob.Setup() failed with unknown store: " + e.Store
+}
+
+// Store keeps the contents of attachments, addressed by key. Keys are chosen
+// by the caller and are safe to use as file names.
+type Store interface {
+	Put(ctx context.Context, key string, r io.Reader) (int64, error)
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	Delete(ctx context.Context, key string) error
+}
+
+func Setup(cfg config.AttachmentsConfiguration, log *zap.Logger) (Store, error) {
+	if log != nil {
+		sugar := log.Sugar()
+		defer sugar.Sync()
+		sugar.Debugw("blob.Setup", "config", cfg)
+	}
+
+	var store Store
+	switch cfg.Store {
+	case "", StoreLocal:
+		local, err := NewLocalStore(cfg.Dir)
+		if err != nil {
+			return nil, err
+		}
+		store = local
+	default:
+		return nil, UnknownStoreError{Store: cfg.Store}
+	}
+
+	return store, nil
+}
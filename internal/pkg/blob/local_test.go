@@ -0,0 +1,48 @@
+package blob
+
+import (
+	"context"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLocalStore(t *testing.T) {
+	ctx := context.Background()
+	store, err := NewLocalStore(t.TempDir())
+	if err != nil {
+		t.Fatal("NewLocalStore() failed with:", err)
+	}
+
+	t.Run("Success round trip", func(t *testing.T) {
+		n, err := store.Put(ctx, "abc123", strings.NewReader("hello"))
+		assert.NoError(t, err)
+		assert.Equal(t, int64(5), n)
+
+		rc, err := store.Get(ctx, "abc123")
+		assert.NoError(t, err)
+		got, err := ioutil.ReadAll(rc)
+		assert.NoError(t, err)
+		assert.NoError(t, rc.Close())
+		assert.Equal(t, "hello", string(got))
+
+		assert.NoError(t, store.Delete(ctx, "abc123"))
+		_, err = store.Get(ctx, "abc123")
+		assert.ErrorIs(t, err, ErrNotFound)
+	})
+
+	t.Run("Fail on missing key", func(t *testing.T) {
+		_, err := store.Get(ctx, "missing")
+		assert.ErrorIs(t, err, ErrNotFound)
+		assert.ErrorIs(t, store.Delete(ctx, "missing"), ErrNotFound)
+	})
+
+	t.Run("Fail on key outside the store", func(t *testing.T) {
+		for _, key := range []string{"", "../escape", "a/b", ".upload-1"} {
+			_, err := store.Put(ctx, key, strings.NewReader("x"))
+			assert.ErrorIs(t, err, ErrInvalidKey, key)
+		}
+	})
+}
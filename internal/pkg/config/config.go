@@ -1,13 +1,21 @@
 package config
 
 import (
+	"errors"
+	"io/ioutil"
+	"os"
 	"strings"
+	"time"
 
 	"github.com/spf13/viper"
 )
 
 const defaultConfigPath = "config/default.yaml"
 
+// fileSuffix marks the environment variables that name a file holding the
+// value of a setting, rather than the value itself.
+const fileSuffix = "_FILE"
+
 type ConfigError struct {
 	ConfigPath string
 	Err        error
@@ -17,32 +25,144 @@ func (e ConfigError) Error() string {
 	return "config.New(" + e.ConfigPath + ") failed with: " + e.Err.Error()
 }
 
+func (e ConfigError) Unwrap() error {
+	return e.Err
+}
+
 type Configuration struct {
-	Logger   LoggerConfiguration
-	Server   ServerConfiguration
-	Database DatabaseConfiguration
+	Logger      LoggerConfiguration
+	Server      ServerConfiguration
+	Database    DatabaseConfiguration
+	Storage     StorageConfiguration
+	Attachments AttachmentsConfiguration
+	Webhooks    WebhooksConfiguration
+	Tracing     TracingConfiguration
+	RateLimit   RateLimitConfiguration
 }
 
 type LoggerConfiguration struct {
 	Preset string
 }
 
+// ServerConfiguration sets where the API listens. ValidateSpec checks every
+// request and response against the OpenAPI document, logging mismatches; it
+// only applies in debug mode. AccessLogSampling maps route templates, such as
+// "/healthz", to the fraction of their requests that get an access log line;
+// other routes, and server errors on any route, are always logged. The client
+// IP is only taken from the X-Forwarded-For and X-Real-IP headers of requests
+// from TrustedProxies, IPs or CIDRs, which are none by default.
 type ServerConfiguration struct {
-	Host string
-	Port string
-	Mode string
+	Host              string
+	Port              string
+	Mode              string
+	ValidateSpec      bool
+	AccessLogSampling map[string]float64
+	TrustedProxies    []string
+	TLS               TLSConfiguration
+}
+
+// TLSConfiguration serves HTTPS with the certificate and key in CertFile and
+// KeyFile, which are read again when they change on disk, checking every
+// ReloadInterval. ClientAuth asks clients for a certificate signed by a CA in
+// ClientCAFile: "none" does not ask, "optional" verifies one when it is given
+// and "require" turns away clients without one. A verified certificate
+// authenticates the user named by its subject common name.
+type TLSConfiguration struct {
+	CertFile       string
+	KeyFile        string
+	ClientAuth     string
+	ClientCAFile   string
+	ReloadInterval time.Duration
 }
 
+// DatabaseConfiguration sets how to connect to Postgres. Connecting at startup
+// is attempted up to ConnectAttempts times, waiting ConnectMinBackoff after the
+// first failure and doubling up to ConnectMaxBackoff. AutoMigrate applies the
+// pending migrations once connected.
 type DatabaseConfiguration struct {
-	DatabaseName string
-	User         string
-	Password     string
-	Host         string
-	Port         string
-	MaxOpenConns int
-	MaxIdleConns int
+	DatabaseName      string
+	User              string
+	Password          Secret
+	Host              string
+	Port              string
+	MaxOpenConns      int
+	MaxIdleConns      int
+	ConnectAttempts   int
+	ConnectMinBackoff time.Duration
+	ConnectMaxBackoff time.Duration
+	AutoMigrate       bool
 }
 
+// StorageConfiguration selects where users, groups and messages are kept:
+// "postgres", the database configured under Database, or "memory", which keeps
+// nothing across restarts.
+type StorageConfiguration struct {
+	Backend string
+}
+
+// AttachmentsConfiguration selects where message attachments are stored and
+// limits what may be uploaded. MaxSize is in bytes and applies to each file.
+// AllowedTypes holds MIME types, such as "image/png" or "image/*".
+type AttachmentsConfiguration struct {
+	Store        string
+	Dir          string
+	MaxSize      int64
+	MaxCount     int
+	AllowedTypes []string
+}
+
+// WebhooksConfiguration tunes webhook delivery. A failed delivery is retried
+// after MinBackoff, doubling up to MaxBackoff, until MaxAttempts is reached.
+// Webhooks may only reach loopback, link-local and private addresses when
+// AllowPrivateAddresses is set.
+type WebhooksConfiguration struct {
+	AllowPrivateAddresses bool
+	PollInterval          time.Duration
+	Timeout               time.Duration
+	BatchSize             int
+	MaxAttempts           int
+	MinBackoff            time.Duration
+	MaxBackoff            time.Duration
+}
+
+// TracingConfiguration selects where OpenTelemetry spans are exported:
+// "otlp", sent over HTTP to Endpoint, such as "localhost:4318"; "stdout",
+// written to standard output; or "none". SampleRatio is the fraction of traces
+// started by the API that are recorded; traces continued from a traceparent
+// header keep the decision of the caller.
+type TracingConfiguration struct {
+	Exporter    string
+	Endpoint    string
+	Insecure    bool
+	ServiceName string
+	SampleRatio float64
+}
+
+// RateLimitConfiguration sets token bucket limits on clients: PerIP on every
+// API request from a client IP, PerSender on the messages and replies each
+// user sends, and PerGroup on the messages sent to each group. Store keeps the
+// buckets in "memory", for a single replica, or in "postgres", shared by every
+// replica.
+type RateLimitConfiguration struct {
+	Store     string
+	PerIP     LimitConfiguration
+	PerSender LimitConfiguration
+	PerGroup  LimitConfiguration
+}
+
+// LimitConfiguration allows Requests every Per on average, and up to Burst at
+// once, which defaults to Requests. A limit without Requests is off.
+type LimitConfiguration struct {
+	Requests int
+	Per      time.Duration
+	Burst    int
+}
+
+// New loads the configuration from the YAML file at configPath, overridden by
+// environment variables such as DATABASE_HOST, and checks that it is valid.
+// Each setting may also be read from a file named by a variable with a _FILE
+// suffix, such as DATABASE_PASSWORD_FILE, to keep secrets out of the
+// environment.
 func New(configPath string) (*Configuration, error) {
 	if configPath == "" {
 		configPath = defaultConfigPath
@@ -53,13 +173,22 @@ func New(configPath string) (*Configuration, error) {
 func setup(configPath string) (*Configuration, error) {
 	var cfg *Configuration
 
-	viper.AutomaticEnv()
-	viper.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+	v := viper.New()
+	v.AutomaticEnv()
+	v.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
 
-	viper.SetConfigFile(configPath)
-	viper.SetConfigType("yaml")
+	v.SetConfigFile(configPath)
+	v.SetConfigType("yaml")
+
+	if err := v.ReadInConfig(); err != nil {
+		setupErr := ConfigError{
+			ConfigPath: configPath,
+			Err:        err,
+		}
+		return nil, setupErr
+	}
 
-	if err := viper.ReadInConfig(); err != nil {
+	if err := readFiles(v); err != nil {
 		setupErr := ConfigError{
 			ConfigPath: configPath,
 			Err:        err,
@@ -67,7 +196,7 @@ func setup(configPath string) (*Configuration, error) {
 		return nil, setupErr
 	}
 
-	err := viper.Unmarshal(&cfg)
+	err := v.Unmarshal(&cfg)
 	if err != nil {
 		setupErr := ConfigError{
 			ConfigPath: configPath,
@@ -76,5 +205,36 @@ func setup(configPath string) (*Configuration, error) {
 		return nil, setupErr
 	}
 
+	if err := cfg.Validate(); err != nil {
+		setupErr := ConfigError{
+			ConfigPath: configPath,
+			Err:        err,
+		}
+		return nil, setupErr
+	}
+
 	return cfg, nil
 }
+
+// readFiles sets each key whose environment variable has a _FILE variant to
+// the contents of the file it names, without a trailing newline. Setting both
+// variables is an error, as it is unclear which should win.
+func readFiles(v *viper.Viper) error {
+	for _, key := range v.AllKeys() {
+		env := strings.ToUpper(strings.ReplaceAll(key, ".", "_"))
+		path, ok := os.LookupEnv(env + fileSuffix)
+		if !ok {
+			continue
+		}
+		if _, ok := os.LookupEnv(env); ok {
+			return errors.New("both " + env + " and " + env + fileSuffix + " are set")
+		}
+
+		contents, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		v.Set(key, strings.TrimRight(string(contents), "\r\n"))
+	}
+	return nil
+}
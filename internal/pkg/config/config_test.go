@@ -1,11 +1,24 @@
 package config
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
 
+// TestMain runs the tests from the root of the repository, where the API is
+// run from, so that they load the same config/default.yaml.
+func TestMain(m *testing.M) {
+	if err := os.Chdir("../../.."); err != nil {
+		panic(err)
+	}
+	os.Exit(m.Run())
+}
+
 func TestNew(t *testing.T) {
 	cases := []struct {
 		name      string
@@ -37,18 +50,64 @@ func TestNew(t *testing.T) {
 					Preset: "development",
 				},
 				Server: ServerConfiguration{
-					Host: "0.0.0.0",
-					Port: "8080",
-					Mode: "debug",
+					Host:         "0.0.0.0",
+					Port:         "8080",
+					Mode:         "debug",
+					ValidateSpec: true,
+					AccessLogSampling: map[string]float64{
+						"/healthz": 0.01,
+						"/metrics": 0.01,
+						"/readyz":  0.01,
+					},
+					TrustedProxies: []string{},
+					TLS: TLSConfiguration{
+						ClientAuth:     "none",
+						ReloadInterval: time.Minute,
+					},
 				},
 				Database: DatabaseConfiguration{
-					DatabaseName: "messagebox",
-					User:         "messagebox_user",
-					Password:     "insecure",
-					Host:         "0.0.0.0",
-					Port:         "5432",
-					MaxOpenConns: 50,
-					MaxIdleConns: 2,
+					DatabaseName:      "messagebox",
+					User:              "messagebox_user",
+					Password:          "insecure",
+					Host:              "0.0.0.0",
+					Port:              "5432",
+					MaxOpenConns:      50,
+					MaxIdleConns:      2,
+					ConnectAttempts:   10,
+					ConnectMinBackoff: time.Second,
+					ConnectMaxBackoff: 30 * time.Second,
+					AutoMigrate:       false,
+				},
+				Storage: StorageConfiguration{
+					Backend: "postgres",
+				},
+				Attachments: AttachmentsConfiguration{
+					Store:        "local",
+					Dir:          "data/attachments",
+					MaxSize:      10485760,
+					MaxCount:     10,
+					AllowedTypes: []string{"application/pdf", "image/*", "text/plain"},
+				},
+				Webhooks: WebhooksConfiguration{
+					PollInterval: 5 * time.Second,
+					Timeout:      10 * time.Second,
+					BatchSize:    20,
+					MaxAttempts:  8,
+					MinBackoff:   30 * time.Second,
+					MaxBackoff:   time.Hour,
+				},
+				Tracing: TracingConfiguration{
+					Exporter:    "none",
+					Endpoint:    "localhost:4318",
+					Insecure:    true,
+					ServiceName: "messagebox",
+					SampleRatio: 1,
+				},
+				RateLimit: RateLimitConfiguration{
+					Store:     "memory",
+					PerIP:     LimitConfiguration{Requests: 600, Per: time.Minute, Burst: 100},
+					PerSender: LimitConfiguration{Requests: 30, Per: time.Minute, Burst: 10},
+					PerGroup:  LimitConfiguration{Requests: 20, Per: time.Minute, Burst: 20},
 				},
 			},
 		},
@@ -61,18 +120,64 @@ func TestNew(t *testing.T) {
 					Preset: "development",
 				},
 				Server: ServerConfiguration{
-					Host: "0.0.0.0",
-					Port: "8080",
-					Mode: "debug",
+					Host:         "0.0.0.0",
+					Port:         "8080",
+					Mode:         "debug",
+					ValidateSpec: true,
+					AccessLogSampling: map[string]float64{
+						"/healthz": 0.01,
+						"/metrics": 0.01,
+						"/readyz":  0.01,
+					},
+					TrustedProxies: []string{},
+					TLS: TLSConfiguration{
+						ClientAuth:     "none",
+						ReloadInterval: time.Minute,
+					},
 				},
 				Database: DatabaseConfiguration{
-					DatabaseName: "messagebox",
-					User:         "messagebox_user",
-					Password:     "insecure",
-					Host:         "0.0.0.0",
-					Port:         "5432",
-					MaxOpenConns: 50,
-					MaxIdleConns: 2,
+					DatabaseName:      "messagebox",
+					User:              "messagebox_user",
+					Password:          "insecure",
+					Host:              "0.0.0.0",
+					Port:              "5432",
+					MaxOpenConns:      50,
+					MaxIdleConns:      2,
+					ConnectAttempts:   10,
+					ConnectMinBackoff: time.Second,
+					ConnectMaxBackoff: 30 * time.Second,
+					AutoMigrate:       false,
+				},
+				Storage: StorageConfiguration{
+					Backend: "postgres",
+				},
+				Attachments: AttachmentsConfiguration{
+					Store:        "local",
+					Dir:          "data/attachments",
+					MaxSize:      10485760,
+					MaxCount:     10,
+					AllowedTypes: []string{"application/pdf", "image/*", "text/plain"},
+				},
+				Webhooks: WebhooksConfiguration{
+					PollInterval: 5 * time.Second,
+					Timeout:      10 * time.Second,
+					BatchSize:    20,
+					MaxAttempts:  8,
+					MinBackoff:   30 * time.Second,
+					MaxBackoff:   time.Hour,
+				},
+				Tracing: TracingConfiguration{
+					Exporter:    "none",
+					Endpoint:    "localhost:4318",
+					Insecure:    true,
+					ServiceName: "messagebox",
+					SampleRatio: 1,
+				},
+				RateLimit: RateLimitConfiguration{
+					Store:     "memory",
+					PerIP:     LimitConfiguration{Requests: 600, Per: time.Minute, Burst: 100},
+					PerSender: LimitConfiguration{Requests: 30, Per: time.Minute, Burst: 10},
+					PerGroup:  LimitConfiguration{Requests: 20, Per: time.Minute, Burst: 20},
 				},
 			},
 		},
@@ -90,3 +195,41 @@ func TestNew(t *testing.T) {
 		})
 	}
 }
+
+func TestNewReadsFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "password")
+	assert.NoError(t, ioutil.WriteFile(path, []byte("from-file\n"), 0600))
+
+	assert.NoError(t, os.Setenv("DATABASE_PASSWORD_FILE", path))
+	defer os.Unsetenv("DATABASE_PASSWORD_FILE")
+
+	cfg, err := New("")
+	assert.NoError(t, err)
+	assert.Equal(t, Secret("from-file"), cfg.Database.Password)
+
+	assert.NoError(t, os.Setenv("DATABASE_PASSWORD", "from-env"))
+	defer os.Unsetenv("DATABASE_PASSWORD")
+
+	_, err = New("")
+	assert.ErrorAs(t, err, &ConfigError{})
+	assert.Contains(t, err.Error(), "both DATABASE_PASSWORD and DATABASE_PASSWORD_FILE are set")
+
+	assert.NoError(t, os.Unsetenv("DATABASE_PASSWORD"))
+	assert.NoError(t, os.Setenv("DATABASE_PASSWORD_FILE", filepath.Join(dir, "missing")))
+
+	_, err = New("")
+	assert.ErrorAs(t, err, &ConfigError{})
+}
+
+func TestNewValidates(t *testing.T) {
+	assert.NoError(t, os.Setenv("SERVER_PORT", "http"))
+	defer os.Unsetenv("SERVER_PORT")
+
+	_, err := New("")
+	assert.ErrorAs(t, err, &InvalidError{})
+	assert.Contains(t, err.Error(), `server.port must be a port number, got "http"`)
+}
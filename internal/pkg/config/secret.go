@@ -0,0 +1,88 @@
+package config
+
+import (
+	"reflect"
+	"time"
+	"unicode"
+)
+
+// Redacted stands in for the value of a secret wherever it is shown.
+const Redacted = "[REDACTED]"
+
+// Secret is a setting, such as a password, that must not be logged. It prints
+// and marshals as Redacted, so that logging a configuration holding it is
+// safe; convert it to a string to use its value.
+type Secret string
+
+func (s Secret) String() string {
+	if s == "" {
+		return ""
+	}
+	return Redacted
+}
+
+func (s Secret) MarshalJSON() ([]byte, error) {
+	return []byte(`"` + s.String() + `"`), nil
+}
+
+var (
+	secretType   = reflect.TypeOf(Secret(""))
+	durationType = reflect.TypeOf(time.Duration(0))
+)
+
+// Settings returns cfg as nested maps keyed as in the configuration file, such
+// as "database" then "connectMaxBackoff", with durations written as in the
+// file. When redacted, secrets are replaced by Redacted.
+func (cfg Configuration) Settings(redacted bool) map[string]interface{} {
+	return settings(reflect.ValueOf(cfg), redacted).(map[string]interface{})
+}
+
+func settings(v reflect.Value, redacted bool) interface{} {
+	switch {
+	case v.Type() == secretType:
+		if redacted {
+			return v.Interface().(Secret).String()
+		}
+		return v.String()
+	case v.Type() == durationType:
+		return v.Interface().(time.Duration).String()
+	}
+
+	switch v.Kind() {
+	case reflect.Struct:
+		out := map[string]interface{}{}
+		for i := 0; i < v.NumField(); i++ {
+			out[settingKey(v.Type().Field(i).Name)] = settings(v.Field(i), redacted)
+		}
+		return out
+	case reflect.Map:
+		out := map[string]interface{}{}
+		iter := v.MapRange()
+		for iter.Next() {
+			out[iter.Key().String()] = settings(iter.Value(), redacted)
+		}
+		return out
+	case reflect.Slice:
+		out := make([]interface{}, v.Len())
+		for i := range out {
+			out[i] = settings(v.Index(i), redacted)
+		}
+		return out
+	default:
+		return v.Interface()
+	}
+}
+
+// settingKey returns the key of a field in the configuration file, which is
+// its name starting in lower case, such as "maxIdleConns", including a leading
+// initialism, such as "tls".
+func settingKey(field string) string {
+	runes := []rune(field)
+	for i, r := range runes {
+		if !unicode.IsUpper(r) || (i > 0 && i+1 < len(runes) && unicode.IsLower(runes[i+1])) {
+			break
+		}
+		runes[i] = unicode.ToLower(r)
+	}
+	return string(runes)
+}
@@ -0,0 +1,46 @@
+package config
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+func TestSecret(t *testing.T) {
+	assert.Equal(t, Redacted, Secret("hunter2").String())
+	assert.Equal(t, "", Secret("").String())
+
+	// logging a configuration must not leak its secrets
+	var buf bytes.Buffer
+	log := zap.New(zapcore.NewCore(zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig()), zapcore.AddSync(&buf), zap.DebugLevel))
+	log.Sugar().Debugw("db.Setup", "config", DatabaseConfiguration{User: "yoshi", Password: "hunter2"})
+
+	assert.Contains(t, buf.String(), `"Password":"[REDACTED]"`)
+	assert.NotContains(t, buf.String(), "hunter2")
+}
+
+func TestSettings(t *testing.T) {
+	cfg, err := New("")
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	settings := cfg.Settings(true)
+	database := settings["database"].(map[string]interface{})
+	assert.Equal(t, Redacted, database["password"])
+	assert.Equal(t, "30s", database["connectMaxBackoff"])
+	assert.Equal(t, "messagebox_user", database["user"])
+
+	tls := settings["server"].(map[string]interface{})["tls"].(map[string]interface{})
+	assert.Equal(t, "1m0s", tls["reloadInterval"])
+	assert.Equal(t, "none", tls["clientAuth"])
+
+	sampling := settings["server"].(map[string]interface{})["accessLogSampling"]
+	assert.Equal(t, map[string]interface{}{"/healthz": 0.01, "/metrics": 0.01, "/readyz": 0.01}, sampling)
+
+	database = cfg.Settings(false)["database"].(map[string]interface{})
+	assert.Equal(t, "insecure", database["password"])
+}
@@ -0,0 +1,211 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The values accepted by the settings that select between implementations,
+// the first being the one that is used when the setting is blank. They are
+// kept here rather than taken from the packages that implement them, as those
+// packages depend on this one.
+var (
+	loggerPresets    = []string{"development", "production"}
+	serverModes      = []string{"debug", "release", "test"}
+	storageBackends  = []string{"postgres", "memory"}
+	attachmentStores = []string{"local"}
+	tracingExporters = []string{"none", "otlp", "stdout"}
+	rateLimitStores  = []string{"memory", "postgres"}
+	clientAuthModes  = []string{"none", "optional", "require"}
+)
+
+// InvalidError lists every setting that is not valid, each by its key in the
+// configuration file.
+type InvalidError struct {
+	Problems []string
+}
+
+func (e InvalidError) Error() string {
+	return "invalid configuration: " + strings.Join(e.Problems, "; ")
+}
+
+// problems collects what is wrong with a configuration.
+type problems []string
+
+func (p *problems) add(key, format string, args ...interface{}) {
+	*p = append(*p, key+" "+fmt.Sprintf(format, args...))
+}
+
+func (p *problems) oneOf(key, value string, allowed []string) {
+	for _, a := range allowed {
+		if value == a {
+			return
+		}
+	}
+	p.add(key, "must be one of %q, got %q", allowed, value)
+}
+
+// withDefault returns value, or the first of allowed when value is blank.
+func withDefault(value string, allowed []string) string {
+	if value == "" {
+		return allowed[0]
+	}
+	return value
+}
+
+func (p *problems) required(key, value string) {
+	if value == "" {
+		p.add(key, "is required")
+	}
+}
+
+func (p *problems) port(key, value string) {
+	if n, err := strconv.Atoi(value); err != nil || n < 1 || n > 65535 {
+		p.add(key, "must be a port number, got %q", value)
+	}
+}
+
+func (p *problems) positive(key string, value int64) {
+	if value <= 0 {
+		p.add(key, "must be positive, got %d", value)
+	}
+}
+
+func (p *problems) notNegative(key string, value int64) {
+	if value < 0 {
+		p.add(key, "must not be negative, got %d", value)
+	}
+}
+
+func (p *problems) notNegativeDuration(key string, value time.Duration) {
+	if value < 0 {
+		p.add(key, "must not be a negative duration, got %q", value.String())
+	}
+}
+
+func (p *problems) positiveDuration(key string, value time.Duration) {
+	if value <= 0 {
+		p.add(key, "must be a positive duration, got %q", value.String())
+	}
+}
+
+func (p *problems) ipOrCIDR(key, value string) {
+	if net.ParseIP(value) != nil {
+		return
+	}
+	if _, _, err := net.ParseCIDR(value); err != nil {
+		p.add(key, "must be an IP or CIDR, got %q", value)
+	}
+}
+
+func (p *problems) fraction(key string, value float64) {
+	if value < 0 || value > 1 {
+		p.add(key, "must be between 0 and 1, got %v", value)
+	}
+}
+
+// Validate checks every setting, returning an InvalidError that lists each
+// one that is not valid.
+func (cfg Configuration) Validate() error {
+	var p problems
+
+	p.oneOf("logger.preset", cfg.Logger.Preset, loggerPresets)
+
+	p.port("server.port", cfg.Server.Port)
+	p.oneOf("server.mode", withDefault(cfg.Server.Mode, serverModes), serverModes)
+	for route, rate := range cfg.Server.AccessLogSampling {
+		p.fraction("server.accessLogSampling."+route, rate)
+	}
+	for i, proxy := range cfg.Server.TrustedProxies {
+		p.ipOrCIDR(fmt.Sprintf("server.trustedProxies[%d]", i), proxy)
+	}
+
+	tls := cfg.Server.TLS
+	if (tls.CertFile == "") != (tls.KeyFile == "") {
+		p.add("server.tls", "needs both certFile and keyFile, or neither")
+	}
+	clientAuth := withDefault(tls.ClientAuth, clientAuthModes)
+	p.oneOf("server.tls.clientAuth", clientAuth, clientAuthModes)
+	if clientAuth != "none" {
+		p.required("server.tls.certFile", tls.CertFile)
+		p.required("server.tls.clientCAFile", tls.ClientCAFile)
+	}
+	p.notNegativeDuration("server.tls.reloadInterval", tls.ReloadInterval)
+
+	backend := withDefault(cfg.Storage.Backend, storageBackends)
+	p.oneOf("storage.backend", backend, storageBackends)
+
+	if backend == "postgres" {
+		db := cfg.Database
+		p.required("database.databaseName", db.DatabaseName)
+		p.required("database.user", db.User)
+		p.required("database.host", db.Host)
+		p.port("database.port", db.Port)
+		p.notNegative("database.maxOpenConns", int64(db.MaxOpenConns))
+		p.notNegative("database.maxIdleConns", int64(db.MaxIdleConns))
+		p.positive("database.connectAttempts", int64(db.ConnectAttempts))
+		p.positiveDuration("database.connectMinBackoff", db.ConnectMinBackoff)
+		p.notNegativeDuration("database.connectMaxBackoff", db.ConnectMaxBackoff)
+	}
+
+	a := cfg.Attachments
+	p.oneOf("attachments.store", withDefault(a.Store, attachmentStores), attachmentStores)
+	if withDefault(a.Store, attachmentStores) == "local" {
+		p.required("attachments.dir", a.Dir)
+	}
+	p.positive("attachments.maxSize", a.MaxSize)
+	p.positive("attachments.maxCount", int64(a.MaxCount))
+	for i, mediaType := range a.AllowedTypes {
+		if parts := strings.Split(mediaType, "/"); len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			p.add(fmt.Sprintf("attachments.allowedTypes[%d]", i), "must be a MIME type such as \"image/png\" or \"image/*\", got %q", mediaType)
+		}
+	}
+
+	w := cfg.Webhooks
+	p.positiveDuration("webhooks.pollInterval", w.PollInterval)
+	p.positiveDuration("webhooks.timeout", w.Timeout)
+	p.positive("webhooks.batchSize", int64(w.BatchSize))
+	p.positive("webhooks.maxAttempts", int64(w.MaxAttempts))
+	p.notNegativeDuration("webhooks.minBackoff", w.MinBackoff)
+	if w.MaxBackoff < w.MinBackoff {
+		p.add("webhooks.maxBackoff", "must not be less than webhooks.minBackoff")
+	}
+
+	t := cfg.Tracing
+	exporter := withDefault(t.Exporter, tracingExporters)
+	p.oneOf("tracing.exporter", exporter, tracingExporters)
+	p.fraction("tracing.sampleRatio", t.SampleRatio)
+	if exporter != "none" {
+		p.required("tracing.serviceName", t.ServiceName)
+	}
+
+	r := cfg.RateLimit
+	store := withDefault(r.Store, rateLimitStores)
+	p.oneOf("rateLimit.store", store, rateLimitStores)
+	if store == "postgres" && backend != "postgres" {
+		p.add("rateLimit.store", "can only be %q when storage.backend is too", store)
+	}
+	limits := []struct {
+		key   string
+		limit LimitConfiguration
+	}{
+		{"rateLimit.perIP", r.PerIP},
+		{"rateLimit.perSender", r.PerSender},
+		{"rateLimit.perGroup", r.PerGroup},
+	}
+	for _, l := range limits {
+		p.notNegative(l.key+".requests", int64(l.limit.Requests))
+		p.notNegative(l.key+".burst", int64(l.limit.Burst))
+		if l.limit.Requests > 0 {
+			p.positiveDuration(l.key+".per", l.limit.Per)
+		}
+	}
+
+	if len(p) > 0 {
+		return InvalidError{Problems: p}
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+package config
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidate(t *testing.T) {
+	valid, err := New("")
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	cases := []struct {
+		name   string
+		modify func(cfg *Configuration)
+		want   []string
+	}{
+		{
+			name:   "Success with the default configuration",
+			modify: func(cfg *Configuration) {},
+		},
+		{
+			name: "Success with blank settings that have defaults",
+			modify: func(cfg *Configuration) {
+				cfg.Server.Mode = ""
+				cfg.Tracing.Exporter = ""
+				cfg.RateLimit.Store = ""
+			},
+		},
+		{
+			name: "Success without database settings when storing in memory",
+			modify: func(cfg *Configuration) {
+				cfg.Storage.Backend = "memory"
+				cfg.Database = DatabaseConfiguration{}
+			},
+		},
+		{
+			name: "Fail on unknown choices",
+			modify: func(cfg *Configuration) {
+				cfg.Logger.Preset = "verbose"
+				cfg.Storage.Backend = "mysql"
+			},
+			want: []string{
+				`logger.preset must be one of ["development" "production"], got "verbose"`,
+				`storage.backend must be one of ["postgres" "memory"], got "mysql"`,
+			},
+		},
+		{
+			name: "Fail on missing database settings",
+			modify: func(cfg *Configuration) {
+				cfg.Database.Host = ""
+				cfg.Database.Port = "0"
+				cfg.Database.ConnectMinBackoff = -time.Second
+			},
+			want: []string{
+				`database.host is required`,
+				`database.port must be a port number, got "0"`,
+				`database.connectMinBackoff must be a positive duration, got "-1s"`,
+			},
+		},
+		{
+			name: "Fail on a connect backoff that would not wait",
+			modify: func(cfg *Configuration) {
+				cfg.Database.ConnectMinBackoff = 0
+			},
+			want: []string{
+				`database.connectMinBackoff must be a positive duration, got "0s"`,
+			},
+		},
+		{
+			name: "Fail on out of range numbers",
+			modify: func(cfg *Configuration) {
+				cfg.Attachments.MaxCount = 0
+				cfg.Attachments.AllowedTypes = []string{"image"}
+				cfg.Webhooks.MaxBackoff = 0
+				cfg.Tracing.SampleRatio = 2
+				cfg.RateLimit.PerIP.Per = 0
+			},
+			want: []string{
+				`attachments.maxCount must be positive, got 0`,
+				`attachments.allowedTypes[0] must be a MIME type such as "image/png" or "image/*", got "image"`,
+				`webhooks.maxBackoff must not be less than webhooks.minBackoff`,
+				`tracing.sampleRatio must be between 0 and 1, got 2`,
+				`rateLimit.perIP.per must be a positive duration, got "0s"`,
+			},
+		},
+		{
+			name: "Fail on incomplete TLS settings",
+			modify: func(cfg *Configuration) {
+				cfg.Server.TLS = TLSConfiguration{KeyFile: "server.key", ClientAuth: "require"}
+			},
+			want: []string{
+				`server.tls needs both certFile and keyFile, or neither`,
+				`server.tls.certFile is required`,
+				`server.tls.clientCAFile is required`,
+			},
+		},
+		{
+			name: "Fail on trusted proxies that are not IPs or CIDRs",
+			modify: func(cfg *Configuration) {
+				cfg.Server.TrustedProxies = []string{"10.0.0.1", "10.0.0.0/8", "proxy.local"}
+			},
+			want: []string{
+				`server.trustedProxies[2] must be an IP or CIDR, got "proxy.local"`,
+			},
+		},
+		{
+			name: "Fail on a postgres rate limit store without postgres storage",
+			modify: func(cfg *Configuration) {
+				cfg.Storage.Backend = "memory"
+				cfg.RateLimit.Store = "postgres"
+			},
+			want: []string{
+				`rateLimit.store can only be "postgres" when storage.backend is too`,
+			},
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := *valid
+			tt.modify(&cfg)
+
+			err := cfg.Validate()
+			if tt.want == nil {
+				assert.NoError(t, err)
+			} else {
+				assert.Equal(t, InvalidError{Problems: tt.want}, err)
+			}
+		})
+	}
+}
@@ -1,30 +1,51 @@
 package db
 
 import (
+	"context"
+	"errors"
+	"time"
+
 	"go.uber.org/zap"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
+	gormlogger "gorm.io/gorm/logger"
 
 	"github.com/benshields/messagebox/internal/pkg/config"
+	"github.com/benshields/messagebox/internal/pkg/tracing"
 )
 
 const driver = "postgres"
 
+// fallbackConnectBackoff is the first wait between connection attempts when
+// cfg.ConnectMinBackoff is not positive, which would retry without waiting.
+const fallbackConnectBackoff = time.Second
+
 var globalDB *gorm.DB // FIXME use DI instead of global
 
+// ErrNotSetup is returned by Ping before Setup has connected.
+var ErrNotSetup = errors.New("database is not set up")
+
+// Setup connects to the database, making up to cfg.ConnectAttempts attempts
+// so that the API can start before the database does. The wait between
+// attempts starts at cfg.ConnectMinBackoff and doubles up to
+// cfg.ConnectMaxBackoff.
 func Setup(cfg config.DatabaseConfiguration, log *zap.Logger) (*gorm.DB, error) {
-	if log != nil {
-		sugar := log.Sugar()
-		defer sugar.Sync()
-		sugar.Debugw("db.Setup", "config", cfg) // TODO this logs the password which is a vulnerability
+	if log == nil {
+		log = zap.NewNop()
 	}
+	sugar := log.Sugar()
+	defer sugar.Sync()
+	sugar.Debugw("db.Setup", "config", cfg)
 
-	dsn := "host=" + cfg.Host + " port=" + cfg.Port + " user=" + cfg.User + " dbname=" + cfg.DatabaseName + "  sslmode=disable password=" + cfg.Password
-	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{})
+	db, err := connect(cfg, newQueryLogger(log), sugar)
 	if err != nil {
 		return nil, err
 	}
 
+	if err := db.Use(tracing.Plugin{}); err != nil {
+		return nil, err
+	}
+
 	gdb, err := db.DB()
 	if err != nil {
 		return nil, err
@@ -38,6 +59,49 @@ func Setup(cfg config.DatabaseConfiguration, log *zap.Logger) (*gorm.DB, error)
 	return db, nil
 }
 
+func connect(cfg config.DatabaseConfiguration, queries gormlogger.Interface, log *zap.SugaredLogger) (*gorm.DB, error) {
+	delay := cfg.ConnectMinBackoff
+	if delay <= 0 {
+		delay = fallbackConnectBackoff
+	}
+	for attempt := 1; ; attempt++ {
+		// opening pings the database, so this fails while it is unreachable
+		db, err := gorm.Open(postgres.Open(DSN(cfg)), &gorm.Config{Logger: queries})
+		if err == nil {
+			return db, nil
+		}
+		if attempt >= cfg.ConnectAttempts {
+			return nil, err
+		}
+
+		log.Warnw("db.Setup failed to connect, retrying", "attempt", attempt, "delay", delay, "error", err)
+		time.Sleep(delay)
+		delay *= 2
+		if cfg.ConnectMaxBackoff > 0 && delay > cfg.ConnectMaxBackoff {
+			delay = cfg.ConnectMaxBackoff
+		}
+	}
+}
+
+// Ping checks that the database can be reached. The pool reconnects by
+// itself, so Ping succeeds again once the database is back.
+func Ping(ctx context.Context) error {
+	if globalDB == nil {
+		return ErrNotSetup
+	}
+	sqlDB, err := globalDB.DB()
+	if err != nil {
+		return err
+	}
+	return sqlDB.PingContext(ctx)
+}
+
+// DSN returns the connection string for cfg, for clients that need their own
+// connection rather than one from the pool.
+func DSN(cfg config.DatabaseConfiguration) string {
+	return "host=" + cfg.Host + " port=" + cfg.Port + " user=" + cfg.User + " dbname=" + cfg.DatabaseName + "  sslmode=disable password=" + string(cfg.Password)
+}
+
 func Get() *gorm.DB {
 	return globalDB
 }
@@ -0,0 +1,42 @@
+package db
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+
+	"github.com/benshields/messagebox/internal/pkg/config"
+)
+
+func TestSetupRetries(t *testing.T) {
+	core, logs := observer.New(zapcore.WarnLevel)
+	cfg := config.DatabaseConfiguration{
+		DatabaseName:      "messagebox",
+		User:              "messagebox_user",
+		Password:          "insecure",
+		Host:              "127.0.0.1",
+		Port:              "1", // nothing listens here
+		ConnectAttempts:   3,
+		ConnectMinBackoff: time.Millisecond,
+		ConnectMaxBackoff: 2 * time.Millisecond,
+	}
+
+	_, err := Setup(cfg, zap.New(core))
+
+	assert.Error(t, err)
+	retries := logs.FilterMessage("db.Setup failed to connect, retrying").All()
+	if assert.Len(t, retries, 2) {
+		assert.Equal(t, time.Millisecond, retries[0].ContextMap()["delay"])
+		assert.Equal(t, 2*time.Millisecond, retries[1].ContextMap()["delay"])
+	}
+}
+
+func TestPingBeforeSetup(t *testing.T) {
+	globalDB = nil
+	assert.Equal(t, ErrNotSetup, Ping(context.Background()))
+}
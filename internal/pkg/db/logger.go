@@ -0,0 +1,71 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+	gormlogger "gorm.io/gorm/logger"
+
+	"github.com/benshields/messagebox/internal/pkg/logger"
+	"github.com/benshields/messagebox/internal/pkg/tracing"
+)
+
+// slowQuery is how long a query may take before it is logged as slow.
+const slowQuery = 200 * time.Millisecond
+
+// queryLogger writes what GORM logs to the logger of the request that ran the
+// query, so that its lines carry the request ID, or to log outside requests.
+// Queries are only logged when they fail or are slow, with their literals
+// redacted, as the values bound to them are user data.
+type queryLogger struct {
+	log   *zap.Logger
+	level gormlogger.LogLevel
+}
+
+func newQueryLogger(log *zap.Logger) gormlogger.Interface {
+	return &queryLogger{log: log, level: gormlogger.Warn}
+}
+
+func (l *queryLogger) LogMode(level gormlogger.LogLevel) gormlogger.Interface {
+	copied := *l
+	copied.level = level
+	return &copied
+}
+
+func (l *queryLogger) Info(ctx context.Context, msg string, data ...interface{}) {
+	if l.level >= gormlogger.Info {
+		logger.FromContext(ctx, l.log).Sugar().Infof(msg, data...)
+	}
+}
+
+func (l *queryLogger) Warn(ctx context.Context, msg string, data ...interface{}) {
+	if l.level >= gormlogger.Warn {
+		logger.FromContext(ctx, l.log).Sugar().Warnf(msg, data...)
+	}
+}
+
+func (l *queryLogger) Error(ctx context.Context, msg string, data ...interface{}) {
+	if l.level >= gormlogger.Error {
+		logger.FromContext(ctx, l.log).Sugar().Errorf(msg, data...)
+	}
+}
+
+func (l *queryLogger) Trace(ctx context.Context, begin time.Time, fc func() (string, int64), err error) {
+	elapsed := time.Since(begin)
+	failed := err != nil && !errors.Is(err, gorm.ErrRecordNotFound) && l.level >= gormlogger.Error
+	slow := elapsed > slowQuery && l.level >= gormlogger.Warn
+	if !failed && !slow {
+		return
+	}
+
+	sql, rows := fc()
+	sugar := logger.FromContext(ctx, l.log).Sugar()
+	if failed {
+		sugar.Warnw("db query failed", "sql", tracing.Redact(sql), "rows", rows, "elapsed", elapsed, "error", err)
+		return
+	}
+	sugar.Warnw("db query is slow", "sql", tracing.Redact(sql), "rows", rows, "elapsed", elapsed)
+}
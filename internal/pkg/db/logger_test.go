@@ -0,0 +1,54 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+	"gorm.io/gorm"
+	gormlogger "gorm.io/gorm/logger"
+
+	"github.com/benshields/messagebox/internal/pkg/logger"
+)
+
+func TestQueryLogger(t *testing.T) {
+	core, logs := observer.New(zapcore.DebugLevel)
+	base := zap.New(core)
+	ctx := logger.NewContext(context.Background(), base.With(zap.String("request_id", "req-1")))
+	l := newQueryLogger(base)
+
+	query := func() (string, int64) {
+		return `SELECT * FROM "users" WHERE name = 'super.mario' LIMIT 1`, 0
+	}
+
+	// quick queries that succeed or find nothing are not logged
+	l.Trace(ctx, time.Now(), query, nil)
+	l.Trace(ctx, time.Now(), query, gorm.ErrRecordNotFound)
+	assert.Equal(t, 0, logs.Len())
+
+	l.Trace(ctx, time.Now(), query, errors.New("connection reset"))
+	l.Trace(context.Background(), time.Now().Add(-time.Second), query, nil)
+
+	entries := logs.All()
+	if !assert.Len(t, entries, 2) {
+		return
+	}
+
+	failed := entries[0].ContextMap()
+	assert.Equal(t, "db query failed", entries[0].Message)
+	assert.Equal(t, "req-1", failed["request_id"])
+	assert.Equal(t, `SELECT * FROM "users" WHERE name = ? LIMIT ?`, failed["sql"])
+	assert.Equal(t, "connection reset", failed["error"])
+
+	assert.Equal(t, "db query is slow", entries[1].Message)
+	assert.NotContains(t, entries[1].ContextMap(), "request_id")
+
+	// nothing is logged once silenced
+	l.LogMode(gormlogger.Silent).Trace(ctx, time.Now(), query, errors.New("connection reset"))
+	assert.Equal(t, 2, logs.Len())
+}
@@ -0,0 +1,166 @@
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+
+	"github.com/benshields/messagebox/internal/pkg/config"
+	"github.com/benshields/messagebox/internal/pkg/db"
+)
+
+// Channel is the Postgres notification channel that new messages are
+// announced on.
+const Channel = "messagebox_messages"
+
+const (
+	// subscriberBuffer is how many events a subscriber may fall behind by
+	// before it is dropped.
+	subscriberBuffer = 64
+
+	minReconnectDelay = time.Second
+	maxReconnectDelay = 30 * time.Second
+)
+
+// MessageEvent announces a newly committed message. Recipients holds the IDs
+// of the users and groups it was addressed to.
+type MessageEvent struct {
+	MessageID  int32   `json:"id"`
+	Re         int32   `json:"re,omitempty"`
+	SenderID   int32   `json:"sender"`
+	Recipients []int32 `json:"recipients"`
+}
+
+// Publish queues ev on tx. Postgres only delivers it to listeners if, and
+// when, tx commits.
+func Publish(tx *gorm.DB, ev MessageEvent) error {
+	payload, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	return tx.Exec("SELECT pg_notify(?, ?)", Channel, string(payload)).Error
+}
+
+// Hub listens on Channel with a connection of its own and fans each event out
+// to every subscriber in this process.
+type Hub struct {
+	dsn    string
+	log    *zap.SugaredLogger
+	cancel context.CancelFunc
+
+	mu   sync.Mutex
+	subs map[chan MessageEvent]struct{}
+}
+
+func Setup(cfg config.DatabaseConfiguration, log *zap.Logger) (*Hub, error) {
+	if log == nil {
+		log = zap.NewNop()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	hub := &Hub{
+		dsn:    db.DSN(cfg),
+		log:    log.Sugar(),
+		cancel: cancel,
+		subs:   make(map[chan MessageEvent]struct{}),
+	}
+	go hub.run(ctx)
+
+	return hub, nil
+}
+
+// Subscribe returns a channel of every event from now on, and a func to stop
+// receiving them. The channel is closed if the subscriber falls too far
+// behind, and it should then resume from the last event it handled.
+func (h *Hub) Subscribe() (<-chan MessageEvent, func()) {
+	ch := make(chan MessageEvent, subscriberBuffer)
+
+	h.mu.Lock()
+	h.subs[ch] = struct{}{}
+	h.mu.Unlock()
+
+	return ch, func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		if _, ok := h.subs[ch]; ok {
+			delete(h.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// Close stops listening and ends every subscription.
+func (h *Hub) Close() {
+	h.cancel()
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subs {
+		delete(h.subs, ch)
+		close(ch)
+	}
+}
+
+func (h *Hub) run(ctx context.Context) {
+	delay := minReconnectDelay
+	for {
+		err := h.listen(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		h.log.Warnw("events.Hub listen failed, reconnecting", "error", err, "delay", delay)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		if delay *= 2; delay > maxReconnectDelay {
+			delay = maxReconnectDelay
+		}
+	}
+}
+
+func (h *Hub) listen(ctx context.Context) error {
+	conn, err := pgx.Connect(ctx, h.dsn)
+	if err != nil {
+		return err
+	}
+	defer conn.Close(context.Background())
+
+	if _, err := conn.Exec(ctx, "LISTEN "+Channel); err != nil {
+		return err
+	}
+
+	for {
+		n, err := conn.WaitForNotification(ctx)
+		if err != nil {
+			return err
+		}
+
+		var ev MessageEvent
+		if err := json.Unmarshal([]byte(n.Payload), &ev); err != nil {
+			h.log.Warnw("events.Hub dropped malformed event", "payload", n.Payload, "error", err)
+			continue
+		}
+		h.broadcast(ev)
+	}
+}
+
+func (h *Hub) broadcast(ev MessageEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subs {
+		select {
+		case ch <- ev:
+		default:
+			delete(h.subs, ch)
+			close(ch)
+		}
+	}
+}
@@ -1,16 +1,91 @@
 package httperr
 
-import "github.com/gin-gonic/gin"
+import (
+	"errors"
+	"net/http"
+	"strings"
 
+	"github.com/gin-gonic/gin"
+)
+
+// ContentType is the media type of every error response, from RFC 7807.
+const ContentType = "application/problem+json"
+
+// TypePrefix starts the type URI of every problem; the code completes it.
+const TypePrefix = "urn:messagebox:problem:"
+
+// coder is implemented by errors that carry a stable code of their own, such
+// as those of the persistence package.
+type coder interface {
+	Code() string
+}
+
+// statusCodes are the codes of errors that carry none of their own.
+var statusCodes = map[int]string{
+	http.StatusBadRequest:            "invalid_request",
+	http.StatusUnauthorized:          "unauthorized",
+	http.StatusForbidden:             "forbidden",
+	http.StatusNotFound:              "not_found",
+	http.StatusMethodNotAllowed:      "method_not_allowed",
+	http.StatusConflict:              "conflict",
+	http.StatusRequestEntityTooLarge: "payload_too_large",
+	http.StatusUnsupportedMediaType:  "unsupported_media_type",
+	http.StatusInternalServerError:   "internal_error",
+	http.StatusServiceUnavailable:    "unavailable",
+}
+
+// NewError writes err as a problem with the given status. Its code is the
+// one err carries, if any, and otherwise the one of status.
 func NewError(c *gin.Context, status int, err error) {
-	er := HTTPError{
-		Code:    status,
-		Message: err.Error(),
+	code := CodeOf(status, err)
+	pr := Problem{
+		Type:   TypePrefix + code,
+		Title:  http.StatusText(status),
+		Status: status,
+		Detail: err.Error(),
+		Code:   code,
+	}
+	var fields ValidationErrors
+	if errors.As(err, &fields) {
+		pr.Errors = fields
+	}
+	c.Header("Content-Type", ContentType)
+	c.JSON(status, pr)
+}
+
+// CodeOf returns the code of err as written with status.
+func CodeOf(status int, err error) string {
+	var ce coder
+	if errors.As(err, &ce) {
+		return ce.Code()
+	}
+	if code, ok := statusCodes[status]; ok {
+		return code
+	}
+	return strings.Map(codeRune, strings.ToLower(http.StatusText(status)))
+}
+
+// codeRune keeps the letters and digits of a status text, joining its words
+// with underscores.
+func codeRune(r rune) rune {
+	switch {
+	case r >= 'a' && r <= 'z', r >= '0' && r <= '9':
+		return r
+	case r == ' ', r == '-':
+		return '_'
+	default:
+		return -1
 	}
-	c.JSON(status, er)
 }
 
-type HTTPError struct {
-	Code    int    `json:"code" example:"400"`
-	Message string `json:"message" example:"status bad request"`
+// Problem is an RFC 7807 problem details object. Clients switch on Code, or
+// equally on Type, both of which never change for a given kind of problem.
+// Errors lists the invalid fields of a rejected request, if it had any.
+type Problem struct {
+	Type   string       `json:"type" example:"urn:messagebox:problem:user_not_found"`
+	Title  string       `json:"title" example:"Not Found"`
+	Status int          `json:"status" example:"404"`
+	Detail string       `json:"detail" example:"user with given username does not exist"`
+	Code   string       `json:"code" example:"user_not_found"`
+	Errors []FieldError `json:"errors,omitempty"`
 }
@@ -0,0 +1,59 @@
+package httperr
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+type codedError struct{}
+
+func (codedError) Error() string { return "user with given username does not exist" }
+func (codedError) Code() string  { return "user_not_found" }
+
+func TestNewError(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	tests := []struct {
+		name         string
+		status       int
+		err          error
+		expectedBody string
+	}{
+		{
+			name:         "Code from error",
+			status:       http.StatusNotFound,
+			err:          codedError{},
+			expectedBody: `{"type":"urn:messagebox:problem:user_not_found","title":"Not Found","status":404,"detail":"user with given username does not exist","code":"user_not_found"}`,
+		},
+		{
+			name:         "Code from status",
+			status:       http.StatusBadRequest,
+			err:          errors.New("invalid request"),
+			expectedBody: `{"type":"urn:messagebox:problem:invalid_request","title":"Bad Request","status":400,"detail":"invalid request","code":"invalid_request"}`,
+		},
+		{
+			name:         "Code from status text",
+			status:       http.StatusTeapot,
+			err:          errors.New("short and stout"),
+			expectedBody: `{"type":"urn:messagebox:problem:im_a_teapot","title":"I'm a teapot","status":418,"detail":"short and stout","code":"im_a_teapot"}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(rec)
+
+			NewError(c, tt.status, tt.err)
+
+			assert.Equal(t, tt.status, rec.Code)
+			assert.Equal(t, ContentType, rec.Header().Get("Content-Type"))
+			assert.Equal(t, tt.expectedBody, rec.Body.String())
+		})
+	}
+}
@@ -0,0 +1,146 @@
+package httperr
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/go-playground/validator/v10"
+)
+
+// arrayIndex matches the array indexes in the field paths of encoding/json.
+var arrayIndex = regexp.MustCompile(`\.(\d+)`)
+
+// FieldError is one invalid field of a request. Field is its path in the
+// JSON body, such as "to[1].username", and Rule is the rule it broke.
+type FieldError struct {
+	Field   string `json:"field" example:"subject"`
+	Rule    string `json:"rule" example:"required"`
+	Message string `json:"message" example:"subject is required"`
+}
+
+// ValidationErrors is a request rejected for its invalid fields. Written by
+// NewError, they are listed in the errors member of the problem.
+type ValidationErrors []FieldError
+
+func (v ValidationErrors) Error() string {
+	return "invalid request"
+}
+
+// RegisterFieldNames makes the validator of gin name fields by their JSON
+// names, which are the names clients know them by.
+func RegisterFieldNames() {
+	v, ok := binding.Validator.Engine().(*validator.Validate)
+	if !ok {
+		return
+	}
+	v.RegisterTagNameFunc(func(field reflect.StructField) string {
+		name := strings.SplitN(field.Tag.Get("json"), ",", 2)[0]
+		switch name {
+		case "-":
+			return ""
+		case "":
+			return field.Name
+		}
+		return name
+	})
+}
+
+// NewBindError writes the error of binding a request body as a bad request,
+// listing every invalid field when err says which they are.
+func NewBindError(c *gin.Context, err error) {
+	fields := FieldErrors(err)
+	if len(fields) == 0 {
+		NewError(c, http.StatusBadRequest, errors.New("invalid request"))
+		return
+	}
+	NewError(c, http.StatusBadRequest, fields)
+}
+
+// FieldErrors returns the invalid fields that err, as returned by binding,
+// reports, or nil if it reports none.
+func FieldErrors(err error) ValidationErrors {
+	var invalid validator.ValidationErrors
+	if errors.As(err, &invalid) {
+		out := make(ValidationErrors, len(invalid))
+		for i, fe := range invalid {
+			out[i] = fieldError(fe)
+		}
+		return out
+	}
+
+	var mistyped *json.UnmarshalTypeError
+	if errors.As(err, &mistyped) && mistyped.Field != "" {
+		field := arrayIndex.ReplaceAllString(mistyped.Field, "[$1]")
+		return ValidationErrors{{
+			Field:   field,
+			Rule:    "type",
+			Message: fmt.Sprintf("%s must be %s", field, jsonType(mistyped.Type)),
+		}}
+	}
+
+	return nil
+}
+
+func fieldError(fe validator.FieldError) FieldError {
+	// drop the name of the request struct itself
+	field := fe.Namespace()
+	if i := strings.Index(field, "."); i >= 0 {
+		field = field[i+1:]
+	}
+
+	return FieldError{
+		Field:   field,
+		Rule:    fe.Tag(),
+		Message: ruleMessage(field, fe),
+	}
+}
+
+func ruleMessage(field string, fe validator.FieldError) string {
+	var limit string
+	switch fe.Kind() {
+	case reflect.String:
+		limit = "%s must be %s %s characters long"
+	case reflect.Slice, reflect.Array, reflect.Map:
+		limit = "%s must have %s %s items"
+	default:
+		limit = "%s must be %s %s"
+	}
+
+	switch fe.Tag() {
+	case "required":
+		return field + " is required"
+	case "min":
+		return fmt.Sprintf(limit, field, "at least", fe.Param())
+	case "max":
+		return fmt.Sprintf(limit, field, "at most", fe.Param())
+	}
+	if fe.Param() != "" {
+		return fmt.Sprintf("%s must satisfy %s=%s", field, fe.Tag(), fe.Param())
+	}
+	return fmt.Sprintf("%s must satisfy %s", field, fe.Tag())
+}
+
+// jsonType names the JSON type that decodes into t.
+func jsonType(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.String:
+		return "a string"
+	case reflect.Bool:
+		return "a boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return "a number"
+	case reflect.Slice, reflect.Array:
+		return "an array"
+	default:
+		return "an object"
+	}
+}
@@ -0,0 +1,45 @@
+package httperr
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/gin-gonic/gin/binding"
+	"github.com/stretchr/testify/assert"
+)
+
+type validated struct {
+	Name  string   `json:"name" binding:"required,max=4"`
+	Tags  []string `json:"tags" binding:"min=1"`
+	Inner struct {
+		Count int `json:"count" binding:"max=3"`
+	} `json:"inner"`
+}
+
+func TestFieldErrors(t *testing.T) {
+	RegisterFieldNames()
+
+	var v validated
+	v.Inner.Count = 4
+	err := binding.Validator.ValidateStruct(&v)
+
+	assert.Equal(t, ValidationErrors{
+		{Field: "name", Rule: "required", Message: "name is required"},
+		{Field: "tags", Rule: "min", Message: "tags must have at least 1 items"},
+		{Field: "inner.count", Rule: "max", Message: "inner.count must be at most 3"},
+	}, FieldErrors(err))
+
+	v = validated{Name: "toolong", Tags: []string{"a"}}
+	err = binding.Validator.ValidateStruct(&v)
+	assert.Equal(t, ValidationErrors{
+		{Field: "name", Rule: "max", Message: "name must be at most 4 characters long"},
+	}, FieldErrors(err))
+
+	err = json.Unmarshal([]byte(`{"name":5}`), &v)
+	assert.Equal(t, ValidationErrors{
+		{Field: "name", Rule: "type", Message: "name must be a string"},
+	}, FieldErrors(err))
+
+	assert.Nil(t, FieldErrors(errors.New("unexpected EOF")))
+}
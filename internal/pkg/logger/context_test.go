@@ -0,0 +1,18 @@
+package logger
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestFromContext(t *testing.T) {
+	fallback := zap.NewExample()
+	scoped := fallback.With(zap.String("request_id", "abc"))
+
+	assert.Same(t, scoped, FromContext(NewContext(context.Background(), scoped), fallback))
+	assert.Same(t, fallback, FromContext(context.Background(), fallback))
+	assert.NotNil(t, FromContext(context.Background(), nil))
+}
@@ -0,0 +1,129 @@
+// Package metrics records what the API does, for Prometheus to scrape.
+package metrics
+
+import (
+	"database/sql"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "messagebox"
+
+// unmatchedRoute labels requests that no route matched, so that scanners
+// probing random paths cannot create a series per path.
+const unmatchedRoute = "unmatched"
+
+// Metrics holds the collectors of the API, in a registry of its own.
+type Metrics struct {
+	registry        *prometheus.Registry
+	requests        *prometheus.CounterVec
+	requestDuration *prometheus.HistogramVec
+
+	// UsersRegistered counts the users that registered.
+	UsersRegistered prometheus.Counter
+	// MessagesSent counts the new messages sent, not counting replies.
+	MessagesSent prometheus.Counter
+	// RepliesCreated counts the replies sent.
+	RepliesCreated prometheus.Counter
+	// GroupsCreated counts the groups created.
+	GroupsCreated prometheus.Counter
+}
+
+// New returns the metrics of the API, registered along with those of the Go
+// runtime and the process.
+func New() *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "http",
+			Name:      "requests_total",
+			Help:      "Requests handled, by method, route template and status code.",
+		}, []string{"method", "route", "status"}),
+
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: "http",
+			Name:      "request_duration_seconds",
+			Help:      "Time taken to handle requests, by method, route template and status code.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"method", "route", "status"}),
+
+		UsersRegistered: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "users_registered_total",
+			Help:      "Users registered.",
+		}),
+
+		MessagesSent: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "messages_sent_total",
+			Help:      "Messages sent, not counting replies.",
+		}),
+
+		RepliesCreated: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "replies_created_total",
+			Help:      "Replies sent.",
+		}),
+
+		GroupsCreated: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "groups_created_total",
+			Help:      "Groups created.",
+		}),
+	}
+
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.requests,
+		m.requestDuration,
+		m.UsersRegistered,
+		m.MessagesSent,
+		m.RepliesCreated,
+		m.GroupsCreated,
+	)
+
+	return m
+}
+
+// RegisterDB adds the connection pool statistics of db, as given by
+// sql.DB.Stats, labelled with the name of the database.
+func (m *Metrics) RegisterDB(db *sql.DB, name string) error {
+	err := m.registry.Register(collectors.NewDBStatsCollector(db, name))
+	var already prometheus.AlreadyRegisteredError
+	if errors.As(err, &already) {
+		return nil
+	}
+	return err
+}
+
+// Handler serves every metric in the Prometheus text format.
+func (m *Metrics) Handler() gin.HandlerFunc {
+	return gin.WrapH(promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{}))
+}
+
+// Middleware counts and times every request, labelled by the template of the
+// route that handled it, such as "/users/:username", rather than by its path.
+func (m *Metrics) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		route := c.FullPath()
+		if route == "" {
+			route = unmatchedRoute
+		}
+		status := strconv.Itoa(c.Writer.Status())
+		m.requests.WithLabelValues(c.Request.Method, route, status).Inc()
+		m.requestDuration.WithLabelValues(c.Request.Method, route, status).Observe(time.Since(start).Seconds())
+	}
+}
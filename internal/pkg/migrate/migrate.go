@@ -0,0 +1,338 @@
+// Package migrate applies the SQL migrations of the database schema. It keeps
+// the schema version in the schema_migrations table the way migrate/migrate
+// does, so that databases migrated by either can be migrated by the other.
+package migrate
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/fs"
+	"regexp"
+	"sort"
+	"strconv"
+
+	"go.uber.org/zap"
+)
+
+// lockID is the key of the Postgres advisory lock held while migrating, so
+// that replicas starting together migrate one after the other.
+const lockID = 7214391550873129522
+
+// fileName matches the names of migration files, such as
+// "000001_create_initial_tables.up.sql".
+var fileName = regexp.MustCompile(`^(\d+)_(.+)\.(up|down)\.sql$`)
+
+// ErrNoMigrations is returned for a source without any migration in it.
+var ErrNoMigrations = errors.New("no migrations found")
+
+type DirtyError struct {
+	Version uint
+}
+
+func (e DirtyError) Error() string {
+	return fmt.Sprintf("database is dirty at version %d: a migration failed part way; repair the schema by hand, then set schema_migrations.dirty to false", e.Version)
+}
+
+type UnknownVersionError struct {
+	Version uint
+}
+
+func (e UnknownVersionError) Error() string {
+	return fmt.Sprintf("no migration has version %d", e.Version)
+}
+
+// Migration is one change to the schema, with the SQL that makes it and the
+// SQL that reverts it.
+type Migration struct {
+	Version uint
+	Name    string
+	Up      string
+	Down    string
+}
+
+// Status is the version of a database, along with every known migration.
+type Status struct {
+	Version    uint
+	Dirty      bool
+	Migrations []MigrationStatus
+}
+
+type MigrationStatus struct {
+	Version uint
+	Name    string
+	Applied bool
+}
+
+// Migrator migrates one database with the migrations it was created with.
+// Version 0 is the database without any migration applied.
+type Migrator struct {
+	db         *sql.DB
+	migrations []Migration
+	log        *zap.SugaredLogger
+}
+
+// New returns a Migrator for the migrations in fsys.
+func New(db *sql.DB, fsys fs.FS, log *zap.Logger) (*Migrator, error) {
+	if log == nil {
+		log = zap.NewNop()
+	}
+
+	migrations, err := Load(fsys)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Migrator{
+		db:         db,
+		migrations: migrations,
+		log:        log.Sugar(),
+	}, nil
+}
+
+// Load reads the migrations in the top directory of fsys, in version order.
+func Load(fsys fs.FS) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[uint]*Migration)
+	for _, entry := range entries {
+		match := fileName.FindStringSubmatch(entry.Name())
+		if entry.IsDir() || match == nil {
+			continue
+		}
+		version, err := strconv.ParseUint(match[1], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("migration %s: %w", entry.Name(), err)
+		}
+		if version == 0 {
+			return nil, fmt.Errorf("migration %s: versions start at 1", entry.Name())
+		}
+		content, err := fs.ReadFile(fsys, entry.Name())
+		if err != nil {
+			return nil, err
+		}
+
+		m, ok := byVersion[uint(version)]
+		if !ok {
+			m = &Migration{Version: uint(version), Name: match[2]}
+			byVersion[uint(version)] = m
+		}
+		if m.Name != match[2] {
+			return nil, fmt.Errorf("migration %d is named both %s and %s", version, m.Name, match[2])
+		}
+		if match[3] == "up" {
+			m.Up = string(content)
+		} else {
+			m.Down = string(content)
+		}
+	}
+
+	if len(byVersion) == 0 {
+		return nil, ErrNoMigrations
+	}
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" {
+			return nil, fmt.Errorf("migration %d_%s has no up migration", m.Version, m.Name)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	return migrations, nil
+}
+
+// Up applies every pending migration.
+func (m *Migrator) Up(ctx context.Context) error {
+	return m.Goto(ctx, m.migrations[len(m.migrations)-1].Version)
+}
+
+// Down reverts the latest applied migration.
+func (m *Migrator) Down(ctx context.Context) error {
+	return m.locked(ctx, func(conn *sql.Conn) error {
+		current, dirty, err := currentVersion(ctx, conn)
+		if err != nil {
+			return err
+		}
+		if dirty {
+			return DirtyError{Version: current}
+		}
+		if current == 0 {
+			return nil
+		}
+		return m.migrate(ctx, conn, current, m.previous(current))
+	})
+}
+
+// Goto applies or reverts migrations until the database is at version.
+func (m *Migrator) Goto(ctx context.Context, version uint) error {
+	return m.locked(ctx, func(conn *sql.Conn) error {
+		current, dirty, err := currentVersion(ctx, conn)
+		if err != nil {
+			return err
+		}
+		if dirty {
+			return DirtyError{Version: current}
+		}
+		return m.migrate(ctx, conn, current, version)
+	})
+}
+
+// Status returns the version of the database and which migrations it has.
+func (m *Migrator) Status(ctx context.Context) (*Status, error) {
+	var status *Status
+	err := m.locked(ctx, func(conn *sql.Conn) error {
+		current, dirty, err := currentVersion(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		status = &Status{Version: current, Dirty: dirty}
+		for _, mig := range m.migrations {
+			status.Migrations = append(status.Migrations, MigrationStatus{
+				Version: mig.Version,
+				Name:    mig.Name,
+				Applied: mig.Version <= current,
+			})
+		}
+		return nil
+	})
+	return status, err
+}
+
+// migrate applies the steps from current to target one at a time. As with
+// migrate/migrate, each step first records its resulting version as dirty,
+// and only marks it clean once its SQL has run.
+func (m *Migrator) migrate(ctx context.Context, conn *sql.Conn, current, target uint) error {
+	steps, err := m.plan(current, target)
+	if err != nil {
+		return err
+	}
+
+	for _, s := range steps {
+		if err := setVersion(ctx, conn, s.to, true); err != nil {
+			return err
+		}
+		if _, err := conn.ExecContext(ctx, s.sql); err != nil {
+			return fmt.Errorf("migration %d_%s %s failed: %w", s.migration.Version, s.migration.Name, s.direction, err)
+		}
+		if err := setVersion(ctx, conn, s.to, false); err != nil {
+			return err
+		}
+		m.log.Infow("migrate applied migration", "version", s.migration.Version, "name", s.migration.Name, "direction", s.direction)
+	}
+	return nil
+}
+
+// step is one migration applied or reverted, leaving the database at to.
+type step struct {
+	migration Migration
+	direction string
+	sql       string
+	to        uint
+}
+
+// plan returns the steps that take the database from current to target.
+func (m *Migrator) plan(current, target uint) ([]step, error) {
+	if target != 0 && m.index(target) < 0 {
+		return nil, UnknownVersionError{Version: target}
+	}
+	if current != 0 && m.index(current) < 0 {
+		return nil, UnknownVersionError{Version: current}
+	}
+
+	var steps []step
+	for _, mig := range m.migrations {
+		if mig.Version > current && mig.Version <= target {
+			steps = append(steps, step{migration: mig, direction: "up", sql: mig.Up, to: mig.Version})
+		}
+	}
+	for i := len(m.migrations) - 1; i >= 0; i-- {
+		mig := m.migrations[i]
+		if mig.Version <= current && mig.Version > target {
+			if mig.Down == "" {
+				return nil, fmt.Errorf("migration %d_%s has no down migration", mig.Version, mig.Name)
+			}
+			steps = append(steps, step{migration: mig, direction: "down", sql: mig.Down, to: m.previous(mig.Version)})
+		}
+	}
+	return steps, nil
+}
+
+// index returns the position of the migration with version, or -1.
+func (m *Migrator) index(version uint) int {
+	for i, mig := range m.migrations {
+		if mig.Version == version {
+			return i
+		}
+	}
+	return -1
+}
+
+// previous returns the version before version, or 0 for the first.
+func (m *Migrator) previous(version uint) uint {
+	if i := m.index(version); i > 0 {
+		return m.migrations[i-1].Version
+	}
+	return 0
+}
+
+// locked runs fn on a connection of its own holding the advisory lock. The
+// lock is tied to the connection, so it is released even if the process dies.
+func (m *Migrator) locked(ctx context.Context, fn func(conn *sql.Conn) error) error {
+	conn, err := m.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", int64(lockID)); err != nil {
+		return err
+	}
+	defer conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1)", int64(lockID))
+
+	if _, err := conn.ExecContext(ctx, "CREATE TABLE IF NOT EXISTS schema_migrations (version bigint NOT NULL PRIMARY KEY, dirty boolean NOT NULL)"); err != nil {
+		return err
+	}
+	return fn(conn)
+}
+
+func currentVersion(ctx context.Context, conn *sql.Conn) (uint, bool, error) {
+	var (
+		v     int64
+		dirty bool
+	)
+	err := conn.QueryRowContext(ctx, "SELECT version, dirty FROM schema_migrations LIMIT 1").Scan(&v, &dirty)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	return uint(v), dirty, nil
+}
+
+// setVersion records version as the only row of schema_migrations, or no row
+// for version 0, as migrate/migrate does.
+func setVersion(ctx context.Context, conn *sql.Conn, version uint, dirty bool) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM schema_migrations"); err != nil {
+		return err
+	}
+	if version != 0 || dirty {
+		if _, err := tx.ExecContext(ctx, "INSERT INTO schema_migrations (version, dirty) VALUES ($1, $2)", int64(version), dirty); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
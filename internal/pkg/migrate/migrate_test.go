@@ -0,0 +1,115 @@
+package migrate
+
+import (
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/benshields/messagebox/db/migrations"
+)
+
+func TestLoad(t *testing.T) {
+	fsys := fstest.MapFS{
+		"000002_add_b.up.sql":   {Data: []byte("CREATE TABLE b ();")},
+		"000002_add_b.down.sql": {Data: []byte("DROP TABLE b;")},
+		"000001_add_a.up.sql":   {Data: []byte("CREATE TABLE a ();")},
+		"000001_add_a.down.sql": {Data: []byte("DROP TABLE a;")},
+		"migrations.go":         {Data: []byte("package migrations")},
+	}
+
+	got, err := Load(fsys)
+
+	assert.NoError(t, err)
+	assert.Equal(t, []Migration{
+		{Version: 1, Name: "add_a", Up: "CREATE TABLE a ();", Down: "DROP TABLE a;"},
+		{Version: 2, Name: "add_b", Up: "CREATE TABLE b ();", Down: "DROP TABLE b;"},
+	}, got)
+}
+
+func TestLoadErrors(t *testing.T) {
+	cases := []struct {
+		name string
+		fsys fstest.MapFS
+	}{
+		{
+			name: "No migrations",
+			fsys: fstest.MapFS{"README.md": {}},
+		},
+		{
+			name: "No up migration",
+			fsys: fstest.MapFS{"000001_add_a.down.sql": {Data: []byte("DROP TABLE a;")}},
+		},
+		{
+			name: "Two names for a version",
+			fsys: fstest.MapFS{
+				"000001_add_a.up.sql":   {Data: []byte("CREATE TABLE a ();")},
+				"000001_add_b.down.sql": {Data: []byte("DROP TABLE b;")},
+			},
+		},
+		{
+			name: "Version 0",
+			fsys: fstest.MapFS{"000000_add_a.up.sql": {Data: []byte("CREATE TABLE a ();")}},
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Load(tt.fsys)
+			assert.Error(t, err)
+		})
+	}
+}
+
+// TestEmbedded checks the migrations built into the binary, each of which
+// must be revertible.
+func TestEmbedded(t *testing.T) {
+	got, err := Load(migrations.FS)
+
+	assert.NoError(t, err)
+	for i, m := range got {
+		assert.Equal(t, uint(i+1), m.Version, "versions must have no gaps")
+		assert.NotEmpty(t, m.Down, "migration %d_%s has no down migration", m.Version, m.Name)
+	}
+}
+
+func TestPlan(t *testing.T) {
+	m := &Migrator{migrations: []Migration{
+		{Version: 1, Name: "add_a", Up: "up 1", Down: "down 1"},
+		{Version: 2, Name: "add_b", Up: "up 2", Down: "down 2"},
+		{Version: 5, Name: "add_c", Up: "up 5", Down: "down 5"},
+	}}
+
+	type planned struct {
+		SQL string
+		To  uint
+	}
+	cases := []struct {
+		name    string
+		current uint
+		target  uint
+		want    []planned
+		wantErr error
+	}{
+		{name: "Up from empty", current: 0, target: 5, want: []planned{{"up 1", 1}, {"up 2", 2}, {"up 5", 5}}},
+		{name: "Up part way", current: 1, target: 2, want: []planned{{"up 2", 2}}},
+		{name: "Down to empty", current: 5, target: 0, want: []planned{{"down 5", 2}, {"down 2", 1}, {"down 1", 0}}},
+		{name: "Down part way", current: 5, target: 2, want: []planned{{"down 5", 2}}},
+		{name: "Already there", current: 2, target: 2, want: nil},
+		{name: "Unknown target", current: 2, target: 3, wantErr: UnknownVersionError{Version: 3}},
+		{name: "Unknown current", current: 4, target: 5, wantErr: UnknownVersionError{Version: 4}},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			steps, err := m.plan(tt.current, tt.target)
+			assert.Equal(t, tt.wantErr, err)
+
+			var got []planned
+			for _, s := range steps {
+				got = append(got, planned{SQL: s.sql, To: s.to})
+			}
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
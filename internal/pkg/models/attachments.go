@@ -0,0 +1,15 @@
+package models
+
+import "time"
+
+// Attachment describes a file sent with a message. Its contents are kept in
+// the blob store under StorageKey.
+type Attachment struct {
+	Model
+	MessageID   int32     `gorm:"column:message_id" json:"-"`
+	Filename    string    `json:"filename"`
+	ContentType string    `json:"contentType"`
+	Size        int64     `json:"size"`
+	StorageKey  string    `json:"-"`
+	CreatedAt   time.Time `gorm:"<-:false" json:"createdAt"`
+}
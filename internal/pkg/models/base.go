@@ -8,6 +8,30 @@ type UriId struct {
 	ID int32 `uri:"id" binding:"required,numeric"`
 }
 
+type UriAttachment struct {
+	ID           int32 `uri:"id" binding:"required,numeric"`
+	AttachmentID int32 `uri:"aid" binding:"required,numeric"`
+}
+
 type UriUsername struct {
 	Username string `uri:"username" binding:"required"`
 }
+
+type UriGroupname struct {
+	Groupname string `uri:"groupname" binding:"required"`
+}
+
+type UriGroupMember struct {
+	Groupname string `uri:"groupname" binding:"required"`
+	Username  string `uri:"username" binding:"required"`
+}
+
+type UriMailboxMessage struct {
+	Username string `uri:"username" binding:"required"`
+	ID       int32  `uri:"id" binding:"required,numeric"`
+}
+
+type UriUserToken struct {
+	Username string `uri:"username" binding:"required"`
+	ID       int32  `uri:"id" binding:"required,numeric"`
+}
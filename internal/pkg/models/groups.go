@@ -1,9 +1,12 @@
 package models
 
+import "time"
+
 type Group struct {
 	Model
-	Name  string `gorm:"not null" json:"groupname"`
-	Users []User `gorm:"-"`
+	Name      string    `gorm:"not null" json:"groupname"`
+	CreatedAt time.Time `gorm:"<-:false" json:"createdAt"`
+	Users     []User    `gorm:"-" json:"-"`
 }
 
 type UserGroup struct {
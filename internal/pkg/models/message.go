@@ -2,11 +2,25 @@ package models
 
 import "time"
 
+const (
+	RecipientTo  = "to"
+	RecipientCc  = "cc"
+	RecipientBcc = "bcc"
+)
+
+// ComposedMessage is a new message as submitted by its sender. Recipient is
+// the original single-recipient form and is treated as the first "to"
+// recipient when given.
 type ComposedMessage struct {
-	Sender    string `json:"sender" binding:"required"`
-	Recipient `json:"recipient" binding:"required"`
-	Subject   string `json:"subject" binding:"required,min=1,max=255"`
-	Body      string `json:"body" binding:"max=2000"`
+	Sender    string `json:"sender"`
+	Recipient `json:"recipient"`
+	To        []Recipient `json:"to"`
+	Cc        []Recipient `json:"cc"`
+	Bcc       []Recipient `json:"bcc"`
+	Subject   string      `json:"subject" binding:"required,min=1,max=255"`
+	Body      string      `json:"body" binding:"max=2000"`
+
+	Attachments []Attachment `json:"-"`
 }
 
 type Recipient struct {
@@ -14,21 +28,67 @@ type Recipient struct {
 	Groupname string `json:"groupname,omitempty"`
 }
 
+// Message is a stored message. Recipient is its primary recipient, the first
+// of To or Cc. Bcc is only filled in for the sender.
 type Message struct {
 	Model       `binding:"required"`
 	Re          int32  `json:"re,omitempty"`
 	Sender      string `gorm:"-" json:"sender" binding:"required"`
 	SenderID    int32  `gorm:"column:sender" json:"-"`
 	Recipient   `gorm:"-" json:"recipient" binding:"required"`
-	RecipientID int32     `gorm:"column:recipient" json:"-"`
-	Subject     string    `json:"subject" binding:"required"`
-	Body        string    `json:"body,omitempty"`
-	SentAt      time.Time `gorm:"<-:create" json:"sentAt" binding:"required"`
+	RecipientID int32        `gorm:"column:recipient" json:"-"`
+	To          []Recipient  `gorm:"-" json:"to,omitempty"`
+	Cc          []Recipient  `gorm:"-" json:"cc,omitempty"`
+	Bcc         []Recipient  `gorm:"-" json:"bcc,omitempty"`
+	Subject     string       `json:"subject" binding:"required"`
+	Body        string       `json:"body,omitempty"`
+	SentAt      time.Time    `gorm:"<-:create" json:"sentAt" binding:"required"`
+	Unread      *bool        `gorm:"-" json:"unread,omitempty"`
+	Attachments []Attachment `gorm:"-" json:"attachments,omitempty"`
+}
+
+// MessageRecipient addresses a message to a user or, for negative IDs, to a
+// group. Kind is one of RecipientTo, RecipientCc or RecipientBcc.
+type MessageRecipient struct {
+	Model
+	MessageID   int32  `gorm:"column:message_id"`
+	RecipientID int32  `gorm:"column:recipient"`
+	Kind        string `gorm:"column:kind"`
 }
 
 type ReplyMessage struct {
 	Re      int32
-	Sender  string `json:"sender" binding:"required"`
+	Sender  string `json:"sender"`
 	Subject string `json:"subject" binding:"required,min=1,max=255"`
 	Body    string `json:"body,omitempty" binding:"max=2000"`
 }
+
+const (
+	ThreadFormatFlat = "flat"
+	ThreadFormatTree = "tree"
+)
+
+type ThreadQuery struct {
+	Format string `form:"format" binding:"omitempty,oneof=flat tree"`
+}
+
+// ThreadMessage is a message placed within its conversation. Depth counts the
+// replies between it and the root message; the parent is given by Re.
+type ThreadMessage struct {
+	Message
+	Depth   int              `gorm:"column:depth" json:"depth"`
+	Replies []*ThreadMessage `gorm:"-" json:"replies,omitempty"`
+}
+
+// Receipt records that a user has read a message. Messages without a receipt
+// for a given user are unread by that user.
+type Receipt struct {
+	MessageID int32     `gorm:"column:message_id;primary_key"`
+	UserID    int32     `gorm:"column:user_id;primary_key"`
+	ReadAt    time.Time `gorm:"<-:create"`
+}
+
+type MailboxSummary struct {
+	Total  int64 `json:"total"`
+	Unread int64 `json:"unread"`
+}
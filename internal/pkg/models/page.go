@@ -0,0 +1,22 @@
+package models
+
+const (
+	OrderAsc  = "asc"
+	OrderDesc = "desc"
+)
+
+type PageQuery struct {
+	Limit  int    `form:"limit" binding:"omitempty,min=1,max=100"`
+	Cursor string `form:"cursor"`
+	Order  string `form:"order" binding:"omitempty,oneof=asc desc"`
+}
+
+type MailboxQuery struct {
+	PageQuery
+	Unread bool `form:"unread"`
+}
+
+type MessagePage struct {
+	Messages []*Message `json:"messages"`
+	Next     string     `json:"next,omitempty"`
+}
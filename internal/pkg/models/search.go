@@ -0,0 +1,22 @@
+package models
+
+// SearchQuery is a full-text search of the messages visible to a user.
+// Results come best match first, so there is no order to choose.
+type SearchQuery struct {
+	Q      string `form:"q" binding:"required,max=255"`
+	Limit  int    `form:"limit" binding:"omitempty,min=1,max=100"`
+	Cursor string `form:"cursor"`
+}
+
+// SearchResult is a message matching a search, with its relevance and an
+// excerpt of its subject and body with the matching terms marked.
+type SearchResult struct {
+	Message
+	Rank    float32 `gorm:"column:rank" json:"rank"`
+	Snippet string  `gorm:"column:snippet" json:"snippet"`
+}
+
+type SearchPage struct {
+	Messages []*SearchResult `json:"messages"`
+	Next     string          `json:"next,omitempty"`
+}
@@ -0,0 +1,14 @@
+package models
+
+import "time"
+
+// APIToken is a bearer token that authenticates requests as its user. Only a
+// hash of the token is stored; the token itself is returned once, when it is
+// created.
+type APIToken struct {
+	Model
+	UserID    int32     `gorm:"column:user_id" json:"-"`
+	TokenHash string    `gorm:"column:token_hash" json:"-"`
+	Token     string    `gorm:"-" json:"token,omitempty"`
+	CreatedAt time.Time `gorm:"<-:false" json:"createdAt"`
+}
@@ -0,0 +1,60 @@
+package models
+
+import "time"
+
+// Webhook is a URL that is sent every message delivered to its owner, a user
+// or a group. A group webhook is only sent messages while CreatorID, the user
+// who created it, is a member of the group. Secret signs each delivery; it is
+// only returned when the webhook is created.
+type Webhook struct {
+	Model
+	OwnerID   int32     `gorm:"column:owner" json:"-"`
+	CreatorID int32     `gorm:"column:created_by" json:"-"`
+	URL       string    `gorm:"column:url" json:"url"`
+	Secret    string    `json:"secret,omitempty"`
+	CreatedAt time.Time `gorm:"<-:false" json:"createdAt"`
+}
+
+type WebhookCreation struct {
+	URL string `json:"url" binding:"required,url,max=2048"`
+}
+
+// WebhookEvent is an entry in the webhook outbox: a message waiting to be
+// delivered to a webhook.
+type WebhookEvent struct {
+	Model
+	WebhookID     int32      `gorm:"column:webhook_id"`
+	MessageID     int32      `gorm:"column:message_id"`
+	Payload       string     `gorm:"type:jsonb"`
+	Attempts      int        `gorm:"<-:update"`
+	NextAttemptAt time.Time  `gorm:"<-:update"`
+	DeliveredAt   *time.Time `gorm:"<-:update"`
+	FailedAt      *time.Time `gorm:"<-:update"`
+}
+
+// WebhookDelivery records one attempt to deliver a WebhookEvent.
+type WebhookDelivery struct {
+	Model
+	EventID     int32     `gorm:"column:event_id" json:"eventId"`
+	WebhookID   int32     `gorm:"column:webhook_id" json:"-"`
+	Attempt     int       `json:"attempt"`
+	StatusCode  *int      `json:"statusCode,omitempty"`
+	Error       string    `json:"error,omitempty"`
+	DurationMs  int64     `json:"durationMs"`
+	AttemptedAt time.Time `json:"attemptedAt"`
+}
+
+// WebhookPayload is the body of each webhook delivery.
+type WebhookPayload struct {
+	Event     string    `json:"event"`
+	Recipient Recipient `json:"recipient"`
+	Message   *Message  `json:"message"`
+}
+
+// PendingWebhookEvent is a WebhookEvent claimed for delivery, along with
+// where to deliver it and how to sign it.
+type PendingWebhookEvent struct {
+	WebhookEvent
+	URL    string `gorm:"column:url"`
+	Secret string `gorm:"column:secret"`
+}
@@ -0,0 +1,72 @@
+// Package openapi embeds the OpenAPI document of the API, serves it, and
+// checks requests and responses against it.
+package openapi
+
+import (
+	"context"
+	_ "embed"
+	"net/http"
+
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/gin-gonic/gin"
+)
+
+//go:embed openapi.yaml
+var spec []byte
+
+// swaggerUIVersion pins the Swagger UI that the docs page loads.
+const swaggerUIVersion = "4.15.5"
+
+type SpecError struct {
+	Err error
+}
+
+func (e SpecError) Error() string {
+	return "openapi.Load() failed with: " + e.Err.Error()
+}
+
+// Load parses the embedded document and checks that it is valid OpenAPI.
+func Load() (*openapi3.T, error) {
+	doc, err := openapi3.NewLoader().LoadFromData(spec)
+	if err != nil {
+		return nil, SpecError{err}
+	}
+	if err := doc.Validate(context.Background()); err != nil {
+		return nil, SpecError{err}
+	}
+	return doc, nil
+}
+
+// SpecHandler serves doc as JSON.
+func SpecHandler(doc *openapi3.T) (gin.HandlerFunc, error) {
+	body, err := doc.MarshalJSON()
+	if err != nil {
+		return nil, SpecError{err}
+	}
+	return func(c *gin.Context) {
+		c.Data(http.StatusOK, "application/json; charset=utf-8", body)
+	}, nil
+}
+
+// DocsHandler serves a Swagger UI page for the document served at specPath.
+func DocsHandler(specPath string) gin.HandlerFunc {
+	page := []byte(`<!DOCTYPE html>
+<html lang="en">
+<head>
+  <meta charset="utf-8">
+  <title>MessageBox API</title>
+  <link rel="stylesheet" href="https://unpkg.com/swagger-ui-dist@` + swaggerUIVersion + `/swagger-ui.css">
+</head>
+<body>
+  <div id="swagger-ui"></div>
+  <script src="https://unpkg.com/swagger-ui-dist@` + swaggerUIVersion + `/swagger-ui-bundle.js"></script>
+  <script>
+    window.ui = SwaggerUIBundle({url: "` + specPath + `", dom_id: "#swagger-ui"});
+  </script>
+</body>
+</html>
+`)
+	return func(c *gin.Context) {
+		c.Data(http.StatusOK, "text/html; charset=utf-8", page)
+	}
+}
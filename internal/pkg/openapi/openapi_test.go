@@ -0,0 +1,113 @@
+package openapi
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestSpecHandler(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	doc, err := Load()
+	if err != nil {
+		t.Fatal("Load() failed with:", err)
+	}
+	spec, err := SpecHandler(doc)
+	if err != nil {
+		t.Fatal("SpecHandler() failed with:", err)
+	}
+
+	r := gin.New()
+	r.GET("/openapi.json", spec)
+	r.GET("/docs", DocsHandler("/openapi.json"))
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/openapi.json", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var served struct {
+		OpenAPI string                 `json:"openapi"`
+		Paths   map[string]interface{} `json:"paths"`
+	}
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &served))
+	assert.Equal(t, "3.0.3", served.OpenAPI)
+	assert.Contains(t, served.Paths, "/users/{username}/mailbox")
+
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/docs", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), `url: "/openapi.json"`)
+}
+
+func TestValidator(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	doc, err := Load()
+	if err != nil {
+		t.Fatal("Load() failed with:", err)
+	}
+
+	cases := []struct {
+		name     string
+		req      string
+		resp     string
+		wantLogs []string
+	}{
+		{
+			name: "Matching request and response",
+			req:  `{"username":"super.mario"}`,
+			resp: `{"username":"super.mario","token":"t0k3n"}`,
+		},
+		{
+			name:     "Request does not match",
+			req:      `{"username":""}`,
+			resp:     `{"username":"","token":"t0k3n"}`,
+			wantLogs: []string{"openapi.Validator request does not match the spec"},
+		},
+		{
+			name:     "Response does not match",
+			req:      `{"username":"super.mario"}`,
+			resp:     `{"username":"super.mario"}`,
+			wantLogs: []string{"openapi.Validator response does not match the spec"},
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			core, logs := observer.New(zapcore.WarnLevel)
+			validate, err := Validator(doc, zap.New(core))
+			if err != nil {
+				t.Fatal("Validator() failed with:", err)
+			}
+
+			r := gin.New()
+			r.Use(validate)
+			r.POST("/users", func(c *gin.Context) {
+				c.Data(http.StatusCreated, "application/json; charset=utf-8", []byte(tt.resp))
+			})
+
+			req := httptest.NewRequest(http.MethodPost, "/users", strings.NewReader(tt.req))
+			req.Header.Set("Content-Type", "application/json")
+			rec := httptest.NewRecorder()
+			r.ServeHTTP(rec, req)
+
+			// the response is passed on whether or not it matches
+			assert.Equal(t, http.StatusCreated, rec.Code)
+			assert.Equal(t, tt.resp, rec.Body.String())
+
+			var got []string
+			for _, entry := range logs.All() {
+				got = append(got, entry.Message)
+			}
+			assert.Equal(t, tt.wantLogs, got)
+		})
+	}
+}
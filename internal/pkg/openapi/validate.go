@@ -0,0 +1,110 @@
+package openapi
+
+import (
+	"bytes"
+	"mime"
+	"strings"
+
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/getkin/kin-openapi/openapi3filter"
+	"github.com/getkin/kin-openapi/routers/gorillamux"
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// maxRecordedBody is the largest response body checked against the document.
+const maxRecordedBody = 1 << 20
+
+// Validator returns middleware that checks every request and response of a
+// documented route against doc, logging each mismatch as a warning. It is an
+// aid for development: requests are handled as they would be without it.
+//
+// Multipart request bodies are not checked, nor are response bodies other than
+// JSON, so that uploads, downloads and streams are not held in memory.
+func Validator(doc *openapi3.T, log *zap.Logger) (gin.HandlerFunc, error) {
+	router, err := gorillamux.NewRouter(doc)
+	if err != nil {
+		return nil, SpecError{err}
+	}
+
+	sugar := log.Sugar()
+	return func(c *gin.Context) {
+		route, params, err := router.FindRoute(c.Request)
+		if err != nil {
+			// undocumented routes are left to NoRoute and NoMethod
+			c.Next()
+			return
+		}
+
+		ctx := c.Request.Context()
+		reqInput := &openapi3filter.RequestValidationInput{
+			Request:    c.Request,
+			PathParams: params,
+			Route:      route,
+			Options: &openapi3filter.Options{
+				ExcludeRequestBody: c.ContentType() == gin.MIMEMultipartPOSTForm,
+				AuthenticationFunc: openapi3filter.NoopAuthenticationFunc,
+			},
+		}
+		if err := openapi3filter.ValidateRequest(ctx, reqInput); err != nil {
+			sugar.Warnw("openapi.Validator request does not match the spec",
+				"method", c.Request.Method, "path", c.Request.URL.Path, "error", err)
+		}
+
+		w := &recorder{ResponseWriter: c.Writer}
+		c.Writer = w
+		c.Next()
+		c.Writer = w.ResponseWriter
+
+		respInput := &openapi3filter.ResponseValidationInput{
+			RequestValidationInput: reqInput,
+			Status:                 w.Status(),
+			Header:                 w.Header(),
+			Options: &openapi3filter.Options{
+				ExcludeResponseBody: w.skipped || w.body.Len() == 0,
+			},
+		}
+		respInput.SetBodyBytes(w.body.Bytes())
+		if err := openapi3filter.ValidateResponse(ctx, respInput); err != nil {
+			sugar.Warnw("openapi.Validator response does not match the spec",
+				"method", c.Request.Method, "path", c.Request.URL.Path, "status", w.Status(), "error", err)
+		}
+	}, nil
+}
+
+// recorder keeps a copy of a JSON response body as it is written.
+type recorder struct {
+	gin.ResponseWriter
+	body    bytes.Buffer
+	skipped bool
+}
+
+func (w *recorder) Write(data []byte) (int, error) {
+	w.record(data)
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *recorder) WriteString(s string) (int, error) {
+	w.record([]byte(s))
+	return w.ResponseWriter.WriteString(s)
+}
+
+func (w *recorder) record(data []byte) {
+	if w.skipped {
+		return
+	}
+	if !isJSON(w.Header().Get("Content-Type")) || w.body.Len()+len(data) > maxRecordedBody {
+		w.skipped = true
+		w.body.Reset()
+		return
+	}
+	w.body.Write(data)
+}
+
+func isJSON(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
@@ -0,0 +1,75 @@
+package persistence
+
+import (
+	"context"
+	"gorm.io/gorm"
+
+	"github.com/benshields/messagebox/internal/pkg/db"
+	"github.com/benshields/messagebox/internal/pkg/models"
+)
+
+type AttachmentRepository struct{}
+
+var attachmentRepository *AttachmentRepository
+
+func GetAttachmentRepository() *AttachmentRepository {
+	if attachmentRepository == nil {
+		attachmentRepository = &AttachmentRepository{}
+	}
+	return attachmentRepository
+}
+
+// Read looks up an attachment by its ID and the ID of its message.
+func (r *AttachmentRepository) Read(ctx context.Context, attachment *models.Attachment) (*models.Attachment, error) {
+	result := db.Get().WithContext(ctx).Take(&attachment, "id = ? AND message_id = ?", attachment.ID, attachment.MessageID)
+	return attachment, translate(result.Error, ErrAttachmentNotFound)
+}
+
+// createAttachments stores the metadata of attachments already put in the blob
+// store as belonging to msg.
+func (r *MessageRepository) createAttachments(tx *gorm.DB, msg *models.Message) error {
+	if len(msg.Attachments) == 0 {
+		return nil
+	}
+
+	for i := range msg.Attachments {
+		msg.Attachments[i].MessageID = msg.ID
+	}
+	return tx.Create(&msg.Attachments).Error
+}
+
+// resolveDetails fills in everything about messages that is not stored in the
+// messages table itself.
+func (r *MessageRepository) resolveDetails(tx *gorm.DB, viewer *models.User, messages []*models.Message) error {
+	if err := r.resolveNames(tx, viewer, messages); err != nil {
+		return err
+	}
+	return r.resolveAttachments(tx, messages)
+}
+
+// resolveAttachments lists the attachments of messages with one query.
+func (r *MessageRepository) resolveAttachments(tx *gorm.DB, messages []*models.Message) error {
+	if len(messages) == 0 {
+		return nil
+	}
+
+	ids := make([]int32, len(messages))
+	for i, msg := range messages {
+		ids[i] = msg.ID
+	}
+
+	var attachments []models.Attachment
+	if err := tx.Order("id").Find(&attachments, "message_id IN ?", ids).Error; err != nil {
+		return err
+	}
+	byMessage := make(map[int32][]models.Attachment)
+	for _, a := range attachments {
+		byMessage[a.MessageID] = append(byMessage[a.MessageID], a)
+	}
+
+	for _, msg := range messages {
+		msg.Attachments = byMessage[msg.ID]
+	}
+
+	return nil
+}
@@ -0,0 +1,89 @@
+package persistence
+
+import (
+	"encoding/base64"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/benshields/messagebox/internal/pkg/models"
+)
+
+const DefaultPageLimit = 50
+
+// cursor marks a position in a message listing. Messages are ordered by
+// (sent_at, id) so that messages sharing a timestamp still page stably.
+type cursor struct {
+	SentAt time.Time
+	ID     int32
+}
+
+func encodeCursor(msg *models.Message) string {
+	raw := msg.SentAt.UTC().Format(time.RFC3339Nano) + "|" + strconv.FormatInt(int64(msg.ID), 10)
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func decodeCursor(s string) (cursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return cursor{}, ErrInvalidCursor
+	}
+
+	parts := strings.SplitN(string(raw), "|", 2)
+	if len(parts) != 2 {
+		return cursor{}, ErrInvalidCursor
+	}
+
+	sentAt, err := time.Parse(time.RFC3339Nano, parts[0])
+	if err != nil {
+		return cursor{}, ErrInvalidCursor
+	}
+	id, err := strconv.ParseInt(parts[1], 10, 32)
+	if err != nil {
+		return cursor{}, ErrInvalidCursor
+	}
+
+	return cursor{SentAt: sentAt, ID: int32(id)}, nil
+}
+
+// paginate applies the keyset condition, ordering and limit of page to a
+// query over the messages table. One row more than the limit is requested so
+// that pageOf can tell whether another page follows.
+func paginate(tx *gorm.DB, page models.PageQuery) (*gorm.DB, error) {
+	cmp, dir := ">", "ASC"
+	if page.Order == models.OrderDesc {
+		cmp, dir = "<", "DESC"
+	}
+
+	if page.Cursor != "" {
+		cur, err := decodeCursor(page.Cursor)
+		if err != nil {
+			return nil, err
+		}
+		tx = tx.Where("(messages.sent_at, messages.id) "+cmp+" (?, ?)", cur.SentAt, cur.ID)
+	}
+
+	return tx.Order("messages.sent_at " + dir).Order("messages.id " + dir).Limit(pageLimit(page) + 1), nil
+}
+
+// pageOf trims the extra row requested by paginate and turns it into the
+// cursor for the next page.
+func pageOf(messages []*models.Message, page models.PageQuery) *models.MessagePage {
+	out := &models.MessagePage{
+		Messages: messages,
+	}
+	if limit := pageLimit(page); len(messages) > limit {
+		out.Messages = messages[:limit]
+		out.Next = encodeCursor(out.Messages[limit-1])
+	}
+	return out
+}
+
+func pageLimit(page models.PageQuery) int {
+	if page.Limit <= 0 {
+		return DefaultPageLimit
+	}
+	return page.Limit
+}
@@ -0,0 +1,96 @@
+package persistence
+
+import (
+	"errors"
+
+	"github.com/jackc/pgconn"
+	"gorm.io/gorm"
+)
+
+// Error is a failure the repositories report to their callers. Its code never
+// changes, so that it can be passed on to clients for them to switch on.
+type Error struct {
+	code    string
+	message string
+}
+
+func (e *Error) Error() string {
+	return e.message
+}
+
+// Code returns the stable, machine-readable identifier of the error.
+func (e *Error) Code() string {
+	return e.code
+}
+
+var (
+	ErrUserNotFound       = &Error{"user_not_found", "user with given username does not exist"}
+	ErrGroupNotFound      = &Error{"group_not_found", "group with given groupname does not exist"}
+	ErrMessageNotFound    = &Error{"message_not_found", "message ID does not exist"}
+	ErrSenderNotFound     = &Error{"sender_not_found", "sender does not exist"}
+	ErrRecipientNotFound  = &Error{"recipient_not_found", "recipient does not exist"}
+	ErrTokenNotFound      = &Error{"token_not_found", "token ID does not exist"}
+	ErrAttachmentNotFound = &Error{"attachment_not_found", "attachment ID does not exist"}
+	ErrWebhookNotFound    = &Error{"webhook_not_found", "webhook ID does not exist"}
+	ErrEventNotFound      = &Error{"event_not_found", "webhook event does not exist"}
+	ErrDuplicateName      = &Error{"duplicate_name", "name is already taken"}
+	ErrAlreadyMember      = &Error{"already_member", "user is already a member of the group"}
+	ErrNotMember          = &Error{"not_member", "user is not a member of the group"}
+	ErrInvalidCursor      = &Error{"invalid_cursor", "invalid cursor"}
+	ErrInvalidValue       = &Error{"invalid_value", "value is too long or out of range"}
+)
+
+// Postgres error codes, from
+// https://www.postgresql.org/docs/current/errcodes-appendix.html
+const (
+	pgStringDataRightTruncation = "22001"
+	pgNumericValueOutOfRange    = "22003"
+	pgForeignKeyViolation       = "23503"
+	pgUniqueViolation           = "23505"
+)
+
+// constraintErrors gives the meaning of violating each constraint of the
+// schema that a request can run into.
+var constraintErrors = map[string]error{
+	"users_name_key":                     ErrDuplicateName,
+	"groups_name_key":                    ErrDuplicateName,
+	"user_groups_group_id_user_id_key":   ErrAlreadyMember,
+	"user_groups_group_id_fkey":          ErrGroupNotFound,
+	"user_groups_user_id_fkey":           ErrUserNotFound,
+	"api_tokens_user_id_fkey":            ErrUserNotFound,
+	"receipts_user_id_fkey":              ErrUserNotFound,
+	"receipts_message_id_fkey":           ErrMessageNotFound,
+	"message_recipients_message_id_fkey": ErrMessageNotFound,
+	"attachments_message_id_fkey":        ErrMessageNotFound,
+	"webhook_events_webhook_id_fkey":     ErrWebhookNotFound,
+	"webhook_events_message_id_fkey":     ErrMessageNotFound,
+	"webhook_deliveries_webhook_id_fkey": ErrWebhookNotFound,
+	"webhook_deliveries_event_id_fkey":   ErrEventNotFound,
+}
+
+// translate turns the errors of gorm and Postgres into those of this package.
+// A missing record becomes notFound. Errors it does not know are returned
+// unchanged.
+func translate(err error, notFound error) error {
+	if err == nil {
+		return nil
+	}
+
+	var pgErr *pgconn.PgError
+	switch {
+	case notFound != nil && errors.Is(err, gorm.ErrRecordNotFound):
+		return notFound
+	case errors.Is(err, gorm.ErrInvalidValue), errors.Is(err, gorm.ErrInvalidValueOfLength):
+		return ErrInvalidValue
+	case errors.As(err, &pgErr):
+		switch pgErr.Code {
+		case pgUniqueViolation, pgForeignKeyViolation:
+			if mapped, ok := constraintErrors[pgErr.ConstraintName]; ok {
+				return mapped
+			}
+		case pgStringDataRightTruncation, pgNumericValueOutOfRange:
+			return ErrInvalidValue
+		}
+	}
+	return err
+}
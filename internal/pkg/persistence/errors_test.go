@@ -0,0 +1,49 @@
+package persistence
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/jackc/pgconn"
+	"github.com/stretchr/testify/assert"
+	"gorm.io/gorm"
+)
+
+func TestTranslate(t *testing.T) {
+	other := errors.New("connection reset")
+	unknown := &pgconn.PgError{Code: pgUniqueViolation, ConstraintName: "elsewhere_key"}
+
+	tests := []struct {
+		name     string
+		err      error
+		notFound error
+		want     error
+	}{
+		{"nil", nil, ErrUserNotFound, nil},
+		{"record not found", gorm.ErrRecordNotFound, ErrUserNotFound, ErrUserNotFound},
+		{"record not found without mapping", gorm.ErrRecordNotFound, nil, gorm.ErrRecordNotFound},
+		{"duplicate username", &pgconn.PgError{Code: pgUniqueViolation, ConstraintName: "users_name_key"}, nil, ErrDuplicateName},
+		{"duplicate groupname", fmt.Errorf("create: %w", &pgconn.PgError{Code: pgUniqueViolation, ConstraintName: "groups_name_key"}), nil, ErrDuplicateName},
+		{"duplicate member", &pgconn.PgError{Code: pgUniqueViolation, ConstraintName: "user_groups_group_id_user_id_key"}, nil, ErrAlreadyMember},
+		{"missing user", &pgconn.PgError{Code: pgForeignKeyViolation, ConstraintName: "user_groups_user_id_fkey"}, nil, ErrUserNotFound},
+		{"too long", &pgconn.PgError{Code: pgStringDataRightTruncation}, nil, ErrInvalidValue},
+		{"invalid value", gorm.ErrInvalidValue, nil, ErrInvalidValue},
+		{"invalid length", gorm.ErrInvalidValueOfLength, nil, ErrInvalidValue},
+		{"unknown constraint", unknown, nil, unknown},
+		{"other", other, ErrUserNotFound, other},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, translate(tt.err, tt.notFound))
+		})
+	}
+}
+
+func TestErrorCode(t *testing.T) {
+	assert.Equal(t, "user_not_found", ErrUserNotFound.Code())
+	assert.Equal(t, "duplicate_name", ErrDuplicateName.Code())
+	assert.Equal(t, "recipient_not_found", ErrRecipientNotFound.Code())
+	assert.Equal(t, "sender_not_found", ErrSenderNotFound.Code())
+}
@@ -0,0 +1,23 @@
+package persistence
+
+import (
+	"context"
+
+	"github.com/benshields/messagebox/internal/pkg/db"
+)
+
+type HealthRepository struct{}
+
+var healthRepository *HealthRepository
+
+func GetHealthRepository() *HealthRepository {
+	if healthRepository == nil {
+		healthRepository = &HealthRepository{}
+	}
+	return healthRepository
+}
+
+// Ping checks that the database can be reached.
+func (r *HealthRepository) Ping(ctx context.Context) error {
+	return db.Ping(ctx)
+}
@@ -0,0 +1,1500 @@
+package persistence
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/benshields/messagebox/internal/pkg/models"
+)
+
+// memoryStore holds every table of the in-memory backend. A single lock guards
+// all of them, so that each repository call is as atomic as the transaction
+// the Postgres backend would use. Lookups scan whole tables; the backend is
+// meant for development and tests, not for production data.
+type memoryStore struct {
+	mu sync.Mutex
+
+	users       []models.User
+	groups      []models.Group
+	userGroups  []models.UserGroup
+	messages    []models.Message
+	recipients  []models.MessageRecipient
+	receipts    []models.Receipt
+	tokens      []models.APIToken
+	attachments []models.Attachment
+	webhooks    []models.Webhook
+	events      []models.WebhookEvent
+	deliveries  []models.WebhookDelivery
+
+	lastIDs map[string]int32
+}
+
+// NewMemory returns repositories that keep everything in memory, with the
+// same semantics as the Postgres backend. Mailbox streaming is the exception:
+// it relies on Postgres notifications, so it is unavailable.
+func NewMemory() *Repositories {
+	s := &memoryStore{
+		lastIDs: make(map[string]int32),
+	}
+	return &Repositories{
+		Users:       &memoryUserRepository{s},
+		Groups:      &memoryGroupRepository{s},
+		Messages:    &memoryMessageRepository{s},
+		Tokens:      &memoryTokenRepository{s},
+		Attachments: &memoryAttachmentRepository{s},
+		Webhooks:    &memoryWebhookRepository{s},
+		Health:      memoryHealthRepository{},
+	}
+}
+
+// Rows are the rows of the tables an in-memory backend starts with, in the
+// order they are inserted. Rows without an ID get the next one, as they would
+// from an identity column, and rows without a time get the current one.
+type Rows struct {
+	Users      []models.User
+	Groups     []models.Group
+	UserGroups []models.UserGroup
+	Messages   []models.Message
+	Recipients []models.MessageRecipient
+	Receipts   []models.Receipt
+	Tokens     []models.APIToken
+}
+
+// NewMemoryWith returns repositories like NewMemory, holding rows.
+func NewMemoryWith(rows Rows) *Repositories {
+	repos := NewMemory()
+	s := repos.Users.(*memoryUserRepository).memoryStore
+	now := time.Now().UTC()
+
+	for _, u := range rows.Users {
+		u.ID = s.seedID("users", u.ID)
+		s.users = append(s.users, u)
+	}
+	for _, g := range rows.Groups {
+		g.ID = -s.seedID("groups", -g.ID)
+		if g.CreatedAt.IsZero() {
+			g.CreatedAt = now
+		}
+		s.groups = append(s.groups, g)
+	}
+	for _, ug := range rows.UserGroups {
+		ug.ID = s.seedID("user_groups", ug.ID)
+		s.userGroups = append(s.userGroups, ug)
+	}
+	for _, m := range rows.Messages {
+		m.ID = s.seedID("messages", m.ID)
+		if m.SentAt.IsZero() {
+			m.SentAt = now
+		}
+		s.messages = append(s.messages, m)
+	}
+	for _, rcpt := range rows.Recipients {
+		rcpt.ID = s.seedID("message_recipients", rcpt.ID)
+		s.recipients = append(s.recipients, rcpt)
+	}
+	for _, receipt := range rows.Receipts {
+		if receipt.ReadAt.IsZero() {
+			receipt.ReadAt = now
+		}
+		s.receipts = append(s.receipts, receipt)
+	}
+	for _, token := range rows.Tokens {
+		token.ID = s.seedID("api_tokens", token.ID)
+		if token.CreatedAt.IsZero() {
+			token.CreatedAt = now
+		}
+		s.tokens = append(s.tokens, token)
+	}
+
+	return repos
+}
+
+// seedID returns id, or the next ID of table when id is zero, and keeps later
+// IDs of table past it.
+func (s *memoryStore) seedID(table string, id int32) int32 {
+	if id == 0 {
+		return s.nextID(table)
+	}
+	if id > s.lastIDs[table] {
+		s.lastIDs[table] = id
+	}
+	return id
+}
+
+// nextID hands out IDs per table, the way an identity column would.
+func (s *memoryStore) nextID(table string) int32 {
+	s.lastIDs[table]++
+	return s.lastIDs[table]
+}
+
+func (s *memoryStore) userByName(name string) (models.User, bool) {
+	for _, u := range s.users {
+		if u.Name == name {
+			return u, true
+		}
+	}
+	return models.User{}, false
+}
+
+func (s *memoryStore) userByID(id int32) (models.User, bool) {
+	for _, u := range s.users {
+		if u.ID == id {
+			return u, true
+		}
+	}
+	return models.User{}, false
+}
+
+func (s *memoryStore) groupByName(name string) (models.Group, bool) {
+	for _, g := range s.groups {
+		if g.Name == name {
+			return g, true
+		}
+	}
+	return models.Group{}, false
+}
+
+func (s *memoryStore) groupByID(id int32) (models.Group, bool) {
+	for _, g := range s.groups {
+		if g.ID == id {
+			return g, true
+		}
+	}
+	return models.Group{}, false
+}
+
+func (s *memoryStore) message(id int32) (models.Message, bool) {
+	for _, m := range s.messages {
+		if m.ID == id {
+			return m, true
+		}
+	}
+	return models.Message{}, false
+}
+
+func (s *memoryStore) isMember(groupID, userID int32) bool {
+	for _, ug := range s.userGroups {
+		if ug.GroupID == groupID && ug.UserID == userID {
+			return true
+		}
+	}
+	return false
+}
+
+// mailboxIDs mirrors UserRepository.mailboxIDs.
+func (s *memoryStore) mailboxIDs(user models.User) []int32 {
+	var ids []int32
+	for _, ug := range s.userGroups {
+		if ug.UserID == user.ID {
+			ids = append(ids, ug.GroupID)
+		}
+	}
+	return append(ids, user.ID)
+}
+
+// addressedTo mirrors addressedToCondition.
+func (s *memoryStore) addressedTo(messageID int32, ids []int32) bool {
+	for _, rcpt := range s.recipients {
+		if rcpt.MessageID == messageID && containsID(ids, rcpt.RecipientID) {
+			return true
+		}
+	}
+	return false
+}
+
+// readable mirrors readableCondition.
+func (s *memoryStore) readable(msg models.Message, user models.User) bool {
+	return msg.SenderID == user.ID || s.addressedTo(msg.ID, s.mailboxIDs(user))
+}
+
+func (s *memoryStore) hasReceipt(messageID, userID int32) bool {
+	for _, receipt := range s.receipts {
+		if receipt.MessageID == messageID && receipt.UserID == userID {
+			return true
+		}
+	}
+	return false
+}
+
+// unread mirrors unreadCondition.
+func (s *memoryStore) unread(msg models.Message, readerID int32) bool {
+	return msg.SenderID != readerID && !s.hasReceipt(msg.ID, readerID)
+}
+
+// unreadByRecipients mirrors unreadByRecipientsCondition.
+func (s *memoryStore) unreadByRecipients(msg models.Message) bool {
+	for _, receipt := range s.receipts {
+		if receipt.MessageID == msg.ID && receipt.UserID != msg.SenderID {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *memoryStore) filterMessages(keep func(models.Message) bool) []models.Message {
+	var out []models.Message
+	for _, m := range s.messages {
+		if keep(m) {
+			out = append(out, m)
+		}
+	}
+	return out
+}
+
+// paginate mirrors paginate and pageOf over messages already filtered.
+func (s *memoryStore) paginate(messages []models.Message, page models.PageQuery) ([]*models.Message, error) {
+	desc := page.Order == models.OrderDesc
+	before := func(a, b models.Message) bool {
+		if !a.SentAt.Equal(b.SentAt) {
+			return a.SentAt.Before(b.SentAt)
+		}
+		return a.ID < b.ID
+	}
+	sort.Slice(messages, func(i, j int) bool {
+		if desc {
+			return before(messages[j], messages[i])
+		}
+		return before(messages[i], messages[j])
+	})
+
+	if page.Cursor != "" {
+		cur, err := decodeCursor(page.Cursor)
+		if err != nil {
+			return nil, err
+		}
+		at := models.Message{Model: models.Model{ID: cur.ID}, SentAt: cur.SentAt}
+
+		var after []models.Message
+		for _, m := range messages {
+			if (desc && before(m, at)) || (!desc && before(at, m)) {
+				after = append(after, m)
+			}
+		}
+		messages = after
+	}
+
+	out := make([]*models.Message, 0)
+	for i := range messages {
+		if len(out) > pageLimit(page) {
+			break
+		}
+		msg := messages[i]
+		out = append(out, &msg)
+	}
+	return out, nil
+}
+
+func (s *memoryStore) resolveUnread(reader models.User, messages []*models.Message) {
+	for _, msg := range messages {
+		unread := s.unread(*msg, reader.ID)
+		msg.Unread = &unread
+	}
+}
+
+// resolveDetails mirrors MessageRepository.resolveDetails.
+func (s *memoryStore) resolveDetails(viewer *models.User, messages []*models.Message) {
+	for _, msg := range messages {
+		sender, _ := s.userByID(msg.SenderID)
+		msg.Sender = sender.Name
+		msg.To, msg.Cc, msg.Bcc = nil, nil, nil
+		showBcc := viewer != nil && viewer.ID == msg.SenderID
+
+		for _, rcpt := range s.recipients {
+			if rcpt.MessageID != msg.ID {
+				continue
+			}
+
+			var named models.Recipient
+			if IsUserID(rcpt.RecipientID) {
+				u, _ := s.userByID(rcpt.RecipientID)
+				named = models.Recipient{Username: u.Name}
+			} else {
+				g, _ := s.groupByID(rcpt.RecipientID)
+				named = models.Recipient{Groupname: g.Name}
+			}
+
+			switch rcpt.Kind {
+			case models.RecipientCc:
+				msg.Cc = append(msg.Cc, named)
+			case models.RecipientBcc:
+				if showBcc {
+					msg.Bcc = append(msg.Bcc, named)
+				}
+			default:
+				msg.To = append(msg.To, named)
+			}
+		}
+
+		switch {
+		case len(msg.To) > 0:
+			msg.Recipient = msg.To[0]
+		case len(msg.Cc) > 0:
+			msg.Recipient = msg.Cc[0]
+		case len(msg.Bcc) > 0:
+			msg.Recipient = msg.Bcc[0]
+		default:
+			msg.Recipient = models.Recipient{}
+		}
+
+		msg.Attachments = nil
+		for _, a := range s.attachments {
+			if a.MessageID == msg.ID {
+				msg.Attachments = append(msg.Attachments, a)
+			}
+		}
+	}
+}
+
+// lookupRecipients mirrors MessageRepository.lookupRecipients.
+func (s *memoryStore) lookupRecipients(msg *models.Message) ([]models.MessageRecipient, error) {
+	kinds := []struct {
+		kind       string
+		recipients []models.Recipient
+	}{
+		{models.RecipientTo, msg.To},
+		{models.RecipientCc, msg.Cc},
+		{models.RecipientBcc, msg.Bcc},
+	}
+
+	var out []models.MessageRecipient
+	seen := make(map[int32]bool)
+	for _, k := range kinds {
+		for _, rcpt := range k.recipients {
+			var id int32
+			if rcpt.Username != "" {
+				u, ok := s.userByName(rcpt.Username)
+				if !ok {
+					return nil, ErrRecipientNotFound
+				}
+				id = u.ID
+			} else {
+				g, ok := s.groupByName(rcpt.Groupname)
+				if !ok {
+					return nil, ErrRecipientNotFound
+				}
+				id = g.ID
+			}
+			if seen[id] {
+				continue
+			}
+			seen[id] = true
+			out = append(out, models.MessageRecipient{RecipientID: id, Kind: k.kind})
+		}
+	}
+	if len(out) == 0 {
+		return nil, ErrRecipientNotFound
+	}
+
+	return out, nil
+}
+
+// createWithRecipients mirrors MessageRepository.createWithRecipients, less
+// the announcement to mailbox streams.
+func (s *memoryStore) createWithRecipients(sender models.User, msg *models.Message, recipients []models.MessageRecipient) error {
+	msg.ID = s.nextID("messages")
+	msg.RecipientID = recipients[0].RecipientID
+	s.messages = append(s.messages, models.Message{
+		Model:       msg.Model,
+		Re:          msg.Re,
+		SenderID:    msg.SenderID,
+		RecipientID: msg.RecipientID,
+		Subject:     msg.Subject,
+		Body:        msg.Body,
+		SentAt:      msg.SentAt,
+	})
+
+	for _, rcpt := range recipients {
+		rcpt.ID = s.nextID("message_recipients")
+		rcpt.MessageID = msg.ID
+		s.recipients = append(s.recipients, rcpt)
+	}
+
+	for _, a := range msg.Attachments {
+		a.ID = s.nextID("attachments")
+		a.MessageID = msg.ID
+		a.CreatedAt = time.Now().UTC()
+		s.attachments = append(s.attachments, a)
+	}
+
+	s.resolveDetails(&sender, []*models.Message{msg})
+
+	return s.createWebhookEvents(msg, recipients)
+}
+
+// subscribed mirrors subscribedCondition.
+func (s *memoryStore) subscribed(w models.Webhook) bool {
+	if IsUserID(w.OwnerID) {
+		return true
+	}
+	for _, ug := range s.userGroups {
+		if ug.GroupID == w.OwnerID && ug.UserID == w.CreatorID {
+			return true
+		}
+	}
+	return false
+}
+
+// createWebhookEvents mirrors MessageRepository.createWebhookEvents.
+func (s *memoryStore) createWebhookEvents(msg *models.Message, recipients []models.MessageRecipient) error {
+	for _, w := range s.webhooks {
+		var owner *models.MessageRecipient
+		for i := range recipients {
+			if recipients[i].RecipientID == w.OwnerID {
+				owner = &recipients[i]
+			}
+		}
+		if owner == nil || !s.subscribed(w) {
+			continue
+		}
+
+		var recipient models.Recipient
+		if IsUserID(w.OwnerID) {
+			u, _ := s.userByID(w.OwnerID)
+			recipient = models.Recipient{Username: u.Name}
+		} else {
+			g, _ := s.groupByID(w.OwnerID)
+			recipient = models.Recipient{Groupname: g.Name}
+		}
+
+		delivered := deliveredTo(msg, w.OwnerID)
+		payload, err := json.Marshal(models.WebhookPayload{
+			Event:     WebhookEventReceived,
+			Recipient: recipient,
+			Message:   &delivered,
+		})
+		if err != nil {
+			return err
+		}
+		s.events = append(s.events, models.WebhookEvent{
+			Model:         models.Model{ID: s.nextID("webhook_events")},
+			WebhookID:     w.ID,
+			MessageID:     msg.ID,
+			Payload:       string(payload),
+			NextAttemptAt: time.Now().UTC(),
+		})
+	}
+
+	return nil
+}
+
+// takeFromMailbox mirrors UserRepository.takeFromMailbox.
+func (s *memoryStore) takeFromMailbox(user *models.User, message *models.Message) error {
+	u, ok := s.userByName(user.Name)
+	if !ok {
+		return ErrUserNotFound
+	}
+	*user = u
+
+	m, ok := s.message(message.ID)
+	if !ok || !s.addressedTo(m.ID, s.mailboxIDs(u)) {
+		return ErrMessageNotFound
+	}
+	*message = m
+
+	return nil
+}
+
+func (s *memoryStore) createToken(user models.User) (*models.APIToken, error) {
+	token, err := newToken()
+	if err != nil {
+		return nil, err
+	}
+
+	out := models.APIToken{
+		Model:     models.Model{ID: s.nextID("api_tokens")},
+		UserID:    user.ID,
+		TokenHash: HashToken(token),
+		CreatedAt: time.Now().UTC(),
+	}
+	s.tokens = append(s.tokens, out)
+	out.Token = token
+
+	return &out, nil
+}
+
+func containsID(ids []int32, id int32) bool {
+	for _, v := range ids {
+		if v == id {
+			return true
+		}
+	}
+	return false
+}
+
+////////// users
+
+type memoryUserRepository struct {
+	*memoryStore
+}
+
+func (r *memoryUserRepository) Register(ctx context.Context, user *models.User) (*models.User, *models.APIToken, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.userByName(user.Name); ok {
+		return user, nil, ErrDuplicateName
+	}
+
+	user.ID = r.nextID("users")
+	r.users = append(r.users, *user)
+
+	token, err := r.createToken(*user)
+	return user, token, err
+}
+
+func (r *memoryUserRepository) Read(ctx context.Context, user *models.User) (*models.User, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	u, ok := r.userByName(user.Name)
+	if !ok {
+		return user, ErrUserNotFound
+	}
+	*user = u
+	return user, nil
+}
+
+func (r *memoryUserRepository) GetMailbox(ctx context.Context, user *models.User, query models.MailboxQuery) (*models.MessagePage, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	u, ok := r.userByName(user.Name)
+	if !ok {
+		return nil, ErrUserNotFound
+	}
+	*user = u
+
+	ids := r.mailboxIDs(u)
+	filtered := r.filterMessages(func(m models.Message) bool {
+		return r.addressedTo(m.ID, ids) && (!query.Unread || r.unread(m, u.ID))
+	})
+
+	messages, err := r.paginate(filtered, query.PageQuery)
+	if err != nil {
+		return nil, err
+	}
+	r.resolveUnread(u, messages)
+	r.resolveDetails(&u, messages)
+
+	return pageOf(messages, query.PageQuery), nil
+}
+
+func (r *memoryUserRepository) SearchMailbox(ctx context.Context, user *models.User, query models.SearchQuery) (*models.SearchPage, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	u, ok := r.userByName(user.Name)
+	if !ok {
+		return nil, ErrUserNotFound
+	}
+	*user = u
+
+	return r.search(u, r.mailboxIDs(u), query)
+}
+
+func (r *memoryUserRepository) GetSent(ctx context.Context, user *models.User, query models.MailboxQuery) (*models.MessagePage, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	u, ok := r.userByName(user.Name)
+	if !ok {
+		return nil, ErrUserNotFound
+	}
+	*user = u
+
+	filtered := r.filterMessages(func(m models.Message) bool {
+		return m.SenderID == u.ID && (!query.Unread || r.unreadByRecipients(m))
+	})
+
+	messages, err := r.paginate(filtered, query.PageQuery)
+	if err != nil {
+		return nil, err
+	}
+	for _, msg := range messages {
+		unread := r.unreadByRecipients(*msg)
+		msg.Unread = &unread
+	}
+	r.resolveDetails(&u, messages)
+
+	return pageOf(messages, query.PageQuery), nil
+}
+
+func (r *memoryUserRepository) GetMailboxSummary(ctx context.Context, user *models.User) (*models.MailboxSummary, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	u, ok := r.userByName(user.Name)
+	if !ok {
+		return &models.MailboxSummary{}, ErrUserNotFound
+	}
+	*user = u
+
+	ids := r.mailboxIDs(u)
+	out := &models.MailboxSummary{}
+	for _, m := range r.messages {
+		if !r.addressedTo(m.ID, ids) {
+			continue
+		}
+		out.Total++
+		if r.unread(m, u.ID) {
+			out.Unread++
+		}
+	}
+	return out, nil
+}
+
+func (r *memoryUserRepository) MarkRead(ctx context.Context, user *models.User, message *models.Message) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := r.takeFromMailbox(user, message); err != nil {
+		return err
+	}
+
+	if !r.hasReceipt(message.ID, user.ID) {
+		r.receipts = append(r.receipts, models.Receipt{
+			MessageID: message.ID,
+			UserID:    user.ID,
+			ReadAt:    time.Now().UTC(),
+		})
+	}
+	return nil
+}
+
+func (r *memoryUserRepository) MarkUnread(ctx context.Context, user *models.User, message *models.Message) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := r.takeFromMailbox(user, message); err != nil {
+		return err
+	}
+
+	kept := r.receipts[:0]
+	for _, receipt := range r.receipts {
+		if receipt.MessageID != message.ID || receipt.UserID != user.ID {
+			kept = append(kept, receipt)
+		}
+	}
+	r.receipts = kept
+	return nil
+}
+
+func (r *memoryUserRepository) GetMailboxMessage(ctx context.Context, user *models.User, message *models.Message) (*models.Message, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := r.takeFromMailbox(user, message); err != nil {
+		return message, err
+	}
+
+	messages := []*models.Message{message}
+	r.resolveUnread(*user, messages)
+	r.resolveDetails(user, messages)
+	return message, nil
+}
+
+func (r *memoryUserRepository) GetMailboxAfter(ctx context.Context, user *models.User, afterID int32, limit int) ([]*models.Message, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	u, ok := r.userByName(user.Name)
+	if !ok {
+		return nil, ErrUserNotFound
+	}
+	*user = u
+
+	ids := r.mailboxIDs(u)
+	messages := make([]*models.Message, 0)
+	for _, m := range r.messages {
+		if len(messages) == limit {
+			break
+		}
+		if m.ID > afterID && r.addressedTo(m.ID, ids) {
+			msg := m
+			messages = append(messages, &msg)
+		}
+	}
+	r.resolveUnread(u, messages)
+	r.resolveDetails(&u, messages)
+
+	return messages, nil
+}
+
+////////// groups
+
+type memoryGroupRepository struct {
+	*memoryStore
+}
+
+func (r *memoryGroupRepository) Create(ctx context.Context, group *models.Group) (*models.Group, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// first ensure all users exist, each named only once
+	users := make([]models.User, 0, len(group.Users))
+	seen := make(map[string]bool)
+	for _, gu := range group.Users {
+		u, ok := r.userByName(gu.Name)
+		if !ok || seen[u.Name] {
+			return group, ErrUserNotFound
+		}
+		seen[u.Name] = true
+		users = append(users, u)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].ID < users[j].ID })
+	group.Users = users
+
+	if _, ok := r.groupByName(group.Name); ok {
+		return group, ErrDuplicateName
+	}
+
+	group.ID = -r.nextID("groups")
+	group.CreatedAt = time.Now().UTC()
+	r.groups = append(r.groups, models.Group{Model: group.Model, Name: group.Name, CreatedAt: group.CreatedAt})
+
+	for _, u := range users {
+		r.userGroups = append(r.userGroups, models.UserGroup{
+			Model:   models.Model{ID: r.nextID("user_groups")},
+			GroupID: group.ID,
+			UserID:  u.ID,
+		})
+	}
+
+	return group, nil
+}
+
+func (r *memoryGroupRepository) Read(ctx context.Context, group *models.Group) (*models.Group, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	g, ok := r.groupByName(group.Name)
+	if !ok {
+		return group, ErrGroupNotFound
+	}
+	*group = g
+	return group, nil
+}
+
+func (r *memoryGroupRepository) GetMembers(ctx context.Context, group *models.Group) ([]models.User, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.members(group), nil
+}
+
+// members mirrors GroupRepository.members.
+func (r *memoryGroupRepository) members(group *models.Group) []models.User {
+	users := make([]models.User, 0)
+	for _, ug := range r.userGroups {
+		if ug.GroupID == group.ID {
+			u, _ := r.userByID(ug.UserID)
+			users = append(users, u)
+		}
+	}
+	return users
+}
+
+func (r *memoryGroupRepository) IsMember(ctx context.Context, group *models.Group, user *models.User) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.isMember(group.ID, user.ID), nil
+}
+
+func (r *memoryGroupRepository) AddMember(ctx context.Context, group *models.Group, user *models.User) (*models.Group, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.isMember(group.ID, user.ID) {
+		return group, ErrAlreadyMember
+	}
+	if _, ok := r.groupByID(group.ID); !ok {
+		return group, ErrGroupNotFound
+	}
+	if _, ok := r.userByID(user.ID); !ok {
+		return group, ErrUserNotFound
+	}
+
+	r.userGroups = append(r.userGroups, models.UserGroup{
+		Model:   models.Model{ID: r.nextID("user_groups")},
+		GroupID: group.ID,
+		UserID:  user.ID,
+	})
+	group.Users = r.members(group)
+
+	return group, nil
+}
+
+func (r *memoryGroupRepository) RemoveMember(ctx context.Context, group *models.Group, user *models.User) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for i, ug := range r.userGroups {
+		if ug.GroupID == group.ID && ug.UserID == user.ID {
+			r.userGroups = append(r.userGroups[:i], r.userGroups[i+1:]...)
+			return nil
+		}
+	}
+	return ErrNotMember
+}
+
+func (r *memoryGroupRepository) CountMessages(ctx context.Context, group *models.Group) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var count int64
+	for _, m := range r.messages {
+		if r.addressedTo(m.ID, []int32{group.ID}) {
+			count++
+		}
+	}
+	return count, nil
+}
+
+////////// messages
+
+type memoryMessageRepository struct {
+	*memoryStore
+}
+
+func (r *memoryMessageRepository) Create(ctx context.Context, composedMsg *models.ComposedMessage) (*models.Message, error) {
+	msg := &models.Message{
+		Sender:  composedMsg.Sender,
+		To:      composedMsg.To,
+		Cc:      composedMsg.Cc,
+		Bcc:     composedMsg.Bcc,
+		Subject: composedMsg.Subject,
+		Body:    composedMsg.Body,
+		SentAt:  time.Now().UTC(),
+
+		Attachments: composedMsg.Attachments,
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// ensure sender exists
+	sender, ok := r.userByName(composedMsg.Sender)
+	if !ok {
+		return msg, ErrSenderNotFound
+	}
+	msg.SenderID = sender.ID
+
+	// ensure recipients exist
+	recipients, err := r.lookupRecipients(msg)
+	if err != nil {
+		return msg, err
+	}
+
+	return msg, r.createWithRecipients(sender, msg, recipients)
+}
+
+func (r *memoryMessageRepository) Read(ctx context.Context, viewer *models.User, message *models.Message) (*models.Message, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	m, ok := r.message(message.ID)
+	if !ok {
+		return message, ErrMessageNotFound
+	}
+	*message = m
+
+	r.resolveDetails(viewer, []*models.Message{message})
+	return message, nil
+}
+
+// CreateReply mirrors MessageRepository.CreateReply.
+func (r *memoryMessageRepository) CreateReply(ctx context.Context, message *models.Message) (*models.Message, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	original, ok := r.message(message.Re)
+	if !ok {
+		return message, ErrMessageNotFound
+	}
+
+	sender, ok := r.userByName(message.Sender)
+	if !ok {
+		return message, ErrSenderNotFound
+	}
+	message.SenderID = sender.ID
+
+	var recipients []models.MessageRecipient
+	toUsers := false
+	for _, rcpt := range r.recipients {
+		if rcpt.MessageID != original.ID {
+			continue
+		}
+		if IsUserID(rcpt.RecipientID) {
+			toUsers = true
+		} else if rcpt.Kind != models.RecipientBcc {
+			recipients = append(recipients, models.MessageRecipient{RecipientID: rcpt.RecipientID, Kind: models.RecipientTo})
+		}
+	}
+	if toUsers || len(recipients) == 0 {
+		recipients = append(recipients, models.MessageRecipient{RecipientID: original.SenderID, Kind: models.RecipientTo})
+	}
+
+	message.SentAt = time.Now().UTC()
+
+	return message, r.createWithRecipients(sender, message, recipients)
+}
+
+func (r *memoryMessageRepository) GetReplies(ctx context.Context, viewer *models.User, message *models.Message) ([]*models.Message, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	m, ok := r.message(message.ID)
+	if !ok {
+		return nil, ErrMessageNotFound
+	}
+	*message = m
+
+	replies := make([]*models.Message, 0)
+	for _, reply := range r.messages {
+		if reply.Re == message.ID && r.readable(reply, *viewer) {
+			reply := reply
+			replies = append(replies, &reply)
+		}
+	}
+	r.resolveDetails(viewer, replies)
+
+	return replies, nil
+}
+
+func (r *memoryMessageRepository) CanRead(ctx context.Context, reader *models.User, message *models.Message) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	m, ok := r.message(message.ID)
+	if !ok {
+		return false, ErrMessageNotFound
+	}
+	*message = m
+
+	return r.readable(*message, *reader), nil
+}
+
+// GetThread mirrors threadQuery: up to the root, then depth-first down, with
+// siblings in the order they were sent, leaving out what viewer may not read.
+func (r *memoryMessageRepository) GetThread(ctx context.Context, viewer *models.User, message *models.Message) ([]*models.ThreadMessage, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	root, ok := r.message(message.ID)
+	if !ok {
+		return make([]*models.ThreadMessage, 0), ErrMessageNotFound
+	}
+	visited := map[int32]bool{root.ID: true}
+	for {
+		parent, ok := r.message(root.Re)
+		if !ok || visited[parent.ID] {
+			break
+		}
+		visited[parent.ID] = true
+		root = parent
+	}
+
+	thread := make([]*models.ThreadMessage, 0)
+	var walk func(msg models.Message, depth int, path map[int32]bool)
+	walk = func(msg models.Message, depth int, path map[int32]bool) {
+		if r.readable(msg, *viewer) {
+			thread = append(thread, &models.ThreadMessage{Message: msg, Depth: depth})
+		}
+		path[msg.ID] = true
+		for _, reply := range r.messages {
+			if reply.Re == msg.ID && !path[reply.ID] {
+				walk(reply, depth+1, path)
+			}
+		}
+		delete(path, msg.ID)
+	}
+	walk(root, 0, make(map[int32]bool))
+
+	messages := make([]*models.Message, len(thread))
+	for i, tm := range thread {
+		messages[i] = &tm.Message
+	}
+	r.resolveDetails(viewer, messages)
+
+	return thread, nil
+}
+
+// search mirrors MessageRepository.Search. Without Postgres text search it
+// matches whole words and quoted phrases, ignoring case but not word endings,
+// and ranks by how often the terms occur, counting the subject more heavily.
+func (s *memoryStore) search(reader models.User, ids []int32, query models.SearchQuery) (*models.SearchPage, error) {
+	limit := query.Limit
+	if limit <= 0 {
+		limit = DefaultPageLimit
+	}
+
+	var cur *searchCursor
+	if query.Cursor != "" {
+		c, err := decodeSearchCursor(query.Cursor)
+		if err != nil {
+			return nil, err
+		}
+		cur = &c
+	}
+
+	alternatives := parseSearch(query.Q)
+	results := make([]*models.SearchResult, 0)
+	for _, m := range s.messages {
+		if m.SenderID != reader.ID && !s.addressedTo(m.ID, ids) {
+			continue
+		}
+
+		rank, terms, ok := matchSearch(alternatives, m)
+		if !ok {
+			continue
+		}
+		if cur != nil && (rank > cur.Rank || (rank == cur.Rank && m.ID >= cur.ID)) {
+			continue
+		}
+
+		results = append(results, &models.SearchResult{
+			Message: m,
+			Rank:    rank,
+			Snippet: highlight(m.Subject+" "+m.Body, terms),
+		})
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Rank != results[j].Rank {
+			return results[i].Rank > results[j].Rank
+		}
+		return results[i].ID > results[j].ID
+	})
+
+	out := &models.SearchPage{
+		Messages: results,
+	}
+	if len(results) > limit {
+		out.Messages = results[:limit]
+		out.Next = encodeSearchCursor(out.Messages[limit-1])
+	}
+
+	messages := make([]*models.Message, len(out.Messages))
+	for i, result := range out.Messages {
+		messages[i] = &result.Message
+	}
+	s.resolveUnread(reader, messages)
+	s.resolveDetails(&reader, messages)
+
+	return out, nil
+}
+
+type searchTerm struct {
+	text    string
+	exclude bool
+}
+
+// parseSearch splits q the way websearch_to_tsquery does: into alternatives
+// separated by "or", each a list of words and quoted phrases that must all
+// match, or must not when prefixed with "-".
+func parseSearch(q string) [][]searchTerm {
+	var alternatives [][]searchTerm
+	var current []searchTerm
+
+	q = strings.ToLower(q)
+	for len(q) > 0 {
+		q = strings.TrimLeft(q, " \t\r\n")
+		if q == "" {
+			break
+		}
+
+		exclude := false
+		if q[0] == '-' {
+			exclude = true
+			q = q[1:]
+		}
+
+		var text string
+		if strings.HasPrefix(q, `"`) {
+			end := strings.Index(q[1:], `"`)
+			if end < 0 {
+				text, q = q[1:], ""
+			} else {
+				text, q = q[1:end+1], q[end+2:]
+			}
+			text = strings.Join(strings.Fields(text), " ")
+		} else {
+			end := strings.IndexAny(q, " \t\r\n")
+			if end < 0 {
+				end = len(q)
+			}
+			text, q = strings.Trim(q[:end], `"`), q[end:]
+		}
+
+		if text == "" {
+			continue
+		}
+		if text == "or" && !exclude {
+			if len(current) > 0 {
+				alternatives = append(alternatives, current)
+			}
+			current = nil
+			continue
+		}
+		current = append(current, searchTerm{text: text, exclude: exclude})
+	}
+	if len(current) > 0 {
+		alternatives = append(alternatives, current)
+	}
+
+	return alternatives
+}
+
+// matchSearch reports whether msg matches any alternative, how well, and the
+// terms to highlight.
+func matchSearch(alternatives [][]searchTerm, msg models.Message) (float32, []string, bool) {
+	subject := strings.ToLower(msg.Subject)
+	body := strings.ToLower(msg.Body)
+
+	var rank float32
+	var terms []string
+	matched := false
+	for _, alternative := range alternatives {
+		var altRank float32
+		var altTerms []string
+		ok := true
+		for _, term := range alternative {
+			inSubject, inBody := countWords(subject, term.text), countWords(body, term.text)
+			if term.exclude != (inSubject+inBody == 0) {
+				ok = false
+				break
+			}
+			if !term.exclude {
+				altRank += float32(inSubject) + 0.4*float32(inBody)
+				altTerms = append(altTerms, term.text)
+			}
+		}
+		if ok {
+			matched = true
+			rank += altRank
+			terms = append(terms, altTerms...)
+		}
+	}
+
+	return rank, terms, matched
+}
+
+// countWords counts the occurrences of phrase in text that start and end on
+// word boundaries.
+func countWords(text, phrase string) int {
+	count := 0
+	for i := 0; i+len(phrase) <= len(text); {
+		at := strings.Index(text[i:], phrase)
+		if at < 0 {
+			break
+		}
+		start, end := i+at, i+at+len(phrase)
+		if (start == 0 || !isWordByte(text[start-1])) && (end == len(text) || !isWordByte(text[end])) {
+			count++
+		}
+		i = start + 1
+	}
+	return count
+}
+
+func isWordByte(b byte) bool {
+	return b >= 'a' && b <= 'z' || b >= 'A' && b <= 'Z' || b >= '0' && b <= '9' || b == '_' || b >= 0x80
+}
+
+// highlight escapes text as HTML and marks the terms in it, as searchSnippet
+// does. Terms are matched rune by rune, ignoring case, as lowercasing text
+// could change its length.
+func highlight(text string, terms []string) string {
+	var b strings.Builder
+	for i := 0; i < len(text); {
+		marked := false
+		for _, term := range terms {
+			end, ok := foldedPrefix(text[i:], term)
+			end += i
+			if ok && (i == 0 || !isWordByte(text[i-1])) && (end == len(text) || !isWordByte(text[end])) {
+				b.WriteString("<mark>" + snippetEscaper.Replace(text[i:end]) + "</mark>")
+				i = end
+				marked = true
+				break
+			}
+		}
+		if !marked {
+			_, size := utf8.DecodeRuneInString(text[i:])
+			b.WriteString(snippetEscaper.Replace(text[i : i+size]))
+			i += size
+		}
+	}
+	return b.String()
+}
+
+// foldedPrefix reports whether text starts with term, ignoring case, and the
+// length in bytes of the prefix of text that matched.
+func foldedPrefix(text, term string) (int, bool) {
+	end := 0
+	for range term {
+		if end == len(text) {
+			return 0, false
+		}
+		_, size := utf8.DecodeRuneInString(text[end:])
+		end += size
+	}
+	return end, strings.EqualFold(text[:end], term)
+}
+
+////////// tokens
+
+type memoryTokenRepository struct {
+	*memoryStore
+}
+
+func (r *memoryTokenRepository) Create(ctx context.Context, user *models.User) (*models.APIToken, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.createToken(*user)
+}
+
+func (r *memoryTokenRepository) FindByUserID(ctx context.Context, user *models.User) ([]*models.APIToken, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	tokens := make([]*models.APIToken, 0)
+	for _, t := range r.tokens {
+		if t.UserID == user.ID {
+			t := t
+			tokens = append(tokens, &t)
+		}
+	}
+	return tokens, nil
+}
+
+func (r *memoryTokenRepository) Delete(ctx context.Context, user *models.User, token *models.APIToken) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for i, t := range r.tokens {
+		if t.ID == token.ID && t.UserID == user.ID {
+			r.tokens = append(r.tokens[:i], r.tokens[i+1:]...)
+			return nil
+		}
+	}
+	return ErrTokenNotFound
+}
+
+func (r *memoryTokenRepository) Authenticate(ctx context.Context, token string) (*models.User, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	hash := HashToken(token)
+	for _, t := range r.tokens {
+		if t.TokenHash == hash {
+			if u, ok := r.userByID(t.UserID); ok {
+				return &u, nil
+			}
+		}
+	}
+	return &models.User{}, ErrTokenNotFound
+}
+
+////////// attachments
+
+type memoryAttachmentRepository struct {
+	*memoryStore
+}
+
+func (r *memoryAttachmentRepository) Read(ctx context.Context, attachment *models.Attachment) (*models.Attachment, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, a := range r.attachments {
+		if a.ID == attachment.ID && a.MessageID == attachment.MessageID {
+			*attachment = a
+			return attachment, nil
+		}
+	}
+	return attachment, ErrAttachmentNotFound
+}
+
+////////// webhooks
+
+type memoryWebhookRepository struct {
+	*memoryStore
+}
+
+func (r *memoryWebhookRepository) Create(ctx context.Context, ownerID, creatorID int32, url string) (*models.Webhook, error) {
+	secret, err := newWebhookSecret()
+	if err != nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	out := models.Webhook{
+		Model:     models.Model{ID: r.nextID("webhooks")},
+		OwnerID:   ownerID,
+		CreatorID: creatorID,
+		URL:       url,
+		Secret:    secret,
+		CreatedAt: time.Now().UTC(),
+	}
+	r.webhooks = append(r.webhooks, out)
+
+	return &out, nil
+}
+
+func (r *memoryWebhookRepository) FindByOwnerID(ctx context.Context, ownerID int32) ([]*models.Webhook, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	webhooks := make([]*models.Webhook, 0)
+	for _, w := range r.webhooks {
+		if w.OwnerID == ownerID {
+			w := w
+			w.Secret = ""
+			webhooks = append(webhooks, &w)
+		}
+	}
+	return webhooks, nil
+}
+
+func (r *memoryWebhookRepository) Delete(ctx context.Context, ownerID int32, webhook *models.Webhook) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for i, w := range r.webhooks {
+		if w.ID == webhook.ID && w.OwnerID == ownerID {
+			r.webhooks = append(r.webhooks[:i], r.webhooks[i+1:]...)
+			r.deleteWebhookEvents(w.ID)
+			return nil
+		}
+	}
+	return ErrWebhookNotFound
+}
+
+// deleteWebhookEvents cascades the deletion of a webhook.
+func (r *memoryWebhookRepository) deleteWebhookEvents(webhookID int32) {
+	events := r.events[:0]
+	for _, ev := range r.events {
+		if ev.WebhookID != webhookID {
+			events = append(events, ev)
+		}
+	}
+	r.events = events
+
+	deliveries := r.deliveries[:0]
+	for _, d := range r.deliveries {
+		if d.WebhookID != webhookID {
+			deliveries = append(deliveries, d)
+		}
+	}
+	r.deliveries = deliveries
+}
+
+func (r *memoryWebhookRepository) FindDeliveries(ctx context.Context, ownerID int32, webhook *models.Webhook) ([]*models.WebhookDelivery, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	found := false
+	for _, w := range r.webhooks {
+		if w.ID == webhook.ID && w.OwnerID == ownerID {
+			*webhook = w
+			webhook.Secret = ""
+			found = true
+		}
+	}
+	if !found {
+		return make([]*models.WebhookDelivery, 0), ErrWebhookNotFound
+	}
+
+	deliveries := make([]*models.WebhookDelivery, 0)
+	for i := len(r.deliveries) - 1; i >= 0 && len(deliveries) < maxDeliveriesListed; i-- {
+		if d := r.deliveries[i]; d.WebhookID == webhook.ID {
+			deliveries = append(deliveries, &d)
+		}
+	}
+	return deliveries, nil
+}
+
+// ClaimDueEvents mirrors claimQuery.
+func (r *memoryWebhookRepository) ClaimDueEvents(ctx context.Context, limit int, lease time.Duration) ([]*models.PendingWebhookEvent, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now().UTC()
+	var due []int
+	for i, ev := range r.events {
+		if ev.DeliveredAt == nil && ev.FailedAt == nil && !ev.NextAttemptAt.After(now) {
+			due = append(due, i)
+		}
+	}
+	sort.SliceStable(due, func(i, j int) bool {
+		return r.events[due[i]].NextAttemptAt.Before(r.events[due[j]].NextAttemptAt)
+	})
+	if len(due) > limit {
+		due = due[:limit]
+	}
+
+	events := make([]*models.PendingWebhookEvent, 0, len(due))
+	for _, i := range due {
+		ev := &r.events[i]
+		ev.NextAttemptAt = now.Add(lease)
+
+		pending := &models.PendingWebhookEvent{WebhookEvent: *ev}
+		for _, w := range r.webhooks {
+			if w.ID == ev.WebhookID {
+				pending.URL, pending.Secret = w.URL, w.Secret
+			}
+		}
+		events = append(events, pending)
+	}
+	return events, nil
+}
+
+// RecordDelivery mirrors WebhookRepository.RecordDelivery.
+func (r *memoryWebhookRepository) RecordDelivery(ctx context.Context, event *models.PendingWebhookEvent, delivery *models.WebhookDelivery, delivered bool, retryAt *time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var ev *models.WebhookEvent
+	for i := range r.events {
+		if r.events[i].ID == event.ID {
+			ev = &r.events[i]
+		}
+	}
+	if ev == nil {
+		return ErrEventNotFound
+	}
+
+	delivery.ID = r.nextID("webhook_deliveries")
+	delivery.EventID = event.ID
+	delivery.WebhookID = event.WebhookID
+	delivery.Attempt = event.Attempts + 1
+	r.deliveries = append(r.deliveries, *delivery)
+
+	ev.Attempts++
+	switch {
+	case delivered:
+		at := delivery.AttemptedAt
+		ev.DeliveredAt = &at
+	case retryAt != nil:
+		ev.NextAttemptAt = *retryAt
+	default:
+		at := delivery.AttemptedAt
+		ev.FailedAt = &at
+	}
+	return nil
+}
+
+// memoryHealthRepository is always ready, as the in-memory backend has
+// nothing to lose a connection to.
+type memoryHealthRepository struct{}
+
+func (memoryHealthRepository) Ping(ctx context.Context) error {
+	return nil
+}
@@ -0,0 +1,408 @@
+package persistence
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/benshields/messagebox/internal/pkg/models"
+)
+
+// seedMemory registers users and groups, keyed by name, in a new in-memory
+// backend. Group members are listed by username.
+func seedMemory(t *testing.T, users []string, groups map[string][]string) (*Repositories, map[string]*models.User) {
+	ctx := context.Background()
+	repos := NewMemory()
+
+	registered := make(map[string]*models.User)
+	for _, name := range users {
+		user, _, err := repos.Users.Register(ctx, &models.User{Name: name})
+		if err != nil {
+			t.Fatal("Register() failed with:", err)
+		}
+		registered[name] = user
+	}
+
+	for name, members := range groups {
+		group := &models.Group{Name: name}
+		for _, member := range members {
+			group.Users = append(group.Users, models.User{Name: member})
+		}
+		if _, err := repos.Groups.Create(ctx, group); err != nil {
+			t.Fatal("Create() failed with:", err)
+		}
+	}
+
+	return repos, registered
+}
+
+func send(t *testing.T, repos *Repositories, msg models.ComposedMessage) *models.Message {
+	ctx := context.Background()
+	out, err := repos.Messages.Create(ctx, &msg)
+	if err != nil {
+		t.Fatal("Create() failed with:", err)
+	}
+	return out
+}
+
+func mailboxIDsOf(page *models.MessagePage) []int32 {
+	ids := make([]int32, len(page.Messages))
+	for i, msg := range page.Messages {
+		ids[i] = msg.ID
+	}
+	return ids
+}
+
+func TestMemoryUsersAndTokens(t *testing.T) {
+	ctx := context.Background()
+	repos, users := seedMemory(t, []string{"super.mario"}, nil)
+
+	_, _, err := repos.Users.Register(ctx, &models.User{Name: "super.mario"})
+	assert.True(t, errors.Is(err, ErrDuplicateName))
+
+	_, err = repos.Users.Read(ctx, &models.User{Name: "Yoshi"})
+	assert.True(t, errors.Is(err, ErrUserNotFound))
+
+	token, err := repos.Tokens.Create(ctx, users["super.mario"])
+	assert.NoError(t, err)
+	assert.NotEmpty(t, token.Token)
+
+	user, err := repos.Tokens.Authenticate(ctx, token.Token)
+	assert.NoError(t, err)
+	assert.Equal(t, "super.mario", user.Name)
+
+	tokens, err := repos.Tokens.FindByUserID(ctx, users["super.mario"])
+	assert.NoError(t, err)
+	assert.Len(t, tokens, 2)
+	assert.Empty(t, tokens[1].Token)
+
+	assert.NoError(t, repos.Tokens.Delete(ctx, users["super.mario"], token))
+	assert.True(t, errors.Is(repos.Tokens.Delete(ctx, users["super.mario"], token), ErrTokenNotFound))
+
+	_, err = repos.Tokens.Authenticate(ctx, token.Token)
+	assert.True(t, errors.Is(err, ErrTokenNotFound))
+}
+
+func TestMemoryGroups(t *testing.T) {
+	ctx := context.Background()
+	repos, users := seedMemory(t, []string{"super.mario", "Yoshi", "luigi"}, map[string][]string{"green": {"luigi", "Yoshi"}})
+
+	_, err := repos.Groups.Create(ctx, &models.Group{Name: "green", Users: []models.User{{Name: "Yoshi"}}})
+	assert.True(t, errors.Is(err, ErrDuplicateName))
+
+	_, err = repos.Groups.Create(ctx, &models.Group{Name: "red", Users: []models.User{{Name: "bowser"}}})
+	assert.True(t, errors.Is(err, ErrUserNotFound))
+
+	group, err := repos.Groups.Read(ctx, &models.Group{Name: "green"})
+	assert.NoError(t, err)
+	assert.Equal(t, int32(-1), group.ID)
+
+	group, err = repos.Groups.AddMember(ctx, group, users["super.mario"])
+	assert.NoError(t, err)
+	assert.Equal(t, []models.User{*users["Yoshi"], *users["luigi"], *users["super.mario"]}, group.Users)
+
+	_, err = repos.Groups.AddMember(ctx, group, users["super.mario"])
+	assert.True(t, errors.Is(err, ErrAlreadyMember))
+
+	assert.NoError(t, repos.Groups.RemoveMember(ctx, group, users["Yoshi"]))
+	assert.True(t, errors.Is(repos.Groups.RemoveMember(ctx, group, users["Yoshi"]), ErrNotMember))
+
+	member, err := repos.Groups.IsMember(ctx, group, users["Yoshi"])
+	assert.NoError(t, err)
+	assert.False(t, member)
+
+	members, err := repos.Groups.GetMembers(ctx, group)
+	assert.NoError(t, err)
+	assert.Equal(t, []models.User{*users["luigi"], *users["super.mario"]}, members)
+}
+
+func TestMemoryMailbox(t *testing.T) {
+	ctx := context.Background()
+	repos, users := seedMemory(t, []string{"super.mario", "Yoshi", "luigi", "toad"}, map[string][]string{"green": {"Yoshi"}})
+
+	first := send(t, repos, models.ComposedMessage{
+		Sender:  "super.mario",
+		To:      []models.Recipient{{Username: "luigi"}},
+		Cc:      []models.Recipient{{Groupname: "green"}},
+		Bcc:     []models.Recipient{{Username: "toad"}},
+		Subject: "hello",
+	})
+	assert.Equal(t, []models.Recipient{{Username: "toad"}}, first.Bcc)
+	send(t, repos, models.ComposedMessage{Sender: "luigi", To: []models.Recipient{{Username: "Yoshi"}}, Subject: "two"})
+	send(t, repos, models.ComposedMessage{Sender: "toad", To: []models.Recipient{{Username: "Yoshi"}}, Subject: "three"})
+
+	_, err := repos.Messages.Create(ctx, &models.ComposedMessage{Sender: "super.mario", To: []models.Recipient{{Username: "bowser"}}, Subject: "nobody"})
+	assert.True(t, errors.Is(err, ErrRecipientNotFound))
+
+	t.Run("Recipients do not see bcc", func(t *testing.T) {
+		page, err := repos.Users.GetMailbox(ctx, &models.User{Name: "toad"}, models.MailboxQuery{})
+		assert.NoError(t, err)
+		if assert.Len(t, page.Messages, 1) {
+			assert.Nil(t, page.Messages[0].Bcc)
+			assert.Equal(t, models.Recipient{Username: "luigi"}, page.Messages[0].Recipient)
+			assert.True(t, *page.Messages[0].Unread)
+		}
+	})
+
+	t.Run("Pages through the mailbox", func(t *testing.T) {
+		page, err := repos.Users.GetMailbox(ctx, &models.User{Name: "Yoshi"}, models.MailboxQuery{PageQuery: models.PageQuery{Limit: 2}})
+		assert.NoError(t, err)
+		assert.Equal(t, []int32{1, 2}, mailboxIDsOf(page))
+		assert.NotEmpty(t, page.Next)
+
+		page, err = repos.Users.GetMailbox(ctx, &models.User{Name: "Yoshi"}, models.MailboxQuery{PageQuery: models.PageQuery{Limit: 2, Cursor: page.Next}})
+		assert.NoError(t, err)
+		assert.Equal(t, []int32{3}, mailboxIDsOf(page))
+		assert.Empty(t, page.Next)
+
+		page, err = repos.Users.GetMailbox(ctx, &models.User{Name: "Yoshi"}, models.MailboxQuery{PageQuery: models.PageQuery{Order: models.OrderDesc}})
+		assert.NoError(t, err)
+		assert.Equal(t, []int32{3, 2, 1}, mailboxIDsOf(page))
+
+		_, err = repos.Users.GetMailbox(ctx, &models.User{Name: "Yoshi"}, models.MailboxQuery{PageQuery: models.PageQuery{Cursor: "nope"}})
+		assert.True(t, errors.Is(err, ErrInvalidCursor))
+	})
+
+	t.Run("Tracks what was read", func(t *testing.T) {
+		assert.NoError(t, repos.Users.MarkRead(ctx, &models.User{Name: "Yoshi"}, &models.Message{Model: models.Model{ID: 2}}))
+		assert.True(t, errors.Is(repos.Users.MarkRead(ctx, &models.User{Name: "luigi"}, &models.Message{Model: models.Model{ID: 2}}), ErrMessageNotFound))
+
+		summary, err := repos.Users.GetMailboxSummary(ctx, &models.User{Name: "Yoshi"})
+		assert.NoError(t, err)
+		assert.Equal(t, &models.MailboxSummary{Total: 3, Unread: 2}, summary)
+
+		page, err := repos.Users.GetMailbox(ctx, &models.User{Name: "Yoshi"}, models.MailboxQuery{Unread: true})
+		assert.NoError(t, err)
+		assert.Equal(t, []int32{1, 3}, mailboxIDsOf(page))
+
+		sent, err := repos.Users.GetSent(ctx, &models.User{Name: "luigi"}, models.MailboxQuery{Unread: true})
+		assert.NoError(t, err)
+		assert.Empty(t, sent.Messages)
+
+		assert.NoError(t, repos.Users.MarkUnread(ctx, &models.User{Name: "Yoshi"}, &models.Message{Model: models.Model{ID: 2}}))
+		sent, err = repos.Users.GetSent(ctx, &models.User{Name: "luigi"}, models.MailboxQuery{Unread: true})
+		assert.NoError(t, err)
+		assert.Equal(t, []int32{2}, mailboxIDsOf(sent))
+	})
+
+	t.Run("Only lets recipients read", func(t *testing.T) {
+		for name, want := range map[string]bool{"super.mario": true, "Yoshi": true, "toad": true, "luigi": true} {
+			allowed, err := repos.Messages.CanRead(ctx, users[name], &models.Message{Model: models.Model{ID: 1}})
+			assert.NoError(t, err)
+			assert.Equal(t, want, allowed, name)
+		}
+
+		allowed, err := repos.Messages.CanRead(ctx, users["luigi"], &models.Message{Model: models.Model{ID: 3}})
+		assert.NoError(t, err)
+		assert.False(t, allowed)
+
+		_, err = repos.Messages.CanRead(ctx, users["luigi"], &models.Message{Model: models.Model{ID: 99}})
+		assert.True(t, errors.Is(err, ErrMessageNotFound))
+	})
+
+	t.Run("Catches up after an ID", func(t *testing.T) {
+		messages, err := repos.Users.GetMailboxAfter(ctx, &models.User{Name: "Yoshi"}, 1, 1)
+		assert.NoError(t, err)
+		if assert.Len(t, messages, 1) {
+			assert.Equal(t, int32(2), messages[0].ID)
+		}
+	})
+}
+
+func TestMemoryThreads(t *testing.T) {
+	ctx := context.Background()
+	repos, users := seedMemory(t, []string{"super.mario", "Yoshi", "toad"}, map[string][]string{"green": {"Yoshi"}})
+
+	send(t, repos, models.ComposedMessage{
+		Sender:  "super.mario",
+		To:      []models.Recipient{{Username: "Yoshi"}},
+		Cc:      []models.Recipient{{Groupname: "green"}},
+		Subject: "root",
+	})
+
+	reply := func(re int32, sender string) *models.Message {
+		out, err := repos.Messages.CreateReply(ctx, &models.Message{Re: re, Sender: sender, Subject: "re"})
+		if err != nil {
+			t.Fatal("CreateReply() failed with:", err)
+		}
+		return out
+	}
+
+	// the original went to a user, so the reply goes to the sender and the group
+	first := reply(1, "Yoshi")
+	assert.Equal(t, []models.Recipient{{Groupname: "green"}, {Username: "super.mario"}}, first.To)
+	reply(1, "super.mario")
+	reply(2, "super.mario")
+
+	_, err := repos.Messages.CreateReply(ctx, &models.Message{Re: 99, Sender: "Yoshi", Subject: "re"})
+	assert.True(t, errors.Is(err, ErrMessageNotFound))
+
+	thread, err := repos.Messages.GetThread(ctx, users["Yoshi"], &models.Message{Model: models.Model{ID: 4}})
+	assert.NoError(t, err)
+	var order []int32
+	var depths []int
+	for _, tm := range thread {
+		order = append(order, tm.ID)
+		depths = append(depths, tm.Depth)
+	}
+	assert.Equal(t, []int32{1, 2, 4, 3}, order)
+	assert.Equal(t, []int{0, 1, 2, 1}, depths)
+
+	replies, err := repos.Messages.GetReplies(ctx, users["Yoshi"], &models.Message{Model: models.Model{ID: 1}})
+	assert.NoError(t, err)
+	assert.Len(t, replies, 2)
+
+	replies, err = repos.Messages.GetReplies(ctx, users["Yoshi"], &models.Message{Model: models.Model{ID: 3}})
+	assert.NoError(t, err)
+	assert.NotNil(t, replies)
+	assert.Empty(t, replies)
+}
+
+func TestMemorySearch(t *testing.T) {
+	ctx := context.Background()
+	repos, _ := seedMemory(t, []string{"super.mario", "Yoshi"}, nil)
+
+	send(t, repos, models.ComposedMessage{Sender: "super.mario", To: []models.Recipient{{Username: "Yoshi"}}, Subject: "Lunch", Body: "Pizza at noon?"})
+	send(t, repos, models.ComposedMessage{Sender: "super.mario", To: []models.Recipient{{Username: "Yoshi"}}, Subject: "Dinner", Body: "lunch was great, pizza again"})
+	send(t, repos, models.ComposedMessage{Sender: "Yoshi", To: []models.Recipient{{Username: "super.mario"}}, Subject: "Eggs", Body: "lunchbox"})
+
+	search := func(q string) []int32 {
+		page, err := repos.Users.SearchMailbox(ctx, &models.User{Name: "Yoshi"}, models.SearchQuery{Q: q})
+		assert.NoError(t, err)
+		ids := make([]int32, len(page.Messages))
+		for i, result := range page.Messages {
+			ids[i] = result.ID
+		}
+		return ids
+	}
+
+	assert.Equal(t, []int32{1, 2}, search("lunch"))
+	assert.Equal(t, []int32{2}, search(`"was great"`))
+	assert.Equal(t, []int32{1}, search("pizza -dinner"))
+	assert.Equal(t, []int32{3, 1}, search("eggs or noon"))
+	assert.Empty(t, search("sushi"))
+
+	page, err := repos.Users.SearchMailbox(ctx, &models.User{Name: "Yoshi"}, models.SearchQuery{Q: "pizza", Limit: 1})
+	assert.NoError(t, err)
+	if assert.Len(t, page.Messages, 1) {
+		assert.Equal(t, "Dinner lunch was great, <mark>pizza</mark> again", page.Messages[0].Snippet)
+	}
+	assert.NotEmpty(t, page.Next)
+
+	page, err = repos.Users.SearchMailbox(ctx, &models.User{Name: "Yoshi"}, models.SearchQuery{Q: "pizza", Limit: 1, Cursor: page.Next})
+	assert.NoError(t, err)
+	if assert.Len(t, page.Messages, 1) {
+		assert.Equal(t, int32(1), page.Messages[0].ID)
+	}
+	assert.Empty(t, page.Next)
+}
+
+func TestMemorySearchNonASCII(t *testing.T) {
+	ctx := context.Background()
+	repos, _ := seedMemory(t, []string{"super.mario", "Yoshi"}, nil)
+
+	// the Kelvin sign is three bytes long, and lowercases to the one byte "k"
+	send(t, repos, models.ComposedMessage{Sender: "super.mario", To: []models.Recipient{{Username: "Yoshi"}}, Subject: "Kelvin", Body: "\u212a\u212a\u212a kelvin, Straße"})
+
+	snippet := func(q string) string {
+		page, err := repos.Users.SearchMailbox(ctx, &models.User{Name: "Yoshi"}, models.SearchQuery{Q: q})
+		assert.NoError(t, err)
+		if !assert.Len(t, page.Messages, 1) {
+			return ""
+		}
+		return page.Messages[0].Snippet
+	}
+
+	assert.Equal(t, "<mark>Kelvin</mark> \u212a\u212a\u212a <mark>kelvin</mark>, Straße", snippet("kelvin"))
+	assert.Equal(t, "Kelvin <mark>\u212a\u212a\u212a</mark> kelvin, Straße", snippet("kkk"))
+	assert.Equal(t, "Kelvin \u212a\u212a\u212a kelvin, <mark>Straße</mark>", snippet("STRAßE"))
+}
+
+func TestMemorySearchEscapesSnippets(t *testing.T) {
+	ctx := context.Background()
+	repos, _ := seedMemory(t, []string{"super.mario", "Yoshi"}, nil)
+
+	send(t, repos, models.ComposedMessage{Sender: "super.mario", To: []models.Recipient{{Username: "Yoshi"}}, Subject: "<b>Pizza</b>", Body: `<script>alert("pizza")</script> & more`})
+
+	page, err := repos.Users.SearchMailbox(ctx, &models.User{Name: "Yoshi"}, models.SearchQuery{Q: "pizza"})
+	assert.NoError(t, err)
+	if assert.Len(t, page.Messages, 1) {
+		assert.Equal(t, `&lt;b&gt;<mark>Pizza</mark>&lt;/b&gt; &lt;script&gt;alert("<mark>pizza</mark>")&lt;/script&gt; &amp; more`, page.Messages[0].Snippet)
+	}
+}
+
+func TestMemoryWebhooks(t *testing.T) {
+	ctx := context.Background()
+	repos, users := seedMemory(t, []string{"super.mario", "Yoshi"}, map[string][]string{"green": {"Yoshi"}})
+
+	hook, err := repos.Webhooks.Create(ctx, users["Yoshi"].ID, users["Yoshi"].ID, "https://example.com/hook")
+	assert.NoError(t, err)
+	assert.NotEmpty(t, hook.Secret)
+
+	hooks, err := repos.Webhooks.FindByOwnerID(ctx, users["Yoshi"].ID)
+	assert.NoError(t, err)
+	if assert.Len(t, hooks, 1) {
+		assert.Empty(t, hooks[0].Secret)
+	}
+
+	send(t, repos, models.ComposedMessage{
+		Sender:  "super.mario",
+		To:      []models.Recipient{{Username: "Yoshi"}},
+		Bcc:     []models.Recipient{{Groupname: "green"}},
+		Subject: "hook",
+	})
+
+	events, err := repos.Webhooks.ClaimDueEvents(ctx, 10, time.Minute)
+	assert.NoError(t, err)
+	if !assert.Len(t, events, 1) {
+		return
+	}
+	assert.Equal(t, hook.Secret, events[0].Secret)
+	assert.Contains(t, events[0].Payload, `"recipient":{"username":"Yoshi"}`)
+	assert.NotContains(t, events[0].Payload, "bcc")
+
+	// leased, so not claimed again
+	again, err := repos.Webhooks.ClaimDueEvents(ctx, 10, time.Minute)
+	assert.NoError(t, err)
+	assert.Empty(t, again)
+
+	status := 500
+	retryAt := time.Now().UTC().Add(-time.Second)
+	assert.NoError(t, repos.Webhooks.RecordDelivery(ctx, events[0], &models.WebhookDelivery{StatusCode: &status, AttemptedAt: time.Now().UTC()}, false, &retryAt))
+
+	events, err = repos.Webhooks.ClaimDueEvents(ctx, 10, time.Minute)
+	assert.NoError(t, err)
+	if assert.Len(t, events, 1) {
+		assert.Equal(t, 1, events[0].Attempts)
+		assert.NoError(t, repos.Webhooks.RecordDelivery(ctx, events[0], &models.WebhookDelivery{AttemptedAt: time.Now().UTC()}, true, nil))
+	}
+
+	deliveries, err := repos.Webhooks.FindDeliveries(ctx, users["Yoshi"].ID, &models.Webhook{Model: models.Model{ID: hook.ID}})
+	assert.NoError(t, err)
+	if assert.Len(t, deliveries, 2) {
+		assert.Equal(t, 2, deliveries[0].Attempt)
+		assert.Equal(t, 1, deliveries[1].Attempt)
+	}
+
+	assert.True(t, errors.Is(repos.Webhooks.Delete(ctx, users["super.mario"].ID, hook), ErrWebhookNotFound))
+	assert.NoError(t, repos.Webhooks.Delete(ctx, users["Yoshi"].ID, hook))
+	_, err = repos.Webhooks.FindDeliveries(ctx, users["Yoshi"].ID, &models.Webhook{Model: models.Model{ID: hook.ID}})
+	assert.True(t, errors.Is(err, ErrWebhookNotFound))
+}
+
+func TestMemorySenderAndRecipient(t *testing.T) {
+	ctx := context.Background()
+	repos, _ := seedMemory(t, []string{"super.mario"}, nil)
+
+	_, err := repos.Messages.Create(ctx, &models.ComposedMessage{Sender: "wario", To: []models.Recipient{{Username: "super.mario"}}, Subject: "hi"})
+	assert.True(t, errors.Is(err, ErrSenderNotFound))
+
+	_, err = repos.Messages.CreateReply(ctx, &models.Message{Re: 1, Sender: "wario", Subject: "re"})
+	assert.True(t, errors.Is(err, ErrMessageNotFound))
+
+	_, err = repos.Messages.Create(ctx, &models.ComposedMessage{Sender: "super.mario", To: []models.Recipient{{Groupname: "koopas"}}, Subject: "hi"})
+	assert.True(t, errors.Is(err, ErrRecipientNotFound))
+}
@@ -1,14 +1,24 @@
 package persistence
 
 import (
+	"context"
 	"time"
 
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 
 	"github.com/benshields/messagebox/internal/pkg/db"
 	"github.com/benshields/messagebox/internal/pkg/models"
 )
 
+// unreadCondition matches messages that the user given by both parameters has
+// not read. Messages the user sent themselves never count as unread.
+const unreadCondition = "messages.sender <> ? AND NOT EXISTS (SELECT 1 FROM receipts WHERE receipts.message_id = messages.id AND receipts.user_id = ?)"
+
+// unreadByRecipientsCondition matches sent messages that none of their
+// recipients has read yet.
+const unreadByRecipientsCondition = "NOT EXISTS (SELECT 1 FROM receipts WHERE receipts.message_id = messages.id AND receipts.user_id <> messages.sender)"
+
 func IsUserID(id int32) bool {
 	return id > 0
 }
@@ -24,49 +34,197 @@ func GetUserRepository() *UserRepository {
 	return userRepository
 }
 
-func (r *UserRepository) Create(user *models.User) (*models.User, error) {
-	result := db.Get().Create(&user)
+func (r *UserRepository) Create(ctx context.Context, user *models.User) (*models.User, error) {
+	result := db.Get().WithContext(ctx).Create(&user)
 	return user, result.Error
 }
 
-func (r *UserRepository) Read(user *models.User) (*models.User, error) {
-	result := db.Get().Take(&user, "name = ?", user.Name)
-	return user, result.Error
+// Register creates user together with its first API token.
+func (r *UserRepository) Register(ctx context.Context, user *models.User) (*models.User, *models.APIToken, error) {
+	var token *models.APIToken
+	err := db.Get().WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(user).Error; err != nil {
+			return translate(err, nil)
+		}
+
+		var err error
+		token, err = GetTokenRepository().create(tx, user)
+		return err
+	})
+	return user, token, err
 }
 
-func (r *UserRepository) GetByID(user *models.User) (*models.User, error) {
-	result := db.Get().Take(&user, "id = ?", user.ID)
-	return user, result.Error
+func (r *UserRepository) Read(ctx context.Context, user *models.User) (*models.User, error) {
+	return user, r.take(db.Get().WithContext(ctx), user)
+}
+
+// take loads the user named by user.Name through tx.
+func (r *UserRepository) take(tx *gorm.DB, user *models.User) error {
+	return translate(tx.Take(user, "name = ?", user.Name).Error, ErrUserNotFound)
 }
 
-func (r *UserRepository) GetMailbox(user *models.User) ([]*models.Message, error) {
+func (r *UserRepository) GetByID(ctx context.Context, user *models.User) (*models.User, error) {
+	result := db.Get().WithContext(ctx).Take(&user, "id = ?", user.ID)
+	return user, translate(result.Error, ErrUserNotFound)
+}
+
+func (r *UserRepository) GetMailbox(ctx context.Context, user *models.User, query models.MailboxQuery) (*models.MessagePage, error) {
 	var err error
-	messages := make([]*models.Message, 0)
-	err = db.Get().Transaction(func(tx *gorm.DB) error {
-		user, err = r.Read(user)
-		if err != nil {
+	var out *models.MessagePage
+	err = db.Get().WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := r.take(tx, user); err != nil {
 			return err
 		}
 
-		userGroups, err := GetGroupRepository().FindByUserID(user)
+		ids, err := r.mailboxIDs(tx, user)
 		if err != nil {
 			return err
 		}
 
-		ids := make([]int32, len(userGroups)+1)
-		for i, userGroup := range userGroups {
-			ids[i] = userGroup.GroupID
+		out, err = GetMessageRepository().findByRecipientID(tx, user, ids, query)
+		return err
+	})
+	return out, err
+}
+
+// SearchMailbox searches the messages in the user's mailbox and those the
+// user sent.
+func (r *UserRepository) SearchMailbox(ctx context.Context, user *models.User, query models.SearchQuery) (*models.SearchPage, error) {
+	user, err := r.Read(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+
+	ids, err := r.mailboxIDs(db.Get().WithContext(ctx), user)
+	if err != nil {
+		return nil, err
+	}
+
+	return GetMessageRepository().Search(ctx, user, ids, query)
+}
+
+func (r *UserRepository) GetSent(ctx context.Context, user *models.User, query models.MailboxQuery) (*models.MessagePage, error) {
+	user, err := r.Read(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+
+	return GetMessageRepository().FindBySenderID(ctx, user, query)
+}
+
+func (r *UserRepository) GetMailboxSummary(ctx context.Context, user *models.User) (*models.MailboxSummary, error) {
+	var err error
+	out := &models.MailboxSummary{}
+	err = db.Get().WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := r.take(tx, user); err != nil {
+			return err
 		}
-		ids[len(userGroups)] = user.ID
 
-		messages, err = GetMessageRepository().FindByRecipientID(ids)
+		ids, err := r.mailboxIDs(tx, user)
 		if err != nil {
 			return err
 		}
 
-		return nil
+		if err := tx.Model(&models.Message{}).Where(addressedToCondition, ids).Count(&out.Total).Error; err != nil {
+			return err
+		}
+
+		return tx.Model(&models.Message{}).Where(addressedToCondition, ids).Where(unreadCondition, user.ID, user.ID).Count(&out.Unread).Error
+	})
+	return out, err
+}
+
+func (r *UserRepository) MarkRead(ctx context.Context, user *models.User, message *models.Message) error {
+	return db.Get().WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := r.takeFromMailbox(tx, user, message); err != nil {
+			return err
+		}
+
+		receipt := models.Receipt{
+			MessageID: message.ID,
+			UserID:    user.ID,
+			ReadAt:    time.Now().UTC(),
+		}
+		return tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&receipt).Error
+	})
+}
+
+func (r *UserRepository) MarkUnread(ctx context.Context, user *models.User, message *models.Message) error {
+	return db.Get().WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := r.takeFromMailbox(tx, user, message); err != nil {
+			return err
+		}
+
+		return tx.Where("message_id = ? AND user_id = ?", message.ID, user.ID).Delete(&models.Receipt{}).Error
 	})
-	return messages, err
+}
+
+// GetMailboxMessage returns a message in the user's mailbox as the user sees
+// it, failing with ErrMessageNotFound unless it is in the mailbox.
+func (r *UserRepository) GetMailboxMessage(ctx context.Context, user *models.User, message *models.Message) (*models.Message, error) {
+	err := db.Get().WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := r.takeFromMailbox(tx, user, message); err != nil {
+			return err
+		}
+
+		messages := []*models.Message{message}
+		if err := GetMessageRepository().resolveUnread(tx, user, messages); err != nil {
+			return err
+		}
+
+		return GetMessageRepository().resolveDetails(tx, user, messages)
+	})
+	return message, err
+}
+
+// GetMailboxAfter lists up to limit messages in the user's mailbox whose IDs
+// come after afterID, lowest first, for clients catching up on a stream.
+func (r *UserRepository) GetMailboxAfter(ctx context.Context, user *models.User, afterID int32, limit int) ([]*models.Message, error) {
+	user, err := r.Read(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+
+	ids, err := r.mailboxIDs(db.Get().WithContext(ctx), user)
+	if err != nil {
+		return nil, err
+	}
+
+	return GetMessageRepository().FindByRecipientIDAfter(ctx, user, ids, afterID, limit)
+}
+
+// mailboxIDs lists the recipient IDs whose messages land in the user's
+// mailbox: the user's own ID and the IDs of every group the user belongs to.
+// It reads through tx, so that a transaction sees one snapshot throughout.
+func (r *UserRepository) mailboxIDs(tx *gorm.DB, user *models.User) ([]int32, error) {
+	var userGroups []*models.UserGroup
+	if err := tx.Find(&userGroups, "user_id = ?", user.ID).Error; err != nil {
+		return nil, err
+	}
+
+	ids := make([]int32, len(userGroups)+1)
+	for i, userGroup := range userGroups {
+		ids[i] = userGroup.GroupID
+	}
+	ids[len(userGroups)] = user.ID
+
+	return ids, nil
+}
+
+// takeFromMailbox loads the user and the message, failing with
+// ErrMessageNotFound unless the message is in the user's mailbox.
+func (r *UserRepository) takeFromMailbox(tx *gorm.DB, user *models.User, message *models.Message) error {
+	if err := r.take(tx, user); err != nil {
+		return err
+	}
+
+	ids, err := r.mailboxIDs(tx, user)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Where(addressedToCondition, ids).Take(message, "id = ?", message.ID).Error
+	return translate(err, ErrMessageNotFound)
 }
 
 ////////// TODO split to another file?
@@ -82,8 +240,8 @@ func GetGroupRepository() *GroupRepository {
 	return groupRepository
 }
 
-func (r *GroupRepository) Create(group *models.Group) (*models.Group, error) {
-	err := db.Get().Transaction(func(tx *gorm.DB) error {
+func (r *GroupRepository) Create(ctx context.Context, group *models.Group) (*models.Group, error) {
+	err := db.Get().WithContext(ctx).Transaction(func(tx *gorm.DB) error {
 		// first ensure all users exist
 		unames := make([]string, len(group.Users))
 		for i, u := range group.Users {
@@ -94,12 +252,12 @@ func (r *GroupRepository) Create(group *models.Group) (*models.Group, error) {
 			return err
 		}
 		if tx.RowsAffected != int64(len(unames)) {
-			return gorm.ErrRecordNotFound
+			return ErrUserNotFound
 		}
 
 		// create group
 		if err := tx.Debug().Table("groups").Model(&group).Select("Name").Create(&group).Error; err != nil {
-			return err
+			return translate(err, nil)
 		}
 
 		// create the user_groups entries
@@ -112,7 +270,7 @@ func (r *GroupRepository) Create(group *models.Group) (*models.Group, error) {
 			userGroups[i] = ug
 		}
 		if err := tx.Debug().Model(&models.UserGroup{}).Table("user_groups").Create(&userGroups).Error; err != nil {
-			return err
+			return translate(err, nil)
 		}
 
 		return nil
@@ -121,22 +279,86 @@ func (r *GroupRepository) Create(group *models.Group) (*models.Group, error) {
 	return group, err
 }
 
-func (r *GroupRepository) Read(group *models.Group) (*models.Group, error) {
-	result := db.Get().Take(&group, "name = ?", group.Name)
-	return group, result.Error
+func (r *GroupRepository) Read(ctx context.Context, group *models.Group) (*models.Group, error) {
+	result := db.Get().WithContext(ctx).Take(&group, "name = ?", group.Name)
+	return group, translate(result.Error, ErrGroupNotFound)
 }
 
-func (r *GroupRepository) GetByID(group *models.Group) (*models.Group, error) {
-	result := db.Get().Take(&group, "id = ?", group.ID)
-	return group, result.Error
+func (r *GroupRepository) GetByID(ctx context.Context, group *models.Group) (*models.Group, error) {
+	result := db.Get().WithContext(ctx).Take(&group, "id = ?", group.ID)
+	return group, translate(result.Error, ErrGroupNotFound)
 }
 
-func (r *GroupRepository) FindByUserID(user *models.User) ([]*models.UserGroup, error) {
+func (r *GroupRepository) FindByUserID(ctx context.Context, user *models.User) ([]*models.UserGroup, error) {
 	var userGroups []*models.UserGroup
-	result := db.Get().Find(&userGroups, "user_id = ?", user.ID)
+	result := db.Get().WithContext(ctx).Find(&userGroups, "user_id = ?", user.ID)
 	return userGroups, result.Error
 }
 
+func (r *GroupRepository) GetMembers(ctx context.Context, group *models.Group) ([]models.User, error) {
+	return r.members(db.Get().WithContext(ctx), group)
+}
+
+// IsMember reports whether user currently belongs to group.
+func (r *GroupRepository) IsMember(ctx context.Context, group *models.Group, user *models.User) (bool, error) {
+	var count int64
+	err := db.Get().WithContext(ctx).Model(&models.UserGroup{}).Where("group_id = ? AND user_id = ?", group.ID, user.ID).Count(&count).Error
+	return count > 0, err
+}
+
+func (r *GroupRepository) AddMember(ctx context.Context, group *models.Group, user *models.User) (*models.Group, error) {
+	err := db.Get().WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		// user_groups_group_id_user_id_key turns away a second membership,
+		// even when two requests add the same user at once
+		ug := models.UserGroup{
+			GroupID: group.ID,
+			UserID:  user.ID,
+		}
+		if err := tx.Create(&ug).Error; err != nil {
+			return translate(err, nil)
+		}
+
+		users, err := r.members(tx, group)
+		if err != nil {
+			return err
+		}
+		group.Users = users
+
+		return nil
+	})
+
+	return group, err
+}
+
+func (r *GroupRepository) RemoveMember(ctx context.Context, group *models.Group, user *models.User) error {
+	result := db.Get().WithContext(ctx).Where("group_id = ? AND user_id = ?", group.ID, user.ID).Delete(&models.UserGroup{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrNotMember
+	}
+	return nil
+}
+
+func (r *GroupRepository) CountMessages(ctx context.Context, group *models.Group) (int64, error) {
+	var count int64
+	result := db.Get().WithContext(ctx).Model(&models.Message{}).Where(addressedToCondition, []int32{group.ID}).Count(&count)
+	return count, result.Error
+}
+
+// members lists the users of a group in the order they joined it.
+func (r *GroupRepository) members(tx *gorm.DB, group *models.Group) ([]models.User, error) {
+	users := make([]models.User, 0)
+	result := tx.Model(&models.User{}).
+		Select("users.*").
+		Joins("JOIN user_groups ON user_groups.user_id = users.id").
+		Where("user_groups.group_id = ?", group.ID).
+		Order("user_groups.id").
+		Find(&users)
+	return users, result.Error
+}
+
 ////////// TODO split to another file?
 
 type MessageRepository struct{}
@@ -150,196 +372,343 @@ func GetMessageRepository() *MessageRepository {
 	return messageRepository
 }
 
-func (r *MessageRepository) Create(composedMsg *models.ComposedMessage) (*models.Message, error) {
+func (r *MessageRepository) Create(ctx context.Context, composedMsg *models.ComposedMessage) (*models.Message, error) {
 	msg := &models.Message{
-		Sender:    composedMsg.Sender,
-		Recipient: composedMsg.Recipient,
-		Subject:   composedMsg.Subject,
-		Body:      composedMsg.Body,
-		SentAt:    time.Now().UTC(),
+		Sender:  composedMsg.Sender,
+		To:      composedMsg.To,
+		Cc:      composedMsg.Cc,
+		Bcc:     composedMsg.Bcc,
+		Subject: composedMsg.Subject,
+		Body:    composedMsg.Body,
+		SentAt:  time.Now().UTC(),
+
+		Attachments: composedMsg.Attachments,
 	}
-	err := db.Get().Transaction(func(tx *gorm.DB) error {
-		var err error
-
+	err := db.Get().WithContext(ctx).Transaction(func(tx *gorm.DB) error {
 		// ensure sender exists
-		senderIn := &models.User{
-			Name: composedMsg.Sender,
+		sender := &models.User{}
+		if err := tx.Take(sender, "name = ?", composedMsg.Sender).Error; err != nil {
+			return translate(err, ErrSenderNotFound)
 		}
-		senderOut, err := GetUserRepository().Read(senderIn) // TODO link the transactions together
+		msg.SenderID = sender.ID
+
+		// ensure recipients exist
+		recipients, err := r.lookupRecipients(tx, msg)
 		if err != nil {
 			return err
 		}
-		msg.SenderID = senderOut.ID
 
-		// ensure recipient exists
-		if composedMsg.Recipient.Username != "" {
-			userRecipientIn := &models.User{
-				Name: composedMsg.Recipient.Username,
-			}
-			userRecipientOut, err := GetUserRepository().Read(userRecipientIn)
-			if err != nil {
-				return err
-			}
-			msg.RecipientID = userRecipientOut.ID
-		} else {
-			groupRecipientIn := &models.Group{
-				Name: composedMsg.Recipient.Groupname,
-			}
-			groupRecipientOut, err := GetGroupRepository().Read(groupRecipientIn)
-			if err != nil {
-				return err
-			}
-			msg.RecipientID = groupRecipientOut.ID
-		}
+		return r.createWithRecipients(tx, sender, msg, recipients)
+	})
 
-		if err := tx.Create(&msg).Error; err != nil {
-			return err
+	return msg, err
+}
+
+// Read looks up a message on behalf of viewer, who sees its blind copies only
+// when they sent it.
+func (r *MessageRepository) Read(ctx context.Context, viewer *models.User, message *models.Message) (*models.Message, error) {
+	err := db.Get().WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Take(&message, "id = ?", message.ID).Error; err != nil {
+			return translate(err, ErrMessageNotFound)
 		}
 
-		return nil
+		return r.resolveDetails(tx, viewer, []*models.Message{message})
 	})
 
-	return msg, err
+	return message, err
 }
 
-func (r *MessageRepository) Read(message *models.Message) (*models.Message, error) {
-	err := db.Get().Transaction(func(tx *gorm.DB) error {
-		if err := tx.Take(&message, "id = ?", message.ID).Error; err != nil {
-			return err
+// CreateReply sends message as a reply to the message it is re. The reply goes
+// to every group the original was addressed to, and to the original sender if
+// it was addressed to any users.
+func (r *MessageRepository) CreateReply(ctx context.Context, message *models.Message) (*models.Message, error) {
+	err := db.Get().WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		original := &models.Message{}
+		if err := tx.Take(original, "id = ?", message.Re).Error; err != nil {
+			return translate(err, ErrMessageNotFound)
 		}
 
-		senderIn := &models.User{
-			Model: models.Model{
-				ID: message.SenderID,
-			},
+		sender := &models.User{}
+		if err := tx.Take(sender, "name = ?", message.Sender).Error; err != nil {
+			return translate(err, ErrSenderNotFound)
 		}
-		senderOut, err := GetUserRepository().GetByID(senderIn)
-		if err != nil {
+		message.SenderID = sender.ID
+
+		var originalRecipients []models.MessageRecipient
+		if err := tx.Order("id").Find(&originalRecipients, "message_id = ?", original.ID).Error; err != nil {
 			return err
 		}
-		message.Sender = senderOut.Name
 
-		if IsUserID(message.RecipientID) {
-			userRecipientIn := &models.User{
-				Model: models.Model{
-					ID: message.RecipientID,
-				},
-			}
-			userRecipientOut, err := GetUserRepository().GetByID(userRecipientIn)
-			if err != nil {
-				return err
-			}
-			message.Recipient = models.Recipient{
-				Username: userRecipientOut.Name,
-			}
-		} else {
-			groupRecipientIn := &models.Group{
-				Model: models.Model{
-					ID: message.RecipientID,
-				},
-			}
-			groupRecipientOut, err := GetGroupRepository().GetByID(groupRecipientIn)
-			if err != nil {
-				return err
-			}
-			message.Recipient = models.Recipient{
-				Groupname: groupRecipientOut.Name,
+		var recipients []models.MessageRecipient
+		toUsers := false
+		for _, rcpt := range originalRecipients {
+			if IsUserID(rcpt.RecipientID) {
+				toUsers = true
+			} else if rcpt.Kind != models.RecipientBcc {
+				recipients = append(recipients, models.MessageRecipient{RecipientID: rcpt.RecipientID, Kind: models.RecipientTo})
 			}
 		}
+		if toUsers || len(recipients) == 0 {
+			recipients = append(recipients, models.MessageRecipient{RecipientID: original.SenderID, Kind: models.RecipientTo})
+		}
 
-		return nil
+		message.SentAt = time.Now().UTC()
+
+		return r.createWithRecipients(tx, sender, message, recipients)
 	})
 
 	return message, err
 }
 
-func (r *MessageRepository) CreateReply(message *models.Message) (*models.Message, error) {
-	err := db.Get().Transaction(func(tx *gorm.DB) error {
-		originalMessageIn := &models.Message{
-			Model: models.Model{
-				ID: message.Re,
-			},
+// GetReplies returns the direct replies to message that viewer may read.
+func (r *MessageRepository) GetReplies(ctx context.Context, viewer *models.User, message *models.Message) ([]*models.Message, error) {
+	var replies []*models.Message
+	err := db.Get().WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Take(&message, "id = ?", message.ID).Error; err != nil {
+			return translate(err, ErrMessageNotFound)
 		}
-		originalMessageOut, err := r.Read(originalMessageIn)
+
+		ids, err := GetUserRepository().mailboxIDs(tx, viewer)
 		if err != nil {
 			return err
 		}
 
-		senderIn := &models.User{
-			Name: message.Sender,
+		if err := tx.Where(readableCondition, viewer.ID, ids).Find(&replies, "re = ?", message.ID).Error; err != nil {
+			return err
 		}
-		senderOut, err := GetUserRepository().Read(senderIn)
-		if err != nil {
+
+		return r.resolveDetails(tx, viewer, replies)
+	})
+
+	return replies, err
+}
+
+// CanRead reports whether reader may read message: the sender, a direct
+// recipient and the current members of a recipient group may. It fails with
+// ErrMessageNotFound when the message does not exist.
+func (r *MessageRepository) CanRead(ctx context.Context, reader *models.User, message *models.Message) (bool, error) {
+	tx := db.Get().WithContext(ctx)
+	if err := tx.Take(message, "id = ?", message.ID).Error; err != nil {
+		return false, translate(err, ErrMessageNotFound)
+	}
+
+	if message.SenderID == reader.ID {
+		return true, nil
+	}
+
+	ids, err := GetUserRepository().mailboxIDs(tx, reader)
+	if err != nil {
+		return false, err
+	}
+
+	var count int64
+	err = tx.Model(&models.MessageRecipient{}).Where("message_id = ? AND recipient IN ?", message.ID, ids).Count(&count).Error
+	return count > 0, err
+}
+
+// threadQuery walks up the re column from a message to the root of its
+// conversation, then back down to every reply beneath that root. Rows come out
+// depth-first, with siblings in the order they were sent.
+const threadQuery = `
+WITH RECURSIVE ancestors AS (
+    SELECT id, re, 0 AS hops, ARRAY[id] AS path FROM messages WHERE id = ?
+    UNION ALL
+    SELECT m.id, m.re, a.hops + 1, a.path || m.id
+    FROM messages m JOIN ancestors a ON m.id = a.re
+    WHERE NOT m.id = ANY(a.path)
+),
+root AS (
+    SELECT id FROM ancestors ORDER BY hops DESC LIMIT 1
+),
+thread AS (
+    SELECT m.id, 0 AS depth, ARRAY[m.id] AS path
+    FROM messages m JOIN root ON m.id = root.id
+    UNION ALL
+    SELECT m.id, t.depth + 1, t.path || m.id
+    FROM messages m JOIN thread t ON m.re = t.id
+    WHERE NOT m.id = ANY(t.path)
+)
+SELECT messages.*, thread.depth
+FROM thread JOIN messages ON messages.id = thread.id
+ORDER BY thread.path`
+
+// GetThread returns the conversation that message belongs to, starting from
+// its root message, leaving out the messages that viewer may not read.
+func (r *MessageRepository) GetThread(ctx context.Context, viewer *models.User, message *models.Message) ([]*models.ThreadMessage, error) {
+	thread := make([]*models.ThreadMessage, 0)
+	err := db.Get().WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Raw(threadQuery, message.ID).Scan(&thread).Error; err != nil {
 			return err
 		}
-		message.SenderID = senderOut.ID
+		if len(thread) == 0 {
+			return ErrMessageNotFound
+		}
 
-		if IsUserID(originalMessageOut.RecipientID) {
-			message.Recipient = models.Recipient{
-				Username: originalMessageOut.Sender,
-			}
-			message.RecipientID = originalMessageOut.SenderID
-		} else {
-			message.Recipient = models.Recipient{
-				Groupname: originalMessageOut.Recipient.Groupname,
+		ids, err := GetUserRepository().mailboxIDs(tx, viewer)
+		if err != nil {
+			return err
+		}
+		threadIDs := make([]int32, len(thread))
+		for i, tm := range thread {
+			threadIDs[i] = tm.ID
+		}
+		var readableIDs []int32
+		if err := tx.Model(&models.Message{}).Where("id IN ?", threadIDs).Where(readableCondition, viewer.ID, ids).Pluck("id", &readableIDs).Error; err != nil {
+			return err
+		}
+		readable := thread[:0]
+		for _, tm := range thread {
+			if containsID(readableIDs, tm.ID) {
+				readable = append(readable, tm)
 			}
-			message.RecipientID = originalMessageOut.RecipientID
 		}
+		thread = readable
 
-		message.SentAt = time.Now().UTC()
-
-		if err := tx.Create(&message).Error; err != nil {
-			return err
+		messages := make([]*models.Message, len(thread))
+		for i, tm := range thread {
+			messages[i] = &tm.Message
 		}
 
-		return nil
+		return r.resolveDetails(tx, viewer, messages)
 	})
 
-	return message, err
+	return thread, err
 }
 
-func (r *MessageRepository) GetReplies(message *models.Message) ([]*models.Message, error) {
-	var replies []*models.Message
-	err := db.Get().Transaction(func(tx *gorm.DB) error {
-		if err := tx.Take(&message, "id = ?", message.ID).Error; err != nil {
-			return err
-		}
+// findByRecipientID pages through the messages addressed to any of ids, within
+// the transaction tx.
+func (r *MessageRepository) findByRecipientID(tx *gorm.DB, reader *models.User, ids []int32, query models.MailboxQuery) (*models.MessagePage, error) {
+	messages := make([]*models.Message, 0)
+	filtered := tx.Where(addressedToCondition, ids)
+	if query.Unread {
+		filtered = filtered.Where(unreadCondition, reader.ID, reader.ID)
+	}
+
+	page, err := paginate(filtered, query.PageQuery)
+	if err != nil {
+		return nil, err
+	}
+	if err := page.Find(&messages).Error; err != nil {
+		return nil, err
+	}
+
+	if err := r.resolveUnread(tx, reader, messages); err != nil {
+		return nil, err
+	}
+	if err := r.resolveDetails(tx, reader, messages); err != nil {
+		return nil, err
+	}
+
+	return pageOf(messages, query.PageQuery), nil
+}
 
-		if err := tx.Find(&replies, "re = ?", message.ID).Error; err != nil {
+// FindByRecipientIDAfter lists up to limit messages addressed to any of ids
+// whose IDs come after afterID, lowest first.
+func (r *MessageRepository) FindByRecipientIDAfter(ctx context.Context, reader *models.User, ids []int32, afterID int32, limit int) ([]*models.Message, error) {
+	messages := make([]*models.Message, 0)
+	err := db.Get().WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where(addressedToCondition, ids).Where("messages.id > ?", afterID).Order("messages.id").Limit(limit).Find(&messages).Error; err != nil {
 			return err
 		}
 
-		for i, in := range replies {
-			out, err := r.Read(in)
-			if err != nil {
-				return err
-			}
-			replies[i] = out
+		if err := r.resolveUnread(tx, reader, messages); err != nil {
+			return err
 		}
 
-		return nil
+		return r.resolveDetails(tx, reader, messages)
 	})
 
-	return replies, err
+	return messages, err
 }
 
-func (r *MessageRepository) FindByRecipientID(ids []int32) ([]*models.Message, error) {
-	var messages []*models.Message
-	err := db.Get().Transaction(func(tx *gorm.DB) error {
-		if err := tx.Order("sent_at").Find(&messages, "recipient IN ?", ids).Error; err != nil {
+// FindBySenderID lists the messages sent by sender. For sent messages the
+// unread flag and filter refer to the recipients: a message is unread until
+// at least one of its recipients has read it.
+func (r *MessageRepository) FindBySenderID(ctx context.Context, sender *models.User, query models.MailboxQuery) (*models.MessagePage, error) {
+	messages := make([]*models.Message, 0)
+	err := db.Get().WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		filtered := tx.Where("sender = ?", sender.ID)
+		if query.Unread {
+			filtered = filtered.Where(unreadByRecipientsCondition)
+		}
+
+		page, err := paginate(filtered, query.PageQuery)
+		if err != nil {
+			return err
+		}
+		if err := page.Find(&messages).Error; err != nil {
 			return err
 		}
 
-		for i, in := range messages {
-			out, err := r.Read(in)
-			if err != nil {
-				return err
-			}
-			messages[i] = out
+		if err := r.resolveUnreadByRecipients(tx, messages); err != nil {
+			return err
 		}
 
-		return nil
+		return r.resolveDetails(tx, sender, messages)
 	})
+	if err != nil {
+		return nil, err
+	}
 
-	return messages, err
+	return pageOf(messages, query.PageQuery), nil
+}
+
+// resolveUnreadByRecipients sets the unread flag of each sent message.
+func (r *MessageRepository) resolveUnreadByRecipients(tx *gorm.DB, messages []*models.Message) error {
+	if len(messages) == 0 {
+		return nil
+	}
+
+	ids := make([]int32, len(messages))
+	for i, msg := range messages {
+		ids[i] = msg.ID
+	}
+
+	var readIDs []int32
+	if err := tx.Model(&models.Receipt{}).
+		Joins("JOIN messages ON messages.id = receipts.message_id").
+		Where("receipts.message_id IN ? AND receipts.user_id <> messages.sender", ids).
+		Distinct().
+		Pluck("receipts.message_id", &readIDs).Error; err != nil {
+		return err
+	}
+	read := make(map[int32]bool, len(readIDs))
+	for _, id := range readIDs {
+		read[id] = true
+	}
+
+	for _, msg := range messages {
+		unread := !read[msg.ID]
+		msg.Unread = &unread
+	}
+
+	return nil
+}
+
+// resolveUnread sets the unread flag of each message as seen by reader.
+func (r *MessageRepository) resolveUnread(tx *gorm.DB, reader *models.User, messages []*models.Message) error {
+	if len(messages) == 0 {
+		return nil
+	}
+
+	ids := make([]int32, len(messages))
+	for i, msg := range messages {
+		ids[i] = msg.ID
+	}
+
+	var readIDs []int32
+	if err := tx.Model(&models.Receipt{}).Where("user_id = ? AND message_id IN ?", reader.ID, ids).Pluck("message_id", &readIDs).Error; err != nil {
+		return err
+	}
+	read := make(map[int32]bool, len(readIDs))
+	for _, id := range readIDs {
+		read[id] = true
+	}
+
+	for _, msg := range messages {
+		unread := msg.SenderID != reader.ID && !read[msg.ID]
+		msg.Unread = &unread
+	}
+
+	return nil
 }
@@ -0,0 +1,225 @@
+package persistence
+
+import (
+	"gorm.io/gorm"
+
+	"github.com/benshields/messagebox/internal/pkg/events"
+	"github.com/benshields/messagebox/internal/pkg/models"
+)
+
+// addressedToCondition matches messages addressed, by to, cc or bcc, to any
+// of the recipient IDs given as its only argument.
+const addressedToCondition = "EXISTS (SELECT 1 FROM message_recipients WHERE message_recipients.message_id = messages.id AND message_recipients.recipient IN ?)"
+
+// readableCondition matches the messages a user may read, as CanRead decides:
+// those sent by the user whose ID is its first argument, and those addressed
+// to any of the recipient IDs, from mailboxIDs, given as its second.
+const readableCondition = "(messages.sender = ? OR " + addressedToCondition + ")"
+
+// lookupRecipients resolves the named to, cc and bcc recipients of msg to
+// their IDs. A recipient named more than once keeps its first kind. It fails
+// with ErrRecipientNotFound if any user or group does not exist.
+func (r *MessageRepository) lookupRecipients(tx *gorm.DB, msg *models.Message) ([]models.MessageRecipient, error) {
+	kinds := []struct {
+		kind       string
+		recipients []models.Recipient
+	}{
+		{models.RecipientTo, msg.To},
+		{models.RecipientCc, msg.Cc},
+		{models.RecipientBcc, msg.Bcc},
+	}
+
+	var usernames, groupnames []string
+	for _, k := range kinds {
+		for _, rcpt := range k.recipients {
+			if rcpt.Username != "" {
+				usernames = append(usernames, rcpt.Username)
+			} else {
+				groupnames = append(groupnames, rcpt.Groupname)
+			}
+		}
+	}
+
+	userIDs := make(map[string]int32)
+	if len(usernames) > 0 {
+		var users []models.User
+		if err := tx.Find(&users, "name IN ?", usernames).Error; err != nil {
+			return nil, err
+		}
+		for _, u := range users {
+			userIDs[u.Name] = u.ID
+		}
+	}
+
+	groupIDs := make(map[string]int32)
+	if len(groupnames) > 0 {
+		var groups []models.Group
+		if err := tx.Find(&groups, "name IN ?", groupnames).Error; err != nil {
+			return nil, err
+		}
+		for _, g := range groups {
+			groupIDs[g.Name] = g.ID
+		}
+	}
+
+	var out []models.MessageRecipient
+	seen := make(map[int32]bool)
+	for _, k := range kinds {
+		for _, rcpt := range k.recipients {
+			var id int32
+			var ok bool
+			if rcpt.Username != "" {
+				id, ok = userIDs[rcpt.Username]
+			} else {
+				id, ok = groupIDs[rcpt.Groupname]
+			}
+			if !ok {
+				return nil, ErrRecipientNotFound
+			}
+			if seen[id] {
+				continue
+			}
+			seen[id] = true
+			out = append(out, models.MessageRecipient{RecipientID: id, Kind: k.kind})
+		}
+	}
+	if len(out) == 0 {
+		return nil, ErrRecipientNotFound
+	}
+
+	return out, nil
+}
+
+// createWithRecipients stores msg, sent by sender, with its first recipient as
+// the primary recipient and with its attachments, announces it to mailbox
+// streams and webhooks once the transaction commits, and fills in its details
+// as sender sees them.
+func (r *MessageRepository) createWithRecipients(tx *gorm.DB, sender *models.User, msg *models.Message, recipients []models.MessageRecipient) error {
+	msg.RecipientID = recipients[0].RecipientID
+	if err := tx.Create(msg).Error; err != nil {
+		return translate(err, nil)
+	}
+
+	for i := range recipients {
+		recipients[i].MessageID = msg.ID
+	}
+	if err := tx.Create(&recipients).Error; err != nil {
+		return translate(err, nil)
+	}
+
+	if err := r.createAttachments(tx, msg); err != nil {
+		return err
+	}
+
+	ev := events.MessageEvent{
+		MessageID: msg.ID,
+		Re:        msg.Re,
+		SenderID:  msg.SenderID,
+	}
+	for _, rcpt := range recipients {
+		ev.Recipients = append(ev.Recipients, rcpt.RecipientID)
+	}
+	if err := events.Publish(tx, ev); err != nil {
+		return err
+	}
+
+	if err := r.resolveDetails(tx, sender, []*models.Message{msg}); err != nil {
+		return err
+	}
+
+	return r.createWebhookEvents(tx, msg, recipients)
+}
+
+// resolveNames fills in the sender and recipient names of messages with one
+// query per table, rather than one Read per message. Blind copies are only
+// listed for messages that viewer sent.
+func (r *MessageRepository) resolveNames(tx *gorm.DB, viewer *models.User, messages []*models.Message) error {
+	if len(messages) == 0 {
+		return nil
+	}
+
+	messageIDs := make([]int32, len(messages))
+	for i, msg := range messages {
+		messageIDs[i] = msg.ID
+	}
+
+	var recipients []models.MessageRecipient
+	if err := tx.Order("id").Find(&recipients, "message_id IN ?", messageIDs).Error; err != nil {
+		return err
+	}
+	byMessage := make(map[int32][]models.MessageRecipient, len(messages))
+	for _, rcpt := range recipients {
+		byMessage[rcpt.MessageID] = append(byMessage[rcpt.MessageID], rcpt)
+	}
+
+	var userIDs, groupIDs []int32
+	for _, msg := range messages {
+		userIDs = append(userIDs, msg.SenderID)
+	}
+	for _, rcpt := range recipients {
+		if IsUserID(rcpt.RecipientID) {
+			userIDs = append(userIDs, rcpt.RecipientID)
+		} else {
+			groupIDs = append(groupIDs, rcpt.RecipientID)
+		}
+	}
+
+	var users []models.User
+	if err := tx.Find(&users, "id IN ?", userIDs).Error; err != nil {
+		return err
+	}
+	usernames := make(map[int32]string, len(users))
+	for _, u := range users {
+		usernames[u.ID] = u.Name
+	}
+
+	groupnames := make(map[int32]string)
+	if len(groupIDs) > 0 {
+		var groups []models.Group
+		if err := tx.Find(&groups, "id IN ?", groupIDs).Error; err != nil {
+			return err
+		}
+		for _, g := range groups {
+			groupnames[g.ID] = g.Name
+		}
+	}
+
+	for _, msg := range messages {
+		msg.Sender = usernames[msg.SenderID]
+		msg.To, msg.Cc, msg.Bcc = nil, nil, nil
+		showBcc := viewer != nil && viewer.ID == msg.SenderID
+
+		for _, rcpt := range byMessage[msg.ID] {
+			var named models.Recipient
+			if IsUserID(rcpt.RecipientID) {
+				named = models.Recipient{Username: usernames[rcpt.RecipientID]}
+			} else {
+				named = models.Recipient{Groupname: groupnames[rcpt.RecipientID]}
+			}
+
+			switch rcpt.Kind {
+			case models.RecipientCc:
+				msg.Cc = append(msg.Cc, named)
+			case models.RecipientBcc:
+				if showBcc {
+					msg.Bcc = append(msg.Bcc, named)
+				}
+			default:
+				msg.To = append(msg.To, named)
+			}
+		}
+
+		switch {
+		case len(msg.To) > 0:
+			msg.Recipient = msg.To[0]
+		case len(msg.Cc) > 0:
+			msg.Recipient = msg.Cc[0]
+		case len(msg.Bcc) > 0:
+			msg.Recipient = msg.Bcc[0]
+		default:
+			msg.Recipient = models.Recipient{}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,125 @@
+package persistence
+
+import (
+	"context"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/benshields/messagebox/internal/pkg/config"
+	"github.com/benshields/messagebox/internal/pkg/models"
+)
+
+const (
+	BackendPostgres = "postgres"
+	BackendMemory   = "memory"
+)
+
+type UnknownBackendError struct {
+	Backend string
+}
+
+func (e UnknownBackendError) Error() string {
+	return "persistence.Setup() failed with unknown backend: " + e.Backend
+}
+
+type Users interface {
+	Register(ctx context.Context, user *models.User) (*models.User, *models.APIToken, error)
+	Read(ctx context.Context, user *models.User) (*models.User, error)
+	GetMailbox(ctx context.Context, user *models.User, query models.MailboxQuery) (*models.MessagePage, error)
+	SearchMailbox(ctx context.Context, user *models.User, query models.SearchQuery) (*models.SearchPage, error)
+	GetSent(ctx context.Context, user *models.User, query models.MailboxQuery) (*models.MessagePage, error)
+	GetMailboxSummary(ctx context.Context, user *models.User) (*models.MailboxSummary, error)
+	MarkRead(ctx context.Context, user *models.User, message *models.Message) error
+	MarkUnread(ctx context.Context, user *models.User, message *models.Message) error
+	GetMailboxMessage(ctx context.Context, user *models.User, message *models.Message) (*models.Message, error)
+	GetMailboxAfter(ctx context.Context, user *models.User, afterID int32, limit int) ([]*models.Message, error)
+}
+
+type Groups interface {
+	Create(ctx context.Context, group *models.Group) (*models.Group, error)
+	Read(ctx context.Context, group *models.Group) (*models.Group, error)
+	GetMembers(ctx context.Context, group *models.Group) ([]models.User, error)
+	IsMember(ctx context.Context, group *models.Group, user *models.User) (bool, error)
+	AddMember(ctx context.Context, group *models.Group, user *models.User) (*models.Group, error)
+	RemoveMember(ctx context.Context, group *models.Group, user *models.User) error
+	CountMessages(ctx context.Context, group *models.Group) (int64, error)
+}
+
+type Messages interface {
+	Create(ctx context.Context, composedMsg *models.ComposedMessage) (*models.Message, error)
+	Read(ctx context.Context, viewer *models.User, message *models.Message) (*models.Message, error)
+	CreateReply(ctx context.Context, message *models.Message) (*models.Message, error)
+	GetReplies(ctx context.Context, viewer *models.User, message *models.Message) ([]*models.Message, error)
+	CanRead(ctx context.Context, reader *models.User, message *models.Message) (bool, error)
+	GetThread(ctx context.Context, viewer *models.User, message *models.Message) ([]*models.ThreadMessage, error)
+}
+
+type Tokens interface {
+	Create(ctx context.Context, user *models.User) (*models.APIToken, error)
+	FindByUserID(ctx context.Context, user *models.User) ([]*models.APIToken, error)
+	Delete(ctx context.Context, user *models.User, token *models.APIToken) error
+	Authenticate(ctx context.Context, token string) (*models.User, error)
+}
+
+type Attachments interface {
+	Read(ctx context.Context, attachment *models.Attachment) (*models.Attachment, error)
+}
+
+type Webhooks interface {
+	Create(ctx context.Context, ownerID, creatorID int32, url string) (*models.Webhook, error)
+	FindByOwnerID(ctx context.Context, ownerID int32) ([]*models.Webhook, error)
+	Delete(ctx context.Context, ownerID int32, webhook *models.Webhook) error
+	FindDeliveries(ctx context.Context, ownerID int32, webhook *models.Webhook) ([]*models.WebhookDelivery, error)
+	ClaimDueEvents(ctx context.Context, limit int, lease time.Duration) ([]*models.PendingWebhookEvent, error)
+	RecordDelivery(ctx context.Context, event *models.PendingWebhookEvent, delivery *models.WebhookDelivery, delivered bool, retryAt *time.Time) error
+}
+
+// Health reports whether the backend can serve requests right now.
+type Health interface {
+	Ping(ctx context.Context) error
+}
+
+// Repositories is one complete storage backend. Every repository in it shares
+// the same underlying store.
+type Repositories struct {
+	Users       Users
+	Groups      Groups
+	Messages    Messages
+	Tokens      Tokens
+	Attachments Attachments
+	Webhooks    Webhooks
+	Health      Health
+}
+
+// Setup returns the repositories of the configured backend. The Postgres
+// backend expects db.Setup to have been called.
+func Setup(cfg config.StorageConfiguration, log *zap.Logger) (*Repositories, error) {
+	if log != nil {
+		sugar := log.Sugar()
+		defer sugar.Sync()
+		sugar.Debugw("persistence.Setup", "config", cfg)
+	}
+
+	switch cfg.Backend {
+	case "", BackendPostgres:
+		return NewPostgres(), nil
+	case BackendMemory:
+		return NewMemory(), nil
+	default:
+		return nil, UnknownBackendError{Backend: cfg.Backend}
+	}
+}
+
+// NewPostgres returns the repositories backed by the database from db.Get.
+func NewPostgres() *Repositories {
+	return &Repositories{
+		Users:       GetUserRepository(),
+		Groups:      GetGroupRepository(),
+		Messages:    GetMessageRepository(),
+		Tokens:      GetTokenRepository(),
+		Attachments: GetAttachmentRepository(),
+		Webhooks:    GetWebhookRepository(),
+		Health:      GetHealthRepository(),
+	}
+}
@@ -0,0 +1,118 @@
+package persistence
+
+import (
+	"context"
+	"encoding/base64"
+	"strconv"
+	"strings"
+
+	"gorm.io/gorm"
+
+	"github.com/benshields/messagebox/internal/pkg/db"
+	"github.com/benshields/messagebox/internal/pkg/models"
+)
+
+// searchFrom parses the search terms the way a web search box would, with
+// quoted phrases, "or" and "-" exclusions, and names the result query.
+const searchFrom = "messages, websearch_to_tsquery('english', ?) query"
+
+const searchRank = "ts_rank(messages.search, query)"
+
+// searchSnippet escapes the subject and body as HTML before marking the terms
+// in them, so that the snippet can be shown as HTML. The parser knows the
+// entities, so they neither match nor get cut in two.
+const searchSnippet = "ts_headline('english', " +
+	"replace(replace(replace(concat_ws(' ', messages.subject, messages.body), '&', '&amp;'), '<', '&lt;'), '>', '&gt;'), " +
+	"query, 'StartSel=<mark>, StopSel=</mark>, MaxFragments=2')"
+
+// snippetEscaper escapes text for a snippet as searchSnippet does.
+var snippetEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+// searchCursor marks a position in search results, which are ordered by
+// (rank, id) descending.
+type searchCursor struct {
+	Rank float32
+	ID   int32
+}
+
+func encodeSearchCursor(result *models.SearchResult) string {
+	raw := strconv.FormatFloat(float64(result.Rank), 'g', -1, 32) + "|" + strconv.FormatInt(int64(result.ID), 10)
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func decodeSearchCursor(s string) (searchCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return searchCursor{}, ErrInvalidCursor
+	}
+
+	parts := strings.SplitN(string(raw), "|", 2)
+	if len(parts) != 2 {
+		return searchCursor{}, ErrInvalidCursor
+	}
+
+	rank, err := strconv.ParseFloat(parts[0], 32)
+	if err != nil {
+		return searchCursor{}, ErrInvalidCursor
+	}
+	id, err := strconv.ParseInt(parts[1], 10, 32)
+	if err != nil {
+		return searchCursor{}, ErrInvalidCursor
+	}
+
+	return searchCursor{Rank: float32(rank), ID: int32(id)}, nil
+}
+
+// Search finds the messages visible to reader, those it sent and those
+// addressed to any of ids, whose subject or body match query.Q. Results come
+// best match first, with a snippet of the matching text.
+func (r *MessageRepository) Search(ctx context.Context, reader *models.User, ids []int32, query models.SearchQuery) (*models.SearchPage, error) {
+	results := make([]*models.SearchResult, 0)
+	limit := query.Limit
+	if limit <= 0 {
+		limit = DefaultPageLimit
+	}
+
+	err := db.Get().WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		filtered := tx.Table(searchFrom, query.Q).
+			Select("messages.*, "+searchRank+" AS rank, "+searchSnippet+" AS snippet").
+			Where("messages.search @@ query").
+			Where("(messages.sender = ? OR "+addressedToCondition+")", reader.ID, ids)
+
+		if query.Cursor != "" {
+			cur, err := decodeSearchCursor(query.Cursor)
+			if err != nil {
+				return err
+			}
+			// compare as real, the type ts_rank returns, so that ties match exactly
+			filtered = filtered.Where("("+searchRank+", messages.id) < (CAST(? AS real), ?)", cur.Rank, cur.ID)
+		}
+
+		if err := filtered.Order("rank DESC").Order("messages.id DESC").Limit(limit + 1).Scan(&results).Error; err != nil {
+			return err
+		}
+
+		messages := make([]*models.Message, len(results))
+		for i, result := range results {
+			messages[i] = &result.Message
+		}
+
+		if err := r.resolveUnread(tx, reader, messages); err != nil {
+			return err
+		}
+
+		return r.resolveDetails(tx, reader, messages)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	out := &models.SearchPage{
+		Messages: results,
+	}
+	if len(results) > limit {
+		out.Messages = results[:limit]
+		out.Next = encodeSearchCursor(out.Messages[limit-1])
+	}
+	return out, nil
+}
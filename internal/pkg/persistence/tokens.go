@@ -0,0 +1,97 @@
+package persistence
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+
+	"gorm.io/gorm"
+
+	"github.com/benshields/messagebox/internal/pkg/db"
+	"github.com/benshields/messagebox/internal/pkg/models"
+)
+
+const tokenPrefix = "mbx_"
+
+// HashToken returns the form in which a bearer token is stored.
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func newToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return tokenPrefix + base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+type TokenRepository struct{}
+
+var tokenRepository *TokenRepository
+
+func GetTokenRepository() *TokenRepository {
+	if tokenRepository == nil {
+		tokenRepository = &TokenRepository{}
+	}
+	return tokenRepository
+}
+
+// Create issues a new token for user. The returned token is the only copy of
+// the plain text token.
+func (r *TokenRepository) Create(ctx context.Context, user *models.User) (*models.APIToken, error) {
+	return r.create(db.Get().WithContext(ctx), user)
+}
+
+func (r *TokenRepository) create(tx *gorm.DB, user *models.User) (*models.APIToken, error) {
+	token, err := newToken()
+	if err != nil {
+		return nil, err
+	}
+
+	out := &models.APIToken{
+		UserID:    user.ID,
+		TokenHash: HashToken(token),
+	}
+	if err := tx.Select("UserID", "TokenHash").Create(out).Error; err != nil {
+		return nil, err
+	}
+	if err := tx.Take(out, "id = ?", out.ID).Error; err != nil {
+		return nil, err
+	}
+	out.Token = token
+
+	return out, nil
+}
+
+func (r *TokenRepository) FindByUserID(ctx context.Context, user *models.User) ([]*models.APIToken, error) {
+	tokens := make([]*models.APIToken, 0)
+	result := db.Get().WithContext(ctx).Order("id").Find(&tokens, "user_id = ?", user.ID)
+	return tokens, result.Error
+}
+
+func (r *TokenRepository) Delete(ctx context.Context, user *models.User, token *models.APIToken) error {
+	result := db.Get().WithContext(ctx).Where("id = ? AND user_id = ?", token.ID, user.ID).Delete(&models.APIToken{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrTokenNotFound
+	}
+	return nil
+}
+
+// Authenticate returns the user that token belongs to, or ErrTokenNotFound if
+// it belongs to nobody.
+func (r *TokenRepository) Authenticate(ctx context.Context, token string) (*models.User, error) {
+	var user models.User
+	result := db.Get().WithContext(ctx).Model(&models.User{}).
+		Select("users.*").
+		Joins("JOIN api_tokens ON api_tokens.user_id = users.id").
+		Where("api_tokens.token_hash = ?", HashToken(token)).
+		Take(&user)
+	return &user, translate(result.Error, ErrTokenNotFound)
+}
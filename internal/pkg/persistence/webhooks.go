@@ -0,0 +1,238 @@
+package persistence
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/benshields/messagebox/internal/pkg/db"
+	"github.com/benshields/messagebox/internal/pkg/models"
+)
+
+const (
+	webhookSecretPrefix = "whsec_"
+
+	// WebhookEventReceived is the event sent for each message received.
+	WebhookEventReceived = "message.received"
+
+	maxDeliveriesListed = 100
+)
+
+// subscribedCondition matches the webhooks still sent messages: those of
+// users, and those of groups whose creator is still a member.
+const subscribedCondition = "(webhooks.owner > 0 OR EXISTS (SELECT 1 FROM user_groups WHERE user_groups.group_id = webhooks.owner AND user_groups.user_id = webhooks.created_by))"
+
+func newWebhookSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return webhookSecretPrefix + hex.EncodeToString(b), nil
+}
+
+type WebhookRepository struct{}
+
+var webhookRepository *WebhookRepository
+
+func GetWebhookRepository() *WebhookRepository {
+	if webhookRepository == nil {
+		webhookRepository = &WebhookRepository{}
+	}
+	return webhookRepository
+}
+
+// Create subscribes url to the messages received by ownerID, a user or group
+// ID, on behalf of the user creatorID. The returned webhook is the only one to
+// include its secret.
+func (r *WebhookRepository) Create(ctx context.Context, ownerID, creatorID int32, url string) (*models.Webhook, error) {
+	secret, err := newWebhookSecret()
+	if err != nil {
+		return nil, err
+	}
+
+	out := &models.Webhook{
+		OwnerID:   ownerID,
+		CreatorID: creatorID,
+		URL:       url,
+		Secret:    secret,
+	}
+	err = db.Get().WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Select("OwnerID", "CreatorID", "URL", "Secret").Create(out).Error; err != nil {
+			return err
+		}
+		return tx.Take(out, "id = ?", out.ID).Error
+	})
+
+	return out, err
+}
+
+func (r *WebhookRepository) FindByOwnerID(ctx context.Context, ownerID int32) ([]*models.Webhook, error) {
+	webhooks := make([]*models.Webhook, 0)
+	result := db.Get().WithContext(ctx).Omit("Secret").Order("id").Find(&webhooks, "owner = ?", ownerID)
+	return webhooks, result.Error
+}
+
+func (r *WebhookRepository) Delete(ctx context.Context, ownerID int32, webhook *models.Webhook) error {
+	result := db.Get().WithContext(ctx).Where("id = ? AND owner = ?", webhook.ID, ownerID).Delete(&models.Webhook{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrWebhookNotFound
+	}
+	return nil
+}
+
+// FindDeliveries lists the most recent delivery attempts of a webhook, newest
+// first.
+func (r *WebhookRepository) FindDeliveries(ctx context.Context, ownerID int32, webhook *models.Webhook) ([]*models.WebhookDelivery, error) {
+	deliveries := make([]*models.WebhookDelivery, 0)
+	err := db.Get().WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Omit("Secret").Take(webhook, "id = ? AND owner = ?", webhook.ID, ownerID).Error; err != nil {
+			return translate(err, ErrWebhookNotFound)
+		}
+
+		return tx.Order("id DESC").Limit(maxDeliveriesListed).Find(&deliveries, "webhook_id = ?", webhook.ID).Error
+	})
+
+	return deliveries, err
+}
+
+// claimQuery leases up to limit due events by pushing their next attempt back,
+// so that other replicas skip them while they are being delivered.
+const claimQuery = `
+UPDATE webhook_events SET next_attempt_at = NOW() + CAST(? AS INTERVAL)
+FROM webhooks
+WHERE webhooks.id = webhook_events.webhook_id AND webhook_events.id IN (
+    SELECT id FROM webhook_events
+    WHERE delivered_at IS NULL AND failed_at IS NULL AND next_attempt_at <= NOW()
+    ORDER BY next_attempt_at
+    LIMIT ?
+    FOR UPDATE SKIP LOCKED
+)
+RETURNING webhook_events.*, webhooks.url, webhooks.secret`
+
+// ClaimDueEvents takes up to limit events that are due for delivery and leases
+// them to the caller for lease.
+func (r *WebhookRepository) ClaimDueEvents(ctx context.Context, limit int, lease time.Duration) ([]*models.PendingWebhookEvent, error) {
+	events := make([]*models.PendingWebhookEvent, 0)
+	result := db.Get().WithContext(ctx).Raw(claimQuery, strconv.FormatInt(lease.Milliseconds(), 10)+" milliseconds", limit).Scan(&events)
+	return events, result.Error
+}
+
+// RecordDelivery logs an attempt to deliver event. When the attempt did not
+// succeed, the event is retried at retryAt, or given up on if retryAt is nil.
+func (r *WebhookRepository) RecordDelivery(ctx context.Context, event *models.PendingWebhookEvent, delivery *models.WebhookDelivery, delivered bool, retryAt *time.Time) error {
+	return db.Get().WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		delivery.EventID = event.ID
+		delivery.WebhookID = event.WebhookID
+		delivery.Attempt = event.Attempts + 1
+		if err := tx.Create(delivery).Error; err != nil {
+			return translate(err, nil)
+		}
+
+		updates := map[string]interface{}{
+			"attempts": gorm.Expr("attempts + 1"),
+		}
+		switch {
+		case delivered:
+			updates["delivered_at"] = delivery.AttemptedAt
+		case retryAt != nil:
+			updates["next_attempt_at"] = *retryAt
+		default:
+			updates["failed_at"] = delivery.AttemptedAt
+		}
+		return tx.Model(&models.WebhookEvent{}).Where("id = ?", event.ID).Updates(updates).Error
+	})
+}
+
+// deliveredTo returns msg as Read shows it to ownerID, whose webhook it is
+// delivered to. Only the sender sees the blind copies, and the recipient that
+// stands for the others is never one of them.
+func deliveredTo(msg *models.Message, ownerID int32) models.Message {
+	delivered := *msg
+	if ownerID == msg.SenderID {
+		return delivered
+	}
+
+	delivered.Bcc = nil
+	switch {
+	case len(delivered.To) > 0:
+		delivered.Recipient = delivered.To[0]
+	case len(delivered.Cc) > 0:
+		delivered.Recipient = delivered.Cc[0]
+	default:
+		delivered.Recipient = models.Recipient{}
+	}
+	return delivered
+}
+
+// createWebhookEvents writes an outbox event for every subscribed webhook of
+// the recipients of msg, in the same transaction as msg itself.
+func (r *MessageRepository) createWebhookEvents(tx *gorm.DB, msg *models.Message, recipients []models.MessageRecipient) error {
+	ids := make([]int32, len(recipients))
+	for i, rcpt := range recipients {
+		ids[i] = rcpt.RecipientID
+	}
+
+	var webhooks []models.Webhook
+	if err := tx.Omit("Secret").Where(subscribedCondition).Find(&webhooks, "owner IN ?", ids).Error; err != nil {
+		return err
+	}
+	if len(webhooks) == 0 {
+		return nil
+	}
+
+	var userIDs, groupIDs []int32
+	for _, w := range webhooks {
+		if IsUserID(w.OwnerID) {
+			userIDs = append(userIDs, w.OwnerID)
+		} else {
+			groupIDs = append(groupIDs, w.OwnerID)
+		}
+	}
+	names := make(map[int32]models.Recipient)
+	if len(userIDs) > 0 {
+		var users []models.User
+		if err := tx.Find(&users, "id IN ?", userIDs).Error; err != nil {
+			return err
+		}
+		for _, u := range users {
+			names[u.ID] = models.Recipient{Username: u.Name}
+		}
+	}
+	if len(groupIDs) > 0 {
+		var groups []models.Group
+		if err := tx.Find(&groups, "id IN ?", groupIDs).Error; err != nil {
+			return err
+		}
+		for _, g := range groups {
+			names[g.ID] = models.Recipient{Groupname: g.Name}
+		}
+	}
+
+	events := make([]models.WebhookEvent, len(webhooks))
+	for i, w := range webhooks {
+		delivered := deliveredTo(msg, w.OwnerID)
+		payload, err := json.Marshal(models.WebhookPayload{
+			Event:     WebhookEventReceived,
+			Recipient: names[w.OwnerID],
+			Message:   &delivered,
+		})
+		if err != nil {
+			return err
+		}
+		events[i] = models.WebhookEvent{
+			WebhookID: w.ID,
+			MessageID: msg.ID,
+			Payload:   string(payload),
+		}
+	}
+
+	return tx.Create(&events).Error
+}
@@ -0,0 +1,51 @@
+package ratelimit
+
+import (
+	"context"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/benshields/messagebox/internal/pkg/db"
+)
+
+// PostgresStore keeps buckets in the rate_limit_buckets table of the database
+// from db.Get, so that every replica draws from the same buckets.
+type PostgresStore struct{}
+
+func NewPostgresStore() *PostgresStore {
+	return &PostgresStore{}
+}
+
+type bucketRow struct {
+	Tokens    float64
+	UpdatedAt time.Time
+}
+
+func (s *PostgresStore) Take(ctx context.Context, key string, limit Limit, now time.Time) (Result, error) {
+	var res Result
+	err := db.Get().WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		// the no-op update locks the row, whether it was just created or not,
+		// until the transaction ends, and returns it as it was
+		var b bucketRow
+		err := tx.Raw(`INSERT INTO rate_limit_buckets (key, tokens, updated_at) VALUES (?, ?, ?)
+			ON CONFLICT (key) DO UPDATE SET key = EXCLUDED.key
+			RETURNING tokens, updated_at`, key, float64(limit.Burst), now).Scan(&b).Error
+		if err != nil {
+			return err
+		}
+
+		var tokens float64
+		tokens, res = limit.take(b.Tokens, b.UpdatedAt, now)
+		if b.UpdatedAt.After(now) {
+			// another replica's clock is ahead; keep the later time
+			now = b.UpdatedAt
+		}
+		return tx.Exec(`UPDATE rate_limit_buckets SET tokens = ?, updated_at = ? WHERE key = ?`, tokens, now, key).Error
+	})
+	return res, err
+}
+
+func (s *PostgresStore) Sweep(ctx context.Context, before time.Time) error {
+	return db.Get().WithContext(ctx).Exec(`DELETE FROM rate_limit_buckets WHERE updated_at < ?`, before).Error
+}
@@ -0,0 +1,183 @@
+// Package ratelimit limits how often clients may act, with token buckets kept
+// in memory or in Postgres.
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/benshields/messagebox/internal/pkg/config"
+	"github.com/benshields/messagebox/internal/pkg/db"
+)
+
+const (
+	StoreMemory   = "memory"
+	StorePostgres = "postgres"
+)
+
+// Scope names what a bucket limits, and prefixes its key.
+type Scope string
+
+const (
+	PerIP     Scope = "ip"
+	PerSender Scope = "sender"
+	PerGroup  Scope = "group"
+)
+
+// sweepEvery is how many takes pass between removing idle buckets.
+const sweepEvery = 1024
+
+type UnknownStoreError struct {
+	Store string
+}
+
+func (e UnknownStoreError) Error() string {
+	return "ratelimit.Setup() failed with unknown store: " + e.Store
+}
+
+// Limit is a token bucket that holds up to Burst tokens and gains Rate tokens
+// a second. The zero Limit is off.
+type Limit struct {
+	Rate  float64
+	Burst int
+}
+
+// NewLimit returns the Limit configured by cfg.
+func NewLimit(cfg config.LimitConfiguration) Limit {
+	if cfg.Requests <= 0 || cfg.Per <= 0 {
+		return Limit{}
+	}
+	burst := cfg.Burst
+	if burst <= 0 {
+		burst = cfg.Requests
+	}
+	return Limit{Rate: float64(cfg.Requests) / cfg.Per.Seconds(), Burst: burst}
+}
+
+// Off reports whether the limit lets everything through.
+func (l Limit) Off() bool {
+	return l.Rate <= 0 || l.Burst <= 0
+}
+
+// fill returns how long an empty bucket takes to fill.
+func (l Limit) fill() time.Duration {
+	return time.Duration(float64(l.Burst) / l.Rate * float64(time.Second))
+}
+
+// take refills a bucket that held tokens when it was last updated, and takes a
+// token from it if it has one. It returns the tokens left.
+func (l Limit) take(tokens float64, updated, now time.Time) (float64, Result) {
+	if elapsed := now.Sub(updated).Seconds(); elapsed > 0 {
+		tokens = math.Min(float64(l.Burst), tokens+elapsed*l.Rate)
+	}
+
+	res := Result{Limit: l.Burst}
+	if tokens >= 1 {
+		tokens--
+		res.Allowed = true
+	} else {
+		res.RetryAfter = l.wait(1 - tokens)
+	}
+	res.Remaining = int(tokens)
+	res.Reset = l.wait(float64(l.Burst) - tokens)
+	return tokens, res
+}
+
+// wait returns how long the bucket takes to gain tokens.
+func (l Limit) wait(tokens float64) time.Duration {
+	return time.Duration(math.Ceil(tokens / l.Rate * float64(time.Second)))
+}
+
+// Result is the outcome of taking a token from a bucket. Reset is how long
+// the bucket takes to fill again, and RetryAfter, when the token was refused,
+// how long until there is one.
+type Result struct {
+	Allowed    bool
+	Limit      int
+	Remaining  int
+	Reset      time.Duration
+	RetryAfter time.Duration
+}
+
+// Store keeps token buckets by key.
+type Store interface {
+	// Take refills the bucket of key for limit and takes a token from it, if
+	// it has one. A bucket that does not exist yet starts full.
+	Take(ctx context.Context, key string, limit Limit, now time.Time) (Result, error)
+	// Sweep removes the buckets that have not been used since before.
+	Sweep(ctx context.Context, before time.Time) error
+}
+
+// Limiter applies the configured limit of each scope.
+type Limiter struct {
+	store  Store
+	limits map[Scope]Limit
+	takes  uint64
+}
+
+func Setup(cfg config.RateLimitConfiguration, log *zap.Logger) (*Limiter, error) {
+	if log != nil {
+		sugar := log.Sugar()
+		defer sugar.Sync()
+		sugar.Debugw("ratelimit.Setup", "config", cfg)
+	}
+
+	var store Store
+	switch cfg.Store {
+	case "", StoreMemory:
+		store = NewMemoryStore()
+	case StorePostgres:
+		if db.Get() == nil {
+			return nil, db.ErrNotSetup
+		}
+		store = NewPostgresStore()
+	default:
+		return nil, UnknownStoreError{Store: cfg.Store}
+	}
+
+	return New(store, map[Scope]Limit{
+		PerIP:     NewLimit(cfg.PerIP),
+		PerSender: NewLimit(cfg.PerSender),
+		PerGroup:  NewLimit(cfg.PerGroup),
+	}), nil
+}
+
+// New returns a Limiter that keeps its buckets in store. Scopes without a
+// limit are not limited.
+func New(store Store, limits map[Scope]Limit) *Limiter {
+	return &Limiter{store: store, limits: limits}
+}
+
+// Take takes a token from the bucket of key in scope. When the scope is not
+// limited, the token is granted with a zero Result.Limit.
+func (l *Limiter) Take(ctx context.Context, scope Scope, key string) (Result, error) {
+	limit := l.limits[scope]
+	if limit.Off() {
+		return Result{Allowed: true}, nil
+	}
+
+	now := time.Now()
+	if atomic.AddUint64(&l.takes, 1)%sweepEvery == 0 {
+		// a bucket left alone for as long as the slowest fills is full, and
+		// no different from one that does not exist
+		if err := l.store.Sweep(ctx, now.Add(-l.longestFill())); err != nil {
+			return Result{}, err
+		}
+	}
+
+	return l.store.Take(ctx, string(scope)+":"+key, limit, now)
+}
+
+func (l *Limiter) longestFill() time.Duration {
+	var longest time.Duration
+	for _, limit := range l.limits {
+		if !limit.Off() && limit.fill() > longest {
+			longest = limit.fill()
+		}
+	}
+	return longest
+}
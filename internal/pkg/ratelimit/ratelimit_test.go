@@ -0,0 +1,82 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/benshields/messagebox/internal/pkg/config"
+)
+
+func TestNewLimit(t *testing.T) {
+	assert.Equal(t, Limit{Rate: 0.5, Burst: 30}, NewLimit(config.LimitConfiguration{Requests: 30, Per: time.Minute}))
+	assert.Equal(t, Limit{Rate: 0.5, Burst: 5}, NewLimit(config.LimitConfiguration{Requests: 30, Per: time.Minute, Burst: 5}))
+	assert.True(t, NewLimit(config.LimitConfiguration{}).Off())
+	assert.True(t, NewLimit(config.LimitConfiguration{Requests: 30}).Off())
+}
+
+func TestMemoryStoreTake(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemoryStore()
+	limit := Limit{Rate: 1, Burst: 2}
+	now := time.Now()
+
+	res, err := s.Take(ctx, "sender:yoshi", limit, now)
+	assert.NoError(t, err)
+	assert.Equal(t, Result{Allowed: true, Limit: 2, Remaining: 1, Reset: time.Second}, res)
+
+	res, _ = s.Take(ctx, "sender:yoshi", limit, now)
+	assert.Equal(t, Result{Allowed: true, Limit: 2, Remaining: 0, Reset: 2 * time.Second}, res)
+
+	res, _ = s.Take(ctx, "sender:yoshi", limit, now.Add(500*time.Millisecond))
+	assert.Equal(t, Result{Allowed: false, Limit: 2, Remaining: 0, Reset: 1500 * time.Millisecond, RetryAfter: 500 * time.Millisecond}, res)
+
+	// other keys have buckets of their own
+	res, _ = s.Take(ctx, "sender:mario", limit, now)
+	assert.True(t, res.Allowed)
+
+	// the bucket refills, but no further than its burst
+	res, _ = s.Take(ctx, "sender:yoshi", limit, now.Add(time.Hour))
+	assert.Equal(t, Result{Allowed: true, Limit: 2, Remaining: 1, Reset: time.Second}, res)
+}
+
+func TestMemoryStoreSweep(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemoryStore()
+	limit := Limit{Rate: 1, Burst: 1}
+	now := time.Now()
+
+	_, _ = s.Take(ctx, "ip:old", limit, now.Add(-time.Hour))
+	_, _ = s.Take(ctx, "ip:new", limit, now)
+	assert.NoError(t, s.Sweep(ctx, now.Add(-time.Minute)))
+
+	assert.NotContains(t, s.buckets, "ip:old")
+	assert.Contains(t, s.buckets, "ip:new")
+}
+
+func TestLimiter(t *testing.T) {
+	ctx := context.Background()
+	l := New(NewMemoryStore(), map[Scope]Limit{PerSender: {Rate: 1, Burst: 1}})
+
+	res, err := l.Take(ctx, PerSender, "yoshi")
+	assert.NoError(t, err)
+	assert.True(t, res.Allowed)
+	res, _ = l.Take(ctx, PerSender, "yoshi")
+	assert.False(t, res.Allowed)
+
+	// scopes share no buckets, and scopes without a limit are not limited
+	for i := 0; i < 3; i++ {
+		res, _ = l.Take(ctx, PerGroup, "yoshi")
+		assert.Equal(t, Result{Allowed: true}, res)
+	}
+}
+
+func TestSetup(t *testing.T) {
+	_, err := Setup(config.RateLimitConfiguration{Store: StoreMemory}, nil)
+	assert.NoError(t, err)
+
+	_, err = Setup(config.RateLimitConfiguration{Store: "redis"}, nil)
+	assert.Equal(t, UnknownStoreError{Store: "redis"}, err)
+}
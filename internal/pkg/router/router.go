@@ -2,29 +2,121 @@ package router
 
 import (
 	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
 
 	"github.com/benshields/messagebox/internal/api/controllers"
 	"github.com/benshields/messagebox/internal/api/middleware"
+	"github.com/benshields/messagebox/internal/pkg/config"
+	"github.com/benshields/messagebox/internal/pkg/httperr"
+	"github.com/benshields/messagebox/internal/pkg/metrics"
+	"github.com/benshields/messagebox/internal/pkg/openapi"
+	"github.com/benshields/messagebox/internal/pkg/persistence"
+	"github.com/benshields/messagebox/internal/pkg/tracing"
 )
 
-func Setup() *gin.Engine {
+// SpecPath and DocsPath serve the OpenAPI document of the API and a page for
+// browsing it.
+const (
+	SpecPath = "/openapi.json"
+	DocsPath = "/docs"
+)
+
+// Setup registers every route. A nil services.Limiter leaves requests
+// unlimited, and a nil services.Metrics is replaced by metrics of its own.
+func Setup(cfg config.ServerConfiguration, repos *persistence.Repositories, services controllers.Services, log *zap.Logger) (*gin.Engine, error) {
+	if log == nil {
+		log = zap.NewNop()
+	}
+	sugar := log.Sugar()
+	defer sugar.Sync()
+	sugar.Debugw("router.Setup", "config", cfg)
+
+	httperr.RegisterFieldNames()
+
+	if services.Metrics == nil {
+		services.Metrics = metrics.New()
+	}
+
+	doc, err := openapi.Load()
+	if err != nil {
+		return nil, err
+	}
+	spec, err := openapi.SpecHandler(doc)
+	if err != nil {
+		return nil, err
+	}
+
 	r := gin.New()
 
+	// gin trusts every proxy unless told otherwise, which would let any client
+	// pick the IP that it is rate limited and logged by
+	if err := r.SetTrustedProxies(cfg.TrustedProxies); err != nil {
+		return nil, err
+	}
+
 	r.NoRoute(middleware.NoRouteHandler())
 	r.NoMethod(middleware.NoMethodHandler())
-	r.Use(gin.Recovery())
+	r.Use(tracing.Middleware(), middleware.RequestLogger(log, cfg.AccessLogSampling), services.Metrics.Middleware(), gin.Recovery())
+
+	if cfg.ValidateSpec && cfg.Mode == gin.DebugMode {
+		validate, err := openapi.Validator(doc, log)
+		if err != nil {
+			return nil, err
+		}
+		r.Use(validate)
+	}
+
+	r.GET(SpecPath, spec)
+	r.GET(DocsPath, openapi.DocsHandler(SpecPath))
+	r.GET("/metrics", services.Metrics.Handler())
+
+	auth := middleware.Authenticate(repos.Tokens, repos.Users)
+	self := middleware.RequireSelf()
+	canRead := middleware.AuthorizeMessage(repos.Messages)
+	member := middleware.RequireMember(repos.Groups)
+	sender := middleware.LimitSender(services.Limiter)
+
+	ctl := controllers.New(repos, services)
+
+	r.GET("/healthz", ctl.Healthz)
+	r.GET("/readyz", ctl.Readyz)
+
+	// probes, scrapes and docs are left unlimited
+	api := r.Group("/", middleware.LimitIP(services.Limiter))
 
-	r.POST("/users", controllers.CreateUser)
-	r.GET("/users/:username", controllers.GetUser)
-	r.GET("users/:username/mailbox", controllers.GetMailbox)
+	api.POST("/users", ctl.CreateUser)
+	api.GET("/users/:username", ctl.GetUser)
+	api.GET("users/:username/mailbox", auth, self, ctl.GetMailbox)
+	api.GET("/users/:username/mailbox/summary", auth, self, ctl.GetMailboxSummary)
+	api.GET("/users/:username/mailbox/search", auth, self, ctl.SearchMailbox)
+	api.GET("/users/:username/mailbox/stream", auth, self, ctl.StreamMailbox)
+	api.POST("/users/:username/mailbox/:id/read", auth, self, ctl.MarkRead)
+	api.POST("/users/:username/mailbox/:id/unread", auth, self, ctl.MarkUnread)
+	api.GET("/users/:username/sent", auth, self, ctl.GetSent)
+	api.DELETE("/users/:username/groups/:groupname", auth, self, ctl.LeaveGroup)
+	api.POST("/users/:username/tokens", auth, self, ctl.CreateToken)
+	api.GET("/users/:username/tokens", auth, self, ctl.GetTokens)
+	api.DELETE("/users/:username/tokens/:id", auth, self, ctl.DeleteToken)
+	api.POST("/users/:username/webhooks", auth, self, ctl.CreateWebhook)
+	api.GET("/users/:username/webhooks", auth, self, ctl.GetWebhooks)
+	api.DELETE("/users/:username/webhooks/:id", auth, self, ctl.DeleteWebhook)
+	api.GET("/users/:username/webhooks/:id/deliveries", auth, self, ctl.GetWebhookDeliveries)
 
-	r.POST("/groups", controllers.CreateGroup)
-	r.GET("/groups/:groupname", controllers.GetGroup)
+	api.POST("/groups", auth, ctl.CreateGroup)
+	api.GET("/groups/:groupname", ctl.GetGroup)
+	api.POST("/groups/:groupname/members", auth, member, ctl.AddGroupMember)
+	api.DELETE("/groups/:groupname/members/:username", auth, member, ctl.RemoveGroupMember)
+	api.POST("/groups/:groupname/webhooks", auth, member, ctl.CreateWebhook)
+	api.GET("/groups/:groupname/webhooks", auth, member, ctl.GetWebhooks)
+	api.DELETE("/groups/:groupname/webhooks/:id", auth, member, ctl.DeleteWebhook)
+	api.GET("/groups/:groupname/webhooks/:id/deliveries", auth, member, ctl.GetWebhookDeliveries)
 
-	r.POST("/messages", controllers.CreateMessage)
-	r.GET("/messages/:id", controllers.GetMessage)
-	r.POST("/messages/:id/replies", controllers.CreateReply)
-	r.GET("/messages/:id/replies", controllers.GetReplies)
+	api.POST("/messages", auth, sender, ctl.CreateMessage)
+	api.GET("/messages/:id", auth, canRead, ctl.GetMessage)
+	api.POST("/messages/:id/replies", auth, canRead, sender, ctl.CreateReply)
+	api.GET("/messages/:id/replies", auth, canRead, ctl.GetReplies)
+	api.GET("/messages/:id/thread", auth, canRead, ctl.GetThread)
+	api.GET("/messages/:id/attachments/:aid", auth, canRead, ctl.GetAttachment)
 
-	return r
+	return r, nil
 }
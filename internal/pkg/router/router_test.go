@@ -2,20 +2,54 @@ package router
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/gin-gonic/gin"
 	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
 	"gorm.io/gorm"
 
+	"github.com/benshields/messagebox/internal/api/controllers"
+	"github.com/benshields/messagebox/internal/api/middleware"
+	"github.com/benshields/messagebox/internal/pkg/blob"
 	"github.com/benshields/messagebox/internal/pkg/config"
 	"github.com/benshields/messagebox/internal/pkg/db"
+	"github.com/benshields/messagebox/internal/pkg/events"
 	"github.com/benshields/messagebox/internal/pkg/models"
+	"github.com/benshields/messagebox/internal/pkg/persistence"
+	"github.com/benshields/messagebox/internal/pkg/ratelimit"
+	"github.com/benshields/messagebox/internal/pkg/webhooks"
 )
 
+// setupRouter sets up the router for tests, without checking requests
+// against the OpenAPI spec.
+func setupRouter(t *testing.T, repos *persistence.Repositories) *gin.Engine {
+	return setupRouterWith(t, repos, controllers.Services{})
+}
+
+func setupRouterWith(t *testing.T, repos *persistence.Repositories, services controllers.Services) *gin.Engine {
+	router, err := Setup(config.ServerConfiguration{Mode: gin.TestMode}, repos, services, nil)
+	if err != nil {
+		t.Fatal("Setup() failed with:", err)
+	}
+	return router
+}
+
 func SeedDB(t *testing.T, conn *gorm.DB, seed string) {
 	reqs := strings.Split(strings.TrimSpace(seed), ";")
 	t.Log("seeding db")
@@ -64,24 +98,38 @@ func AssertMessageSliceEqual(t *testing.T, expected, actual []byte) {
 	}
 }
 
-func TestCreateUser(t *testing.T) {
-	dbCfg := config.DatabaseConfiguration{
-		DatabaseName: "messagebox",
-		User:         "messagebox_user",
-		Password:     "insecure",
-		Host:         "0.0.0.0",
-		Port:         "5432",
+func AssertMessagePageEqual(t *testing.T, expected, actual []byte) {
+	var exp, act struct {
+		Messages json.RawMessage `json:"messages"`
+		Next     string          `json:"next"`
 	}
+	err := json.Unmarshal(expected, &exp)
+	assert.NoError(t, err)
 
-	database, err := db.Setup(dbCfg, nil)
-	if err != nil {
-		t.Fatal("db.Setup() failed with:", err)
-	}
+	err = json.Unmarshal(actual, &act)
+	assert.NoError(t, err)
+
+	assert.Equal(t, exp.Next, act.Next)
+	AssertMessageSliceEqual(t, exp.Messages, act.Messages)
+}
+
+func AssertUserRegistered(t *testing.T, expected, actual []byte) {
+	var exp controllers.UserRegistered
+	err := json.Unmarshal(expected, &exp)
+	assert.NoError(t, err)
+
+	var act controllers.UserRegistered
+	err = json.Unmarshal(actual, &act)
+	assert.NoError(t, err)
+
+	assert.Equal(t, exp.Username, act.Username)
+	assert.NotEmpty(t, act.Token)
+}
 
+func TestCreateUser(t *testing.T) {
 	seed := `TRUNCATE users CASCADE;`
-	SeedDB(t, database, seed)
 
-	router := Setup()
+	router := setupRouter(t, setupRepos(t, seed))
 
 	cases := []struct {
 		name         string
@@ -111,19 +159,19 @@ func TestCreateUser(t *testing.T) {
 			name:         "Fail on duplicate",
 			req:          `{"username":"super.mario"}`,
 			expectedCode: http.StatusConflict,
-			expectedBody: `{"code":409,"message":"user with the same username already registered"}`,
+			expectedBody: `{"type":"urn:messagebox:problem:duplicate_name","title":"Conflict","status":409,"detail":"name is already taken","code":"duplicate_name"}`,
 		},
 		{
 			name:         "Fail on bad request",
 			req:          `{"oh_no":"bad request!"}`,
 			expectedCode: http.StatusBadRequest,
-			expectedBody: `{"code":400,"message":"invalid request"}`,
+			expectedBody: `{"type":"urn:messagebox:problem:invalid_request","title":"Bad Request","status":400,"detail":"invalid request","code":"invalid_request","errors":[{"field":"username","rule":"required","message":"username is required"}]}`,
 		},
 		{
 			name:         "Fail on too long",
 			req:          `{"username":"012345678901234567890123456789012"}`,
 			expectedCode: http.StatusBadRequest,
-			expectedBody: `{"code":400,"message":"invalid request"}`,
+			expectedBody: `{"type":"urn:messagebox:problem:invalid_request","title":"Bad Request","status":400,"detail":"invalid request","code":"invalid_request","errors":[{"field":"username","rule":"max","message":"username must be at most 32 characters long"}]}`,
 		},
 	}
 
@@ -134,26 +182,128 @@ func TestCreateUser(t *testing.T) {
 			rec := httptest.NewRecorder()
 			router.ServeHTTP(rec, req)
 			assert.Equal(t, tt.expectedCode, rec.Code)
-			assert.Equal(t, tt.expectedBody, rec.Body.String())
+
+			if tt.expectedCode == http.StatusCreated {
+				AssertUserRegistered(t, []byte(tt.expectedBody), rec.Body.Bytes())
+			} else {
+				assert.Equal(t, tt.expectedBody, rec.Body.String())
+			}
+
 			rec.Body.Reset()
 		})
 	}
 }
 
-func TestGetMailbox(t *testing.T) {
-	dbCfg := config.DatabaseConfiguration{
-		DatabaseName: "messagebox",
-		User:         "messagebox_user",
-		Password:     "insecure",
-		Host:         "0.0.0.0",
-		Port:         "5432",
+func TestTokens(t *testing.T) {
+	seed := `BEGIN;
+	TRUNCATE api_tokens RESTART IDENTITY CASCADE;
+	TRUNCATE users RESTART IDENTITY CASCADE;
+	INSERT INTO users (name) VALUES ('super.mario');
+	INSERT INTO users (name) VALUES ('luigi');
+	INSERT INTO api_tokens (user_id, token_hash) VALUES (1, encode(sha256('super.mario-token'), 'hex'));
+	INSERT INTO api_tokens (user_id, token_hash) VALUES (2, encode(sha256('luigi-token'), 'hex'));
+	COMMIT;`
+
+	router := setupRouter(t, setupRepos(t, seed))
+
+	cases := []struct {
+		name         string
+		verb         string
+		path         string
+		auth         string
+		expectedCode int
+		expectedBody string
+	}{
+		{
+			name:         "Create token - success",
+			verb:         http.MethodPost,
+			path:         "/users/super.mario/tokens",
+			auth:         "super.mario",
+			expectedCode: http.StatusCreated,
+		},
+		{
+			name:         "List tokens - success",
+			verb:         http.MethodGet,
+			path:         "/users/super.mario/tokens",
+			auth:         "super.mario",
+			expectedCode: http.StatusOK,
+		},
+		{
+			name:         "Create token - fail for another user",
+			verb:         http.MethodPost,
+			path:         "/users/luigi/tokens",
+			auth:         "super.mario",
+			expectedCode: http.StatusForbidden,
+			expectedBody: `{"type":"urn:messagebox:problem:forbidden","title":"Forbidden","status":403,"detail":"not permitted to act for another user","code":"forbidden"}`,
+		},
+		{
+			name:         "Create token - fail without token",
+			verb:         http.MethodPost,
+			path:         "/users/super.mario/tokens",
+			expectedCode: http.StatusUnauthorized,
+			expectedBody: `{"type":"urn:messagebox:problem:unauthorized","title":"Unauthorized","status":401,"detail":"missing bearer token","code":"unauthorized"}`,
+		},
+		{
+			name:         "Delete token - fail for another user's token",
+			verb:         http.MethodDelete,
+			path:         "/users/super.mario/tokens/2",
+			auth:         "super.mario",
+			expectedCode: http.StatusNotFound,
+			expectedBody: `{"type":"urn:messagebox:problem:token_not_found","title":"Not Found","status":404,"detail":"token ID does not exist","code":"token_not_found"}`,
+		},
+		{
+			name:         "Delete token - success",
+			verb:         http.MethodDelete,
+			path:         "/users/super.mario/tokens/1",
+			auth:         "super.mario",
+			expectedCode: http.StatusNoContent,
+			expectedBody: ``,
+		},
+		{
+			name:         "Deleted token - fail to authenticate",
+			verb:         http.MethodGet,
+			path:         "/users/super.mario/tokens",
+			auth:         "super.mario",
+			expectedCode: http.StatusUnauthorized,
+			expectedBody: `{"type":"urn:messagebox:problem:unauthorized","title":"Unauthorized","status":401,"detail":"invalid bearer token","code":"unauthorized"}`,
+		},
 	}
 
-	database, err := db.Setup(dbCfg, nil)
-	if err != nil {
-		t.Fatal("db.Setup() failed with:", err)
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(tt.verb, tt.path, nil)
+			assert.NoError(t, err)
+			if tt.auth != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.auth+"-token")
+			}
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+			assert.Equal(t, tt.expectedCode, rec.Code)
+
+			switch tt.expectedCode {
+			case http.StatusCreated:
+				var token models.APIToken
+				err := json.Unmarshal(rec.Body.Bytes(), &token)
+				assert.NoError(t, err)
+				assert.NotEmpty(t, token.Token)
+			case http.StatusOK:
+				var tokens []models.APIToken
+				err := json.Unmarshal(rec.Body.Bytes(), &tokens)
+				assert.NoError(t, err)
+				assert.Len(t, tokens, 2)
+				for _, token := range tokens {
+					assert.Empty(t, token.Token)
+				}
+			default:
+				assert.Equal(t, tt.expectedBody, rec.Body.String())
+			}
+
+			rec.Body.Reset()
+		})
 	}
+}
 
+func TestGetMailbox(t *testing.T) {
 	seed := `BEGIN;
 	TRUNCATE messages RESTART IDENTITY CASCADE;
 	TRUNCATE user_groups RESTART IDENTITY CASCADE;
@@ -178,13 +328,15 @@ func TestGetMailbox(t *testing.T) {
 	INSERT INTO messages (re, sender, recipient, subject, body) VALUES (0, 1, 5, 'hi', 'shy guy');
 	INSERT INTO messages (re, sender, recipient, subject, body, sent_at) VALUES (0, 5, 2, 'hi yoshi', 'from shy guy', '1994-12-31T00:00:05Z');
 	INSERT INTO messages (re, sender, recipient, subject, body, sent_at) VALUES (0, 4, -2, 'hi GOATs', 'from toad', '1994-12-31T00:00:02Z');
+	INSERT INTO api_tokens (user_id, token_hash) SELECT id, encode(sha256(convert_to(name || '-token', 'UTF8')), 'hex') FROM users;
+	INSERT INTO message_recipients (message_id, recipient, kind) SELECT id, recipient, 'to' FROM messages;
 	COMMIT;`
-	SeedDB(t, database, seed)
 
-	router := Setup()
+	router := setupRouter(t, setupRepos(t, seed))
 
 	cases := []struct {
 		name           string
+		auth           string
 		req            string
 		expectedCode   int
 		expectedBody   string
@@ -192,49 +344,61 @@ func TestGetMailbox(t *testing.T) {
 	}{
 		{
 			name:         "Success with no messages",
+			auth:         "toad",
 			req:          "toad",
 			expectedCode: http.StatusOK,
-			expectedBody: `[]`,
+			expectedBody: `{"messages":[]}`,
 		},
 		{
 			name:         "Success with 1 direct message",
+			auth:         "shy.guy",
 			req:          "shy.guy",
 			expectedCode: http.StatusOK,
-			expectedBody: `[
-				{"id":7,"sender":"super.mario","recipient":{"username":"shy.guy"},"subject":"hi","body":"shy guy","sentAt":"2019-09-03T17:12:42Z"}]`,
+			expectedBody: `{"messages":[
+				{"id":7,"sender":"super.mario","recipient":{"username":"shy.guy"},"to":[{"username":"shy.guy"}],"subject":"hi","body":"shy guy","sentAt":"2019-09-03T17:12:42Z","unread":true}]}`,
 		},
 		{
 			name:         "Success with 2 direct messages",
+			auth:         "super.mario",
 			req:          "super.mario",
 			expectedCode: http.StatusOK,
-			expectedBody: `[
-				{"id":3,"re":1,"sender":"luigi","recipient":{"username":"super.mario"},"subject":"re: hello","body":"use","sentAt":"2019-09-03T17:12:42Z"},
-				{"id":4,"re":1,"sender":"luigi","recipient":{"username":"super.mario"},"subject":"re: hello","body":"user*","sentAt":"2019-09-03T17:12:42Z"}]`,
+			expectedBody: `{"messages":[
+				{"id":3,"re":1,"sender":"luigi","recipient":{"username":"super.mario"},"to":[{"username":"super.mario"}],"subject":"re: hello","body":"use","sentAt":"2019-09-03T17:12:42Z","unread":true},
+				{"id":4,"re":1,"sender":"luigi","recipient":{"username":"super.mario"},"to":[{"username":"super.mario"}],"subject":"re: hello","body":"user*","sentAt":"2019-09-03T17:12:42Z","unread":true}]}`,
 		},
 		{
 			name:         "Success with 2 direct messages & 4 groups messages from 2 groups",
+			auth:         "Yoshi",
 			req:          "Yoshi",
 			expectedCode: http.StatusOK,
-			expectedBody: `[
-				{"id":5,"re":2,"sender":"luigi","recipient":{"groupname":"green"},"subject":"re: hello","body":"group","sentAt":"1994-12-31T00:00:01Z"},
-				{"id":9,"sender":"toad","recipient":{"groupname":"GOATs"},"subject":"hi GOATs","body":"from toad","sentAt":"1994-12-31T00:00:02Z"},
-				{"id":6,"re":2,"sender":"Yoshi","recipient":{"groupname":"green"},"subject":"re: hello","body":"group again","sentAt":"1994-12-31T00:00:03Z"},
-				{"id":1,"sender":"super.mario","recipient":{"username":"Yoshi"},"subject":"hello","body":"user","sentAt":"1994-12-31T00:00:04Z"},
-				{"id":8,"sender":"shy.guy","recipient":{"username":"Yoshi"},"subject":"hi yoshi","body":"from shy guy","sentAt":"1994-12-31T00:00:05Z"},
-				{"id":2,"sender":"super.mario","recipient":{"groupname":"green"},"subject":"hello","body":"group","sentAt":"1994-12-31T00:00:06Z"}]`,
+			expectedBody: `{"messages":[
+				{"id":5,"re":2,"sender":"luigi","recipient":{"groupname":"green"},"to":[{"groupname":"green"}],"subject":"re: hello","body":"group","sentAt":"1994-12-31T00:00:01Z","unread":true},
+				{"id":9,"sender":"toad","recipient":{"groupname":"GOATs"},"to":[{"groupname":"GOATs"}],"subject":"hi GOATs","body":"from toad","sentAt":"1994-12-31T00:00:02Z","unread":true},
+				{"id":6,"re":2,"sender":"Yoshi","recipient":{"groupname":"green"},"to":[{"groupname":"green"}],"subject":"re: hello","body":"group again","sentAt":"1994-12-31T00:00:03Z","unread":false},
+				{"id":1,"sender":"super.mario","recipient":{"username":"Yoshi"},"to":[{"username":"Yoshi"}],"subject":"hello","body":"user","sentAt":"1994-12-31T00:00:04Z","unread":true},
+				{"id":8,"sender":"shy.guy","recipient":{"username":"Yoshi"},"to":[{"username":"Yoshi"}],"subject":"hi yoshi","body":"from shy guy","sentAt":"1994-12-31T00:00:05Z","unread":true},
+				{"id":2,"sender":"super.mario","recipient":{"groupname":"green"},"to":[{"groupname":"green"}],"subject":"hello","body":"group","sentAt":"1994-12-31T00:00:06Z","unread":true}]}`,
 			expectOrdering: true,
 		},
 		{
 			name:         "Fail on no username",
+			auth:         "Yoshi",
 			req:          "",
-			expectedCode: http.StatusBadRequest,
-			expectedBody: `{"code":400,"message":"invalid request"}`,
+			expectedCode: http.StatusForbidden,
+			expectedBody: `{"type":"urn:messagebox:problem:forbidden","title":"Forbidden","status":403,"detail":"not permitted to act for another user","code":"forbidden"}`,
 		},
 		{
-			name:         "Fail on missing username",
-			req:          "bowser",
-			expectedCode: http.StatusNotFound,
-			expectedBody: `{"code":404,"message":"user with given username does not exist"}`,
+			name:         "Fail on another user's mailbox",
+			auth:         "Yoshi",
+			req:          "shy.guy",
+			expectedCode: http.StatusForbidden,
+			expectedBody: `{"type":"urn:messagebox:problem:forbidden","title":"Forbidden","status":403,"detail":"not permitted to act for another user","code":"forbidden"}`,
+		},
+		{
+			name:         "Fail on missing token",
+			req:          "Yoshi",
+			expectedCode: http.StatusUnauthorized,
+			expectedBody: `{"type":"urn:messagebox:problem:unauthorized","title":"Unauthorized","status":401,"detail":"missing bearer token","code":"unauthorized"}`,
 		},
 	}
 
@@ -242,19 +406,27 @@ func TestGetMailbox(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			req, err := http.NewRequest(http.MethodGet, "/users/"+tt.req+"/mailbox", nil)
 			assert.NoError(t, err)
+			if tt.auth != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.auth+"-token")
+			}
 			rec := httptest.NewRecorder()
 			router.ServeHTTP(rec, req)
 			assert.Equal(t, tt.expectedCode, rec.Code)
 
 			if tt.expectedCode == http.StatusOK {
 				// set expectedBody.sentAt to actual value
-				var expected []models.Message
-				err := json.Unmarshal([]byte(tt.expectedBody), &expected)
+				var expectedPage models.MessagePage
+				err := json.Unmarshal([]byte(tt.expectedBody), &expectedPage)
 				assert.NoError(t, err)
+				expected := expectedPage.Messages
 
-				var actual []models.Message
-				err = json.Unmarshal(rec.Body.Bytes(), &actual)
+				var actualPage models.MessagePage
+				err = json.Unmarshal(rec.Body.Bytes(), &actualPage)
 				assert.NoError(t, err)
+				actual := actualPage.Messages
+				if !assert.Len(t, actual, len(expected)) {
+					return
+				}
 
 				if tt.expectOrdering {
 					for i, exp := range expected {
@@ -284,125 +456,213 @@ func TestGetMailbox(t *testing.T) {
 	}
 }
 
-func TestCreateGroup(t *testing.T) {
-	dbCfg := config.DatabaseConfiguration{
-		DatabaseName: "messagebox",
-		User:         "messagebox_user",
-		Password:     "insecure",
-		Host:         "0.0.0.0",
-		Port:         "5432",
+func TestGetMailboxPagination(t *testing.T) {
+	seed := `BEGIN;
+	TRUNCATE messages RESTART IDENTITY CASCADE;
+	TRUNCATE user_groups RESTART IDENTITY CASCADE;
+	TRUNCATE groups RESTART IDENTITY CASCADE;
+	TRUNCATE users RESTART IDENTITY CASCADE;
+	INSERT INTO users (name) VALUES ('super.mario');
+	INSERT INTO users (name) VALUES ('Yoshi');
+	INSERT INTO groups (name) VALUES ('green');
+	INSERT INTO user_groups (group_id, user_id) VALUES (-1,2);
+	INSERT INTO messages (re, sender, recipient, subject, body, sent_at) VALUES (0, 1, 2, 'one', 'user', '1994-12-31T00:00:01Z');
+	INSERT INTO messages (re, sender, recipient, subject, body, sent_at) VALUES (0, 1, -1, 'two', 'group', '1994-12-31T00:00:02Z');
+	INSERT INTO messages (re, sender, recipient, subject, body, sent_at) VALUES (0, 1, 2, 'three', 'same time', '1994-12-31T00:00:03Z');
+	INSERT INTO messages (re, sender, recipient, subject, body, sent_at) VALUES (0, 1, -1, 'four', 'same time', '1994-12-31T00:00:03Z');
+	INSERT INTO messages (re, sender, recipient, subject, body, sent_at) VALUES (0, 1, 2, 'five', 'user', '1994-12-31T00:00:05Z');
+	INSERT INTO api_tokens (user_id, token_hash) SELECT id, encode(sha256(convert_to(name || '-token', 'UTF8')), 'hex') FROM users;
+	INSERT INTO message_recipients (message_id, recipient, kind) SELECT id, recipient, 'to' FROM messages;
+	COMMIT;`
+
+	router := setupRouter(t, setupRepos(t, seed))
+
+	getPage := func(t *testing.T, query string) (int, models.MessagePage) {
+		req, err := http.NewRequest(http.MethodGet, "/users/Yoshi/mailbox?"+query, nil)
+		assert.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer Yoshi-token")
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+
+		var page models.MessagePage
+		if rec.Code == http.StatusOK {
+			err = json.Unmarshal(rec.Body.Bytes(), &page)
+			assert.NoError(t, err)
+		}
+		return rec.Code, page
 	}
 
-	database, err := db.Setup(dbCfg, nil)
-	if err != nil {
-		t.Fatal("db.Setup() failed with:", err)
+	ids := func(page models.MessagePage) []int32 {
+		out := make([]int32, len(page.Messages))
+		for i, msg := range page.Messages {
+			out[i] = msg.ID
+		}
+		return out
 	}
 
+	t.Run("Success walking oldest first", func(t *testing.T) {
+		code, page := getPage(t, "limit=2")
+		assert.Equal(t, http.StatusOK, code)
+		assert.Equal(t, []int32{1, 2}, ids(page))
+		assert.NotEmpty(t, page.Next)
+
+		code, page = getPage(t, "limit=2&cursor="+page.Next)
+		assert.Equal(t, http.StatusOK, code)
+		assert.Equal(t, []int32{3, 4}, ids(page))
+		assert.NotEmpty(t, page.Next)
+
+		code, page = getPage(t, "limit=2&cursor="+page.Next)
+		assert.Equal(t, http.StatusOK, code)
+		assert.Equal(t, []int32{5}, ids(page))
+		assert.Empty(t, page.Next)
+	})
+
+	t.Run("Success walking newest first", func(t *testing.T) {
+		code, page := getPage(t, "limit=3&order=desc")
+		assert.Equal(t, http.StatusOK, code)
+		assert.Equal(t, []int32{5, 4, 3}, ids(page))
+		assert.NotEmpty(t, page.Next)
+
+		code, page = getPage(t, "limit=3&order=desc&cursor="+page.Next)
+		assert.Equal(t, http.StatusOK, code)
+		assert.Equal(t, []int32{2, 1}, ids(page))
+		assert.Empty(t, page.Next)
+	})
+
+	t.Run("Fail on invalid cursor", func(t *testing.T) {
+		code, _ := getPage(t, "cursor=not-a-cursor")
+		assert.Equal(t, http.StatusBadRequest, code)
+	})
+
+	t.Run("Fail on limit too large", func(t *testing.T) {
+		code, _ := getPage(t, "limit=101")
+		assert.Equal(t, http.StatusBadRequest, code)
+	})
+
+	t.Run("Fail on unknown order", func(t *testing.T) {
+		code, _ := getPage(t, "order=sideways")
+		assert.Equal(t, http.StatusBadRequest, code)
+	})
+}
+
+func TestSearchMailbox(t *testing.T) {
 	seed := `BEGIN;
+	TRUNCATE messages RESTART IDENTITY CASCADE;
 	TRUNCATE user_groups RESTART IDENTITY CASCADE;
 	TRUNCATE groups RESTART IDENTITY CASCADE;
 	TRUNCATE users RESTART IDENTITY CASCADE;
 	INSERT INTO users (name) VALUES ('super.mario');
 	INSERT INTO users (name) VALUES ('Yoshi');
 	INSERT INTO users (name) VALUES ('luigi');
+	INSERT INTO groups (name) VALUES ('green');
+	INSERT INTO user_groups (group_id, user_id) VALUES (-1,2);
+	INSERT INTO messages (re, sender, recipient, subject, body, sent_at) VALUES (0, 1, 2, 'pizza party', 'bring pizza and cake', '1994-12-31T00:00:01Z');
+	INSERT INTO messages (re, sender, recipient, subject, body, sent_at) VALUES (0, 1, -1, 'meeting', 'pizza for lunch', '1994-12-31T00:00:02Z');
+	INSERT INTO messages (re, sender, recipient, subject, body, sent_at) VALUES (0, 3, 1, 'pizza', 'just for mario', '1994-12-31T00:00:03Z');
+	INSERT INTO messages (re, sender, recipient, subject, body, sent_at) VALUES (0, 2, 3, 'cake recipe', 'flour and eggs', '1994-12-31T00:00:04Z');
+	INSERT INTO api_tokens (user_id, token_hash) SELECT id, encode(sha256(convert_to(name || '-token', 'UTF8')), 'hex') FROM users;
+	INSERT INTO message_recipients (message_id, recipient, kind) SELECT id, recipient, 'to' FROM messages;
 	COMMIT;`
-	SeedDB(t, database, seed)
 
-	router := Setup()
+	router := setupRouter(t, setupRepos(t, seed))
 
-	cases := []struct {
-		name         string
-		req          string
-		expectedCode int
-		expectedBody string
-	}{
-		{
-			name: "Success 1 user",
-			req: `{"groupname":"bros",
-					"usernames": [
-				  		"super.mario"
-					]}`,
-			expectedCode: http.StatusCreated,
-			expectedBody: `{"groupname":"bros","usernames":["super.mario"]}`,
-		},
-		{
-			name: "Success 2 users",
-			req: `{"groupname":"pals",
-					"usernames": [
-						"super.mario",
-						"Yoshi"
-					]}`,
-			expectedCode: http.StatusCreated,
-			expectedBody: `{"groupname":"pals","usernames":["super.mario","Yoshi"]}`,
-		},
-		{
-			name: "Fail on duplicate",
-			req: `{"groupname":"bros",
-					"usernames": [
-						"super.mario",
-						"luigi"
-					]}`,
-			expectedCode: http.StatusConflict,
-			expectedBody: `{"code":409,"message":"group with the same groupname already registered"}`,
-		},
-		{
-			name: "Fail on missing user",
-			req: `{"groupname":"dinos",
-					"usernames": [
-						"Yoshi",
-						"Barney"
-					]}`,
-			expectedCode: http.StatusNotFound,
-			expectedBody: `{"code":404,"message":"one or more users with given usernames do not exist"}`,
-		},
-		{
-			name: "Fail on bad request",
-			req: `{"oh_no":"no group name!",
-			"usernames": [
-				"luigi",
-				"Yoshi"
-			]}`,
-			expectedCode: http.StatusBadRequest,
-			expectedBody: `{"code":400,"message":"invalid request"}`,
-		},
-		{
-			name: "Fail on bad request",
-			req: `{"groupname":"012345678901234567890123456789012",
-			"usernames": [
-				"luigi",
-				"Yoshi"
-			]}`,
-			expectedCode: http.StatusBadRequest,
-			expectedBody: `{"code":400,"message":"invalid request"}`,
-		},
-	}
+	search := func(t *testing.T, auth, username, query string) (int, models.SearchPage) {
+		req, err := http.NewRequest(http.MethodGet, "/users/"+username+"/mailbox/search?"+query, nil)
+		assert.NoError(t, err)
+		if auth != "" {
+			req.Header.Set("Authorization", "Bearer "+auth+"-token")
+		}
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
 
-	for _, tt := range cases {
-		t.Run(tt.name, func(t *testing.T) {
-			req, err := http.NewRequest(http.MethodPost, "/groups", bytes.NewBufferString(tt.req))
+		var page models.SearchPage
+		if rec.Code == http.StatusOK {
+			err = json.Unmarshal(rec.Body.Bytes(), &page)
 			assert.NoError(t, err)
-			rec := httptest.NewRecorder()
-			router.ServeHTTP(rec, req)
-			assert.Equal(t, tt.expectedCode, rec.Code)
-			assert.Equal(t, tt.expectedBody, rec.Body.String())
-			rec.Body.Reset()
-		})
+		}
+		return rec.Code, page
 	}
-}
 
-func TestCreateMessage(t *testing.T) {
-	dbCfg := config.DatabaseConfiguration{
-		DatabaseName: "messagebox",
-		User:         "messagebox_user",
-		Password:     "insecure",
-		Host:         "0.0.0.0",
-		Port:         "5432",
+	ids := func(page models.SearchPage) []int32 {
+		out := make([]int32, len(page.Messages))
+		for i, result := range page.Messages {
+			out[i] = result.ID
+		}
+		return out
 	}
 
-	database, err := db.Setup(dbCfg, nil)
+	t.Run("Success matching subject and body", func(t *testing.T) {
+		code, page := search(t, "Yoshi", "Yoshi", "q=pizza")
+		assert.Equal(t, http.StatusOK, code)
+		assert.Equal(t, []int32{1, 2}, ids(page))
+		assert.Empty(t, page.Next)
+		for _, result := range page.Messages {
+			assert.Contains(t, result.Snippet, "<mark>pizza</mark>")
+			assert.Greater(t, result.Rank, float32(0))
+		}
+		assert.Equal(t, "super.mario", page.Messages[0].Sender)
+		assert.Equal(t, models.Recipient{Groupname: "green"}, page.Messages[1].Recipient)
+	})
+
+	t.Run("Success including sent messages", func(t *testing.T) {
+		code, page := search(t, "Yoshi", "Yoshi", "q=cake")
+		assert.Equal(t, http.StatusOK, code)
+		assert.Equal(t, []int32{4, 1}, ids(page))
+	})
+
+	t.Run("Success with no matches", func(t *testing.T) {
+		code, page := search(t, "Yoshi", "Yoshi", "q=mario")
+		assert.Equal(t, http.StatusOK, code)
+		assert.Empty(t, page.Messages)
+	})
+
+	t.Run("Success walking pages", func(t *testing.T) {
+		code, page := search(t, "Yoshi", "Yoshi", "q=pizza&limit=1")
+		assert.Equal(t, http.StatusOK, code)
+		assert.Equal(t, []int32{1}, ids(page))
+		assert.NotEmpty(t, page.Next)
+
+		code, page = search(t, "Yoshi", "Yoshi", "q=pizza&limit=1&cursor="+page.Next)
+		assert.Equal(t, http.StatusOK, code)
+		assert.Equal(t, []int32{2}, ids(page))
+		assert.Empty(t, page.Next)
+	})
+
+	t.Run("Fail on missing query", func(t *testing.T) {
+		code, _ := search(t, "Yoshi", "Yoshi", "")
+		assert.Equal(t, http.StatusBadRequest, code)
+	})
+
+	t.Run("Fail on invalid cursor", func(t *testing.T) {
+		code, _ := search(t, "Yoshi", "Yoshi", "q=pizza&cursor=not-a-cursor")
+		assert.Equal(t, http.StatusBadRequest, code)
+	})
+
+	t.Run("Fail on limit too large", func(t *testing.T) {
+		code, _ := search(t, "Yoshi", "Yoshi", "q=pizza&limit=101")
+		assert.Equal(t, http.StatusBadRequest, code)
+	})
+
+	t.Run("Fail on another user's mailbox", func(t *testing.T) {
+		code, _ := search(t, "Yoshi", "super.mario", "q=pizza")
+		assert.Equal(t, http.StatusForbidden, code)
+	})
+
+	t.Run("Fail on missing token", func(t *testing.T) {
+		code, _ := search(t, "", "Yoshi", "q=pizza")
+		assert.Equal(t, http.StatusUnauthorized, code)
+	})
+}
+
+func TestStreamMailbox(t *testing.T) {
+	requirePostgres(t)
+
+	hub, err := events.Setup(testDatabaseConfig, nil)
 	if err != nil {
-		t.Fatal("db.Setup() failed with:", err)
+		t.Fatal("events.Setup() failed with:", err)
 	}
+	defer hub.Close()
+	time.Sleep(500 * time.Millisecond) // let the hub start listening
 
 	seed := `BEGIN;
 	TRUNCATE messages RESTART IDENTITY CASCADE;
@@ -411,74 +671,1172 @@ func TestCreateMessage(t *testing.T) {
 	TRUNCATE users RESTART IDENTITY CASCADE;
 	INSERT INTO users (name) VALUES ('super.mario');
 	INSERT INTO users (name) VALUES ('Yoshi');
-	INSERT INTO users (name) VALUES ('luigi');
 	INSERT INTO groups (name) VALUES ('green');
 	INSERT INTO user_groups (group_id, user_id) VALUES (-1,2);
-	INSERT INTO user_groups (group_id, user_id) VALUES (-1,3);
+	INSERT INTO messages (re, sender, recipient, subject, body) VALUES (0, 1, 2, 'one', 'user');
+	INSERT INTO messages (re, sender, recipient, subject, body) VALUES (0, 2, 1, 'two', 'not for Yoshi');
+	INSERT INTO messages (re, sender, recipient, subject, body) VALUES (0, 1, -1, 'three', 'group');
+	INSERT INTO api_tokens (user_id, token_hash) SELECT id, encode(sha256(convert_to(name || '-token', 'UTF8')), 'hex') FROM users;
+	INSERT INTO message_recipients (message_id, recipient, kind) SELECT id, recipient, 'to' FROM messages;
 	COMMIT;`
-	SeedDB(t, database, seed)
 
-	router := Setup()
+	router := setupRouterWith(t, setupRepos(t, seed), controllers.Services{Events: hub})
 
-	cases := []struct {
-		name         string
-		req          string
-		expectedCode int
-		expectedBody string
-	}{
-		{
-			name: "Success with user recipient",
-			req: `{
-				"sender": "super.mario",
-				"recipient": {
-				  "username": "luigi"
-				},
-				"subject": "PR For MessageBox",
-				"body": "I have the first version of messagebox ready to review."
-			  }`,
-			expectedCode: http.StatusCreated,
-			expectedBody: `{"id":1,"sender":"super.mario","recipient":{"username":"luigi"},"subject":"PR For MessageBox","body":"I have the first version of messagebox ready to review.","sentAt":"2019-09-03T17:12:42Z"}`,
-		},
-		{
-			name: "Success with group recipient",
-			req: `{
-				"sender": "super.mario",
-				"recipient": {
-				  "groupname": "green"
-				},
-				"subject": "PR For MessageBox",
-				"body": "I have the first version of messagebox ready to review."
-			  }`,
-			expectedCode: http.StatusCreated,
-			expectedBody: `{"id":2,"sender":"super.mario","recipient":{"groupname":"green"},"subject":"PR For MessageBox","body":"I have the first version of messagebox ready to review.","sentAt":"2019-09-03T17:12:42Z"}`,
-		},
-		{
-			name: "Success with no body",
-			req: `{
-				"sender": "super.mario",
-				"recipient": {
-				  "groupname": "green"
-				},
-				"subject": "PR For MessageBox"
-			  }`,
-			expectedCode: http.StatusCreated,
-			expectedBody: `{"id":3,"sender":"super.mario","recipient":{"groupname":"green"},"subject":"PR For MessageBox","sentAt":"2019-09-03T17:12:42Z"}`,
-		},
-		{
-			name: "Fail on missing sender",
-			req: `{
-				"sender": "bowser",
-				"recipient": {
-				  "username": "luigi"
+	// stream runs a request against the stream until during has passed
+	stream := func(t *testing.T, query, lastEventID string, during func()) *httptest.ResponseRecorder {
+		ctx, cancel := context.WithCancel(context.Background())
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, "/users/Yoshi/mailbox/stream"+query, nil)
+		assert.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer Yoshi-token")
+		if lastEventID != "" {
+			req.Header.Set("Last-Event-ID", lastEventID)
+		}
+		rec := httptest.NewRecorder()
+
+		done := make(chan struct{})
+		go func() {
+			router.ServeHTTP(rec, req)
+			close(done)
+		}()
+
+		time.Sleep(200 * time.Millisecond)
+		during()
+		time.Sleep(500 * time.Millisecond)
+		cancel()
+		<-done
+		return rec
+	}
+	post := func(t *testing.T, path, body string) {
+		req, err := http.NewRequest(http.MethodPost, path, bytes.NewBufferString(body))
+		assert.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer super.mario-token")
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusCreated, rec.Code)
+	}
+
+	t.Run("Success catching up from Last-Event-ID", func(t *testing.T) {
+		defer func(lookback int32) { controllers.ResumeLookback = lookback }(controllers.ResumeLookback)
+		controllers.ResumeLookback = 0
+
+		rec := stream(t, "", "1", func() {})
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, "text/event-stream", rec.Header().Get("Content-Type"))
+		assert.NotContains(t, rec.Body.String(), "id: 1\n")
+		assert.NotContains(t, rec.Body.String(), "id: 2\n")
+		assert.Contains(t, rec.Body.String(), `id: 3
+event: message
+data: {"id":3,"sender":"super.mario","recipient":{"groupname":"green"},"to":[{"groupname":"green"}],"subject":"three","body":"group",`)
+	})
+
+	t.Run("Success catching up on messages committed after the last event", func(t *testing.T) {
+		// message 1 may have committed after message 3 was sent
+		rec := stream(t, "", "3", func() {})
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Contains(t, rec.Body.String(), "id: 1\nevent: message\n")
+		assert.NotContains(t, rec.Body.String(), "id: 2\n")
+		assert.Contains(t, rec.Body.String(), "id: 3\nevent: message\n")
+	})
+
+	t.Run("Success catching up from lastEventId", func(t *testing.T) {
+		rec := stream(t, "?lastEventId=0", "", func() {})
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.NotContains(t, rec.Body.String(), "id: 1\n")
+	})
+
+	t.Run("Success pushing new messages and replies", func(t *testing.T) {
+		rec := stream(t, "", "", func() {
+			post(t, "/messages", `{"to":[{"username":"Yoshi"}],"subject":"four"}`)
+			post(t, "/messages", `{"to":[{"username":"super.mario"}],"subject":"not for Yoshi"}`)
+			post(t, "/messages/3/replies", `{"subject":"re: three"}`)
+		})
+		assert.Equal(t, http.StatusOK, rec.Code)
+		body := rec.Body.String()
+		assert.Contains(t, body, "id: 4\nevent: message\n")
+		assert.NotContains(t, body, "id: 5\n")
+		assert.Contains(t, body, "id: 6\nevent: reply\n")
+		assert.NotContains(t, body, "id: 3\n")
+	})
+
+	t.Run("Success pushing messages that commit out of order", func(t *testing.T) {
+		var slowID int32
+		rec := stream(t, "", "", func() {
+			// the slow message takes its ID first, and commits last
+			tx := db.Get().Begin()
+			assert.NoError(t, tx.Raw(`INSERT INTO messages (re, sender, recipient, subject) VALUES (0, 1, 2, 'slow') RETURNING id`).Scan(&slowID).Error)
+			post(t, "/messages", `{"to":[{"username":"Yoshi"}],"subject":"fast"}`)
+			assert.NoError(t, tx.Exec(`INSERT INTO message_recipients (message_id, recipient, kind) VALUES (?, 2, 'to')`, slowID).Error)
+			assert.NoError(t, events.Publish(tx, events.MessageEvent{MessageID: slowID, SenderID: 1, Recipients: []int32{2}}))
+			assert.NoError(t, tx.Commit().Error)
+		})
+		body := rec.Body.String()
+		assert.Contains(t, body, "id: "+strconv.Itoa(int(slowID)+1)+"\nevent: message\n")
+		assert.Contains(t, body, "id: "+strconv.Itoa(int(slowID))+"\nevent: message\n")
+	})
+
+	t.Run("Success sending heartbeats", func(t *testing.T) {
+		defer func(interval time.Duration) { controllers.HeartbeatInterval = interval }(controllers.HeartbeatInterval)
+		controllers.HeartbeatInterval = 50 * time.Millisecond
+
+		rec := stream(t, "", "", func() {})
+		assert.Contains(t, rec.Body.String(), ": heartbeat\n\n")
+	})
+
+	t.Run("Fail on invalid Last-Event-ID", func(t *testing.T) {
+		req, err := http.NewRequest(http.MethodGet, "/users/Yoshi/mailbox/stream", nil)
+		assert.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer Yoshi-token")
+		req.Header.Set("Last-Event-ID", "yesterday")
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+		assert.Equal(t, `{"type":"urn:messagebox:problem:invalid_request","title":"Bad Request","status":400,"detail":"invalid Last-Event-ID","code":"invalid_request"}`, rec.Body.String())
+	})
+
+	t.Run("Fail on another user's stream", func(t *testing.T) {
+		req, err := http.NewRequest(http.MethodGet, "/users/super.mario/mailbox/stream", nil)
+		assert.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer Yoshi-token")
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusForbidden, rec.Code)
+	})
+}
+
+func TestWebhooks(t *testing.T) {
+	seed := `BEGIN;
+	TRUNCATE webhooks RESTART IDENTITY CASCADE;
+	TRUNCATE messages RESTART IDENTITY CASCADE;
+	TRUNCATE user_groups RESTART IDENTITY CASCADE;
+	TRUNCATE groups RESTART IDENTITY CASCADE;
+	TRUNCATE users RESTART IDENTITY CASCADE;
+	INSERT INTO users (name) VALUES ('super.mario');
+	INSERT INTO users (name) VALUES ('Yoshi');
+	INSERT INTO groups (name) VALUES ('green');
+	INSERT INTO user_groups (group_id, user_id) VALUES (-1,2);
+	INSERT INTO api_tokens (user_id, token_hash) SELECT id, encode(sha256(convert_to(name || '-token', 'UTF8')), 'hex') FROM users;
+	COMMIT;`
+
+	repos := setupRepos(t, seed)
+	// the test servers listen on loopback
+	router := setupRouterWith(t, repos, controllers.Services{WebhookGuard: webhooks.Guard{AllowPrivate: true}})
+
+	do := func(t *testing.T, method, path, token, body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, path, bytes.NewBufferString(body))
+		assert.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	var received []*http.Request
+	var bodies [][]byte
+	okServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		received = append(received, r)
+		bodies = append(bodies, body)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer okServer.Close()
+
+	failServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failServer.Close()
+
+	dispatcher := webhooks.NewDispatcher(config.WebhooksConfiguration{AllowPrivateAddresses: true}, repos.Webhooks, nil)
+
+	var secret string
+	t.Run("Success creating a webhook", func(t *testing.T) {
+		rec := do(t, http.MethodPost, "/users/Yoshi/webhooks", "Yoshi-token", `{"url":"`+okServer.URL+`"}`)
+		assert.Equal(t, http.StatusCreated, rec.Code)
+
+		var out models.Webhook
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &out))
+		assert.Equal(t, int32(1), out.ID)
+		assert.Equal(t, okServer.URL, out.URL)
+		assert.True(t, strings.HasPrefix(out.Secret, "whsec_"))
+		secret = out.Secret
+	})
+
+	t.Run("Success listing webhooks without their secrets", func(t *testing.T) {
+		rec := do(t, http.MethodGet, "/users/Yoshi/webhooks", "Yoshi-token", "")
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Contains(t, rec.Body.String(), `"url":"`+okServer.URL+`"`)
+		assert.NotContains(t, rec.Body.String(), "secret")
+	})
+
+	t.Run("Success delivering a signed message", func(t *testing.T) {
+		rec := do(t, http.MethodPost, "/messages", "super.mario-token", `{"to":[{"username":"Yoshi"}],"subject":"hook"}`)
+		assert.Equal(t, http.StatusCreated, rec.Code)
+
+		n, err := dispatcher.RunOnce(context.Background())
+		assert.NoError(t, err)
+		assert.Equal(t, 1, n)
+
+		if assert.Len(t, received, 1) {
+			req := received[0]
+			assert.Equal(t, "message.received", req.Header.Get(webhooks.EventHeader))
+			assert.Equal(t, "1", req.Header.Get(webhooks.DeliveryHeader))
+
+			signature := req.Header.Get(webhooks.SignatureHeader)
+			ts, err := strconv.ParseInt(strings.TrimPrefix(strings.Split(signature, ",")[0], "t="), 10, 64)
+			assert.NoError(t, err)
+			assert.Equal(t, webhooks.Sign(secret, time.Unix(ts, 0), bodies[0]), signature)
+			assert.Contains(t, string(bodies[0]), `"recipient":{"username":"Yoshi"}`)
+			assert.Contains(t, string(bodies[0]), `"subject":"hook"`)
+		}
+
+		n, err = dispatcher.RunOnce(context.Background())
+		assert.NoError(t, err)
+		assert.Equal(t, 0, n)
+
+		rec = do(t, http.MethodGet, "/users/Yoshi/webhooks/1/deliveries", "Yoshi-token", "")
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Contains(t, rec.Body.String(), `"eventId":1,"attempt":1,"statusCode":204`)
+	})
+
+	t.Run("Success scheduling a retry after a failed delivery", func(t *testing.T) {
+		rec := do(t, http.MethodPost, "/groups/green/webhooks", "Yoshi-token", `{"url":"`+failServer.URL+`"}`)
+		assert.Equal(t, http.StatusCreated, rec.Code)
+
+		rec = do(t, http.MethodPost, "/messages", "super.mario-token", `{"to":[{"groupname":"green"}],"subject":"hook"}`)
+		assert.Equal(t, http.StatusCreated, rec.Code)
+
+		n, err := dispatcher.RunOnce(context.Background())
+		assert.NoError(t, err)
+		assert.Equal(t, 1, n)
+
+		// not due again until after the backoff
+		n, err = dispatcher.RunOnce(context.Background())
+		assert.NoError(t, err)
+		assert.Equal(t, 0, n)
+
+		rec = do(t, http.MethodGet, "/groups/green/webhooks/2/deliveries", "Yoshi-token", "")
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Contains(t, rec.Body.String(), `"attempt":1,"statusCode":500`)
+	})
+
+	t.Run("Fail on a group the user is not a member of", func(t *testing.T) {
+		rec := do(t, http.MethodGet, "/groups/green/webhooks", "super.mario-token", "")
+		assert.Equal(t, http.StatusForbidden, rec.Code)
+		assert.Equal(t, `{"type":"urn:messagebox:problem:forbidden","title":"Forbidden","status":403,"detail":"not a member of the group","code":"forbidden"}`, rec.Body.String())
+	})
+
+	t.Run("Fail on a private URL", func(t *testing.T) {
+		router := setupRouter(t, repos)
+		req, err := http.NewRequest(http.MethodPost, "/users/Yoshi/webhooks", bytes.NewBufferString(`{"url":"http://169.254.169.254/latest/meta-data"}`))
+		assert.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer Yoshi-token")
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+		assert.Equal(t, `{"type":"urn:messagebox:problem:invalid_request","title":"Bad Request","status":400,"detail":"invalid request","code":"invalid_request","errors":[{"field":"url","rule":"url","message":"url must not be a loopback, link-local or private address"}]}`, rec.Body.String())
+	})
+
+	t.Run("Fail on a non-HTTP URL", func(t *testing.T) {
+		rec := do(t, http.MethodPost, "/users/Yoshi/webhooks", "Yoshi-token", `{"url":"ftp://example.com/hook"}`)
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+	})
+
+	t.Run("Fail on another user's webhook", func(t *testing.T) {
+		rec := do(t, http.MethodDelete, "/users/super.mario/webhooks/1", "super.mario-token", "")
+		assert.Equal(t, http.StatusNotFound, rec.Code)
+		assert.Equal(t, `{"type":"urn:messagebox:problem:webhook_not_found","title":"Not Found","status":404,"detail":"webhook ID does not exist","code":"webhook_not_found"}`, rec.Body.String())
+	})
+
+	t.Run("Success deleting a webhook", func(t *testing.T) {
+		rec := do(t, http.MethodDelete, "/users/Yoshi/webhooks/1", "Yoshi-token", "")
+		assert.Equal(t, http.StatusNoContent, rec.Code)
+
+		rec = do(t, http.MethodDelete, "/users/Yoshi/webhooks/1", "Yoshi-token", "")
+		assert.Equal(t, http.StatusNotFound, rec.Code)
+	})
+	t.Run("Success sending nothing to a group webhook once its creator leaves", func(t *testing.T) {
+		rec := do(t, http.MethodPost, "/groups/green/webhooks", "Yoshi-token", `{"url":"`+okServer.URL+`"}`)
+		assert.Equal(t, http.StatusCreated, rec.Code)
+
+		rec = do(t, http.MethodDelete, "/users/Yoshi/groups/green", "Yoshi-token", "")
+		assert.Equal(t, http.StatusNoContent, rec.Code)
+
+		rec = do(t, http.MethodPost, "/messages", "super.mario-token", `{"to":[{"groupname":"green"}],"subject":"hook"}`)
+		assert.Equal(t, http.StatusCreated, rec.Code)
+
+		n, err := dispatcher.RunOnce(context.Background())
+		assert.NoError(t, err)
+		assert.Equal(t, 0, n)
+		assert.Len(t, received, 1)
+	})
+}
+
+func TestWebhooksHideBlindCopies(t *testing.T) {
+	seed := `BEGIN;
+	TRUNCATE webhooks RESTART IDENTITY CASCADE;
+	TRUNCATE messages RESTART IDENTITY CASCADE;
+	TRUNCATE users RESTART IDENTITY CASCADE;
+	INSERT INTO users (name) VALUES ('alice');
+	INSERT INTO users (name) VALUES ('bob');
+	INSERT INTO users (name) VALUES ('carol');
+	INSERT INTO api_tokens (user_id, token_hash) SELECT id, encode(sha256(convert_to(name || '-token', 'UTF8')), 'hex') FROM users;
+	COMMIT;`
+
+	repos := setupRepos(t, seed)
+	// the test server listens on loopback
+	router := setupRouterWith(t, repos, controllers.Services{WebhookGuard: webhooks.Guard{AllowPrivate: true}})
+
+	do := func(path, token, body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(http.MethodPost, path, bytes.NewBufferString(body))
+		assert.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	bodies := map[string]string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		bodies[r.URL.Path] = string(body)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	for _, name := range []string{"bob", "carol"} {
+		rec := do("/users/"+name+"/webhooks", name+"-token", `{"url":"`+server.URL+`/`+name+`"}`)
+		assert.Equal(t, http.StatusCreated, rec.Code)
+	}
+	rec := do("/messages", "alice-token", `{"bcc":[{"username":"bob"},{"username":"carol"}],"subject":"surprise"}`)
+	assert.Equal(t, http.StatusCreated, rec.Code)
+
+	dispatcher := webhooks.NewDispatcher(config.WebhooksConfiguration{AllowPrivateAddresses: true}, repos.Webhooks, nil)
+	n, err := dispatcher.RunOnce(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+
+	for name, other := range map[string]string{"bob": "carol", "carol": "bob"} {
+		body := bodies["/"+name]
+		assert.Contains(t, body, `"recipient":{"username":"`+name+`"}`)
+		assert.Contains(t, body, `"subject":"surprise"`)
+		assert.NotContains(t, body, other)
+		assert.NotContains(t, body, "bcc")
+	}
+}
+
+func TestMailboxReceipts(t *testing.T) {
+	seed := `BEGIN;
+	TRUNCATE messages RESTART IDENTITY CASCADE;
+	TRUNCATE user_groups RESTART IDENTITY CASCADE;
+	TRUNCATE groups RESTART IDENTITY CASCADE;
+	TRUNCATE users RESTART IDENTITY CASCADE;
+	INSERT INTO users (name) VALUES ('super.mario');
+	INSERT INTO users (name) VALUES ('Yoshi');
+	INSERT INTO users (name) VALUES ('luigi');
+	INSERT INTO groups (name) VALUES ('green');
+	INSERT INTO user_groups (group_id, user_id) VALUES (-1,2);
+	INSERT INTO user_groups (group_id, user_id) VALUES (-1,3);
+	INSERT INTO messages (re, sender, recipient, subject, body, sent_at) VALUES (0, 1, 2, 'hello', 'user', '1994-12-31T00:00:01Z');
+	INSERT INTO messages (re, sender, recipient, subject, body, sent_at) VALUES (0, 1, -1, 'hello', 'group', '1994-12-31T00:00:02Z');
+	INSERT INTO messages (re, sender, recipient, subject, body, sent_at) VALUES (2, 2, -1, 're: hello', 'group', '1994-12-31T00:00:03Z');
+	INSERT INTO api_tokens (user_id, token_hash) SELECT id, encode(sha256(convert_to(name || '-token', 'UTF8')), 'hex') FROM users;
+	INSERT INTO message_recipients (message_id, recipient, kind) SELECT id, recipient, 'to' FROM messages;
+	COMMIT;`
+
+	router := setupRouter(t, setupRepos(t, seed))
+
+	cases := []struct {
+		name         string
+		auth         string
+		verb         string
+		path         string
+		expectedCode int
+		expectedBody string
+	}{
+		{
+			name:         "Summary before reading",
+			auth:         "Yoshi",
+			verb:         http.MethodGet,
+			path:         "/users/Yoshi/mailbox/summary",
+			expectedCode: http.StatusOK,
+			expectedBody: `{"total":3,"unread":2}`,
+		},
+		{
+			name:         "Mark direct message read",
+			auth:         "Yoshi",
+			verb:         http.MethodPost,
+			path:         "/users/Yoshi/mailbox/1/read",
+			expectedCode: http.StatusNoContent,
+			expectedBody: ``,
+		},
+		{
+			name:         "Mark direct message read twice",
+			auth:         "Yoshi",
+			verb:         http.MethodPost,
+			path:         "/users/Yoshi/mailbox/1/read",
+			expectedCode: http.StatusNoContent,
+			expectedBody: ``,
+		},
+		{
+			name:         "Mark group message read for one member",
+			auth:         "Yoshi",
+			verb:         http.MethodPost,
+			path:         "/users/Yoshi/mailbox/2/read",
+			expectedCode: http.StatusNoContent,
+			expectedBody: ``,
+		},
+		{
+			name:         "Summary after reading",
+			auth:         "Yoshi",
+			verb:         http.MethodGet,
+			path:         "/users/Yoshi/mailbox/summary",
+			expectedCode: http.StatusOK,
+			expectedBody: `{"total":3,"unread":0}`,
+		},
+		{
+			name:         "Group message still unread for other member",
+			auth:         "luigi",
+			verb:         http.MethodGet,
+			path:         "/users/luigi/mailbox/summary",
+			expectedCode: http.StatusOK,
+			expectedBody: `{"total":2,"unread":2}`,
+		},
+		{
+			name:         "Mark direct message unread",
+			auth:         "Yoshi",
+			verb:         http.MethodPost,
+			path:         "/users/Yoshi/mailbox/1/unread",
+			expectedCode: http.StatusNoContent,
+			expectedBody: ``,
+		},
+		{
+			name:         "Unread filter",
+			auth:         "Yoshi",
+			verb:         http.MethodGet,
+			path:         "/users/Yoshi/mailbox?unread=true",
+			expectedCode: http.StatusOK,
+			expectedBody: `{"messages":[{"id":1,"sender":"super.mario","recipient":{"username":"Yoshi"},"to":[{"username":"Yoshi"}],"subject":"hello","body":"user","sentAt":"1994-12-31T00:00:01Z","unread":true}]}`,
+		},
+		{
+			name:         "Fail on message outside mailbox",
+			auth:         "luigi",
+			verb:         http.MethodPost,
+			path:         "/users/luigi/mailbox/1/read",
+			expectedCode: http.StatusNotFound,
+			expectedBody: `{"type":"urn:messagebox:problem:message_not_found","title":"Not Found","status":404,"detail":"message ID does not exist","code":"message_not_found"}`,
+		},
+		{
+			name:         "Fail on missing message",
+			auth:         "Yoshi",
+			verb:         http.MethodPost,
+			path:         "/users/Yoshi/mailbox/1234/read",
+			expectedCode: http.StatusNotFound,
+			expectedBody: `{"type":"urn:messagebox:problem:message_not_found","title":"Not Found","status":404,"detail":"message ID does not exist","code":"message_not_found"}`,
+		},
+		{
+			name:         "Fail on another user's mailbox",
+			auth:         "luigi",
+			verb:         http.MethodGet,
+			path:         "/users/Yoshi/mailbox/summary",
+			expectedCode: http.StatusForbidden,
+			expectedBody: `{"type":"urn:messagebox:problem:forbidden","title":"Forbidden","status":403,"detail":"not permitted to act for another user","code":"forbidden"}`,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(tt.verb, tt.path, nil)
+			assert.NoError(t, err)
+			if tt.auth != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.auth+"-token")
+			}
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+			assert.Equal(t, tt.expectedCode, rec.Code)
+
+			if strings.HasSuffix(tt.path, "unread=true") {
+				AssertMessagePageEqual(t, []byte(tt.expectedBody), rec.Body.Bytes())
+			} else {
+				assert.Equal(t, tt.expectedBody, rec.Body.String())
+			}
+
+			rec.Body.Reset()
+		})
+	}
+}
+
+func TestGetSent(t *testing.T) {
+	seed := `BEGIN;
+	TRUNCATE messages RESTART IDENTITY CASCADE;
+	TRUNCATE user_groups RESTART IDENTITY CASCADE;
+	TRUNCATE groups RESTART IDENTITY CASCADE;
+	TRUNCATE users RESTART IDENTITY CASCADE;
+	INSERT INTO users (name) VALUES ('super.mario');
+	INSERT INTO users (name) VALUES ('Yoshi');
+	INSERT INTO users (name) VALUES ('luigi');
+	INSERT INTO groups (name) VALUES ('green');
+	INSERT INTO user_groups (group_id, user_id) VALUES (-1,2);
+	INSERT INTO user_groups (group_id, user_id) VALUES (-1,3);
+	INSERT INTO messages (re, sender, recipient, subject, body, sent_at) VALUES (0, 1, 2, 'hello', 'user', '1994-12-31T00:00:01Z');
+	INSERT INTO messages (re, sender, recipient, subject, body, sent_at) VALUES (0, 1, -1, 'hello', 'group', '1994-12-31T00:00:02Z');
+	INSERT INTO messages (re, sender, recipient, subject, body, sent_at) VALUES (2, 2, -1, 're: hello', 'group', '1994-12-31T00:00:03Z');
+	INSERT INTO messages (re, sender, recipient, subject, body, sent_at) VALUES (0, 1, 3, 'hi', 'luigi', '1994-12-31T00:00:04Z');
+	INSERT INTO receipts (message_id, user_id) VALUES (2, 3);
+	INSERT INTO api_tokens (user_id, token_hash) SELECT id, encode(sha256(convert_to(name || '-token', 'UTF8')), 'hex') FROM users;
+	INSERT INTO message_recipients (message_id, recipient, kind) SELECT id, recipient, 'to' FROM messages;
+	COMMIT;`
+
+	router := setupRouter(t, setupRepos(t, seed))
+
+	cases := []struct {
+		name         string
+		auth         string
+		req          string
+		query        string
+		expectedCode int
+		expectedBody string
+	}{
+		{
+			name:         "Success with no sent messages",
+			auth:         "luigi",
+			req:          "luigi",
+			expectedCode: http.StatusOK,
+			expectedBody: `{"messages":[]}`,
+		},
+		{
+			name:         "Success with user and group recipients",
+			auth:         "super.mario",
+			req:          "super.mario",
+			expectedCode: http.StatusOK,
+			expectedBody: `{"messages":[
+				{"id":1,"sender":"super.mario","recipient":{"username":"Yoshi"},"to":[{"username":"Yoshi"}],"subject":"hello","body":"user","sentAt":"1994-12-31T00:00:01Z","unread":true},
+				{"id":2,"sender":"super.mario","recipient":{"groupname":"green"},"to":[{"groupname":"green"}],"subject":"hello","body":"group","sentAt":"1994-12-31T00:00:02Z","unread":false},
+				{"id":4,"sender":"super.mario","recipient":{"username":"luigi"},"to":[{"username":"luigi"}],"subject":"hi","body":"luigi","sentAt":"1994-12-31T00:00:04Z","unread":true}]}`,
+		},
+		{
+			name:         "Success newest first with limit",
+			auth:         "super.mario",
+			req:          "super.mario",
+			query:        "?order=desc&limit=1",
+			expectedCode: http.StatusOK,
+			expectedBody: `{"messages":[
+				{"id":4,"sender":"super.mario","recipient":{"username":"luigi"},"to":[{"username":"luigi"}],"subject":"hi","body":"luigi","sentAt":"1994-12-31T00:00:04Z","unread":true}]}`,
+		},
+		{
+			name:         "Success unread by recipients only",
+			auth:         "super.mario",
+			req:          "super.mario",
+			query:        "?unread=true",
+			expectedCode: http.StatusOK,
+			expectedBody: `{"messages":[
+				{"id":1,"sender":"super.mario","recipient":{"username":"Yoshi"},"to":[{"username":"Yoshi"}],"subject":"hello","body":"user","sentAt":"1994-12-31T00:00:01Z","unread":true},
+				{"id":4,"sender":"super.mario","recipient":{"username":"luigi"},"to":[{"username":"luigi"}],"subject":"hi","body":"luigi","sentAt":"1994-12-31T00:00:04Z","unread":true}]}`,
+		},
+		{
+			name:         "Fail on invalid cursor",
+			auth:         "super.mario",
+			req:          "super.mario",
+			query:        "?cursor=not-a-cursor",
+			expectedCode: http.StatusBadRequest,
+			expectedBody: `{"type":"urn:messagebox:problem:invalid_cursor","title":"Bad Request","status":400,"detail":"invalid cursor","code":"invalid_cursor"}`,
+		},
+		{
+			name:         "Fail on another user's sent folder",
+			auth:         "luigi",
+			req:          "super.mario",
+			expectedCode: http.StatusForbidden,
+			expectedBody: `{"type":"urn:messagebox:problem:forbidden","title":"Forbidden","status":403,"detail":"not permitted to act for another user","code":"forbidden"}`,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, "/users/"+tt.req+"/sent"+tt.query, nil)
+			assert.NoError(t, err)
+			if tt.auth != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.auth+"-token")
+			}
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+			assert.Equal(t, tt.expectedCode, rec.Code)
+
+			if tt.expectedCode == http.StatusOK {
+				var expected models.MessagePage
+				err := json.Unmarshal([]byte(tt.expectedBody), &expected)
+				assert.NoError(t, err)
+
+				var actual models.MessagePage
+				err = json.Unmarshal(rec.Body.Bytes(), &actual)
+				assert.NoError(t, err)
+
+				if assert.Len(t, actual.Messages, len(expected.Messages)) {
+					for i, exp := range expected.Messages {
+						act := actual.Messages[i]
+						exp.SentAt = act.SentAt
+						assert.Equal(t, exp, act)
+					}
+				}
+			} else {
+				assert.Equal(t, tt.expectedBody, rec.Body.String())
+			}
+
+			rec.Body.Reset()
+		})
+	}
+}
+
+func TestCreateGroup(t *testing.T) {
+	seed := `BEGIN;
+	TRUNCATE user_groups RESTART IDENTITY CASCADE;
+	TRUNCATE groups RESTART IDENTITY CASCADE;
+	TRUNCATE users RESTART IDENTITY CASCADE;
+	INSERT INTO users (name) VALUES ('super.mario');
+	INSERT INTO users (name) VALUES ('Yoshi');
+	INSERT INTO users (name) VALUES ('luigi');
+	INSERT INTO api_tokens (user_id, token_hash) SELECT id, encode(sha256(convert_to(name || '-token', 'UTF8')), 'hex') FROM users;
+	COMMIT;`
+
+	router := setupRouter(t, setupRepos(t, seed))
+
+	cases := []struct {
+		name         string
+		auth         string
+		req          string
+		expectedCode int
+		expectedBody string
+	}{
+		{
+			name: "Success 1 user",
+			auth: "super.mario",
+			req: `{"groupname":"bros",
+					"usernames": [
+				  		"super.mario"
+					]}`,
+			expectedCode: http.StatusCreated,
+			expectedBody: `{"groupname":"bros","usernames":["super.mario"]}`,
+		},
+		{
+			name: "Success 2 users",
+			auth: "super.mario",
+			req: `{"groupname":"pals",
+					"usernames": [
+						"super.mario",
+						"Yoshi"
+					]}`,
+			expectedCode: http.StatusCreated,
+			expectedBody: `{"groupname":"pals","usernames":["super.mario","Yoshi"]}`,
+		},
+		{
+			name: "Fail on duplicate",
+			auth: "super.mario",
+			req: `{"groupname":"bros",
+					"usernames": [
+						"super.mario",
+						"luigi"
+					]}`,
+			expectedCode: http.StatusConflict,
+			expectedBody: `{"type":"urn:messagebox:problem:duplicate_name","title":"Conflict","status":409,"detail":"name is already taken","code":"duplicate_name"}`,
+		},
+		{
+			name: "Fail on missing user",
+			auth: "Yoshi",
+			req: `{"groupname":"dinos",
+					"usernames": [
+						"Yoshi",
+						"Barney"
+					]}`,
+			expectedCode: http.StatusNotFound,
+			expectedBody: `{"type":"urn:messagebox:problem:user_not_found","title":"Not Found","status":404,"detail":"user with given username does not exist","code":"user_not_found"}`,
+		},
+		{
+			name: "Fail on bad request",
+			auth: "luigi",
+			req: `{"oh_no":"no group name!",
+			"usernames": [
+				"luigi",
+				"Yoshi"
+			]}`,
+			expectedCode: http.StatusBadRequest,
+			expectedBody: `{"type":"urn:messagebox:problem:invalid_request","title":"Bad Request","status":400,"detail":"invalid request","code":"invalid_request","errors":[{"field":"groupname","rule":"required","message":"groupname is required"}]}`,
+		},
+		{
+			name: "Fail on bad request",
+			auth: "luigi",
+			req: `{"groupname":"012345678901234567890123456789012",
+			"usernames": [
+				"luigi",
+				"Yoshi"
+			]}`,
+			expectedCode: http.StatusBadRequest,
+			expectedBody: `{"type":"urn:messagebox:problem:invalid_request","title":"Bad Request","status":400,"detail":"invalid request","code":"invalid_request","errors":[{"field":"groupname","rule":"max","message":"groupname must be at most 32 characters long"}]}`,
+		},
+		{
+			name: "Fail on creating a group without the creator",
+			auth: "luigi",
+			req: `{"groupname":"dinos",
+					"usernames": [
+						"Yoshi"
+					]}`,
+			expectedCode: http.StatusForbidden,
+			expectedBody: `{"type":"urn:messagebox:problem:forbidden","title":"Forbidden","status":403,"detail":"not a member of the group","code":"forbidden"}`,
+		},
+		{
+			name: "Fail on missing token",
+			req: `{"groupname":"dinos",
+					"usernames": [
+						"Yoshi"
+					]}`,
+			expectedCode: http.StatusUnauthorized,
+			expectedBody: `{"type":"urn:messagebox:problem:unauthorized","title":"Unauthorized","status":401,"detail":"missing bearer token","code":"unauthorized"}`,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodPost, "/groups", bytes.NewBufferString(tt.req))
+			assert.NoError(t, err)
+			if tt.auth != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.auth+"-token")
+			}
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+			assert.Equal(t, tt.expectedCode, rec.Code)
+			assert.Equal(t, tt.expectedBody, rec.Body.String())
+			rec.Body.Reset()
+		})
+	}
+}
+
+func TestAddGroupMember(t *testing.T) {
+	seed := `BEGIN;
+	TRUNCATE user_groups RESTART IDENTITY CASCADE;
+	TRUNCATE groups RESTART IDENTITY CASCADE;
+	TRUNCATE users RESTART IDENTITY CASCADE;
+	INSERT INTO users (name) VALUES ('super.mario');
+	INSERT INTO users (name) VALUES ('Yoshi');
+	INSERT INTO users (name) VALUES ('luigi');
+	INSERT INTO groups (name) VALUES ('bros');
+	INSERT INTO user_groups (group_id, user_id) VALUES (-1,1);
+	INSERT INTO api_tokens (user_id, token_hash) SELECT id, encode(sha256(convert_to(name || '-token', 'UTF8')), 'hex') FROM users;
+	COMMIT;`
+
+	router := setupRouter(t, setupRepos(t, seed))
+
+	cases := []struct {
+		name         string
+		auth         string
+		reqURI       string
+		req          string
+		expectedCode int
+		expectedBody string
+	}{
+		{
+			name:         "Success",
+			auth:         "super.mario",
+			reqURI:       "bros",
+			req:          `{"username":"luigi"}`,
+			expectedCode: http.StatusCreated,
+			expectedBody: `{"groupname":"bros","usernames":["super.mario","luigi"]}`,
+		},
+		{
+			name:         "Fail on duplicate membership",
+			auth:         "super.mario",
+			reqURI:       "bros",
+			req:          `{"username":"luigi"}`,
+			expectedCode: http.StatusConflict,
+			expectedBody: `{"type":"urn:messagebox:problem:already_member","title":"Conflict","status":409,"detail":"user is already a member of the group","code":"already_member"}`,
+		},
+		{
+			name:         "Fail on missing group",
+			auth:         "super.mario",
+			reqURI:       "dinos",
+			req:          `{"username":"Yoshi"}`,
+			expectedCode: http.StatusNotFound,
+			expectedBody: `{"type":"urn:messagebox:problem:group_not_found","title":"Not Found","status":404,"detail":"group with given groupname does not exist","code":"group_not_found"}`,
+		},
+		{
+			name:         "Fail on missing user",
+			auth:         "super.mario",
+			reqURI:       "bros",
+			req:          `{"username":"wario"}`,
+			expectedCode: http.StatusNotFound,
+			expectedBody: `{"type":"urn:messagebox:problem:user_not_found","title":"Not Found","status":404,"detail":"user with given username does not exist","code":"user_not_found"}`,
+		},
+		{
+			name:         "Fail on bad request",
+			auth:         "super.mario",
+			reqURI:       "bros",
+			req:          `{"oh_no":"no username!"}`,
+			expectedCode: http.StatusBadRequest,
+			expectedBody: `{"type":"urn:messagebox:problem:invalid_request","title":"Bad Request","status":400,"detail":"invalid request","code":"invalid_request","errors":[{"field":"username","rule":"required","message":"username is required"}]}`,
+		},
+		{
+			name:         "Fail on joining a group as a non-member",
+			auth:         "Yoshi",
+			reqURI:       "bros",
+			req:          `{"username":"Yoshi"}`,
+			expectedCode: http.StatusForbidden,
+			expectedBody: `{"type":"urn:messagebox:problem:forbidden","title":"Forbidden","status":403,"detail":"not a member of the group","code":"forbidden"}`,
+		},
+		{
+			name:         "Fail on missing token",
+			reqURI:       "bros",
+			req:          `{"username":"Yoshi"}`,
+			expectedCode: http.StatusUnauthorized,
+			expectedBody: `{"type":"urn:messagebox:problem:unauthorized","title":"Unauthorized","status":401,"detail":"missing bearer token","code":"unauthorized"}`,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodPost, "/groups/"+tt.reqURI+"/members", bytes.NewBufferString(tt.req))
+			assert.NoError(t, err)
+			if tt.auth != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.auth+"-token")
+			}
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+			assert.Equal(t, tt.expectedCode, rec.Code)
+			assert.Equal(t, tt.expectedBody, rec.Body.String())
+			rec.Body.Reset()
+		})
+	}
+}
+
+func TestRemoveGroupMember(t *testing.T) {
+	seed := `BEGIN;
+	TRUNCATE user_groups RESTART IDENTITY CASCADE;
+	TRUNCATE groups RESTART IDENTITY CASCADE;
+	TRUNCATE users RESTART IDENTITY CASCADE;
+	INSERT INTO users (name) VALUES ('super.mario');
+	INSERT INTO users (name) VALUES ('Yoshi');
+	INSERT INTO users (name) VALUES ('luigi');
+	INSERT INTO groups (name) VALUES ('bros');
+	INSERT INTO user_groups (group_id, user_id) VALUES (-1,1);
+	INSERT INTO user_groups (group_id, user_id) VALUES (-1,3);
+	INSERT INTO api_tokens (user_id, token_hash) SELECT id, encode(sha256(convert_to(name || '-token', 'UTF8')), 'hex') FROM users;
+	COMMIT;`
+
+	router := setupRouter(t, setupRepos(t, seed))
+
+	cases := []struct {
+		name         string
+		auth         string
+		path         string
+		expectedCode int
+		expectedBody string
+	}{
+		{
+			name:         "Success removing a member",
+			auth:         "super.mario",
+			path:         "/groups/bros/members/luigi",
+			expectedCode: http.StatusNoContent,
+			expectedBody: ``,
+		},
+		{
+			name:         "Fail on removing a non-member",
+			auth:         "super.mario",
+			path:         "/groups/bros/members/luigi",
+			expectedCode: http.StatusNotFound,
+			expectedBody: `{"type":"urn:messagebox:problem:not_member","title":"Not Found","status":404,"detail":"user is not a member of the group","code":"not_member"}`,
+		},
+		{
+			name:         "Fail on removing as a non-member",
+			auth:         "Yoshi",
+			path:         "/groups/bros/members/super.mario",
+			expectedCode: http.StatusForbidden,
+			expectedBody: `{"type":"urn:messagebox:problem:forbidden","title":"Forbidden","status":403,"detail":"not a member of the group","code":"forbidden"}`,
+		},
+		{
+			name:         "Fail on removing without a token",
+			path:         "/groups/bros/members/super.mario",
+			expectedCode: http.StatusUnauthorized,
+			expectedBody: `{"type":"urn:messagebox:problem:unauthorized","title":"Unauthorized","status":401,"detail":"missing bearer token","code":"unauthorized"}`,
+		},
+		{
+			name:         "Success leaving a group",
+			auth:         "super.mario",
+			path:         "/users/super.mario/groups/bros",
+			expectedCode: http.StatusNoContent,
+			expectedBody: ``,
+		},
+		{
+			name:         "Fail on leaving a group twice",
+			auth:         "super.mario",
+			path:         "/users/super.mario/groups/bros",
+			expectedCode: http.StatusNotFound,
+			expectedBody: `{"type":"urn:messagebox:problem:not_member","title":"Not Found","status":404,"detail":"user is not a member of the group","code":"not_member"}`,
+		},
+		{
+			name:         "Fail on missing group",
+			auth:         "super.mario",
+			path:         "/groups/dinos/members/Yoshi",
+			expectedCode: http.StatusNotFound,
+			expectedBody: `{"type":"urn:messagebox:problem:group_not_found","title":"Not Found","status":404,"detail":"group with given groupname does not exist","code":"group_not_found"}`,
+		},
+		{
+			name:         "Fail on leaving for another user",
+			auth:         "super.mario",
+			path:         "/users/luigi/groups/bros",
+			expectedCode: http.StatusForbidden,
+			expectedBody: `{"type":"urn:messagebox:problem:forbidden","title":"Forbidden","status":403,"detail":"not permitted to act for another user","code":"forbidden"}`,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodDelete, tt.path, nil)
+			assert.NoError(t, err)
+			if tt.auth != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.auth+"-token")
+			}
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+			assert.Equal(t, tt.expectedCode, rec.Code)
+			assert.Equal(t, tt.expectedBody, rec.Body.String())
+			rec.Body.Reset()
+		})
+	}
+}
+
+func TestGetGroup(t *testing.T) {
+	seed := `BEGIN;
+	TRUNCATE messages RESTART IDENTITY CASCADE;
+	TRUNCATE user_groups RESTART IDENTITY CASCADE;
+	TRUNCATE groups RESTART IDENTITY CASCADE;
+	TRUNCATE users RESTART IDENTITY CASCADE;
+	INSERT INTO users (name) VALUES ('super.mario');
+	INSERT INTO users (name) VALUES ('Yoshi');
+	INSERT INTO users (name) VALUES ('luigi');
+	INSERT INTO groups (name, created_at) VALUES ('green', '1994-12-31T00:00:00Z');
+	INSERT INTO groups (name, created_at) VALUES ('empty', '1995-01-01T00:00:00Z');
+	INSERT INTO user_groups (group_id, user_id) VALUES (-1,2);
+	INSERT INTO user_groups (group_id, user_id) VALUES (-1,3);
+	INSERT INTO messages (re, sender, recipient, subject, body) VALUES (0, 1, -1, 'hello', 'group');
+	INSERT INTO messages (re, sender, recipient, subject, body) VALUES (1, 3, -1, 're: hello', 'group');
+	INSERT INTO messages (re, sender, recipient, subject, body) VALUES (0, 1, 2, 'hello', 'user');
+	INSERT INTO message_recipients (message_id, recipient, kind) SELECT id, recipient, 'to' FROM messages;
+	COMMIT;`
+
+	router := setupRouter(t, setupRepos(t, seed))
+
+	cases := []struct {
+		name         string
+		req          string
+		expectedCode int
+		expectedBody string
+	}{
+		{
+			name:         "Success with members and messages",
+			req:          "green",
+			expectedCode: http.StatusOK,
+			expectedBody: `{"groupname":"green","usernames":["Yoshi","luigi"],"createdAt":"1994-12-31T00:00:00Z","memberCount":2,"messageCount":2}`,
+		},
+		{
+			name:         "Success with no members",
+			req:          "empty",
+			expectedCode: http.StatusOK,
+			expectedBody: `{"groupname":"empty","usernames":[],"createdAt":"1995-01-01T00:00:00Z","memberCount":0,"messageCount":0}`,
+		},
+		{
+			name:         "Fail on missing group",
+			req:          "dinos",
+			expectedCode: http.StatusNotFound,
+			expectedBody: `{"type":"urn:messagebox:problem:group_not_found","title":"Not Found","status":404,"detail":"group with given groupname does not exist","code":"group_not_found"}`,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, "/groups/"+tt.req, nil)
+			assert.NoError(t, err)
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+			assert.Equal(t, tt.expectedCode, rec.Code)
+
+			if tt.expectedCode == http.StatusOK {
+				var expected controllers.GroupDetails
+				err := json.Unmarshal([]byte(tt.expectedBody), &expected)
+				assert.NoError(t, err)
+
+				var actual controllers.GroupDetails
+				err = json.Unmarshal(rec.Body.Bytes(), &actual)
+				assert.NoError(t, err)
+
+				assert.True(t, expected.CreatedAt.Equal(actual.CreatedAt))
+				expected.CreatedAt = actual.CreatedAt
+				assert.Equal(t, expected, actual)
+			} else {
+				assert.Equal(t, tt.expectedBody, rec.Body.String())
+			}
+
+			rec.Body.Reset()
+		})
+	}
+}
+
+func TestCreateMessage(t *testing.T) {
+	seed := `BEGIN;
+	TRUNCATE messages RESTART IDENTITY CASCADE;
+	TRUNCATE user_groups RESTART IDENTITY CASCADE;
+	TRUNCATE groups RESTART IDENTITY CASCADE;
+	TRUNCATE users RESTART IDENTITY CASCADE;
+	INSERT INTO users (name) VALUES ('super.mario');
+	INSERT INTO users (name) VALUES ('Yoshi');
+	INSERT INTO users (name) VALUES ('luigi');
+	INSERT INTO groups (name) VALUES ('green');
+	INSERT INTO user_groups (group_id, user_id) VALUES (-1,2);
+	INSERT INTO user_groups (group_id, user_id) VALUES (-1,3);
+	INSERT INTO api_tokens (user_id, token_hash) VALUES (1, encode(sha256('super.mario-token'), 'hex'));
+	COMMIT;`
+
+	router := setupRouter(t, setupRepos(t, seed))
+
+	cases := []struct {
+		name         string
+		auth         string
+		req          string
+		expectedCode int
+		expectedBody string
+	}{
+		{
+			name: "Success with user recipient",
+			auth: "super.mario",
+			req: `{
+				"sender": "super.mario",
+				"recipient": {
+				  "username": "luigi"
+				},
+				"subject": "PR For MessageBox",
+				"body": "I have the first version of messagebox ready to review."
+			  }`,
+			expectedCode: http.StatusCreated,
+			expectedBody: `{"id":1,"sender":"super.mario","recipient":{"username":"luigi"},"to":[{"username":"luigi"}],"subject":"PR For MessageBox","body":"I have the first version of messagebox ready to review.","sentAt":"2019-09-03T17:12:42Z"}`,
+		},
+		{
+			name: "Success with group recipient",
+			auth: "super.mario",
+			req: `{
+				"sender": "super.mario",
+				"recipient": {
+				  "groupname": "green"
 				},
 				"subject": "PR For MessageBox",
 				"body": "I have the first version of messagebox ready to review."
 			  }`,
+			expectedCode: http.StatusCreated,
+			expectedBody: `{"id":2,"sender":"super.mario","recipient":{"groupname":"green"},"to":[{"groupname":"green"}],"subject":"PR For MessageBox","body":"I have the first version of messagebox ready to review.","sentAt":"2019-09-03T17:12:42Z"}`,
+		},
+		{
+			name: "Success with no body",
+			auth: "super.mario",
+			req: `{
+				"sender": "super.mario",
+				"recipient": {
+				  "groupname": "green"
+				},
+				"subject": "PR For MessageBox"
+			  }`,
+			expectedCode: http.StatusCreated,
+			expectedBody: `{"id":3,"sender":"super.mario","recipient":{"groupname":"green"},"to":[{"groupname":"green"}],"subject":"PR For MessageBox","sentAt":"2019-09-03T17:12:42Z"}`,
+		},
+		{
+			name: "Success with to, cc and bcc recipients",
+			auth: "super.mario",
+			req: `{
+				"to": [{"username": "luigi"}, {"groupname": "green"}],
+				"cc": [{"username": "Yoshi"}, {"username": "luigi"}],
+				"bcc": [{"username": "super.mario"}],
+				"subject": "PR For MessageBox"
+			  }`,
+			expectedCode: http.StatusCreated,
+			expectedBody: `{"id":4,"sender":"super.mario","recipient":{"username":"luigi"},"to":[{"username":"luigi"},{"groupname":"green"}],"cc":[{"username":"Yoshi"}],"bcc":[{"username":"super.mario"}],"subject":"PR For MessageBox","sentAt":"2019-09-03T17:12:42Z"}`,
+		},
+		{
+			name: "Success with recipient and to",
+			auth: "super.mario",
+			req: `{
+				"recipient": {
+				  "username": "Yoshi"
+				},
+				"to": [{"username": "luigi"}],
+				"subject": "PR For MessageBox"
+			  }`,
+			expectedCode: http.StatusCreated,
+			expectedBody: `{"id":5,"sender":"super.mario","recipient":{"username":"Yoshi"},"to":[{"username":"Yoshi"},{"username":"luigi"}],"subject":"PR For MessageBox","sentAt":"2019-09-03T17:12:42Z"}`,
+		},
+		{
+			name: "Fail on no recipients",
+			auth: "super.mario",
+			req: `{
+				"subject": "PR For MessageBox"
+			  }`,
+			expectedCode: http.StatusBadRequest,
+			expectedBody: `{"type":"urn:messagebox:problem:invalid_request","title":"Bad Request","status":400,"detail":"invalid request","code":"invalid_request","errors":[{"field":"to","rule":"required","message":"at least one recipient is required"}]}`,
+		},
+		{
+			name: "Fail on cc naming a user and a group",
+			auth: "super.mario",
+			req: `{
+				"to": [{"username": "luigi"}],
+				"cc": [{"username": "Yoshi", "groupname": "green"}],
+				"subject": "PR For MessageBox"
+			  }`,
+			expectedCode: http.StatusBadRequest,
+			expectedBody: `{"type":"urn:messagebox:problem:invalid_request","title":"Bad Request","status":400,"detail":"invalid request","code":"invalid_request","errors":[{"field":"cc[0]","rule":"exactly_one","message":"cc[0] must name exactly one of username or groupname"}]}`,
+		},
+		{
+			name: "Fail on bcc recipient does not exist",
+			auth: "super.mario",
+			req: `{
+				"to": [{"username": "luigi"}],
+				"bcc": [{"username": "bowser"}],
+				"subject": "PR For MessageBox"
+			  }`,
 			expectedCode: http.StatusNotFound,
-			expectedBody: `{"code":404,"message":"sender or recipient does not exist"}`,
+			expectedBody: `{"type":"urn:messagebox:problem:recipient_not_found","title":"Not Found","status":404,"detail":"recipient does not exist","code":"recipient_not_found"}`,
+		},
+		{
+			name: "Fail on sender not matching token",
+			auth: "super.mario",
+			req: `{
+				"sender": "bowser",
+				"recipient": {
+				  "username": "luigi"
+				},
+				"subject": "PR For MessageBox",
+				"body": "I have the first version of messagebox ready to review."
+			  }`,
+			expectedCode: http.StatusForbidden,
+			expectedBody: `{"type":"urn:messagebox:problem:forbidden","title":"Forbidden","status":403,"detail":"sender does not match the authenticated user","code":"forbidden"}`,
+		},
+		{
+			name: "Fail on missing token",
+			req: `{
+				"recipient": {
+				  "username": "luigi"
+				},
+				"subject": "PR For MessageBox",
+				"body": "I have the first version of messagebox ready to review."
+			  }`,
+			expectedCode: http.StatusUnauthorized,
+			expectedBody: `{"type":"urn:messagebox:problem:unauthorized","title":"Unauthorized","status":401,"detail":"missing bearer token","code":"unauthorized"}`,
+		},
+		{
+			name: "Fail on invalid token",
+			auth: "bowser",
+			req: `{
+				"recipient": {
+				  "username": "luigi"
+				},
+				"subject": "PR For MessageBox",
+				"body": "I have the first version of messagebox ready to review."
+			  }`,
+			expectedCode: http.StatusUnauthorized,
+			expectedBody: `{"type":"urn:messagebox:problem:unauthorized","title":"Unauthorized","status":401,"detail":"invalid bearer token","code":"unauthorized"}`,
 		},
 		{
 			name: "Fail on missing user recipient",
+			auth: "super.mario",
 			req: `{
 				"sender": "super.mario",
 				"recipient": {
@@ -488,10 +1846,11 @@ func TestCreateMessage(t *testing.T) {
 				"body": "I have the first version of messagebox ready to review."
 			  }`,
 			expectedCode: http.StatusNotFound,
-			expectedBody: `{"code":404,"message":"sender or recipient does not exist"}`,
+			expectedBody: `{"type":"urn:messagebox:problem:recipient_not_found","title":"Not Found","status":404,"detail":"recipient does not exist","code":"recipient_not_found"}`,
 		},
 		{
 			name: "Fail on missing group recipient",
+			auth: "super.mario",
 			req: `{
 				"sender": "super.mario",
 				"recipient": {
@@ -501,23 +1860,37 @@ func TestCreateMessage(t *testing.T) {
 				"body": "I have the first version of messagebox ready to review."
 			  }`,
 			expectedCode: http.StatusNotFound,
-			expectedBody: `{"code":404,"message":"sender or recipient does not exist"}`,
+			expectedBody: `{"type":"urn:messagebox:problem:recipient_not_found","title":"Not Found","status":404,"detail":"recipient does not exist","code":"recipient_not_found"}`,
 		},
 		{
-			name: "Fail on bad request",
+			name: "Success with sender taken from token",
+			auth: "super.mario",
 			req: `{
-				"oh_no": "no sender!",
 				"recipient": {
 				  "username": "luigi"
 				},
 				"subject": "PR For MessageBox",
 				"body": "I have the first version of messagebox ready to review."
 			  }`,
+			expectedCode: http.StatusCreated,
+			expectedBody: `{"id":6,"sender":"super.mario","recipient":{"username":"luigi"},"to":[{"username":"luigi"}],"subject":"PR For MessageBox","body":"I have the first version of messagebox ready to review.","sentAt":"2019-09-03T17:12:42Z"}`,
+		},
+		{
+			name: "Fail on bad request",
+			auth: "super.mario",
+			req: `{
+				"recipient": {
+				  "username": "luigi"
+				},
+				"oh_no": "no subject!",
+				"body": "I have the first version of messagebox ready to review."
+			  }`,
 			expectedCode: http.StatusBadRequest,
-			expectedBody: `{"code":400,"message":"invalid request"}`,
+			expectedBody: `{"type":"urn:messagebox:problem:invalid_request","title":"Bad Request","status":400,"detail":"invalid request","code":"invalid_request","errors":[{"field":"subject","rule":"required","message":"subject is required"}]}`,
 		},
 		{
 			name: "Fail on subject too long (256)",
+			auth: "super.mario",
 			req: `{
 				"sender": "super.mario",
 				"recipient": {
@@ -527,10 +1900,11 @@ func TestCreateMessage(t *testing.T) {
 				"body": "I have the first version of messagebox ready to review."
 			  }`,
 			expectedCode: http.StatusBadRequest,
-			expectedBody: `{"code":400,"message":"invalid request"}`,
+			expectedBody: `{"type":"urn:messagebox:problem:invalid_request","title":"Bad Request","status":400,"detail":"invalid request","code":"invalid_request","errors":[{"field":"subject","rule":"max","message":"subject must be at most 255 characters long"}]}`,
 		},
 		{
 			name: "Fail on body too long (2001)",
+			auth: "super.mario",
 			req: `{
 				"sender": "super.mario",
 				"recipient": {
@@ -540,7 +1914,7 @@ func TestCreateMessage(t *testing.T) {
 				"body": "012345678901234567890123456789012345678901234567890123456789012345678901234567890123456789012345678901234567890123456789012345678901234567890123456789012345678901234567890123456789012345678901234567890123456789012345678901234567890123456789012345678901234567890123456789012345678901234567890123456789012345678901234567890123456789012345678901234567890123456789012345678901234567890123456789012345678901234567890123456789012345678901234567890123456789012345678901234567890123456789012345678901234567890123456789012345678901234567890123456789012345678901234567890123456789012345678901234567890123456789012345678901234567890123456789012345678901234567890123456789012345678901234567890123456789012345678901234567890123456789012345678901234567890123456789012345678901234567890123456789012345678901234567890123456789012345678901234567890123456789012345678901234567890123456789012345678901234567890123456789012345678901234567890123456789012345678901234567890123456789012345678901234567890123456789012345678901234567890123456789012345678901234567890123456789012345678901234567890123456789012345678901234567890123456789012345678901234567890123456789012345678901234567890123456789012345678901234567890123456789012345678901234567890123456789012345678901234567890123456789012345678901234567890123456789012345678901234567890123456789012345678901234567890123456789012345678901234567890123456789012345678901234567890123456789012345678901234567890123456789012345678901234567890123456789012345678901234567890123456789012345678901234567890123456789012345678901234567890123456789012345678901234567890123456789012345678901234567890123456789012345678901234567890123456789012345678901234567890123456789012345678901234567890123456789012345678901234567890123456789012345678901234567890123456789012345678901234567890123456789012345678901234567890123456789012345678901234567890123456789012345678901234567890123456789012345678901234567890123456789012345678901234567890123456789012345678901234567890123456789012345678901234567890"
 			  }`,
 			expectedCode: http.StatusBadRequest,
-			expectedBody: `{"code":400,"message":"invalid request"}`,
+			expectedBody: `{"type":"urn:messagebox:problem:invalid_request","title":"Bad Request","status":400,"detail":"invalid request","code":"invalid_request","errors":[{"field":"body","rule":"max","message":"body must be at most 2000 characters long"}]}`,
 		},
 	}
 
@@ -548,6 +1922,9 @@ func TestCreateMessage(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			req, err := http.NewRequest(http.MethodPost, "/messages", bytes.NewBufferString(tt.req))
 			assert.NoError(t, err)
+			if tt.auth != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.auth+"-token")
+			}
 			rec := httptest.NewRecorder()
 			router.ServeHTTP(rec, req)
 			assert.Equal(t, tt.expectedCode, rec.Code)
@@ -563,20 +1940,243 @@ func TestCreateMessage(t *testing.T) {
 	}
 }
 
-func TestGetMessage(t *testing.T) {
-	dbCfg := config.DatabaseConfiguration{
-		DatabaseName: "messagebox",
-		User:         "messagebox_user",
-		Password:     "insecure",
-		Host:         "0.0.0.0",
-		Port:         "5432",
+func TestMessageRecipients(t *testing.T) {
+	seed := `BEGIN;
+	TRUNCATE messages RESTART IDENTITY CASCADE;
+	TRUNCATE user_groups RESTART IDENTITY CASCADE;
+	TRUNCATE groups RESTART IDENTITY CASCADE;
+	TRUNCATE users RESTART IDENTITY CASCADE;
+	INSERT INTO users (name) VALUES ('super.mario');
+	INSERT INTO users (name) VALUES ('Yoshi');
+	INSERT INTO users (name) VALUES ('luigi');
+	INSERT INTO users (name) VALUES ('toad');
+	INSERT INTO groups (name) VALUES ('green');
+	INSERT INTO user_groups (group_id, user_id) VALUES (-1,2);
+	INSERT INTO messages (re, sender, recipient, subject, body, sent_at) VALUES (0, 1, 3, 'hello', 'everyone', '1994-12-31T00:00:01Z');
+	INSERT INTO message_recipients (message_id, recipient, kind) VALUES (1, 3, 'to');
+	INSERT INTO message_recipients (message_id, recipient, kind) VALUES (1, -1, 'cc');
+	INSERT INTO message_recipients (message_id, recipient, kind) VALUES (1, 4, 'bcc');
+	INSERT INTO api_tokens (user_id, token_hash) SELECT id, encode(sha256(convert_to(name || '-token', 'UTF8')), 'hex') FROM users;
+	COMMIT;`
+
+	router := setupRouter(t, setupRepos(t, seed))
+
+	cases := []struct {
+		name         string
+		auth         string
+		method       string
+		path         string
+		req          string
+		expectedCode int
+		expectedBody string
+	}{
+		{
+			name:         "Sender sees bcc recipients",
+			auth:         "super.mario",
+			method:       http.MethodGet,
+			path:         "/messages/1",
+			expectedCode: http.StatusOK,
+			expectedBody: `{"id":1,"sender":"super.mario","recipient":{"username":"luigi"},"to":[{"username":"luigi"}],"cc":[{"groupname":"green"}],"bcc":[{"username":"toad"}],"subject":"hello","body":"everyone","sentAt":"1994-12-31T00:00:01Z"}`,
+		},
+		{
+			name:         "To recipient does not see bcc recipients",
+			auth:         "luigi",
+			method:       http.MethodGet,
+			path:         "/messages/1",
+			expectedCode: http.StatusOK,
+			expectedBody: `{"id":1,"sender":"super.mario","recipient":{"username":"luigi"},"to":[{"username":"luigi"}],"cc":[{"groupname":"green"}],"subject":"hello","body":"everyone","sentAt":"1994-12-31T00:00:01Z"}`,
+		},
+		{
+			name:         "Cc group member may read",
+			auth:         "Yoshi",
+			method:       http.MethodGet,
+			path:         "/messages/1",
+			expectedCode: http.StatusOK,
+			expectedBody: `{"id":1,"sender":"super.mario","recipient":{"username":"luigi"},"to":[{"username":"luigi"}],"cc":[{"groupname":"green"}],"subject":"hello","body":"everyone","sentAt":"1994-12-31T00:00:01Z"}`,
+		},
+		{
+			name:         "Bcc recipient may read but does not see bcc recipients",
+			auth:         "toad",
+			method:       http.MethodGet,
+			path:         "/messages/1",
+			expectedCode: http.StatusOK,
+			expectedBody: `{"id":1,"sender":"super.mario","recipient":{"username":"luigi"},"to":[{"username":"luigi"}],"cc":[{"groupname":"green"}],"subject":"hello","body":"everyone","sentAt":"1994-12-31T00:00:01Z"}`,
+		},
+		{
+			name:         "Bcc recipient finds the message in their mailbox",
+			auth:         "toad",
+			method:       http.MethodGet,
+			path:         "/users/toad/mailbox",
+			expectedCode: http.StatusOK,
+			expectedBody: `{"messages":[{"id":1,"sender":"super.mario","recipient":{"username":"luigi"},"to":[{"username":"luigi"}],"cc":[{"groupname":"green"}],"subject":"hello","body":"everyone","sentAt":"1994-12-31T00:00:01Z","unread":true}]}`,
+		},
+		{
+			name:         "Reply from bcc recipient goes to the sender and the cc group",
+			auth:         "toad",
+			method:       http.MethodPost,
+			path:         "/messages/1/replies",
+			req:          `{"subject": "re: hello"}`,
+			expectedCode: http.StatusCreated,
+			expectedBody: `{"id":2,"re":1,"sender":"toad","recipient":{"groupname":"green"},"to":[{"groupname":"green"},{"username":"super.mario"}],"subject":"re: hello","sentAt":"2019-09-03T17:12:42Z"}`,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(tt.method, tt.path, bytes.NewBufferString(tt.req))
+			assert.NoError(t, err)
+			if tt.auth != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.auth+"-token")
+			}
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+			assert.Equal(t, tt.expectedCode, rec.Code)
+
+			switch {
+			case strings.HasPrefix(tt.expectedBody, `{"messages":`):
+				AssertMessagePageEqual(t, []byte(tt.expectedBody), rec.Body.Bytes())
+			case tt.expectedCode == http.StatusOK, tt.expectedCode == http.StatusCreated:
+				AssertMessageEqual(t, []byte(tt.expectedBody), rec.Body.Bytes())
+			default:
+				assert.Equal(t, tt.expectedBody, rec.Body.String())
+			}
+
+			rec.Body.Reset()
+		})
 	}
+}
 
-	database, err := db.Setup(dbCfg, nil)
+func TestAttachments(t *testing.T) {
+	blobCfg := config.AttachmentsConfiguration{
+		Dir:          t.TempDir(),
+		MaxSize:      32,
+		MaxCount:     2,
+		AllowedTypes: []string{"text/*"},
+	}
+	store, err := blob.Setup(blobCfg, nil)
 	if err != nil {
-		t.Fatal("db.Setup() failed with:", err)
+		t.Fatal("blob.Setup() failed with:", err)
+	}
+
+	seed := `BEGIN;
+	TRUNCATE messages RESTART IDENTITY CASCADE;
+	TRUNCATE user_groups RESTART IDENTITY CASCADE;
+	TRUNCATE groups RESTART IDENTITY CASCADE;
+	TRUNCATE users RESTART IDENTITY CASCADE;
+	INSERT INTO users (name) VALUES ('super.mario');
+	INSERT INTO users (name) VALUES ('luigi');
+	INSERT INTO users (name) VALUES ('toad');
+	INSERT INTO api_tokens (user_id, token_hash) SELECT id, encode(sha256(convert_to(name || '-token', 'UTF8')), 'hex') FROM users;
+	COMMIT;`
+
+	router := setupRouterWith(t, setupRepos(t, seed), controllers.Services{Blobs: store, Attachments: blobCfg})
+
+	type file struct {
+		name    string
+		content string
 	}
+	send := func(t *testing.T, auth, path, message string, files ...file) *httptest.ResponseRecorder {
+		body := &bytes.Buffer{}
+		form := multipart.NewWriter(body)
+		assert.NoError(t, form.WriteField("message", message))
+		for _, f := range files {
+			part, err := form.CreateFormFile("attachments", f.name)
+			assert.NoError(t, err)
+			_, err = part.Write([]byte(f.content))
+			assert.NoError(t, err)
+		}
+		assert.NoError(t, form.Close())
+
+		req, err := http.NewRequest(http.MethodPost, path, body)
+		assert.NoError(t, err)
+		req.Header.Set("Content-Type", form.FormDataContentType())
+		req.Header.Set("Authorization", "Bearer "+auth+"-token")
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+	get := func(t *testing.T, auth, path string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(http.MethodGet, path, nil)
+		assert.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer "+auth+"-token")
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	t.Run("Success sending and downloading an attachment", func(t *testing.T) {
+		rec := send(t, "super.mario", "/messages", `{"to":[{"username":"luigi"}],"subject":"notes"}`, file{"notes.txt", "remember the mushrooms"})
+		assert.Equal(t, http.StatusCreated, rec.Code)
+
+		var msg models.Message
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &msg))
+		assert.Len(t, msg.Attachments, 1)
+		assert.Equal(t, "notes.txt", msg.Attachments[0].Filename)
+		assert.Equal(t, "text/plain", msg.Attachments[0].ContentType)
+		assert.Equal(t, int64(22), msg.Attachments[0].Size)
+
+		path := "/messages/" + strconv.Itoa(int(msg.ID)) + "/attachments/" + strconv.Itoa(int(msg.Attachments[0].ID))
+		rec = get(t, "luigi", path)
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, "remember the mushrooms", rec.Body.String())
+		assert.Equal(t, "text/plain", rec.Header().Get("Content-Type"))
+		assert.Equal(t, `attachment; filename=notes.txt`, rec.Header().Get("Content-Disposition"))
+
+		rec = get(t, "toad", path)
+		assert.Equal(t, http.StatusForbidden, rec.Code)
+
+		rec = get(t, "luigi", "/messages/"+strconv.Itoa(int(msg.ID))+"/attachments/999")
+		assert.Equal(t, http.StatusNotFound, rec.Code)
+		assert.Equal(t, `{"type":"urn:messagebox:problem:attachment_not_found","title":"Not Found","status":404,"detail":"attachment ID does not exist","code":"attachment_not_found"}`, rec.Body.String())
+	})
+
+	t.Run("Success replying with an attachment", func(t *testing.T) {
+		rec := send(t, "luigi", "/messages/1/replies", `{"subject":"re: notes"}`, file{"reply.txt", "got it"})
+		assert.Equal(t, http.StatusCreated, rec.Code)
+
+		var msg models.Message
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &msg))
+		assert.Len(t, msg.Attachments, 1)
+		assert.Equal(t, "reply.txt", msg.Attachments[0].Filename)
+	})
+
+	t.Run("Fail on attachment too large", func(t *testing.T) {
+		rec := send(t, "super.mario", "/messages", `{"to":[{"username":"luigi"}],"subject":"big"}`, file{"big.txt", strings.Repeat("a", 33)})
+		assert.Equal(t, http.StatusRequestEntityTooLarge, rec.Code)
+	})
+
+	t.Run("Fail on request body too large", func(t *testing.T) {
+		rec := send(t, "super.mario", "/messages", `{"to":[{"username":"luigi"}],"subject":"huge"}`, file{"huge.txt", strings.Repeat("a", 2<<20)})
+		assert.Equal(t, http.StatusRequestEntityTooLarge, rec.Code)
+		assert.Contains(t, rec.Body.String(), "attachments too large")
+	})
+
+	t.Run("Fail on too many attachments", func(t *testing.T) {
+		rec := send(t, "super.mario", "/messages", `{"to":[{"username":"luigi"}],"subject":"many"}`, file{"a.txt", "a"}, file{"b.txt", "b"}, file{"c.txt", "c"})
+		assert.Equal(t, http.StatusRequestEntityTooLarge, rec.Code)
+	})
+
+	t.Run("Fail on attachment type not allowed", func(t *testing.T) {
+		rec := send(t, "super.mario", "/messages", `{"to":[{"username":"luigi"}],"subject":"image"}`, file{"image.txt", "\x89PNG\r\n\x1a\n"})
+		assert.Equal(t, http.StatusUnsupportedMediaType, rec.Code)
+		assert.Equal(t, `{"type":"urn:messagebox:problem:unsupported_media_type","title":"Unsupported Media Type","status":415,"detail":"attachment type not allowed","code":"unsupported_media_type"}`, rec.Body.String())
+	})
+
+	t.Run("Fail on missing message part", func(t *testing.T) {
+		body := &bytes.Buffer{}
+		form := multipart.NewWriter(body)
+		assert.NoError(t, form.Close())
+		req, err := http.NewRequest(http.MethodPost, "/messages", body)
+		assert.NoError(t, err)
+		req.Header.Set("Content-Type", form.FormDataContentType())
+		req.Header.Set("Authorization", "Bearer super.mario-token")
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+	})
+}
 
+func TestGetMessage(t *testing.T) {
 	seed := `BEGIN;
 	TRUNCATE messages RESTART IDENTITY CASCADE;
 	TRUNCATE user_groups RESTART IDENTITY CASCADE;
@@ -590,46 +2190,65 @@ func TestGetMessage(t *testing.T) {
 	INSERT INTO user_groups (group_id, user_id) VALUES (-1,3);
 	INSERT INTO messages (re, sender, recipient, subject, body) VALUES (0, 1, 2, 'hello', 'user');
 	INSERT INTO messages (re, sender, recipient, subject, body) VALUES (0, 1, -1, 'hello', 'group');
+	INSERT INTO api_tokens (user_id, token_hash) SELECT id, encode(sha256(convert_to(name || '-token', 'UTF8')), 'hex') FROM users;
+	INSERT INTO message_recipients (message_id, recipient, kind) SELECT id, recipient, 'to' FROM messages;
 	COMMIT;`
-	SeedDB(t, database, seed)
 
-	router := Setup()
+	router := setupRouter(t, setupRepos(t, seed))
 
 	cases := []struct {
 		name         string
+		auth         string
 		req          string
 		expectedCode int
 		expectedBody string
 	}{
 		{
 			name:         "Success with user recipient",
+			auth:         "Yoshi",
 			req:          "1",
 			expectedCode: http.StatusOK,
-			expectedBody: `{"id":1,"sender":"super.mario","recipient":{"username":"Yoshi"},"subject":"hello","body":"user","sentAt":"2019-09-03T17:12:42Z"}`,
+			expectedBody: `{"id":1,"sender":"super.mario","recipient":{"username":"Yoshi"},"to":[{"username":"Yoshi"}],"subject":"hello","body":"user","sentAt":"2019-09-03T17:12:42Z"}`,
 		},
 		{
 			name:         "Success with group recipient",
+			auth:         "luigi",
 			req:          "2",
 			expectedCode: http.StatusOK,
-			expectedBody: `{"id":2,"sender":"super.mario","recipient":{"groupname":"green"},"subject":"hello","body":"group","sentAt":"2019-09-03T17:12:42Z"}`,
+			expectedBody: `{"id":2,"sender":"super.mario","recipient":{"groupname":"green"},"to":[{"groupname":"green"}],"subject":"hello","body":"group","sentAt":"2019-09-03T17:12:42Z"}`,
 		},
 		{
 			name:         "Fail on no id",
 			req:          "",
 			expectedCode: http.StatusNotFound,
-			expectedBody: `{"code":404,"message":"no route found"}`,
+			expectedBody: `{"type":"urn:messagebox:problem:not_found","title":"Not Found","status":404,"detail":"no route found","code":"not_found"}`,
 		},
 		{
 			name:         "Fail on missing id",
+			auth:         "Yoshi",
 			req:          "3",
 			expectedCode: http.StatusNotFound,
-			expectedBody: `{"code":404,"message":"message ID does not exist"}`,
+			expectedBody: `{"type":"urn:messagebox:problem:message_not_found","title":"Not Found","status":404,"detail":"message ID does not exist","code":"message_not_found"}`,
+		},
+		{
+			name:         "Fail on bad request",
+			auth:         "Yoshi",
+			req:          "abc",
+			expectedCode: http.StatusBadRequest,
+			expectedBody: `{"type":"urn:messagebox:problem:invalid_request","title":"Bad Request","status":400,"detail":"invalid request","code":"invalid_request"}`,
+		},
+		{
+			name:         "Fail on message for another user",
+			auth:         "luigi",
+			req:          "1",
+			expectedCode: http.StatusForbidden,
+			expectedBody: `{"type":"urn:messagebox:problem:forbidden","title":"Forbidden","status":403,"detail":"not permitted to read this message","code":"forbidden"}`,
 		},
 		{
-			name:         "Fail on bad request",
-			req:          "abc",
-			expectedCode: http.StatusBadRequest,
-			expectedBody: `{"code":400,"message":"invalid request"}`,
+			name:         "Fail on missing token",
+			req:          "1",
+			expectedCode: http.StatusUnauthorized,
+			expectedBody: `{"type":"urn:messagebox:problem:unauthorized","title":"Unauthorized","status":401,"detail":"missing bearer token","code":"unauthorized"}`,
 		},
 	}
 
@@ -637,6 +2256,9 @@ func TestGetMessage(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			req, err := http.NewRequest(http.MethodGet, "/messages/"+tt.req, nil)
 			assert.NoError(t, err)
+			if tt.auth != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.auth+"-token")
+			}
 			rec := httptest.NewRecorder()
 			router.ServeHTTP(rec, req)
 			assert.Equal(t, tt.expectedCode, rec.Code)
@@ -653,19 +2275,6 @@ func TestGetMessage(t *testing.T) {
 }
 
 func TestCreateReply(t *testing.T) {
-	dbCfg := config.DatabaseConfiguration{
-		DatabaseName: "messagebox",
-		User:         "messagebox_user",
-		Password:     "insecure",
-		Host:         "0.0.0.0",
-		Port:         "5432",
-	}
-
-	database, err := db.Setup(dbCfg, nil)
-	if err != nil {
-		t.Fatal("db.Setup() failed with:", err)
-	}
-
 	seed := `BEGIN;
 	TRUNCATE messages RESTART IDENTITY CASCADE;
 	TRUNCATE user_groups RESTART IDENTITY CASCADE;
@@ -677,15 +2286,17 @@ func TestCreateReply(t *testing.T) {
 	INSERT INTO groups (name) VALUES ('green');
 	INSERT INTO user_groups (group_id, user_id) VALUES (-1,2);
 	INSERT INTO user_groups (group_id, user_id) VALUES (-1,3);
-	INSERT INTO messages (re, sender, recipient, subject, body) VALUES (0, 1, 2, 'hello', 'user');
+	INSERT INTO messages (re, sender, recipient, subject, body) VALUES (0, 1, 3, 'hello', 'user');
 	INSERT INTO messages (re, sender, recipient, subject, body) VALUES (0, 1, -1, 'hello', 'group');
+	INSERT INTO api_tokens (user_id, token_hash) VALUES (3, encode(sha256('luigi-token'), 'hex'));
+	INSERT INTO message_recipients (message_id, recipient, kind) SELECT id, recipient, 'to' FROM messages;
 	COMMIT;`
-	SeedDB(t, database, seed)
 
-	router := Setup()
+	router := setupRouter(t, setupRepos(t, seed))
 
 	cases := []struct {
 		name         string
+		auth         string
 		reqID        string
 		req          string
 		expectedCode int
@@ -693,6 +2304,7 @@ func TestCreateReply(t *testing.T) {
 	}{
 		{
 			name:  "Success with reply to user",
+			auth:  "luigi",
 			reqID: "1",
 			req: `{
 				"sender": "luigi",
@@ -700,10 +2312,11 @@ func TestCreateReply(t *testing.T) {
 				"body": "user"
 			  }`,
 			expectedCode: http.StatusCreated,
-			expectedBody: `{"id":3,"re":1,"sender":"luigi","recipient":{"username":"super.mario"},"subject":"re: hello","body":"user","sentAt":"2019-09-03T17:12:42Z"}`,
+			expectedBody: `{"id":3,"re":1,"sender":"luigi","recipient":{"username":"super.mario"},"to":[{"username":"super.mario"}],"subject":"re: hello","body":"user","sentAt":"2019-09-03T17:12:42Z"}`,
 		},
 		{
 			name:  "Success with reply to group",
+			auth:  "luigi",
 			reqID: "2",
 			req: `{
 				"sender": "luigi",
@@ -711,26 +2324,29 @@ func TestCreateReply(t *testing.T) {
 				"body": "group"
 			  }`,
 			expectedCode: http.StatusCreated,
-			expectedBody: `{"id":4,"re":2,"sender":"luigi","recipient":{"groupname":"green"},"subject":"re: hello","body":"group","sentAt":"2019-09-03T17:12:42Z"}`,
+			expectedBody: `{"id":4,"re":2,"sender":"luigi","recipient":{"groupname":"green"},"to":[{"groupname":"green"}],"subject":"re: hello","body":"group","sentAt":"2019-09-03T17:12:42Z"}`,
 		},
 		{
 			name:  "Success with no body",
+			auth:  "luigi",
 			reqID: "2",
 			req: `{
 				"sender": "luigi",
 				"subject": "re: hello"
 			  }`,
 			expectedCode: http.StatusCreated,
-			expectedBody: `{"id":5,"re":2,"sender":"luigi","recipient":{"groupname":"green"},"subject":"re: hello","sentAt":"2019-09-03T17:12:42Z"}`,
+			expectedBody: `{"id":5,"re":2,"sender":"luigi","recipient":{"groupname":"green"},"to":[{"groupname":"green"}],"subject":"re: hello","sentAt":"2019-09-03T17:12:42Z"}`,
 		},
 		{
 			name:         "Fail on no id",
+			auth:         "luigi",
 			reqID:        "",
 			expectedCode: http.StatusBadRequest,
-			expectedBody: `{"code":400,"message":"invalid request"}`,
+			expectedBody: `{"type":"urn:messagebox:problem:invalid_request","title":"Bad Request","status":400,"detail":"invalid request","code":"invalid_request"}`,
 		},
 		{
 			name:  "Fail on missing id",
+			auth:  "luigi",
 			reqID: "42",
 			req: `{
 				"sender": "luigi",
@@ -738,21 +2354,33 @@ func TestCreateReply(t *testing.T) {
 				"body": "group"
 			  }`,
 			expectedCode: http.StatusNotFound,
-			expectedBody: `{"code":404,"message":"sender or message ID does not exist"}`,
+			expectedBody: `{"type":"urn:messagebox:problem:message_not_found","title":"Not Found","status":404,"detail":"message ID does not exist","code":"message_not_found"}`,
 		},
 		{
-			name:  "Fail on missing sender",
+			name:  "Fail on sender not matching token",
+			auth:  "luigi",
 			reqID: "2",
 			req: `{
 				"sender": "bowser",
 				"subject": "re: hello",
 				"body": "group"
 			  }`,
-			expectedCode: http.StatusNotFound,
-			expectedBody: `{"code":404,"message":"sender or message ID does not exist"}`,
+			expectedCode: http.StatusForbidden,
+			expectedBody: `{"type":"urn:messagebox:problem:forbidden","title":"Forbidden","status":403,"detail":"sender does not match the authenticated user","code":"forbidden"}`,
+		},
+		{
+			name:  "Fail on missing token",
+			reqID: "2",
+			req: `{
+				"subject": "re: hello",
+				"body": "group"
+			  }`,
+			expectedCode: http.StatusUnauthorized,
+			expectedBody: `{"type":"urn:messagebox:problem:unauthorized","title":"Unauthorized","status":401,"detail":"missing bearer token","code":"unauthorized"}`,
 		},
 		{
 			name:  "Fail on bad request",
+			auth:  "luigi",
 			reqID: "1",
 			req: `{
 				"sender": "luigi",
@@ -760,10 +2388,11 @@ func TestCreateReply(t *testing.T) {
 				"body": "user"
 			  }`,
 			expectedCode: http.StatusBadRequest,
-			expectedBody: `{"code":400,"message":"invalid request"}`,
+			expectedBody: `{"type":"urn:messagebox:problem:invalid_request","title":"Bad Request","status":400,"detail":"invalid request","code":"invalid_request","errors":[{"field":"subject","rule":"required","message":"subject is required"}]}`,
 		},
 		{
 			name:  "Fail on subject too long (256)",
+			auth:  "luigi",
 			reqID: "1",
 			req: `{
 				"sender": "luigi",
@@ -771,10 +2400,11 @@ func TestCreateReply(t *testing.T) {
 				"body": "user"
 			  }`,
 			expectedCode: http.StatusBadRequest,
-			expectedBody: `{"code":400,"message":"invalid request"}`,
+			expectedBody: `{"type":"urn:messagebox:problem:invalid_request","title":"Bad Request","status":400,"detail":"invalid request","code":"invalid_request","errors":[{"field":"subject","rule":"max","message":"subject must be at most 255 characters long"}]}`,
 		},
 		{
 			name:  "Fail on bad request",
+			auth:  "luigi",
 			reqID: "1",
 			req: `{
 				"sender": "luigi",
@@ -782,7 +2412,7 @@ func TestCreateReply(t *testing.T) {
 				"body": "012345678901234567890123456789012345678901234567890123456789012345678901234567890123456789012345678901234567890123456789012345678901234567890123456789012345678901234567890123456789012345678901234567890123456789012345678901234567890123456789012345678901234567890123456789012345678901234567890123456789012345678901234567890123456789012345678901234567890123456789012345678901234567890123456789012345678901234567890123456789012345678901234567890123456789012345678901234567890123456789012345678901234567890123456789012345678901234567890123456789012345678901234567890123456789012345678901234567890123456789012345678901234567890123456789012345678901234567890123456789012345678901234567890123456789012345678901234567890123456789012345678901234567890123456789012345678901234567890123456789012345678901234567890123456789012345678901234567890123456789012345678901234567890123456789012345678901234567890123456789012345678901234567890123456789012345678901234567890123456789012345678901234567890123456789012345678901234567890123456789012345678901234567890123456789012345678901234567890123456789012345678901234567890123456789012345678901234567890123456789012345678901234567890123456789012345678901234567890123456789012345678901234567890123456789012345678901234567890123456789012345678901234567890123456789012345678901234567890123456789012345678901234567890123456789012345678901234567890123456789012345678901234567890123456789012345678901234567890123456789012345678901234567890123456789012345678901234567890123456789012345678901234567890123456789012345678901234567890123456789012345678901234567890123456789012345678901234567890123456789012345678901234567890123456789012345678901234567890123456789012345678901234567890123456789012345678901234567890123456789012345678901234567890123456789012345678901234567890123456789012345678901234567890123456789012345678901234567890123456789012345678901234567890123456789012345678901234567890123456789012345678901234567890123456789012345678901234567890123456789012345678901234567890"
 			  }`,
 			expectedCode: http.StatusBadRequest,
-			expectedBody: `{"code":400,"message":"invalid request"}`,
+			expectedBody: `{"type":"urn:messagebox:problem:invalid_request","title":"Bad Request","status":400,"detail":"invalid request","code":"invalid_request","errors":[{"field":"body","rule":"max","message":"body must be at most 2000 characters long"}]}`,
 		},
 	}
 
@@ -790,6 +2420,9 @@ func TestCreateReply(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			req, err := http.NewRequest(http.MethodPost, "/messages/"+tt.reqID+"/replies", bytes.NewBufferString(tt.req))
 			assert.NoError(t, err)
+			if tt.auth != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.auth+"-token")
+			}
 			rec := httptest.NewRecorder()
 			router.ServeHTTP(rec, req)
 			assert.Equal(t, tt.expectedCode, rec.Code)
@@ -806,19 +2439,6 @@ func TestCreateReply(t *testing.T) {
 }
 
 func TestGetReplies(t *testing.T) {
-	dbCfg := config.DatabaseConfiguration{
-		DatabaseName: "messagebox",
-		User:         "messagebox_user",
-		Password:     "insecure",
-		Host:         "0.0.0.0",
-		Port:         "5432",
-	}
-
-	database, err := db.Setup(dbCfg, nil)
-	if err != nil {
-		t.Fatal("db.Setup() failed with:", err)
-	}
-
 	seed := `BEGIN;
 	TRUNCATE messages RESTART IDENTITY CASCADE;
 	TRUNCATE user_groups RESTART IDENTITY CASCADE;
@@ -836,56 +2456,64 @@ func TestGetReplies(t *testing.T) {
 	INSERT INTO messages (re, sender, recipient, subject, body) VALUES (1, 3, 1, 're: hello', 'user*');
 	INSERT INTO messages (re, sender, recipient, subject, body) VALUES (2, 3, -1, 're: hello', 'group');
 	INSERT INTO messages (re, sender, recipient, subject, body) VALUES (2, 2, -1, 're: hello', 'group again');
+	INSERT INTO api_tokens (user_id, token_hash) SELECT id, encode(sha256(convert_to(name || '-token', 'UTF8')), 'hex') FROM users;
+	INSERT INTO message_recipients (message_id, recipient, kind) SELECT id, recipient, 'to' FROM messages;
 	COMMIT;`
-	SeedDB(t, database, seed)
 
-	router := Setup()
+	router := setupRouter(t, setupRepos(t, seed))
 
 	cases := []struct {
 		name         string
+		auth         string
 		req          string
 		expectedCode int
 		expectedBody string
 	}{
 		{
 			name:         "Success with original user recipient",
+			auth:         "super.mario",
 			req:          "1",
 			expectedCode: http.StatusOK,
 			expectedBody: `[
-				{"id":3,"re":1,"sender":"luigi","recipient":{"username":"super.mario"},"subject":"re: hello","body":"use","sentAt":"2019-09-03T17:12:42Z"},
-				{"id":4,"re":1,"sender":"luigi","recipient":{"username":"super.mario"},"subject":"re: hello","body":"user*","sentAt":"2019-09-03T17:12:42Z"}]`,
+				{"id":3,"re":1,"sender":"luigi","recipient":{"username":"super.mario"},"to":[{"username":"super.mario"}],"subject":"re: hello","body":"use","sentAt":"2019-09-03T17:12:42Z"},
+				{"id":4,"re":1,"sender":"luigi","recipient":{"username":"super.mario"},"to":[{"username":"super.mario"}],"subject":"re: hello","body":"user*","sentAt":"2019-09-03T17:12:42Z"}]`,
 		},
 		{
 			name:         "Success with original group recipient",
+			auth:         "Yoshi",
 			req:          "2",
 			expectedCode: http.StatusOK,
 			expectedBody: `[
-				{"id":5,"re":2,"sender":"luigi","recipient":{"groupname":"green"},"subject":"re: hello","body":"group","sentAt":"2019-09-03T17:12:42Z"},
-				{"id":6,"re":2,"sender":"Yoshi","recipient":{"groupname":"green"},"subject":"re: hello","body":"group again","sentAt":"2019-09-03T17:12:42Z"}]`,
+				{"id":5,"re":2,"sender":"luigi","recipient":{"groupname":"green"},"to":[{"groupname":"green"}],"subject":"re: hello","body":"group","sentAt":"2019-09-03T17:12:42Z"},
+				{"id":6,"re":2,"sender":"Yoshi","recipient":{"groupname":"green"},"to":[{"groupname":"green"}],"subject":"re: hello","body":"group again","sentAt":"2019-09-03T17:12:42Z"}]`,
 		},
 		{
 			name:         "Success with original user recipient but no replies",
+			auth:         "super.mario",
 			req:          "3",
 			expectedCode: http.StatusOK,
 			expectedBody: `[]`,
 		},
 		{
 			name:         "Success with original group recipient but no replies",
+			auth:         "luigi",
 			req:          "5",
 			expectedCode: http.StatusOK,
 			expectedBody: `[]`,
 		},
 		{
 			name:         "Fail on no id",
+			auth:         "luigi",
 			req:          "",
 			expectedCode: http.StatusBadRequest,
-			expectedBody: `{"code":400,"message":"invalid request"}`,
+			expectedBody: `{"type":"urn:messagebox:problem:invalid_request","title":"Bad Request","status":400,"detail":"invalid request","code":"invalid_request"}`,
 		},
 		{
 			name:         "Fail on missing id",
+			auth:         "luigi",
 			req:          "42",
 			expectedCode: http.StatusNotFound,
-			expectedBody: `{"code":404,"message":"message ID does not exist"}`,
+			expectedBody: `{"type":"urn:messagebox:problem:message_not_found","title":"Not Found","status":404,"detail":"message ID does not exist","code":"message_not_found"}`,
 		},
 	}
 
@@ -893,6 +2521,9 @@ func TestGetReplies(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			req, err := http.NewRequest(http.MethodGet, "/messages/"+tt.req+"/replies", nil)
 			assert.NoError(t, err)
+			if tt.auth != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.auth+"-token")
+			}
 			rec := httptest.NewRecorder()
 			router.ServeHTTP(rec, req)
 			assert.Equal(t, tt.expectedCode, rec.Code)
@@ -927,34 +2558,243 @@ func TestGetReplies(t *testing.T) {
 	}
 }
 
-func TestIntegration(t *testing.T) {
-	dbCfg := config.DatabaseConfiguration{
-		DatabaseName: "messagebox",
-		User:         "messagebox_user",
-		Password:     "insecure",
-		Host:         "0.0.0.0",
-		Port:         "5432",
+func TestGetThread(t *testing.T) {
+	seed := `BEGIN;
+	TRUNCATE messages RESTART IDENTITY CASCADE;
+	TRUNCATE user_groups RESTART IDENTITY CASCADE;
+	TRUNCATE groups RESTART IDENTITY CASCADE;
+	TRUNCATE users RESTART IDENTITY CASCADE;
+	INSERT INTO users (name) VALUES ('super.mario');
+	INSERT INTO users (name) VALUES ('luigi');
+	INSERT INTO messages (re, sender, recipient, subject, body, sent_at) VALUES (0, 1, 2, 'hello', 'root', '1994-12-31T00:00:01Z');
+	INSERT INTO messages (re, sender, recipient, subject, body, sent_at) VALUES (1, 2, 1, 're: hello', 'first reply', '1994-12-31T00:00:02Z');
+	INSERT INTO messages (re, sender, recipient, subject, body, sent_at) VALUES (2, 1, 2, 're: re: hello', 'nested reply', '1994-12-31T00:00:03Z');
+	INSERT INTO messages (re, sender, recipient, subject, body, sent_at) VALUES (1, 2, 1, 're: hello', 'second reply', '1994-12-31T00:00:04Z');
+	INSERT INTO messages (re, sender, recipient, subject, body, sent_at) VALUES (0, 2, 1, 'other', 'unrelated', '1994-12-31T00:00:05Z');
+	INSERT INTO api_tokens (user_id, token_hash) SELECT id, encode(sha256(convert_to(name || '-token', 'UTF8')), 'hex') FROM users;
+	INSERT INTO message_recipients (message_id, recipient, kind) SELECT id, recipient, 'to' FROM messages;
+	COMMIT;`
+
+	router := setupRouter(t, setupRepos(t, seed))
+
+	flatThread := `[
+		{"id":1,"sender":"super.mario","recipient":{"username":"luigi"},"to":[{"username":"luigi"}],"subject":"hello","body":"root","sentAt":"1994-12-31T00:00:01Z","depth":0},
+		{"id":2,"re":1,"sender":"luigi","recipient":{"username":"super.mario"},"to":[{"username":"super.mario"}],"subject":"re: hello","body":"first reply","sentAt":"1994-12-31T00:00:02Z","depth":1},
+		{"id":3,"re":2,"sender":"super.mario","recipient":{"username":"luigi"},"to":[{"username":"luigi"}],"subject":"re: re: hello","body":"nested reply","sentAt":"1994-12-31T00:00:03Z","depth":2},
+		{"id":4,"re":1,"sender":"luigi","recipient":{"username":"super.mario"},"to":[{"username":"super.mario"}],"subject":"re: hello","body":"second reply","sentAt":"1994-12-31T00:00:04Z","depth":1}]`
+
+	cases := []struct {
+		name         string
+		auth         string
+		reqURI       string
+		query        string
+		expectedCode int
+		expectedBody string
+	}{
+		{
+			name:         "Success flat from root",
+			auth:         "super.mario",
+			reqURI:       "1",
+			expectedCode: http.StatusOK,
+			expectedBody: flatThread,
+		},
+		{
+			name:         "Success flat from nested reply",
+			auth:         "super.mario",
+			reqURI:       "3",
+			query:        "?format=flat",
+			expectedCode: http.StatusOK,
+			expectedBody: flatThread,
+		},
+		{
+			name:         "Success single message thread",
+			auth:         "super.mario",
+			reqURI:       "5",
+			expectedCode: http.StatusOK,
+			expectedBody: `[{"id":5,"sender":"luigi","recipient":{"username":"super.mario"},"to":[{"username":"super.mario"}],"subject":"other","body":"unrelated","sentAt":"1994-12-31T00:00:05Z","depth":0}]`,
+		},
+		{
+			name:         "Success tree",
+			auth:         "super.mario",
+			reqURI:       "4",
+			query:        "?format=tree",
+			expectedCode: http.StatusOK,
+			expectedBody: `{"id":1,"sender":"super.mario","recipient":{"username":"luigi"},"to":[{"username":"luigi"}],"subject":"hello","body":"root","sentAt":"1994-12-31T00:00:01Z","depth":0,"replies":[
+				{"id":2,"re":1,"sender":"luigi","recipient":{"username":"super.mario"},"to":[{"username":"super.mario"}],"subject":"re: hello","body":"first reply","sentAt":"1994-12-31T00:00:02Z","depth":1,"replies":[
+					{"id":3,"re":2,"sender":"super.mario","recipient":{"username":"luigi"},"to":[{"username":"luigi"}],"subject":"re: re: hello","body":"nested reply","sentAt":"1994-12-31T00:00:03Z","depth":2}]},
+				{"id":4,"re":1,"sender":"luigi","recipient":{"username":"super.mario"},"to":[{"username":"super.mario"}],"subject":"re: hello","body":"second reply","sentAt":"1994-12-31T00:00:04Z","depth":1}]}`,
+		},
+		{
+			name:         "Fail on unknown format",
+			auth:         "super.mario",
+			reqURI:       "1",
+			query:        "?format=graph",
+			expectedCode: http.StatusBadRequest,
+			expectedBody: `{"type":"urn:messagebox:problem:invalid_request","title":"Bad Request","status":400,"detail":"invalid request","code":"invalid_request"}`,
+		},
+		{
+			name:         "Fail on missing message",
+			auth:         "super.mario",
+			reqURI:       "1234567",
+			expectedCode: http.StatusNotFound,
+			expectedBody: `{"type":"urn:messagebox:problem:message_not_found","title":"Not Found","status":404,"detail":"message ID does not exist","code":"message_not_found"}`,
+		},
 	}
 
-	database, err := db.Setup(dbCfg, nil)
-	if err != nil {
-		t.Fatal("db.Setup() failed with:", err)
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, "/messages/"+tt.reqURI+"/thread"+tt.query, nil)
+			assert.NoError(t, err)
+			if tt.auth != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.auth+"-token")
+			}
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+			assert.Equal(t, tt.expectedCode, rec.Code)
+
+			if tt.expectedCode == http.StatusOK {
+				assert.JSONEq(t, tt.expectedBody, rec.Body.String())
+			} else {
+				assert.Equal(t, tt.expectedBody, rec.Body.String())
+			}
+
+			rec.Body.Reset()
+		})
+	}
+}
+
+func TestRepliesAndThreadHideUnreadableMessages(t *testing.T) {
+	seed := `BEGIN;
+	TRUNCATE messages RESTART IDENTITY CASCADE;
+	TRUNCATE user_groups RESTART IDENTITY CASCADE;
+	TRUNCATE groups RESTART IDENTITY CASCADE;
+	TRUNCATE users RESTART IDENTITY CASCADE;
+	INSERT INTO users (name) VALUES ('alice');
+	INSERT INTO users (name) VALUES ('bob');
+	INSERT INTO users (name) VALUES ('carol');
+	INSERT INTO messages (re, sender, recipient, subject, body, sent_at) VALUES (0, 1, 2, 'plans', 'for everyone', '1994-12-31T00:00:01Z');
+	INSERT INTO messages (re, sender, recipient, subject, body, sent_at) VALUES (1, 2, 1, 're: plans', 'for alice only', '1994-12-31T00:00:02Z');
+	INSERT INTO message_recipients (message_id, recipient, kind) VALUES (1, 2, 'to');
+	INSERT INTO message_recipients (message_id, recipient, kind) VALUES (1, 3, 'to');
+	INSERT INTO message_recipients (message_id, recipient, kind) VALUES (2, 1, 'to');
+	INSERT INTO api_tokens (user_id, token_hash) SELECT id, encode(sha256(convert_to(name || '-token', 'UTF8')), 'hex') FROM users;
+	COMMIT;`
+
+	router := setupRouter(t, setupRepos(t, seed))
+
+	root := `{"id":1,"sender":"alice","recipient":{"username":"bob"},"to":[{"username":"bob"},{"username":"carol"}],"subject":"plans","body":"for everyone","sentAt":"1994-12-31T00:00:01Z"`
+	reply := `{"id":2,"re":1,"sender":"bob","recipient":{"username":"alice"},"to":[{"username":"alice"}],"subject":"re: plans","body":"for alice only","sentAt":"1994-12-31T00:00:02Z"`
+
+	cases := []struct {
+		name         string
+		auth         string
+		reqURI       string
+		expectedCode int
+		expectedBody string
+	}{
+		{
+			name:         "Fail to read the reply",
+			auth:         "carol",
+			reqURI:       "/messages/2",
+			expectedCode: http.StatusForbidden,
+			expectedBody: `{"type":"urn:messagebox:problem:forbidden","title":"Forbidden","status":403,"detail":"not permitted to read this message","code":"forbidden"}`,
+		},
+		{
+			name:         "Success replies without the unreadable reply",
+			auth:         "carol",
+			reqURI:       "/messages/1/replies",
+			expectedCode: http.StatusOK,
+			expectedBody: `[]`,
+		},
+		{
+			name:         "Success thread without the unreadable reply",
+			auth:         "carol",
+			reqURI:       "/messages/1/thread",
+			expectedCode: http.StatusOK,
+			expectedBody: `[` + root + `,"depth":0}]`,
+		},
+		{
+			name:         "Success replies as the recipient",
+			auth:         "alice",
+			reqURI:       "/messages/1/replies",
+			expectedCode: http.StatusOK,
+			expectedBody: `[` + reply + `}]`,
+		},
+		{
+			name:         "Success thread as the sender",
+			auth:         "bob",
+			reqURI:       "/messages/1/thread",
+			expectedCode: http.StatusOK,
+			expectedBody: `[` + root + `,"depth":0},` + reply + `,"depth":1}]`,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, tt.reqURI, nil)
+			assert.NoError(t, err)
+			req.Header.Set("Authorization", "Bearer "+tt.auth+"-token")
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+			assert.Equal(t, tt.expectedCode, rec.Code)
+
+			if tt.expectedCode == http.StatusOK {
+				assert.JSONEq(t, tt.expectedBody, rec.Body.String())
+			} else {
+				assert.Equal(t, tt.expectedBody, rec.Body.String())
+			}
+		})
 	}
+}
+
+func TestThreadTreeWithUnreadableMessages(t *testing.T) {
+	// bob replied twice to the group, and has since left it
+	seed := `BEGIN;
+	TRUNCATE messages RESTART IDENTITY CASCADE;
+	TRUNCATE user_groups RESTART IDENTITY CASCADE;
+	TRUNCATE groups RESTART IDENTITY CASCADE;
+	TRUNCATE users RESTART IDENTITY CASCADE;
+	INSERT INTO users (name) VALUES ('alice');
+	INSERT INTO users (name) VALUES ('bob');
+	INSERT INTO groups (name) VALUES ('friends');
+	INSERT INTO user_groups (group_id, user_id) VALUES (-1,1);
+	INSERT INTO messages (re, sender, recipient, subject, body, sent_at) VALUES (0, 1, -1, 'plans', 'for friends', '1994-12-31T00:00:01Z');
+	INSERT INTO messages (re, sender, recipient, subject, body, sent_at) VALUES (1, 2, -1, 're: plans', 'first', '1994-12-31T00:00:02Z');
+	INSERT INTO messages (re, sender, recipient, subject, body, sent_at) VALUES (1, 2, -1, 're: plans', 'second', '1994-12-31T00:00:03Z');
+	INSERT INTO api_tokens (user_id, token_hash) SELECT id, encode(sha256(convert_to(name || '-token', 'UTF8')), 'hex') FROM users;
+	INSERT INTO message_recipients (message_id, recipient, kind) SELECT id, recipient, 'to' FROM messages;
+	COMMIT;`
 
+	router := setupRouter(t, setupRepos(t, seed))
+
+	req, err := http.NewRequest(http.MethodGet, "/messages/3/thread?format=tree", nil)
+	assert.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer bob-token")
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `{"id":2,"re":1,"sender":"bob","recipient":{"groupname":"friends"},"to":[{"groupname":"friends"}],"subject":"re: plans","body":"first","sentAt":"1994-12-31T00:00:02Z","depth":1,
+		"replies":[{"id":3,"re":1,"sender":"bob","recipient":{"groupname":"friends"},"to":[{"groupname":"friends"}],"subject":"re: plans","body":"second","sentAt":"1994-12-31T00:00:03Z","depth":1}]}`, rec.Body.String())
+}
+
+func TestIntegration(t *testing.T) {
 	seed := `BEGIN;
 	TRUNCATE messages RESTART IDENTITY CASCADE;
 	TRUNCATE user_groups RESTART IDENTITY CASCADE;
 	TRUNCATE groups RESTART IDENTITY CASCADE;
 	TRUNCATE users RESTART IDENTITY CASCADE;
 	COMMIT;`
-	SeedDB(t, database, seed)
 
-	router := Setup()
+	testIntegration(t, setupRouter(t, setupRepos(t, seed)))
+}
 
+func testIntegration(t *testing.T, router *gin.Engine) {
 	cases := []struct {
 		name         string
 		verb         string
 		path         string
+		auth         string
 		reqURI       string
 		req          string
 		expectedCode int
@@ -968,6 +2808,7 @@ func TestIntegration(t *testing.T) {
 			req:          `{"username":"super.mario"}`,
 			expectedCode: http.StatusCreated,
 			expectedBody: `{"username":"super.mario"}`,
+			expectedType: controllers.UserRegistered{},
 		},
 		{
 			name:         "Register a new user - success Copy",
@@ -976,6 +2817,7 @@ func TestIntegration(t *testing.T) {
 			req:          `{"username":"indy.cat"}`,
 			expectedCode: http.StatusCreated,
 			expectedBody: `{"username":"indy.cat"}`,
+			expectedType: controllers.UserRegistered{},
 		},
 		{
 			name:         "Register a new user - fail 409 duplicate",
@@ -983,7 +2825,7 @@ func TestIntegration(t *testing.T) {
 			path:         "/users",
 			req:          `{"username":"super.mario"}`,
 			expectedCode: http.StatusConflict,
-			expectedBody: `{"code":409,"message":"user with the same username already registered"}`,
+			expectedBody: `{"type":"urn:messagebox:problem:duplicate_name","title":"Conflict","status":409,"detail":"name is already taken","code":"duplicate_name"}`,
 		},
 		{
 			name:         "Register a new user - fail 400 bad request",
@@ -991,10 +2833,11 @@ func TestIntegration(t *testing.T) {
 			path:         "/users",
 			req:          `{"oh_no":"bad request!"}`,
 			expectedCode: http.StatusBadRequest,
-			expectedBody: `{"code":400,"message":"invalid request"}`,
+			expectedBody: `{"type":"urn:messagebox:problem:invalid_request","title":"Bad Request","status":400,"detail":"invalid request","code":"invalid_request","errors":[{"field":"username","rule":"required","message":"username is required"}]}`,
 		},
 		{
 			name: "Register group - success",
+			auth: "super.mario",
 			verb: http.MethodPost,
 			path: "/groups",
 			req: `{"groupname":"quantummetric",
@@ -1006,6 +2849,7 @@ func TestIntegration(t *testing.T) {
 		},
 		{
 			name: "Register group - fail 409 duplicate",
+			auth: "super.mario",
 			verb: http.MethodPost,
 			path: "/groups",
 			req: `{"groupname":"quantummetric",
@@ -1013,10 +2857,11 @@ func TestIntegration(t *testing.T) {
 				  		"super.mario"
 					]}`,
 			expectedCode: http.StatusConflict,
-			expectedBody: `{"code":409,"message":"group with the same groupname already registered"}`,
+			expectedBody: `{"type":"urn:messagebox:problem:duplicate_name","title":"Conflict","status":409,"detail":"name is already taken","code":"duplicate_name"}`,
 		},
 		{
 			name: "Register group - fail 400 bad request",
+			auth: "super.mario",
 			verb: http.MethodPost,
 			path: "/groups",
 			req: `{"oh_no":"no group name!",
@@ -1024,10 +2869,11 @@ func TestIntegration(t *testing.T) {
 				  		"super.mario"
 					]}`,
 			expectedCode: http.StatusBadRequest,
-			expectedBody: `{"code":400,"message":"invalid request"}`,
+			expectedBody: `{"type":"urn:messagebox:problem:invalid_request","title":"Bad Request","status":400,"detail":"invalid request","code":"invalid_request","errors":[{"field":"groupname","rule":"required","message":"groupname is required"}]}`,
 		},
 		{
 			name: "Create message - success group",
+			auth: "super.mario",
 			verb: http.MethodPost,
 			path: "/messages",
 			req: `{
@@ -1039,11 +2885,12 @@ func TestIntegration(t *testing.T) {
 				"body": "Wanna grab some lunch at Fuzzy's?"
 			  }`,
 			expectedCode: http.StatusCreated,
-			expectedBody: `{"id":1,"sender":"super.mario","recipient":{"groupname":"quantummetric"},"subject":"Lunch","body":"Wanna grab some lunch at Fuzzy's?","sentAt":"2019-09-03T17:12:42Z"}`,
+			expectedBody: `{"id":1,"sender":"super.mario","recipient":{"groupname":"quantummetric"},"to":[{"groupname":"quantummetric"}],"subject":"Lunch","body":"Wanna grab some lunch at Fuzzy's?","sentAt":"2019-09-03T17:12:42Z"}`,
 			expectedType: models.Message{},
 		},
 		{
 			name: "Create message - success user",
+			auth: "super.mario",
 			verb: http.MethodPost,
 			path: "/messages",
 			req: `{
@@ -1055,69 +2902,75 @@ func TestIntegration(t *testing.T) {
 				"body": "Whats up?"
 			  }`,
 			expectedCode: http.StatusCreated,
-			expectedBody: `{"id":2,"sender":"super.mario","recipient":{"username":"indy.cat"},"subject":"Hey!","body":"Whats up?","sentAt":"2019-09-03T17:12:42Z"}`,
+			expectedBody: `{"id":2,"sender":"super.mario","recipient":{"username":"indy.cat"},"to":[{"username":"indy.cat"}],"subject":"Hey!","body":"Whats up?","sentAt":"2019-09-03T17:12:42Z"}`,
 			expectedType: models.Message{},
 		},
 		{
 			name: "Create message - fail 400 bad request",
+			auth: "super.mario",
 			verb: http.MethodPost,
 			path: "/messages",
 			req: `{
-				"oh_no": "no sender!",
 				"recipient": {
 					"groupname": "quantummetric"
 				  },
-				  "subject": "Lunch",
+				  "oh_no": "no subject!",
 				  "body": "Wanna grab some lunch at Fuzzy's?"
 			  }`,
 			expectedCode: http.StatusBadRequest,
-			expectedBody: `{"code":400,"message":"invalid request"}`,
+			expectedBody: `{"type":"urn:messagebox:problem:invalid_request","title":"Bad Request","status":400,"detail":"invalid request","code":"invalid_request","errors":[{"field":"subject","rule":"required","message":"subject is required"}]}`,
 		},
 		{
 			name:         "Get mailbox messages - success for user indy.cat",
+			auth:         "indy.cat",
 			verb:         http.MethodGet,
 			path:         "/users/<uri>/mailbox",
 			reqURI:       "indy.cat",
 			expectedCode: http.StatusOK,
-			expectedBody: `[{"id":2,"sender":"super.mario","recipient":{"username":"indy.cat"},"subject":"Hey!","body":"Whats up?","sentAt":"2019-09-03T17:12:42Z"}]`,
-			expectedType: []models.Message{},
+			expectedBody: `{"messages":[{"id":2,"sender":"super.mario","recipient":{"username":"indy.cat"},"to":[{"username":"indy.cat"}],"subject":"Hey!","body":"Whats up?","sentAt":"2019-09-03T17:12:42Z","unread":true}]}`,
+			expectedType: models.MessagePage{},
 		},
 		{
 			name:         "Get mailbox messages - success for user super.mario",
+			auth:         "super.mario",
 			verb:         http.MethodGet,
 			path:         "/users/<uri>/mailbox",
 			reqURI:       "super.mario",
 			expectedCode: http.StatusOK,
-			expectedBody: `[{"id":1,"sender":"super.mario","recipient":{"groupname":"quantummetric"},"subject":"Lunch","body":"Wanna grab some lunch at Fuzzy's?","sentAt":"2019-09-03T17:12:42Z"}]`,
-			expectedType: []models.Message{},
+			expectedBody: `{"messages":[{"id":1,"sender":"super.mario","recipient":{"groupname":"quantummetric"},"to":[{"groupname":"quantummetric"}],"subject":"Lunch","body":"Wanna grab some lunch at Fuzzy's?","sentAt":"2019-09-03T17:12:42Z","unread":false}]}`,
+			expectedType: models.MessagePage{},
 		},
 		{
-			name:         "Get mailbox messages - fail 404",
+			name:         "Get mailbox messages - fail 403 another user",
+			auth:         "super.mario",
 			verb:         http.MethodGet,
 			path:         "/users/<uri>/mailbox",
 			reqURI:       "superman",
-			expectedCode: http.StatusNotFound,
-			expectedBody: `{"code":404,"message":"user with given username does not exist"}`,
+			expectedCode: http.StatusForbidden,
+			expectedBody: `{"type":"urn:messagebox:problem:forbidden","title":"Forbidden","status":403,"detail":"not permitted to act for another user","code":"forbidden"}`,
 		},
 		{
 			name:         "Get message - success",
+			auth:         "super.mario",
 			verb:         http.MethodGet,
 			path:         "/messages/<uri>",
 			reqURI:       "1",
 			expectedCode: http.StatusOK,
-			expectedBody: `{"id":1,"sender":"super.mario","recipient":{"groupname":"quantummetric"},"subject":"Lunch","body":"Wanna grab some lunch at Fuzzy's?","sentAt":"2019-09-03T17:12:42Z"}`,
+			expectedBody: `{"id":1,"sender":"super.mario","recipient":{"groupname":"quantummetric"},"to":[{"groupname":"quantummetric"}],"subject":"Lunch","body":"Wanna grab some lunch at Fuzzy's?","sentAt":"2019-09-03T17:12:42Z"}`,
 			expectedType: models.Message{},
 		},
 		{
 			name:         "Get message - fail 404",
+			auth:         "super.mario",
 			verb:         http.MethodGet,
 			path:         "/messages/<uri>",
 			reqURI:       "12345789",
 			expectedCode: http.StatusNotFound,
-			expectedBody: `{"code":404,"message":"message ID does not exist"}`,
+			expectedBody: `{"type":"urn:messagebox:problem:message_not_found","title":"Not Found","status":404,"detail":"message ID does not exist","code":"message_not_found"}`,
 		},
 		{
 			name:   "Create reply - success with group",
+			auth:   "super.mario",
 			verb:   http.MethodPost,
 			path:   "/messages/<uri>/replies",
 			reqURI: "1",
@@ -1127,11 +2980,12 @@ func TestIntegration(t *testing.T) {
 				"body": "Wow, this is a reply!"
 			  }`,
 			expectedCode: http.StatusCreated,
-			expectedBody: `{"id":3,"re":1,"sender":"super.mario","recipient":{"groupname":"quantummetric"},"subject":"Im replying!!!","body":"Wow, this is a reply!","sentAt":"2019-09-03T17:12:42Z"}`,
+			expectedBody: `{"id":3,"re":1,"sender":"super.mario","recipient":{"groupname":"quantummetric"},"to":[{"groupname":"quantummetric"}],"subject":"Im replying!!!","body":"Wow, this is a reply!","sentAt":"2019-09-03T17:12:42Z"}`,
 			expectedType: models.Message{},
 		},
 		{
 			name:   "Create reply - success with user",
+			auth:   "super.mario",
 			verb:   http.MethodPost,
 			path:   "/messages/<uri>/replies",
 			reqURI: "2",
@@ -1141,49 +2995,55 @@ func TestIntegration(t *testing.T) {
 				"body": "Another reply??? WOW!!!"
 			  }`,
 			expectedCode: http.StatusCreated,
-			expectedBody: `{"id":4,"re":2,"sender":"super.mario","recipient":{"username":"super.mario"},"subject":"Guess what??","body":"Another reply??? WOW!!!","sentAt":"2019-09-03T17:12:42Z"}`,
+			expectedBody: `{"id":4,"re":2,"sender":"super.mario","recipient":{"username":"super.mario"},"to":[{"username":"super.mario"}],"subject":"Guess what??","body":"Another reply??? WOW!!!","sentAt":"2019-09-03T17:12:42Z"}`,
 			expectedType: models.Message{},
 		},
 		{
 			name:         "Get replies - success",
+			auth:         "super.mario",
 			verb:         http.MethodGet,
 			path:         "/messages/<uri>/replies",
 			reqURI:       "1",
 			expectedCode: http.StatusOK,
-			expectedBody: `[{"id":3,"re":1,"sender":"super.mario","recipient":{"groupname":"quantummetric"},"subject":"Im replying!!!","body":"Wow, this is a reply!","sentAt":"2019-09-03T17:12:42Z"}]`,
+			expectedBody: `[{"id":3,"re":1,"sender":"super.mario","recipient":{"groupname":"quantummetric"},"to":[{"groupname":"quantummetric"}],"subject":"Im replying!!!","body":"Wow, this is a reply!","sentAt":"2019-09-03T17:12:42Z"}]`,
 			expectedType: []models.Message{},
 		},
 		{
 			name:         "Get replies - fail 404",
+			auth:         "super.mario",
 			verb:         http.MethodGet,
 			path:         "/messages/<uri>/replies",
 			reqURI:       "1234567",
 			expectedCode: http.StatusNotFound,
-			expectedBody: `{"code":404,"message":"message ID does not exist"}`,
+			expectedBody: `{"type":"urn:messagebox:problem:message_not_found","title":"Not Found","status":404,"detail":"message ID does not exist","code":"message_not_found"}`,
 		},
 		{
 			name:         "Get mailbox messages with replies - success for user indy.cat",
+			auth:         "indy.cat",
 			verb:         http.MethodGet,
 			path:         "/users/<uri>/mailbox",
 			reqURI:       "indy.cat",
 			expectedCode: http.StatusOK,
-			expectedBody: `[{"id":2,"sender":"super.mario","recipient":{"username":"indy.cat"},"subject":"Hey!","body":"Whats up?","sentAt":"2019-09-03T17:12:42Z"}]`,
-			expectedType: []models.Message{},
+			expectedBody: `{"messages":[{"id":2,"sender":"super.mario","recipient":{"username":"indy.cat"},"to":[{"username":"indy.cat"}],"subject":"Hey!","body":"Whats up?","sentAt":"2019-09-03T17:12:42Z","unread":true}]}`,
+			expectedType: models.MessagePage{},
 		},
 		{
 			name:         "Get mailbox messages with replies - success for user super.mario",
+			auth:         "super.mario",
 			verb:         http.MethodGet,
 			path:         "/users/<uri>/mailbox",
 			reqURI:       "super.mario",
 			expectedCode: http.StatusOK,
-			expectedBody: `[
-				{"id":1,"sender":"super.mario","recipient":{"groupname":"quantummetric"},"subject":"Lunch","body":"Wanna grab some lunch at Fuzzy's?","sentAt":"2019-09-03T17:12:42Z"},
-				{"id":3,"re":1,"sender":"super.mario","recipient":{"groupname":"quantummetric"},"subject":"Im replying!!!","body":"Wow, this is a reply!","sentAt":"2019-09-03T17:12:42Z"},
-				{"id":4,"re":2,"sender":"super.mario","recipient":{"username":"super.mario"},"subject":"Guess what??","body":"Another reply??? WOW!!!","sentAt":"2019-09-03T17:12:42Z"}]`,
-			expectedType: []models.Message{},
+			expectedBody: `{"messages":[
+				{"id":1,"sender":"super.mario","recipient":{"groupname":"quantummetric"},"to":[{"groupname":"quantummetric"}],"subject":"Lunch","body":"Wanna grab some lunch at Fuzzy's?","sentAt":"2019-09-03T17:12:42Z","unread":false},
+				{"id":3,"re":1,"sender":"super.mario","recipient":{"groupname":"quantummetric"},"to":[{"groupname":"quantummetric"}],"subject":"Im replying!!!","body":"Wow, this is a reply!","sentAt":"2019-09-03T17:12:42Z","unread":false},
+				{"id":4,"re":2,"sender":"super.mario","recipient":{"username":"super.mario"},"to":[{"username":"super.mario"}],"subject":"Guess what??","body":"Another reply??? WOW!!!","sentAt":"2019-09-03T17:12:42Z","unread":false}]}`,
+			expectedType: models.MessagePage{},
 		},
 	}
 
+	tokens := make(map[string]string)
+
 	for _, tt := range cases {
 		t.Run(tt.name, func(t *testing.T) {
 			path := strings.Replace(tt.path, `<uri>`, tt.reqURI, 1)
@@ -1195,6 +3055,9 @@ func TestIntegration(t *testing.T) {
 				req, err = http.NewRequest(tt.verb, path, nil)
 			}
 			assert.NoError(t, err)
+			if tt.auth != "" {
+				req.Header.Set("Authorization", "Bearer "+tokens[tt.auth])
+			}
 			rec := httptest.NewRecorder()
 			router.ServeHTTP(rec, req)
 			assert.Equal(t, tt.expectedCode, rec.Code)
@@ -1202,10 +3065,18 @@ func TestIntegration(t *testing.T) {
 			switch tt.expectedCode {
 			case http.StatusOK, http.StatusCreated:
 				switch tt.expectedType.(type) {
+				case controllers.UserRegistered:
+					AssertUserRegistered(t, []byte(tt.expectedBody), rec.Body.Bytes())
+					var registered controllers.UserRegistered
+					err := json.Unmarshal(rec.Body.Bytes(), &registered)
+					assert.NoError(t, err)
+					tokens[registered.Username] = registered.Token
 				case models.Message:
 					AssertMessageEqual(t, []byte(tt.expectedBody), rec.Body.Bytes())
 				case []models.Message:
 					AssertMessageSliceEqual(t, []byte(tt.expectedBody), rec.Body.Bytes())
+				case models.MessagePage:
+					AssertMessagePageEqual(t, []byte(tt.expectedBody), rec.Body.Bytes())
 				default:
 					assert.Equal(t, tt.expectedBody, rec.Body.String())
 				}
@@ -1217,3 +3088,324 @@ func TestIntegration(t *testing.T) {
 		})
 	}
 }
+
+// unreachable is a storage backend whose database cannot be reached.
+type unreachable struct{}
+
+func (unreachable) Ping(ctx context.Context) error {
+	return errors.New("connection refused")
+}
+
+func TestHealth(t *testing.T) {
+	down := persistence.NewMemory()
+	down.Health = unreachable{}
+
+	cases := []struct {
+		name         string
+		repos        *persistence.Repositories
+		path         string
+		expectedCode int
+		expectedBody string
+	}{
+		{
+			name:         "Healthy",
+			repos:        persistence.NewMemory(),
+			path:         "/healthz",
+			expectedCode: http.StatusOK,
+			expectedBody: `{"status":"ok"}`,
+		},
+		{
+			name:         "Healthy while the database is unreachable",
+			repos:        down,
+			path:         "/healthz",
+			expectedCode: http.StatusOK,
+			expectedBody: `{"status":"ok"}`,
+		},
+		{
+			name:         "Ready",
+			repos:        persistence.NewMemory(),
+			path:         "/readyz",
+			expectedCode: http.StatusOK,
+			expectedBody: `{"status":"ready"}`,
+		},
+		{
+			name:         "Not ready while the database is unreachable",
+			repos:        down,
+			path:         "/readyz",
+			expectedCode: http.StatusServiceUnavailable,
+			expectedBody: `{"type":"urn:messagebox:problem:unavailable","title":"Service Unavailable","status":503,"detail":"database is unreachable","code":"unavailable"}`,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			router := setupRouter(t, tt.repos)
+			req, err := http.NewRequest(http.MethodGet, tt.path, nil)
+			assert.NoError(t, err)
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+			assert.Equal(t, tt.expectedCode, rec.Code)
+			assert.Equal(t, tt.expectedBody, rec.Body.String())
+		})
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	router := setupRouter(t, persistence.NewMemory())
+
+	req, err := http.NewRequest(http.MethodPost, "/users", bytes.NewBufferString(`{"username":"super.mario"}`))
+	assert.NoError(t, err)
+	router.ServeHTTP(httptest.NewRecorder(), req)
+
+	req, err = http.NewRequest(http.MethodGet, "/metrics", nil)
+	assert.NoError(t, err)
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), `messagebox_http_requests_total{method="POST",route="/users",status="201"}`)
+	assert.Contains(t, rec.Body.String(), `messagebox_http_request_duration_seconds_bucket{method="POST",route="/users",status="201",le="0.005"}`)
+	assert.Contains(t, rec.Body.String(), "messagebox_users_registered_total")
+	assert.Contains(t, rec.Body.String(), "messagebox_messages_sent_total")
+}
+
+func TestRequestLog(t *testing.T) {
+	core, logs := observer.New(zapcore.InfoLevel)
+	cfg := config.ServerConfiguration{
+		Mode:              gin.TestMode,
+		AccessLogSampling: map[string]float64{"/healthz": 0},
+	}
+	router, err := Setup(cfg, persistence.NewMemory(), controllers.Services{}, zap.New(core))
+	if err != nil {
+		t.Fatal("Setup() failed with:", err)
+	}
+
+	// a request ID from the caller is kept
+	req, err := http.NewRequest(http.MethodPost, "/users", bytes.NewBufferString(`{"username":"super.mario"}`))
+	assert.NoError(t, err)
+	req.Header.Set(middleware.RequestIDHeader, "req-1")
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	assert.Equal(t, "req-1", rec.Header().Get(middleware.RequestIDHeader))
+
+	var registered controllers.UserRegistered
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &registered))
+
+	// an invalid one is replaced
+	req, err = http.NewRequest(http.MethodGet, "/users/super.mario/mailbox", nil)
+	assert.NoError(t, err)
+	req.Header.Set(middleware.RequestIDHeader, "forged\nline")
+	req.Header.Set("Authorization", "Bearer "+registered.Token)
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	mailboxID := rec.Header().Get(middleware.RequestIDHeader)
+	assert.Regexp(t, `^[0-9a-f]{32}$`, mailboxID)
+
+	// sampled out
+	req, err = http.NewRequest(http.MethodGet, "/healthz", nil)
+	assert.NoError(t, err)
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	assert.NotEmpty(t, rec.Header().Get(middleware.RequestIDHeader))
+
+	lines := logs.FilterMessage("request handled").All()
+	if !assert.Len(t, lines, 2) {
+		return
+	}
+
+	created := lines[0].ContextMap()
+	assert.Equal(t, "req-1", created["request_id"])
+	assert.Equal(t, http.MethodPost, created["method"])
+	assert.Equal(t, "/users", created["route"])
+	assert.EqualValues(t, http.StatusCreated, created["status"])
+	assert.Contains(t, created, "latency")
+	assert.NotContains(t, created, "user")
+
+	mailbox := lines[1].ContextMap()
+	assert.Equal(t, mailboxID, mailbox["request_id"])
+	assert.Equal(t, "/users/:username/mailbox", mailbox["route"])
+	assert.Equal(t, "super.mario", mailbox["user"])
+	assert.Greater(t, mailbox["size"], int64(0))
+}
+
+func TestRateLimit(t *testing.T) {
+	limiter := ratelimit.New(ratelimit.NewMemoryStore(), map[ratelimit.Scope]ratelimit.Limit{
+		ratelimit.PerIP:     {Rate: 1, Burst: 5},
+		ratelimit.PerSender: {Rate: 1, Burst: 2},
+		ratelimit.PerGroup:  {Rate: 1, Burst: 1},
+	})
+	router, err := Setup(config.ServerConfiguration{Mode: gin.TestMode}, persistence.NewMemory(), controllers.Services{Limiter: limiter}, nil)
+	if err != nil {
+		t.Fatal("Setup() failed with:", err)
+	}
+
+	send := func(body, token string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(http.MethodPost, "/messages", bytes.NewBufferString(body))
+		assert.NoError(t, err)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	req, err := http.NewRequest(http.MethodPost, "/users", bytes.NewBufferString(`{"username":"super.mario"}`))
+	assert.NoError(t, err)
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	var registered controllers.UserRegistered
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &registered))
+	assert.Equal(t, "5", rec.Header().Get("RateLimit-Limit"))
+	assert.Equal(t, "4", rec.Header().Get("RateLimit-Remaining"))
+
+	req, err = http.NewRequest(http.MethodPost, "/groups", bytes.NewBufferString(`{"groupname":"mushroom.kingdom","usernames":["super.mario"]}`))
+	assert.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer "+registered.Token)
+	router.ServeHTTP(httptest.NewRecorder(), req)
+
+	// the group has room for one message
+	rec = send(`{"to":[{"groupname":"mushroom.kingdom"}],"subject":"hello"}`, registered.Token)
+	assert.Equal(t, http.StatusCreated, rec.Code)
+	rec = send(`{"to":[{"groupname":"mushroom.kingdom"}],"subject":"hello again"}`, registered.Token)
+	assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+	assert.Equal(t, "1", rec.Header().Get("Retry-After"))
+	assert.Equal(t, "1", rec.Header().Get("RateLimit-Limit"))
+	assert.Equal(t, "0", rec.Header().Get("RateLimit-Remaining"))
+	assert.Equal(t, `{"type":"urn:messagebox:problem:too_many_requests","title":"Too Many Requests","status":429,"detail":"rate limit exceeded, retry later","code":"too_many_requests"}`, rec.Body.String())
+
+	// and the sender had room for two
+	rec = send(`{"to":[{"username":"super.mario"}],"subject":"note to self"}`, registered.Token)
+	assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+	assert.Equal(t, "2", rec.Header().Get("RateLimit-Limit"))
+
+	// and the client IP for five requests
+	rec = send(`{"to":[{"username":"super.mario"}],"subject":"note to self"}`, "")
+	assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+	assert.Equal(t, "5", rec.Header().Get("RateLimit-Limit"))
+
+	// probes are not limited
+	req, err = http.NewRequest(http.MethodGet, "/healthz", nil)
+	assert.NoError(t, err)
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Empty(t, rec.Header().Get("RateLimit-Limit"))
+}
+
+func TestRateLimitGroups(t *testing.T) {
+	limiter := ratelimit.New(ratelimit.NewMemoryStore(), map[ratelimit.Scope]ratelimit.Limit{
+		ratelimit.PerGroup: {Rate: 1, Burst: 1},
+	})
+	router, err := Setup(config.ServerConfiguration{Mode: gin.TestMode}, persistence.NewMemory(), controllers.Services{Limiter: limiter}, nil)
+	if err != nil {
+		t.Fatal("Setup() failed with:", err)
+	}
+
+	var registered controllers.UserRegistered
+	post := func(path, body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(http.MethodPost, path, bytes.NewBufferString(body))
+		assert.NoError(t, err)
+		if registered.Token != "" {
+			req.Header.Set("Authorization", "Bearer "+registered.Token)
+		}
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := post("/users", `{"username":"super.mario"}`)
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &registered))
+	post("/groups", `{"groupname":"mushroom.kingdom","usernames":["super.mario"]}`)
+
+	// a message to a group that does not exist takes no tokens from the others
+	rec = post("/messages", `{"to":[{"groupname":"mushroom.kingdom"},{"groupname":"ghost.house"}],"subject":"hello"}`)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+	assert.Empty(t, rec.Header().Get("RateLimit-Limit"))
+
+	rec = post("/messages", `{"to":[{"groupname":"mushroom.kingdom"}],"subject":"hello"}`)
+	assert.Equal(t, http.StatusCreated, rec.Code)
+	var sent models.Message
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &sent))
+
+	// replies go to the group too
+	rec = post("/messages/"+strconv.Itoa(int(sent.ID))+"/replies", `{"subject":"re: hello"}`)
+	assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+	assert.Equal(t, "1", rec.Header().Get("RateLimit-Limit"))
+}
+
+func TestRateLimitClientIP(t *testing.T) {
+	cases := []struct {
+		name           string
+		trustedProxies []string
+		expectedCode   int
+	}{
+		{
+			name:         "Fail on forwarded IPs from untrusted proxies",
+			expectedCode: http.StatusTooManyRequests,
+		},
+		{
+			name:           "Success on forwarded IPs from trusted proxies",
+			trustedProxies: []string{"192.0.2.0/24"},
+			expectedCode:   http.StatusNotFound,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			limiter := ratelimit.New(ratelimit.NewMemoryStore(), map[ratelimit.Scope]ratelimit.Limit{
+				ratelimit.PerIP: {Rate: 1, Burst: 1},
+			})
+			cfg := config.ServerConfiguration{Mode: gin.TestMode, TrustedProxies: tt.trustedProxies}
+			router, err := Setup(cfg, persistence.NewMemory(), controllers.Services{Limiter: limiter}, nil)
+			if err != nil {
+				t.Fatal("Setup() failed with:", err)
+			}
+
+			// both requests come from 192.0.2.1, claiming to be forwarded for others
+			var rec *httptest.ResponseRecorder
+			for _, ip := range []string{"203.0.113.1", "203.0.113.2"} {
+				req := httptest.NewRequest(http.MethodGet, "/users/super.mario", nil)
+				req.Header.Set("X-Forwarded-For", ip)
+				rec = httptest.NewRecorder()
+				router.ServeHTTP(rec, req)
+			}
+			assert.Equal(t, tt.expectedCode, rec.Code)
+		})
+	}
+}
+
+func TestClientCertificate(t *testing.T) {
+	router := setupRouter(t, persistence.NewMemory())
+
+	req, err := http.NewRequest(http.MethodPost, "/users", bytes.NewBufferString(`{"username":"billing"}`))
+	assert.NoError(t, err)
+	router.ServeHTTP(httptest.NewRecorder(), req)
+
+	get := func(state *tls.ConnectionState) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(http.MethodGet, "/users/billing/mailbox", nil)
+		assert.NoError(t, err)
+		req.TLS = state
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+	verified := func(commonName string) *tls.ConnectionState {
+		cert := &x509.Certificate{Subject: pkix.Name{CommonName: commonName}}
+		return &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+	}
+
+	// a verified certificate authenticates the user named by its subject
+	rec := get(verified("billing"))
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	rec = get(verified("payroll"))
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	assert.Contains(t, rec.Body.String(), "no user for client certificate subject")
+
+	// certificates the handshake did not verify count for nothing
+	rec = get(&tls.ConnectionState{PeerCertificates: []*x509.Certificate{{Subject: pkix.Name{CommonName: "billing"}}}})
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	assert.Contains(t, rec.Body.String(), "missing bearer token")
+}
@@ -0,0 +1,181 @@
+package router
+
+import (
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/benshields/messagebox/internal/pkg/config"
+	"github.com/benshields/messagebox/internal/pkg/db"
+	"github.com/benshields/messagebox/internal/pkg/models"
+	"github.com/benshields/messagebox/internal/pkg/persistence"
+)
+
+// testBackendEnv selects the storage backend the router tests run against:
+// the in-memory one by default, or Postgres when set to "postgres".
+const testBackendEnv = "MESSAGEBOX_TEST_BACKEND"
+
+var testDatabaseConfig = config.DatabaseConfiguration{
+	DatabaseName: "messagebox",
+	User:         "messagebox_user",
+	Password:     "insecure",
+	Host:         "0.0.0.0",
+	Port:         "5432",
+}
+
+func usePostgres() bool {
+	return os.Getenv(testBackendEnv) == "postgres"
+}
+
+// requirePostgres skips tests of what only the Postgres backend does.
+func requirePostgres(t *testing.T) {
+	if !usePostgres() {
+		t.Skip("needs Postgres; set " + testBackendEnv + "=postgres to run it")
+	}
+}
+
+// setupRepos returns repositories holding the rows that seed inserts. The
+// seed is SQL, run as is against Postgres; for the in-memory backend its
+// INSERT statements are read by parseSeed.
+func setupRepos(t *testing.T, seed string) *persistence.Repositories {
+	if !usePostgres() {
+		return persistence.NewMemoryWith(parseSeed(t, seed))
+	}
+
+	database, err := db.Setup(testDatabaseConfig, nil)
+	if err != nil {
+		t.Fatal("db.Setup() failed with:", err)
+	}
+	SeedDB(t, database, seed)
+	return persistence.NewPostgres()
+}
+
+var (
+	insertPattern = regexp.MustCompile(`(?s)^INSERT INTO (\w+) \(([^)]*)\) VALUES \((.*)\)$`)
+	lineBreaks    = regexp.MustCompile(`\s*\n\s*`)
+	hashPattern   = regexp.MustCompile(`^encode\(sha256\('([^']*)'\), 'hex'\)$`)
+)
+
+// The INSERT ... SELECT statements that seeds use, which copy other tables.
+const (
+	seedTokensForUsers  = `INSERT INTO api_tokens (user_id, token_hash) SELECT id, encode(sha256(convert_to(name || '-token', 'UTF8')), 'hex') FROM users`
+	seedToForRecipients = `INSERT INTO message_recipients (message_id, recipient, kind) SELECT id, recipient, 'to' FROM messages`
+)
+
+// parseSeed reads the rows that the statements of seed insert. Only the SQL
+// that seeds use is understood; anything else fails the test, rather than
+// leaving the in-memory backend to differ silently from Postgres.
+func parseSeed(t *testing.T, seed string) persistence.Rows {
+	var rows persistence.Rows
+	for _, stmt := range strings.Split(seed, ";") {
+		stmt = strings.TrimSpace(lineBreaks.ReplaceAllString(stmt, " "))
+		switch {
+		case stmt == "" || stmt == "BEGIN" || stmt == "COMMIT" || strings.HasPrefix(stmt, "TRUNCATE "):
+			// the backend starts empty
+		case stmt == seedTokensForUsers:
+			for i, u := range rows.Users {
+				rows.Tokens = append(rows.Tokens, models.APIToken{UserID: int32(i + 1), TokenHash: persistence.HashToken(u.Name + "-token")})
+			}
+		case stmt == seedToForRecipients:
+			for i, m := range rows.Messages {
+				rows.Recipients = append(rows.Recipients, models.MessageRecipient{MessageID: int32(i + 1), RecipientID: m.RecipientID, Kind: models.RecipientTo})
+			}
+		default:
+			parseInsert(t, &rows, stmt)
+		}
+	}
+	return rows
+}
+
+func parseInsert(t *testing.T, rows *persistence.Rows, stmt string) {
+	match := insertPattern.FindStringSubmatch(stmt)
+	if match == nil {
+		t.Fatalf("seed statement not understood: %s", stmt)
+	}
+	table := match[1]
+	columns := strings.Split(match[2], ", ")
+	values := splitValues(match[3])
+	if len(columns) != len(values) {
+		t.Fatalf("seed statement has %d columns and %d values: %s", len(columns), len(values), stmt)
+	}
+
+	row := make(map[string]string, len(columns))
+	for i, column := range columns {
+		row[column] = values[i]
+	}
+	str := func(column string) string {
+		return strings.ReplaceAll(strings.TrimSuffix(strings.TrimPrefix(row[column], "'"), "'"), "''", "'")
+	}
+	id := func(column string) int32 {
+		n, err := strconv.ParseInt(row[column], 10, 32)
+		if err != nil {
+			t.Fatalf("seed statement has a bad %s: %s", column, stmt)
+		}
+		return int32(n)
+	}
+	timestamp := func(column string) time.Time {
+		if _, ok := row[column]; !ok {
+			return time.Time{}
+		}
+		ts, err := time.Parse(time.RFC3339, str(column))
+		if err != nil {
+			t.Fatalf("seed statement has a bad %s: %s", column, stmt)
+		}
+		return ts
+	}
+
+	switch table {
+	case "users":
+		rows.Users = append(rows.Users, models.User{Name: str("name")})
+	case "groups":
+		rows.Groups = append(rows.Groups, models.Group{Name: str("name"), CreatedAt: timestamp("created_at")})
+	case "user_groups":
+		rows.UserGroups = append(rows.UserGroups, models.UserGroup{GroupID: id("group_id"), UserID: id("user_id")})
+	case "messages":
+		rows.Messages = append(rows.Messages, models.Message{
+			Re:          id("re"),
+			SenderID:    id("sender"),
+			RecipientID: id("recipient"),
+			Subject:     str("subject"),
+			Body:        str("body"),
+			SentAt:      timestamp("sent_at"),
+		})
+	case "message_recipients":
+		rows.Recipients = append(rows.Recipients, models.MessageRecipient{MessageID: id("message_id"), RecipientID: id("recipient"), Kind: str("kind")})
+	case "receipts":
+		rows.Receipts = append(rows.Receipts, models.Receipt{MessageID: id("message_id"), UserID: id("user_id")})
+	case "api_tokens":
+		hash := hashPattern.FindStringSubmatch(row["token_hash"])
+		if hash == nil {
+			t.Fatalf("seed statement has a bad token_hash: %s", stmt)
+		}
+		rows.Tokens = append(rows.Tokens, models.APIToken{UserID: id("user_id"), TokenHash: persistence.HashToken(hash[1])})
+	default:
+		t.Fatalf("seed statement inserts into an unknown table: %s", stmt)
+	}
+}
+
+// splitValues splits a VALUES list at the commas outside quotes and brackets.
+func splitValues(list string) []string {
+	var values []string
+	var quoted bool
+	depth, start := 0, 0
+	for i, r := range list {
+		switch {
+		case r == '\'':
+			quoted = !quoted
+		case quoted:
+		case r == '(':
+			depth++
+		case r == ')':
+			depth--
+		case r == ',' && depth == 0:
+			values = append(values, strings.TrimSpace(list[start:i]))
+			start = i + 1
+		}
+	}
+	return append(values, strings.TrimSpace(list[start:]))
+}
@@ -0,0 +1,68 @@
+package router
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+
+	"github.com/benshields/messagebox/internal/api/controllers"
+	"github.com/benshields/messagebox/internal/pkg/config"
+	"github.com/benshields/messagebox/internal/pkg/openapi"
+	"github.com/benshields/messagebox/internal/pkg/persistence"
+)
+
+// pathParam matches the parameters of gin paths, such as ":username".
+var pathParam = regexp.MustCompile(`:(\w+)`)
+
+// TestRoutesMatchSpec fails when a route is registered without being
+// documented in the OpenAPI spec, or documented without being registered.
+func TestRoutesMatchSpec(t *testing.T) {
+	doc, err := openapi.Load()
+	if err != nil {
+		t.Fatal("openapi.Load() failed with:", err)
+	}
+
+	var documented []string
+	for path, item := range doc.Paths {
+		for method := range item.Operations() {
+			documented = append(documented, method+" "+path)
+		}
+	}
+	sort.Strings(documented)
+
+	var registered []string
+	for _, route := range setupRouter(t, persistence.NewMemory()).Routes() {
+		path := pathParam.ReplaceAllString(route.Path, "{$1}")
+		if !strings.HasPrefix(path, "/") {
+			path = "/" + path
+		}
+		registered = append(registered, route.Method+" "+path)
+	}
+	sort.Strings(registered)
+
+	assert.Equal(t, documented, registered)
+}
+
+// TestIntegrationMatchesSpec runs the requests of TestIntegration with the
+// spec validator on, and fails on every response it finds does not match.
+func TestIntegrationMatchesSpec(t *testing.T) {
+	core, logs := observer.New(zapcore.WarnLevel)
+	cfg := config.ServerConfiguration{Mode: gin.DebugMode, ValidateSpec: true}
+	router, err := Setup(cfg, persistence.NewMemory(), controllers.Services{}, zap.New(core))
+	if err != nil {
+		t.Fatal("Setup() failed with:", err)
+	}
+
+	testIntegration(t, router)
+
+	for _, entry := range logs.FilterMessageSnippet("response does not match").All() {
+		t.Errorf("%s: %v", entry.Message, entry.ContextMap())
+	}
+}
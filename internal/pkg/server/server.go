@@ -29,8 +29,11 @@ func (e ShutdownError) Error() string {
 	return "APIServer.Shutdown() failed unexpectedly: " + e.Err.Error()
 }
 
+// APIServer serves the router over HTTP, or over HTTPS when cfg.TLS names a
+// certificate and key.
 type APIServer struct {
 	httpServer *http.Server
+	certs      *certReloader
 	log        *zap.Logger
 }
 
@@ -48,23 +51,44 @@ func Setup(cfg config.ServerConfiguration, log *zap.Logger, router *gin.Engine)
 	gin.SetMode(cfg.Mode)
 	srv.httpServer.Handler = router
 
+	if cfg.TLS.CertFile != "" {
+		certs, err := newCertReloader(cfg.TLS, log)
+		if err != nil {
+			return nil, err
+		}
+		srv.certs = certs
+		srv.httpServer.TLSConfig = certs.TLSConfig()
+	}
+
 	return srv, nil
 }
 
 func (srv *APIServer) Start(ctx context.Context, errCh chan<- error) {
+	if srv.certs != nil {
+		go srv.certs.watch(ctx)
+	}
+
 	go func() {
 		for {
 			select {
 			case <-ctx.Done():
 				errCh <- nil
 				return
-			case errCh <- srv.httpServer.ListenAndServe():
+			case errCh <- srv.listenAndServe():
 				return
 			}
 		}
 	}()
 }
 
+func (srv *APIServer) listenAndServe() error {
+	if srv.certs != nil {
+		// the certificate comes from TLSConfig
+		return srv.httpServer.ListenAndServeTLS("", "")
+	}
+	return srv.httpServer.ListenAndServe()
+}
+
 func (srv *APIServer) Shutdown(ctx context.Context) error {
 	err := srv.httpServer.Shutdown(ctx)
 	if err != nil && err != http.ErrServerClosed {
@@ -0,0 +1,206 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/benshields/messagebox/internal/pkg/config"
+)
+
+// The choices of config.TLSConfiguration.ClientAuth: whether the server asks
+// clients for a certificate signed by a CA in ClientCAFile.
+const (
+	// ClientAuthNone does not ask for a certificate.
+	ClientAuthNone = "none"
+	// ClientAuthOptional verifies a certificate when the client gives one.
+	ClientAuthOptional = "optional"
+	// ClientAuthRequire turns away clients without a verified certificate.
+	ClientAuthRequire = "require"
+)
+
+// TLSError is returned by Setup when the certificate, key or client CA files
+// cannot be loaded.
+type TLSError struct {
+	Err error
+}
+
+func (e TLSError) Error() string {
+	return "server TLS setup failed: " + e.Err.Error()
+}
+
+// UnknownClientAuthError is returned by Setup for a ClientAuth that is not one
+// of the ClientAuth constants.
+type UnknownClientAuthError struct {
+	ClientAuth string
+}
+
+func (e UnknownClientAuthError) Error() string {
+	return "unknown TLS client auth: " + e.ClientAuth
+}
+
+var errNoClientCAs = errors.New("no certificates found in the client CA file")
+
+// certReloader holds the TLS configuration built from the certificate, key and
+// client CA files, and builds it again when one of them changes on disk. A
+// failed reload is logged and the previous configuration is kept.
+type certReloader struct {
+	cfg        config.TLSConfiguration
+	clientAuth tls.ClientAuthType
+	log        *zap.Logger
+
+	mu       sync.RWMutex
+	current  *tls.Config
+	modTimes []time.Time
+}
+
+func newCertReloader(cfg config.TLSConfiguration, log *zap.Logger) (*certReloader, error) {
+	clientAuth, err := clientAuthType(cfg.ClientAuth)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &certReloader{
+		cfg:        cfg,
+		clientAuth: clientAuth,
+		log:        log,
+	}
+	if _, err := r.reload(); err != nil {
+		return nil, TLSError{err}
+	}
+	return r, nil
+}
+
+func clientAuthType(clientAuth string) (tls.ClientAuthType, error) {
+	switch clientAuth {
+	case ClientAuthNone, "":
+		return tls.NoClientCert, nil
+	case ClientAuthOptional:
+		return tls.VerifyClientCertIfGiven, nil
+	case ClientAuthRequire:
+		return tls.RequireAndVerifyClientCert, nil
+	default:
+		return tls.NoClientCert, UnknownClientAuthError{ClientAuth: clientAuth}
+	}
+}
+
+// TLSConfig returns the configuration for the server to listen with, which
+// hands each connection the latest configuration.
+func (r *certReloader) TLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			r.mu.RLock()
+			defer r.mu.RUnlock()
+			return r.current, nil
+		},
+	}
+}
+
+// reload builds the configuration again when a file has changed since the last
+// time, reporting whether it did.
+func (r *certReloader) reload() (bool, error) {
+	modTimes, err := r.statFiles()
+	if err != nil {
+		return false, err
+	}
+
+	r.mu.RLock()
+	unchanged := r.current != nil && sameTimes(modTimes, r.modTimes)
+	r.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.cfg.CertFile, r.cfg.KeyFile)
+	if err != nil {
+		return false, err
+	}
+	// the handshake uses this configuration rather than the server's, so it
+	// must offer HTTP/2 itself
+	next := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   r.clientAuth,
+		NextProtos:   []string{"h2", "http/1.1"},
+	}
+	if r.clientAuth != tls.NoClientCert {
+		pem, err := ioutil.ReadFile(r.cfg.ClientCAFile)
+		if err != nil {
+			return false, err
+		}
+		next.ClientCAs = x509.NewCertPool()
+		if !next.ClientCAs.AppendCertsFromPEM(pem) {
+			return false, errNoClientCAs
+		}
+	}
+
+	r.mu.Lock()
+	r.current = next
+	r.modTimes = modTimes
+	r.mu.Unlock()
+	return true, nil
+}
+
+// statFiles returns the modification time of each file. Any change counts,
+// as a file replaced by a copy may be older than the one it replaces.
+func (r *certReloader) statFiles() ([]time.Time, error) {
+	paths := []string{r.cfg.CertFile, r.cfg.KeyFile}
+	if r.clientAuth != tls.NoClientCert {
+		paths = append(paths, r.cfg.ClientCAFile)
+	}
+
+	modTimes := make([]time.Time, len(paths))
+	for i, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		modTimes[i] = info.ModTime()
+	}
+	return modTimes, nil
+}
+
+func sameTimes(a, b []time.Time) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !a[i].Equal(b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// watch checks the files every ReloadInterval until ctx is done. A zero
+// interval never checks them.
+func (r *certReloader) watch(ctx context.Context) {
+	if r.cfg.ReloadInterval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(r.cfg.ReloadInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			reloaded, err := r.reload()
+			switch {
+			case err != nil:
+				r.log.Warn("TLS reload failed, keeping the current certificate", zap.Error(err))
+			case reloaded:
+				r.log.Info("TLS certificate reloaded", zap.String("certFile", r.cfg.CertFile))
+			}
+		}
+	}
+}
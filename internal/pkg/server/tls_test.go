@@ -0,0 +1,185 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+
+	"github.com/benshields/messagebox/internal/pkg/config"
+)
+
+// testCert is a certificate and its key, signed by parent or else by itself.
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCert(t *testing.T, commonName string, parent *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	assert.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	assert.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.NoError(t, err)
+	return &testCert{cert: cert, key: key}
+}
+
+func (c *testCert) certPEM() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.cert.Raw})
+}
+
+func (c *testCert) keyPEM(t *testing.T) []byte {
+	der, err := x509.MarshalECPrivateKey(c.key)
+	assert.NoError(t, err)
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+}
+
+func (c *testCert) tlsCertificate(t *testing.T) tls.Certificate {
+	cert, err := tls.X509KeyPair(c.certPEM(), c.keyPEM(t))
+	assert.NoError(t, err)
+	return cert
+}
+
+// writeFiles writes the certificate and key of c to cfg, dated at modTime.
+func (c *testCert) writeFiles(t *testing.T, cfg config.TLSConfiguration, modTime time.Time) {
+	assert.NoError(t, ioutil.WriteFile(cfg.CertFile, c.certPEM(), 0600))
+	assert.NoError(t, ioutil.WriteFile(cfg.KeyFile, c.keyPEM(t), 0600))
+	assert.NoError(t, os.Chtimes(cfg.CertFile, modTime, modTime))
+	assert.NoError(t, os.Chtimes(cfg.KeyFile, modTime, modTime))
+}
+
+func TestTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	ca := newTestCert(t, "messagebox test CA", nil)
+	cfg := config.TLSConfiguration{
+		CertFile:     filepath.Join(dir, "server.crt"),
+		KeyFile:      filepath.Join(dir, "server.key"),
+		ClientAuth:   ClientAuthRequire,
+		ClientCAFile: filepath.Join(dir, "ca.crt"),
+	}
+	assert.NoError(t, ioutil.WriteFile(cfg.ClientCAFile, ca.certPEM(), 0600))
+	first := newTestCert(t, "first", ca)
+	first.writeFiles(t, cfg, time.Now().Add(-time.Minute))
+
+	router := gin.New()
+	router.GET("/", func(c *gin.Context) {
+		c.String(http.StatusOK, c.Request.TLS.VerifiedChains[0][0].Subject.CommonName)
+	})
+	srv, err := Setup(config.ServerConfiguration{Mode: gin.TestMode, TLS: cfg}, zap.NewNop(), router)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	go func() {
+		_ = srv.httpServer.Serve(tls.NewListener(listener, srv.httpServer.TLSConfig))
+	}()
+	defer srv.httpServer.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	client := newTestCert(t, "billing", ca)
+	get := func(certs ...tls.Certificate) (string, string, error) {
+		c := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots, Certificates: certs}}}
+		res, err := c.Get("https://" + listener.Addr().String())
+		if err != nil {
+			return "", "", err
+		}
+		defer res.Body.Close()
+		body, err := ioutil.ReadAll(res.Body)
+		return string(body), res.TLS.PeerCertificates[0].Subject.CommonName, err
+	}
+
+	// the server sees the subject of a client certificate signed by the CA
+	subject, served, err := get(client.tlsCertificate(t))
+	assert.NoError(t, err)
+	assert.Equal(t, "billing", subject)
+	assert.Equal(t, "first", served)
+
+	// and offers HTTP/2
+	conn, err := tls.Dial("tcp", listener.Addr().String(), &tls.Config{RootCAs: roots, Certificates: []tls.Certificate{client.tlsCertificate(t)}, NextProtos: []string{"h2"}})
+	if assert.NoError(t, err) {
+		assert.Equal(t, "h2", conn.ConnectionState().NegotiatedProtocol)
+		conn.Close()
+	}
+
+	// and turns away clients without one, or with one signed by another CA
+	_, _, err = get()
+	assert.Error(t, err)
+	_, _, err = get(newTestCert(t, "billing", newTestCert(t, "another CA", nil)).tlsCertificate(t))
+	assert.Error(t, err)
+
+	// unchanged files are not reloaded
+	reloaded, err := srv.certs.reload()
+	assert.NoError(t, err)
+	assert.False(t, reloaded)
+
+	// replaced files are, even when older than the ones they replace
+	newTestCert(t, "second", ca).writeFiles(t, cfg, time.Now().Add(-time.Hour))
+	reloaded, err = srv.certs.reload()
+	assert.NoError(t, err)
+	assert.True(t, reloaded)
+	_, served, err = get(client.tlsCertificate(t))
+	assert.NoError(t, err)
+	assert.Equal(t, "second", served)
+
+	// files that cannot be loaded leave the current certificate in place
+	assert.NoError(t, ioutil.WriteFile(cfg.KeyFile, []byte("not a key"), 0600))
+	_, err = srv.certs.reload()
+	assert.Error(t, err)
+	_, served, err = get(client.tlsCertificate(t))
+	assert.NoError(t, err)
+	assert.Equal(t, "second", served)
+}
+
+func TestSetupTLSErrors(t *testing.T) {
+	router := gin.New()
+
+	_, err := Setup(config.ServerConfiguration{Mode: gin.TestMode, TLS: config.TLSConfiguration{CertFile: "does/not/exist", KeyFile: "does/not/exist"}}, zap.NewNop(), router)
+	assert.ErrorAs(t, err, &TLSError{})
+
+	_, err = Setup(config.ServerConfiguration{Mode: gin.TestMode, TLS: config.TLSConfiguration{CertFile: "does/not/exist", ClientAuth: "sometimes"}}, zap.NewNop(), router)
+	assert.Equal(t, UnknownClientAuthError{ClientAuth: "sometimes"}, err)
+}
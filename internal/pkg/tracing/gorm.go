@@ -0,0 +1,109 @@
+package tracing
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.10.0"
+	"go.opentelemetry.io/otel/trace"
+	"gorm.io/gorm"
+)
+
+// spanKey keeps the span of a query on its statement, between the callbacks
+// that run before and after it.
+const spanKey = "tracing:span"
+
+// literal matches the string and number literals of a SQL statement, along
+// with its placeholders, which are kept.
+var literal = regexp.MustCompile(`'(?:[^']|'')*'|\$\d+|\b\d+(?:\.\d+)?\b`)
+
+// Plugin is a GORM plugin that records a span for every query, as a child of
+// the span in the context the query runs with, as set by gorm.DB.WithContext.
+// The SQL text is recorded with its literals replaced by "?", and without the
+// values bound to its placeholders, so that spans hold no user data.
+type Plugin struct{}
+
+func (Plugin) Name() string {
+	return "tracing"
+}
+
+func (Plugin) Initialize(db *gorm.DB) error {
+	cb := db.Callback()
+	processors := []struct {
+		name          string
+		before, after registerer
+	}{
+		{name: "create", before: cb.Create().Before("*"), after: cb.Create().After("*")},
+		{name: "query", before: cb.Query().Before("*"), after: cb.Query().After("*")},
+		{name: "update", before: cb.Update().Before("*"), after: cb.Update().After("*")},
+		{name: "delete", before: cb.Delete().Before("*"), after: cb.Delete().After("*")},
+		{name: "row", before: cb.Row().Before("*"), after: cb.Row().After("*")},
+		{name: "raw", before: cb.Raw().Before("*"), after: cb.Raw().After("*")},
+	}
+	for _, p := range processors {
+		if err := p.before.Register("tracing:before_"+p.name, startSpan); err != nil {
+			return err
+		}
+		if err := p.after.Register("tracing:after_"+p.name, endSpan); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// registerer is a point in the chain of callbacks of a GORM processor.
+type registerer interface {
+	Register(name string, fn func(*gorm.DB)) error
+}
+
+func startSpan(db *gorm.DB) {
+	ctx, span := tracer().Start(db.Statement.Context, "gorm",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(semconv.DBSystemPostgreSQL),
+	)
+	db.Statement.Context = ctx
+	db.InstanceSet(spanKey, span)
+}
+
+func endSpan(db *gorm.DB) {
+	v, ok := db.InstanceGet(spanKey)
+	if !ok {
+		return
+	}
+	span := v.(trace.Span)
+	defer span.End()
+
+	statement := Redact(db.Statement.SQL.String())
+	operation := strings.ToUpper(strings.SplitN(strings.TrimSpace(statement), " ", 2)[0])
+	name := operation
+	if db.Statement.Table != "" {
+		name += " " + db.Statement.Table
+		span.SetAttributes(semconv.DBSQLTableKey.String(db.Statement.Table))
+	}
+	if name != "" {
+		span.SetName(name)
+	}
+	span.SetAttributes(
+		semconv.DBStatementKey.String(statement),
+		semconv.DBOperationKey.String(operation),
+	)
+
+	// a missing record is an answer rather than a failure
+	if db.Error != nil && !errors.Is(db.Error, gorm.ErrRecordNotFound) {
+		span.RecordError(db.Error)
+		span.SetStatus(codes.Error, db.Error.Error())
+	}
+}
+
+// Redact replaces the string and number literals of statement with "?",
+// keeping its placeholders, such as "$1".
+func Redact(statement string) string {
+	return literal.ReplaceAllStringFunc(statement, func(s string) string {
+		if strings.HasPrefix(s, "$") {
+			return s
+		}
+		return "?"
+	})
+}
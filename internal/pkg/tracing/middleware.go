@@ -0,0 +1,42 @@
+package tracing
+
+import (
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.10.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// unmatchedRoute names the spans of requests that no route matched, so that
+// scanners probing random paths do not create a span name per path.
+const unmatchedRoute = "unmatched"
+
+// Middleware records a span for every request, named by the template of the
+// route that handles it, such as "GET /users/:username". A traceparent header
+// makes the span a child of the caller's. The span is put in the context of
+// the request, so that the queries the handlers run become its children.
+func Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := otel.GetTextMapPropagator().Extract(c.Request.Context(), propagation.HeaderCarrier(c.Request.Header))
+
+		route := c.FullPath()
+		name := route
+		if name == "" {
+			name = unmatchedRoute
+		}
+
+		ctx, span := tracer().Start(ctx, c.Request.Method+" "+name,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(semconv.HTTPServerAttributesFromHTTPRequest("", route, c.Request)...),
+		)
+		defer span.End()
+
+		c.Request = c.Request.WithContext(ctx)
+		c.Next()
+
+		status := c.Writer.Status()
+		span.SetAttributes(semconv.HTTPAttributesFromHTTPStatusCode(status)...)
+		span.SetStatus(semconv.SpanStatusFromHTTPStatusCodeAndSpanKind(status, trace.SpanKindServer))
+	}
+}
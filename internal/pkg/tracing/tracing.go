@@ -0,0 +1,111 @@
+// Package tracing records OpenTelemetry spans for the requests the API handles
+// and the queries it runs, and exports them.
+package tracing
+
+import (
+	"context"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.10.0"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+
+	"github.com/benshields/messagebox/internal/pkg/config"
+)
+
+const (
+	ExporterOTLP   = "otlp"
+	ExporterStdout = "stdout"
+	ExporterNone   = "none"
+)
+
+// instrumentationName names the tracer that spans are started with.
+const instrumentationName = "github.com/benshields/messagebox"
+
+// shutdownTimeout bounds how long Close waits for spans to be exported.
+const shutdownTimeout = 5 * time.Second
+
+type ExporterError struct {
+	Exporter string
+}
+
+func (e ExporterError) Error() string {
+	return "unknown TracingConfiguration.Exporter value: " + e.Exporter
+}
+
+// Provider exports the spans recorded once Setup has returned.
+type Provider struct {
+	tp  *sdktrace.TracerProvider
+	log *zap.SugaredLogger
+}
+
+// Setup installs the tracer provider and the W3C trace context propagator
+// used by Middleware and Plugin. With the "none" exporter no spans are
+// recorded, but trace context is still passed from incoming requests to the
+// queries they run.
+func Setup(cfg config.TracingConfiguration, log *zap.Logger) (*Provider, error) {
+	if log == nil {
+		log = zap.NewNop()
+	}
+	sugar := log.Sugar()
+	defer sugar.Sync()
+	sugar.Debugw("tracing.Setup", "config", cfg)
+
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch cfg.Exporter {
+	case ExporterOTLP:
+		opts := []otlptracehttp.Option{}
+		if cfg.Endpoint != "" {
+			opts = append(opts, otlptracehttp.WithEndpoint(cfg.Endpoint))
+		}
+		if cfg.Insecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		exporter, err = otlptracehttp.New(context.Background(), opts...)
+	case ExporterStdout:
+		exporter, err = stdouttrace.New()
+	case ExporterNone, "":
+		return &Provider{}, nil
+	default:
+		return nil, ExporterError{Exporter: cfg.Exporter}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.SampleRatio))),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceNameKey.String(cfg.ServiceName))),
+	)
+	otel.SetTracerProvider(tp)
+
+	return &Provider{tp: tp, log: sugar}, nil
+}
+
+// Close exports the spans that are still buffered and stops exporting.
+func (p *Provider) Close() {
+	if p == nil || p.tp == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := p.tp.Shutdown(ctx); err != nil {
+		p.log.Warnw("tracing.Provider failed to export spans", "error", err)
+	}
+}
+
+// tracer is looked up on every use so that spans go to the provider installed
+// by Setup, even from middleware and plugins created before it ran.
+func tracer() trace.Tracer {
+	return otel.Tracer(instrumentationName)
+}
@@ -0,0 +1,161 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	semconv "go.opentelemetry.io/otel/semconv/v1.10.0"
+	"go.opentelemetry.io/otel/trace"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+
+	"github.com/benshields/messagebox/internal/pkg/config"
+	"github.com/benshields/messagebox/internal/pkg/models"
+)
+
+// record installs a tracer provider that keeps every span it ends.
+func record(t *testing.T) *tracetest.SpanRecorder {
+	if _, err := Setup(config.TracingConfiguration{Exporter: ExporterNone}, nil); err != nil {
+		t.Fatal("Setup() failed with:", err)
+	}
+	rec := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(rec)))
+	return rec
+}
+
+func attributes(span sdktrace.ReadOnlySpan) map[attribute.Key]attribute.Value {
+	attrs := map[attribute.Key]attribute.Value{}
+	for _, kv := range span.Attributes() {
+		attrs[kv.Key] = kv.Value
+	}
+	return attrs
+}
+
+func TestSetup(t *testing.T) {
+	for _, exporter := range []string{ExporterNone, ExporterStdout, ExporterOTLP} {
+		tp, err := Setup(config.TracingConfiguration{Exporter: exporter, SampleRatio: 1}, nil)
+		assert.NoError(t, err, exporter)
+		tp.Close()
+	}
+
+	_, err := Setup(config.TracingConfiguration{Exporter: "zipkin"}, nil)
+	assert.Equal(t, ExporterError{Exporter: "zipkin"}, err)
+}
+
+func TestMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	rec := record(t)
+
+	var handled trace.SpanContext
+	r := gin.New()
+	r.Use(Middleware())
+	r.GET("/users/:username", func(c *gin.Context) {
+		handled = trace.SpanContextFromContext(c.Request.Context())
+		c.Status(http.StatusNotFound)
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/users/yoshi", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	r.ServeHTTP(httptest.NewRecorder(), req)
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/wp-admin", nil))
+
+	spans := rec.Ended()
+	if !assert.Len(t, spans, 2) {
+		return
+	}
+
+	span := spans[0]
+	assert.Equal(t, "GET /users/:username", span.Name())
+	assert.Equal(t, trace.SpanKindServer, span.SpanKind())
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", span.Parent().TraceID().String())
+	assert.Equal(t, "00f067aa0ba902b7", span.Parent().SpanID().String())
+	assert.Equal(t, span.SpanContext().SpanID(), handled.SpanID())
+	attrs := attributes(span)
+	assert.Equal(t, "/users/:username", attrs[semconv.HTTPRouteKey].AsString())
+	assert.Equal(t, int64(http.StatusNotFound), attrs[semconv.HTTPStatusCodeKey].AsInt64())
+
+	assert.Equal(t, "GET unmatched", spans[1].Name())
+	assert.False(t, spans[1].Parent().IsValid())
+}
+
+func TestPlugin(t *testing.T) {
+	rec := record(t)
+
+	// DryRun builds the SQL without running it, so no database is needed
+	db, err := gorm.Open(postgres.Open("host=localhost"), &gorm.Config{DryRun: true, DisableAutomaticPing: true})
+	if err != nil {
+		t.Fatal("gorm.Open() failed with:", err)
+	}
+	if err := db.Use(Plugin{}); err != nil {
+		t.Fatal("db.Use() failed with:", err)
+	}
+
+	ctx, parent := otel.Tracer("test").Start(context.Background(), "parent")
+	db.WithContext(ctx).Where("name = ?", "yoshi").Find(&[]models.User{})
+	db.WithContext(ctx).Exec("UPDATE users SET name = 'yoshi' WHERE id = 42")
+	parent.End()
+
+	spans := rec.Ended()
+	if !assert.Len(t, spans, 3) {
+		return
+	}
+
+	query := attributes(spans[0])
+	assert.Equal(t, "SELECT users", spans[0].Name())
+	assert.Equal(t, trace.SpanKindClient, spans[0].SpanKind())
+	assert.Equal(t, parent.SpanContext().SpanID(), spans[0].Parent().SpanID())
+	assert.Equal(t, `SELECT * FROM "users" WHERE name = $1`, query[semconv.DBStatementKey].AsString())
+	assert.Equal(t, "users", query[semconv.DBSQLTableKey].AsString())
+	assert.Equal(t, "postgresql", query[semconv.DBSystemKey].AsString())
+
+	raw := attributes(spans[1])
+	assert.Equal(t, "UPDATE", spans[1].Name())
+	assert.Equal(t, "UPDATE users SET name = ? WHERE id = ?", raw[semconv.DBStatementKey].AsString())
+}
+
+func TestRedact(t *testing.T) {
+	cases := []struct {
+		statement string
+		want      string
+	}{
+		{`SELECT * FROM "users" WHERE name = $1`, `SELECT * FROM "users" WHERE name = $1`},
+		{`SELECT * FROM users WHERE name = 'yoshi' LIMIT 20`, `SELECT * FROM users WHERE name = ? LIMIT ?`},
+		{`SELECT 'it''s' FROM t1 WHERE score > 1.5`, `SELECT ? FROM t1 WHERE score > ?`},
+		{`SELECT * FROM messages WHERE id IN ($1,$2,$3)`, `SELECT * FROM messages WHERE id IN ($1,$2,$3)`},
+	}
+	for _, tt := range cases {
+		assert.Equal(t, tt.want, Redact(tt.statement))
+	}
+}
+
+func TestPluginRecordsErrors(t *testing.T) {
+	rec := record(t)
+
+	db, err := gorm.Open(postgres.Open("host=localhost"), &gorm.Config{DryRun: true, DisableAutomaticPing: true})
+	if err != nil {
+		t.Fatal("gorm.Open() failed with:", err)
+	}
+	if err := db.Use(Plugin{}); err != nil {
+		t.Fatal("db.Use() failed with:", err)
+	}
+
+	failed := errors.New("boom")
+	db.Callback().Query().Before("gorm:query").Register("test:fail", func(db *gorm.DB) {
+		db.AddError(failed)
+	})
+	db.Find(&[]models.User{})
+
+	spans := rec.Ended()
+	if assert.Len(t, spans, 1) {
+		assert.Equal(t, "boom", spans[0].Status().Description)
+	}
+}
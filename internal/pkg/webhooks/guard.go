@@ -0,0 +1,109 @@
+package webhooks
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/url"
+	"syscall"
+)
+
+// ErrPrivateAddress is returned for webhook URLs, and connections, to
+// loopback, link-local or private addresses, through which a webhook could
+// reach services that are not meant to be exposed.
+var ErrPrivateAddress = errors.New("webhook address is not public")
+
+var privateNetworks = parseCIDRs(
+	"0.0.0.0/8",      // this network
+	"10.0.0.0/8",     // private
+	"100.64.0.0/10",  // carrier-grade NAT
+	"127.0.0.0/8",    // loopback
+	"169.254.0.0/16", // link-local, including cloud metadata services
+	"172.16.0.0/12",  // private
+	"192.168.0.0/16", // private
+	"::/128",         // unspecified
+	"::1/128",        // loopback
+	"fc00::/7",       // unique local
+	"fe80::/10",      // link-local
+)
+
+func parseCIDRs(cidrs ...string) []*net.IPNet {
+	networks := make([]*net.IPNet, len(cidrs))
+	for i, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks[i] = network
+	}
+	return networks
+}
+
+func isPrivate(ip net.IP) bool {
+	if v4 := ip.To4(); v4 != nil {
+		ip = v4
+	}
+	for _, network := range privateNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return ip.IsMulticast()
+}
+
+// Guard keeps webhooks from reaching loopback, link-local and private
+// addresses, unless AllowPrivate is set. URLs are checked when a webhook is
+// created, and each connection again when it is dialled, as the name of a
+// host may resolve to a different address by then.
+type Guard struct {
+	AllowPrivate bool
+}
+
+// CheckURL fails with ErrPrivateAddress when the host of rawURL is, or
+// resolves to, an address that webhooks may not reach.
+func (g Guard) CheckURL(ctx context.Context, rawURL string) error {
+	if g.AllowPrivate {
+		return nil
+	}
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+
+	host := u.Hostname()
+	if ip := net.ParseIP(host); ip != nil {
+		if isPrivate(ip) {
+			return ErrPrivateAddress
+		}
+		return nil
+	}
+
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return err
+	}
+	for _, addr := range addrs {
+		if isPrivate(addr.IP) {
+			return ErrPrivateAddress
+		}
+	}
+	return nil
+}
+
+// control is a net.Dialer Control func, which sees the address actually
+// dialled once the host name has been resolved.
+func (g Guard) control(network, address string, c syscall.RawConn) error {
+	if g.AllowPrivate {
+		return nil
+	}
+
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || isPrivate(ip) {
+		return ErrPrivateAddress
+	}
+	return nil
+}
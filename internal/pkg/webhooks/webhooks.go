@@ -0,0 +1,221 @@
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/benshields/messagebox/internal/pkg/config"
+	"github.com/benshields/messagebox/internal/pkg/models"
+	"github.com/benshields/messagebox/internal/pkg/persistence"
+)
+
+const (
+	// SignatureHeader carries "t=<unix time>,v1=<signature>", where the
+	// signature is the hex HMAC-SHA256, keyed by the webhook secret, of the
+	// timestamp, a ".", and the request body.
+	SignatureHeader = "X-Messagebox-Signature"
+	EventHeader     = "X-Messagebox-Event"
+	DeliveryHeader  = "X-Messagebox-Delivery"
+
+	DefaultPollInterval = 5 * time.Second
+	DefaultTimeout      = 10 * time.Second
+	DefaultBatchSize    = 20
+	DefaultMaxAttempts  = 8
+	DefaultMinBackoff   = 30 * time.Second
+	DefaultMaxBackoff   = time.Hour
+)
+
+// Sign returns the SignatureHeader value for body sent at timestamp.
+func Sign(secret string, timestamp time.Time, body []byte) string {
+	t := strconv.FormatInt(timestamp.Unix(), 10)
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(t))
+	mac.Write([]byte("."))
+	mac.Write(body)
+
+	return "t=" + t + ",v1=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Dispatcher delivers the webhook outbox. Any number of dispatchers, in any
+// number of replicas, may run at once; each event is leased to one of them at
+// a time.
+type Dispatcher struct {
+	cfg    config.WebhooksConfiguration
+	repo   persistence.Webhooks
+	client *http.Client
+	log    *zap.SugaredLogger
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// NewDispatcher returns a dispatcher of the outbox in repo that only delivers
+// when RunOnce is called. Unset limits in cfg take their defaults.
+func NewDispatcher(cfg config.WebhooksConfiguration, repo persistence.Webhooks, log *zap.Logger) *Dispatcher {
+	if log == nil {
+		log = zap.NewNop()
+	}
+	if cfg.PollInterval <= 0 {
+		cfg.PollInterval = DefaultPollInterval
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = DefaultTimeout
+	}
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = DefaultBatchSize
+	}
+	if cfg.MaxAttempts <= 0 {
+		cfg.MaxAttempts = DefaultMaxAttempts
+	}
+	if cfg.MinBackoff <= 0 {
+		cfg.MinBackoff = DefaultMinBackoff
+	}
+	if cfg.MaxBackoff <= 0 {
+		cfg.MaxBackoff = DefaultMaxBackoff
+	}
+
+	// deliveries go straight to the webhook, never through a proxy, so that
+	// the guard sees the address of the webhook itself
+	guard := Guard{AllowPrivate: cfg.AllowPrivateAddresses}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = (&net.Dialer{
+		Timeout:   cfg.Timeout,
+		KeepAlive: 30 * time.Second,
+		Control:   guard.control,
+	}).DialContext
+
+	return &Dispatcher{
+		cfg:    cfg,
+		repo:   repo,
+		client: &http.Client{Timeout: cfg.Timeout, Transport: transport},
+		log:    log.Sugar(),
+	}
+}
+
+// Setup starts a dispatcher polling the outbox every cfg.PollInterval.
+func Setup(cfg config.WebhooksConfiguration, repo persistence.Webhooks, log *zap.Logger) (*Dispatcher, error) {
+	d := NewDispatcher(cfg, repo, log)
+	d.log.Debugw("webhooks.Setup", "config", d.cfg)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	d.cancel = cancel
+	d.done = make(chan struct{})
+	go d.run(ctx)
+
+	return d, nil
+}
+
+// Close stops polling and waits for deliveries in progress to finish.
+func (d *Dispatcher) Close() {
+	if d.cancel == nil {
+		return
+	}
+	d.cancel()
+	<-d.done
+}
+
+func (d *Dispatcher) run(ctx context.Context) {
+	defer close(d.done)
+
+	ticker := time.NewTicker(d.cfg.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		// drain the outbox a batch at a time before waiting again
+		for {
+			n, err := d.RunOnce(ctx)
+			if err != nil {
+				d.log.Warnw("webhooks.Dispatcher failed to claim events", "error", err)
+			}
+			if err != nil || n < d.cfg.BatchSize || ctx.Err() != nil {
+				break
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// RunOnce delivers a batch of due events and returns how many it claimed.
+func (d *Dispatcher) RunOnce(ctx context.Context) (int, error) {
+	r := d.repo
+
+	// lease events for long enough to try every one of them
+	lease := d.cfg.Timeout*time.Duration(d.cfg.BatchSize) + time.Minute
+	events, err := r.ClaimDueEvents(ctx, d.cfg.BatchSize, lease)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, ev := range events {
+		delivery := d.deliver(ctx, ev)
+
+		delivered := delivery.StatusCode != nil && *delivery.StatusCode >= 200 && *delivery.StatusCode < 300
+		var retryAt *time.Time
+		if !delivered && ev.Attempts+1 < d.cfg.MaxAttempts {
+			at := delivery.AttemptedAt.Add(d.Backoff(ev.Attempts + 1))
+			retryAt = &at
+		}
+
+		if err := r.RecordDelivery(ctx, ev, delivery, delivered, retryAt); err != nil {
+			d.log.Warnw("webhooks.Dispatcher failed to record delivery", "event", ev.ID, "error", err)
+		}
+	}
+
+	return len(events), nil
+}
+
+// Backoff returns how long to wait after the given number of failed attempts.
+func (d *Dispatcher) Backoff(attempts int) time.Duration {
+	backoff := d.cfg.MinBackoff
+	for i := 1; i < attempts; i++ {
+		backoff *= 2
+		if backoff >= d.cfg.MaxBackoff {
+			return d.cfg.MaxBackoff
+		}
+	}
+	return backoff
+}
+
+func (d *Dispatcher) deliver(ctx context.Context, ev *models.PendingWebhookEvent) *models.WebhookDelivery {
+	start := time.Now().UTC()
+	delivery := &models.WebhookDelivery{
+		AttemptedAt: start,
+	}
+
+	body := []byte(ev.Payload)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, ev.URL, bytes.NewReader(body))
+	if err != nil {
+		delivery.Error = err.Error()
+		return delivery
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(EventHeader, persistence.WebhookEventReceived)
+	req.Header.Set(DeliveryHeader, strconv.FormatInt(int64(ev.ID), 10))
+	req.Header.Set(SignatureHeader, Sign(ev.Secret, start, body))
+
+	resp, err := d.client.Do(req)
+	delivery.DurationMs = time.Since(start).Milliseconds()
+	if err != nil {
+		delivery.Error = err.Error()
+		return delivery
+	}
+	resp.Body.Close()
+
+	delivery.StatusCode = &resp.StatusCode
+	return delivery
+}
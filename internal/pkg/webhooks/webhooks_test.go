@@ -0,0 +1,159 @@
+package webhooks
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/benshields/messagebox/internal/pkg/config"
+	"github.com/benshields/messagebox/internal/pkg/models"
+	"github.com/benshields/messagebox/internal/pkg/persistence"
+)
+
+func TestSign(t *testing.T) {
+	timestamp := time.Unix(1567530762, 0)
+	body := []byte(`{"event":"message.received"}`)
+
+	got := Sign("whsec_test", timestamp, body)
+	assert.Equal(t, "t=1567530762,v1=283a053c1b859a05aa65b92ddcbe9a889dd35c35a361037fd485a79d8e84dcb8", got)
+	assert.NotEqual(t, got, Sign("whsec_other", timestamp, body))
+	assert.NotEqual(t, got, Sign("whsec_test", timestamp.Add(time.Second), body))
+}
+
+func TestBackoff(t *testing.T) {
+	d := NewDispatcher(config.WebhooksConfiguration{
+		MinBackoff: 30 * time.Second,
+		MaxBackoff: 5 * time.Minute,
+	}, nil, nil)
+
+	cases := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{attempts: 1, want: 30 * time.Second},
+		{attempts: 2, want: time.Minute},
+		{attempts: 3, want: 2 * time.Minute},
+		{attempts: 4, want: 4 * time.Minute},
+		{attempts: 5, want: 5 * time.Minute},
+		{attempts: 20, want: 5 * time.Minute},
+	}
+
+	for _, tt := range cases {
+		assert.Equal(t, tt.want, d.Backoff(tt.attempts), "attempts %d", tt.attempts)
+	}
+}
+
+func TestRunOnce(t *testing.T) {
+	ctx := context.Background()
+	repos := persistence.NewMemory()
+	user, _, err := repos.Users.Register(ctx, &models.User{Name: "Yoshi"})
+	assert.NoError(t, err)
+
+	var signature string
+	var body []byte
+	status := http.StatusInternalServerError
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		signature = r.Header.Get(SignatureHeader)
+		body, _ = ioutil.ReadAll(r.Body)
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+
+	hook, err := repos.Webhooks.Create(ctx, user.ID, user.ID, srv.URL)
+	assert.NoError(t, err)
+
+	_, err = repos.Messages.Create(ctx, &models.ComposedMessage{Sender: "Yoshi", To: []models.Recipient{{Username: "Yoshi"}}, Subject: "note to self"})
+	assert.NoError(t, err)
+
+	d := NewDispatcher(config.WebhooksConfiguration{AllowPrivateAddresses: true, MaxAttempts: 2, MinBackoff: time.Nanosecond}, repos.Webhooks, nil)
+
+	n, err := d.RunOnce(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+	assert.Contains(t, string(body), `"subject":"note to self"`)
+	assert.Contains(t, signature, ",v1=")
+
+	// the retry is due at once, and is the last attempt
+	time.Sleep(time.Millisecond)
+	status = http.StatusOK
+	n, err = d.RunOnce(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+
+	n, err = d.RunOnce(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+
+	deliveries, err := repos.Webhooks.FindDeliveries(ctx, user.ID, hook)
+	assert.NoError(t, err)
+	if assert.Len(t, deliveries, 2) {
+		assert.Equal(t, http.StatusOK, *deliveries[0].StatusCode)
+		assert.Equal(t, http.StatusInternalServerError, *deliveries[1].StatusCode)
+	}
+}
+
+func TestRunOnceRefusesPrivateAddresses(t *testing.T) {
+	ctx := context.Background()
+	repos := persistence.NewMemory()
+	user, _, err := repos.Users.Register(ctx, &models.User{Name: "Yoshi"})
+	assert.NoError(t, err)
+
+	var called bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	}))
+	defer srv.Close()
+
+	// a webhook created while the host resolved to a public address
+	hook, err := repos.Webhooks.Create(ctx, user.ID, user.ID, srv.URL)
+	assert.NoError(t, err)
+
+	_, err = repos.Messages.Create(ctx, &models.ComposedMessage{Sender: "Yoshi", To: []models.Recipient{{Username: "Yoshi"}}, Subject: "note to self"})
+	assert.NoError(t, err)
+
+	d := NewDispatcher(config.WebhooksConfiguration{}, repos.Webhooks, nil)
+	n, err := d.RunOnce(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+	assert.False(t, called)
+
+	deliveries, err := repos.Webhooks.FindDeliveries(ctx, user.ID, hook)
+	assert.NoError(t, err)
+	if assert.Len(t, deliveries, 1) {
+		assert.Nil(t, deliveries[0].StatusCode)
+		assert.Contains(t, deliveries[0].Error, ErrPrivateAddress.Error())
+	}
+}
+
+func TestGuardCheckURL(t *testing.T) {
+	cases := []struct {
+		url     string
+		wantErr error
+	}{
+		{url: "https://93.184.216.34/hook"},
+		{url: "https://[2606:2800:220:1:248:1893:25c8:1946]/hook"},
+		{url: "http://127.0.0.1:8080/hook", wantErr: ErrPrivateAddress},
+		{url: "http://localhost/hook", wantErr: ErrPrivateAddress},
+		{url: "http://169.254.169.254/latest/meta-data", wantErr: ErrPrivateAddress},
+		{url: "http://10.1.2.3/hook", wantErr: ErrPrivateAddress},
+		{url: "http://172.16.0.1/hook", wantErr: ErrPrivateAddress},
+		{url: "http://192.168.1.1/hook", wantErr: ErrPrivateAddress},
+		{url: "http://0.0.0.0/hook", wantErr: ErrPrivateAddress},
+		{url: "http://[::1]/hook", wantErr: ErrPrivateAddress},
+		{url: "http://[fd00::1]/hook", wantErr: ErrPrivateAddress},
+		{url: "http://[fe80::1]/hook", wantErr: ErrPrivateAddress},
+		{url: "http://[::ffff:127.0.0.1]/hook", wantErr: ErrPrivateAddress},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.url, func(t *testing.T) {
+			assert.Equal(t, tt.wantErr, Guard{}.CheckURL(context.Background(), tt.url))
+			assert.NoError(t, Guard{AllowPrivate: true}.CheckURL(context.Background(), tt.url))
+		})
+	}
+}